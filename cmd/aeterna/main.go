@@ -5,10 +5,15 @@ import (
 	"os"
 
 	"github.com/turtacn/Aeterna/internal/cli"
+	"github.com/turtacn/Aeterna/internal/supervisor"
 	"github.com/turtacn/Aeterna/pkg/logger"
 )
 
 func main() {
+	// Must run before anything else: a child started through the shim
+	// execs its command here.
+	supervisor.InitExecShim()
+
 	defer func() {
 		if r := recover(); r != nil {
 			if logger.Log != nil {
@@ -0,0 +1,113 @@
+package canary
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/consts"
+	"github.com/turtacn/Aeterna/pkg/logger"
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+// Process is the view of a candidate process required by the Observer.
+type Process interface {
+	Pid() int
+	Done() <-chan struct{}
+	Wait() error
+}
+
+// Observer judges a candidate during the SOAKING phase.
+// The candidate's exit is watched continuously; probes run every Interval
+// once Warmup has elapsed.
+type Observer struct {
+	Duration         time.Duration
+	Interval         time.Duration
+	Warmup           time.Duration
+	ProbeTimeout     time.Duration
+	FailureThreshold int
+	Probes           []Probe
+}
+
+// NewObserver creates an Observer of target from the canary configuration.
+// Probing starts after the given warmup delay.
+func NewObserver(cfg protocol.CanaryConfig, warmup time.Duration, target Target) *Observer {
+	o := &Observer{
+		Duration:         parseDuration(cfg.SoakTime, consts.DefaultSoakTime),
+		Interval:         parseDuration(cfg.Interval, consts.DefaultCanaryInterval),
+		Warmup:           warmup,
+		ProbeTimeout:     parseDuration(cfg.HealthCheck.Timeout, consts.DefaultProbeTimeout),
+		FailureThreshold: cfg.FailureThreshold,
+		Probes:           ProbesFromConfig(cfg, target),
+	}
+	if o.FailureThreshold <= 0 {
+		o.FailureThreshold = 1
+	}
+	return o
+}
+
+// Soak observes the candidate for the configured duration.
+// It returns nil if the candidate stayed alive and every criterion held, or an
+// error describing the first breach as soon as it happens.
+func (o *Observer) Soak(ctx context.Context, p Process) error {
+	deadline := time.NewTimer(o.Duration)
+	defer deadline.Stop()
+	ticker := time.NewTicker(o.Interval)
+	defer ticker.Stop()
+
+	probeAfter := time.Now().Add(o.Warmup)
+	failures := make(map[string]int, len(o.Probes))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.Done():
+			return exitError(p)
+		case <-deadline.C:
+			select {
+			case <-p.Done():
+				return exitError(p)
+			default:
+				return nil
+			}
+		case <-ticker.C:
+			if time.Now().Before(probeAfter) {
+				continue
+			}
+			for _, probe := range o.Probes {
+				if err := o.check(ctx, probe); err != nil {
+					failures[probe.Name()]++
+					logger.Log.Warn("Canary: Probe failed", "probe", probe.Name(), "failures", failures[probe.Name()], "err", err)
+					if failures[probe.Name()] >= o.FailureThreshold {
+						return fmt.Errorf("%s: %w", probe.Name(), err)
+					}
+					continue
+				}
+				failures[probe.Name()] = 0
+			}
+		}
+	}
+}
+
+func (o *Observer) check(ctx context.Context, probe Probe) error {
+	ctx, cancel := context.WithTimeout(ctx, o.ProbeTimeout)
+	defer cancel()
+	return probe.Check(ctx)
+}
+
+func exitError(p Process) error {
+	if err := p.Wait(); err != nil {
+		return fmt.Errorf("candidate (pid %d) exited during soak: %w", p.Pid(), err)
+	}
+	return fmt.Errorf("candidate (pid %d) exited during soak with status 0", p.Pid())
+}
+
+func parseDuration(s string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// Personal.AI order the ending
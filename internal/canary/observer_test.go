@@ -0,0 +1,82 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeProcess struct {
+	done chan struct{}
+	err  error
+}
+
+func newFakeProcess() *fakeProcess           { return &fakeProcess{done: make(chan struct{})} }
+func (p *fakeProcess) Pid() int              { return 42 }
+func (p *fakeProcess) Done() <-chan struct{} { return p.done }
+func (p *fakeProcess) Wait() error           { <-p.done; return p.err }
+
+type fakeProbe struct {
+	err error
+}
+
+func (p *fakeProbe) Name() string                    { return "fake" }
+func (p *fakeProbe) Check(ctx context.Context) error { return p.err }
+
+func testObserver(probes ...Probe) *Observer {
+	return &Observer{
+		Duration:         200 * time.Millisecond,
+		Interval:         10 * time.Millisecond,
+		ProbeTimeout:     time.Second,
+		FailureThreshold: 1,
+		Probes:           probes,
+	}
+}
+
+func TestObserver_Success(t *testing.T) {
+	o := testObserver(&fakeProbe{})
+	if err := o.Soak(context.Background(), newFakeProcess()); err != nil {
+		t.Errorf("Expected promotion, got %v", err)
+	}
+}
+
+func TestObserver_EarlyExit(t *testing.T) {
+	o := testObserver()
+	o.Duration = 10 * time.Second
+
+	p := newFakeProcess()
+	p.err = errors.New("exit status 1")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(p.done)
+	}()
+
+	start := time.Now()
+	if err := o.Soak(context.Background(), p); err == nil {
+		t.Fatal("Expected rollback verdict when the candidate exits")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected the verdict as soon as the candidate exited")
+	}
+}
+
+func TestObserver_ProbeBreach(t *testing.T) {
+	probe := &fakeProbe{err: errors.New("unhealthy")}
+	o := testObserver(probe)
+	o.FailureThreshold = 3
+
+	err := o.Soak(context.Background(), newFakeProcess())
+	if err == nil || !errors.Is(err, probe.err) {
+		t.Errorf("Expected probe breach, got %v", err)
+	}
+}
+
+func TestObserver_WarmupSkipsProbes(t *testing.T) {
+	o := testObserver(&fakeProbe{err: errors.New("still loading")})
+	o.Warmup = time.Second
+
+	if err := o.Soak(context.Background(), newFakeProcess()); err != nil {
+		t.Errorf("Expected probes to be skipped during warmup, got %v", err)
+	}
+}
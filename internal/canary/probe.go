@@ -0,0 +1,227 @@
+package canary
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/turtacn/Aeterna/pkg/logger"
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+// Probe checks a single success criterion of a candidate process.
+type Probe interface {
+	// Name identifies the probe in logs and rollback reasons.
+	Name() string
+	// Check returns nil if the criterion currently holds.
+	Check(ctx context.Context) error
+}
+
+// HTTPProbe succeeds when a GET request to URL answers with a 2xx status.
+type HTTPProbe struct {
+	URL string
+}
+
+// Name returns the probe identifier.
+func (p *HTTPProbe) Name() string { return "http_get " + p.URL }
+
+// Check performs the HTTP request.
+func (p *HTTPProbe) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// TCPProbe succeeds when a TCP connection to Addr can be established.
+type TCPProbe struct {
+	Addr string
+}
+
+// Name returns the probe identifier.
+func (p *TCPProbe) Name() string { return "tcp_socket " + p.Addr }
+
+// Check dials the address.
+func (p *TCPProbe) Check(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// MetricsProbe scrapes Prometheus text-format metrics from URL and checks
+// every matching sample against the configured thresholds.
+type MetricsProbe struct {
+	URL        string
+	Thresholds []protocol.MetricThreshold
+}
+
+// Name returns the probe identifier.
+func (p *MetricsProbe) Name() string { return "metrics " + p.URL }
+
+// Check scrapes the endpoint and evaluates the thresholds.
+func (p *MetricsProbe) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return fmt.Errorf("parse metrics: %w", err)
+	}
+
+	for _, th := range p.Thresholds {
+		if err := checkThreshold(families[th.Name], th); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkThreshold(family *dto.MetricFamily, th protocol.MetricThreshold) error {
+	if family == nil {
+		return fmt.Errorf("metric %s not exposed", th.Name)
+	}
+
+	matched := 0
+	for _, m := range family.GetMetric() {
+		if !labelsMatch(m, th.Labels) {
+			continue
+		}
+		value, ok := sampleValue(m)
+		if !ok {
+			continue
+		}
+		matched++
+		if th.Min != nil && value < *th.Min {
+			return fmt.Errorf("metric %s = %g below minimum %g", th.Name, value, *th.Min)
+		}
+		if th.Max != nil && value > *th.Max {
+			return fmt.Errorf("metric %s = %g above maximum %g", th.Name, value, *th.Max)
+		}
+	}
+	if matched == 0 {
+		return fmt.Errorf("metric %s has no sample matching %v", th.Name, th.Labels)
+	}
+	return nil
+}
+
+func labelsMatch(m *dto.Metric, want map[string]string) bool {
+	for name, value := range want {
+		found := false
+		for _, lp := range m.GetLabel() {
+			if lp.GetName() == name && lp.GetValue() == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// sampleValue extracts a scalar from gauges, counters and untyped samples.
+func sampleValue(m *dto.Metric) (float64, bool) {
+	switch {
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue(), true
+	case m.Counter != nil:
+		return m.GetCounter().GetValue(), true
+	case m.Untyped != nil:
+		return m.GetUntyped().GetValue(), true
+	}
+	return 0, false
+}
+
+// During a soak both generations serve the inherited listeners, so a probe of
+// one of them may well be answered by the old process. Probe targets reach the
+// candidate alone through the placeholders below, filled in for the candidate
+// under soak: Aeterna gives every generation a port of its own, in
+// AETERNA_PROBE_PORT, on which it serves its health and metrics endpoints.
+const (
+	PlaceholderPid       = "{pid}"
+	PlaceholderProbePort = "{probe_port}"
+)
+
+// Target is the candidate the probes of a soak run against.
+type Target struct {
+	Pid       int
+	ProbePort int // 0 unless the probes use PlaceholderProbePort
+}
+
+func (t Target) expand(s string) string {
+	return strings.NewReplacer(PlaceholderPid, strconv.Itoa(t.Pid), PlaceholderProbePort, strconv.Itoa(t.ProbePort)).Replace(s)
+}
+
+// UsesProbePort reports whether a probe of cfg targets the probe port of the
+// candidate, which then needs one.
+func UsesProbePort(cfg protocol.CanaryConfig) bool {
+	for _, s := range []string{cfg.HealthCheck.HTTPGet, cfg.HealthCheck.TCPSocket, cfg.Metrics.URL} {
+		if strings.Contains(s, PlaceholderProbePort) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllocateProbePort returns a free port on the loopback interface.
+func AllocateProbePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// ProbesFromConfig builds the probes declared in the canary configuration,
+// against target.
+func ProbesFromConfig(cfg protocol.CanaryConfig, target Target) []Probe {
+	var probes []Probe
+	add := func(p Probe, raw string) {
+		if !strings.Contains(raw, PlaceholderProbePort) {
+			logger.Log.Warn("Probe target is shared by both generations", "probe", p.Name())
+		}
+		probes = append(probes, p)
+	}
+	if cfg.HealthCheck.HTTPGet != "" {
+		add(&HTTPProbe{URL: target.expand(cfg.HealthCheck.HTTPGet)}, cfg.HealthCheck.HTTPGet)
+	}
+	if cfg.HealthCheck.TCPSocket != "" {
+		add(&TCPProbe{Addr: target.expand(cfg.HealthCheck.TCPSocket)}, cfg.HealthCheck.TCPSocket)
+	}
+	if cfg.Metrics.URL != "" && len(cfg.Metrics.Thresholds) > 0 {
+		add(&MetricsProbe{URL: target.expand(cfg.Metrics.URL), Thresholds: cfg.Metrics.Thresholds}, cfg.Metrics.URL)
+	}
+	return probes
+}
+
+// Personal.AI order the ending
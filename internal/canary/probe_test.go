@@ -0,0 +1,128 @@
+package canary
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+func floatPtr(v float64) *float64 { return &v }
+
+func TestHTTPProbe(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	p := &HTTPProbe{URL: srv.URL}
+	if err := p.Check(context.Background()); err != nil {
+		t.Errorf("Expected healthy probe, got %v", err)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := p.Check(context.Background()); err == nil {
+		t.Error("Expected probe to fail on 503")
+	}
+}
+
+func TestTCPProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := l.Addr().String()
+
+	p := &TCPProbe{Addr: addr}
+	if err := p.Check(context.Background()); err != nil {
+		t.Errorf("Expected healthy probe, got %v", err)
+	}
+
+	l.Close()
+	if err := p.Check(context.Background()); err == nil {
+		t.Error("Expected probe to fail once the listener is closed")
+	}
+}
+
+func TestMetricsProbe_Thresholds(t *testing.T) {
+	errors := 3
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# TYPE http_errors_total counter\n")
+		fmt.Fprintf(w, "http_errors_total{code=\"500\"} %d\n", errors)
+		fmt.Fprintf(w, "http_errors_total{code=\"404\"} 100\n")
+		fmt.Fprintf(w, "# TYPE ready gauge\nready 1\n")
+	}))
+	defer srv.Close()
+
+	p := &MetricsProbe{URL: srv.URL, Thresholds: []protocol.MetricThreshold{
+		{Name: "http_errors_total", Labels: map[string]string{"code": "500"}, Max: floatPtr(5)},
+		{Name: "ready", Min: floatPtr(1)},
+	}}
+	if err := p.Check(context.Background()); err != nil {
+		t.Errorf("Expected thresholds to hold, got %v", err)
+	}
+
+	errors = 10
+	if err := p.Check(context.Background()); err == nil {
+		t.Error("Expected threshold breach on http_errors_total")
+	}
+
+	missing := &MetricsProbe{URL: srv.URL, Thresholds: []protocol.MetricThreshold{
+		{Name: "not_exposed", Max: floatPtr(1)},
+	}}
+	if err := missing.Check(context.Background()); err == nil {
+		t.Error("Expected failure for a metric that is not exposed")
+	}
+}
+
+func TestProbesFromConfig(t *testing.T) {
+	probes := ProbesFromConfig(protocol.CanaryConfig{
+		HealthCheck: protocol.HealthCheckConfig{HTTPGet: "http://127.0.0.1/health", TCPSocket: "127.0.0.1:{probe_port}"},
+		Metrics: protocol.MetricsCheckConfig{
+			URL:        "http://127.0.0.1:{probe_port}/metrics?pid={pid}",
+			Thresholds: []protocol.MetricThreshold{{Name: "up", Min: floatPtr(1)}},
+		},
+	}, Target{Pid: 42, ProbePort: 9100})
+	if len(probes) != 3 {
+		t.Fatalf("Expected 3 probes, got %d", len(probes))
+	}
+	if addr := probes[1].(*TCPProbe).Addr; addr != "127.0.0.1:9100" {
+		t.Errorf("Expected the probe port of the candidate, got %q", addr)
+	}
+	if url := probes[2].(*MetricsProbe).URL; url != "http://127.0.0.1:9100/metrics?pid=42" {
+		t.Errorf("Expected the candidate in the URL, got %q", url)
+	}
+}
+
+func TestObserver_ProbesCandidateNotOldProcess(t *testing.T) {
+	// The old process keeps answering healthy on the shared listener...
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer old.Close()
+	// ...while the candidate is unhealthy on its own probe port.
+	candidate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer candidate.Close()
+	port := candidate.Listener.Addr().(*net.TCPAddr).Port
+
+	shared := ProbesFromConfig(protocol.CanaryConfig{
+		HealthCheck: protocol.HealthCheckConfig{HTTPGet: old.URL + "/health"},
+	}, Target{Pid: 42, ProbePort: port})
+	if err := shared[0].Check(context.Background()); err != nil {
+		t.Fatalf("Expected the old process to answer a shared target, got %v", err)
+	}
+
+	o := NewObserver(protocol.CanaryConfig{
+		SoakTime:    "200ms",
+		Interval:    "10ms",
+		HealthCheck: protocol.HealthCheckConfig{HTTPGet: "http://127.0.0.1:{probe_port}/health"},
+	}, 0, Target{Pid: 42, ProbePort: port})
+	if err := o.Soak(context.Background(), newFakeProcess()); err == nil {
+		t.Error("Expected the unhealthy candidate to be rolled back")
+	}
+}
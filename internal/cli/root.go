@@ -1,12 +1,21 @@
 package cli
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/turtacn/Aeterna/internal/monitor"
 	"github.com/turtacn/Aeterna/internal/orchestrator"
+	"github.com/turtacn/Aeterna/internal/supervisor"
 	"github.com/turtacn/Aeterna/pkg/logger"
 	"github.com/turtacn/Aeterna/pkg/protocol"
 	"gopkg.in/yaml.v3"
@@ -41,12 +50,13 @@ var startCmd = &cobra.Command{
 
 		logger.Log.Info("Booting Aeterna UPHR-O Engine...", "service", cfg.Service.Name)
 
-		// 3. Start Engine
+		// 3. Start Engine and mirror the business process's exit code
 		engine := orchestrator.NewEngine(&cfg)
-		if err := engine.Start(); err != nil {
-			logger.Log.Error("Engine fatal error", "err", err)
-			os.Exit(1)
+		err = engine.Start()
+		if err != nil {
+			logger.Log.Error("Engine stopped with error", "err", err)
 		}
+		os.Exit(supervisor.ExitCode(err))
 	},
 }
 
@@ -60,10 +70,77 @@ var reloadCmd = &cobra.Command{
 	},
 }
 
+var (
+	upgradeBinary string
+	upgradeSocket string
+)
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Replace the running Aeterna binary without restarting the service",
+	Run: func(cmd *cobra.Command, args []string) {
+		socketPath, tokenFile := controlPaths()
+		if upgradeSocket != "" {
+			socketPath = upgradeSocket
+		}
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			fmt.Printf("Error reading the control API token: %v\n", err)
+			os.Exit(1)
+		}
+		body, _ := json.Marshal(map[string]string{"binary": upgradeBinary})
+
+		req, _ := http.NewRequest(http.MethodPost, "http://aeterna/v1/upgrade", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		resp, err := controlClient(socketPath).Do(req)
+		if err != nil {
+			fmt.Printf("Error contacting Aeterna at %s: %v\n", socketPath, err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusAccepted {
+			fmt.Printf("Upgrade refused: %s\n", strings.TrimSpace(string(msg)))
+			os.Exit(1)
+		}
+		fmt.Printf("Upgrade to %s started.\n", upgradeBinary)
+	},
+}
+
+// controlPaths returns the socket and token file of the control API, as
+// configured in the config file.
+func controlPaths() (socketPath, tokenFile string) {
+	var cfg protocol.Config
+	if data, err := os.ReadFile(cfgFile); err == nil {
+		yaml.Unmarshal(data, &cfg)
+	}
+	return orchestrator.ControlPaths(&cfg)
+}
+
+// controlClient returns an HTTP client talking to the control API on the
+// Unix socket at socketPath.
+func controlClient(socketPath string) *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "aeterna.yaml", "config file path")
 	rootCmd.AddCommand(startCmd)
 	rootCmd.AddCommand(reloadCmd)
+
+	upgradeCmd.Flags().StringVar(&upgradeBinary, "binary", "", "path of the new Aeterna binary")
+	upgradeCmd.Flags().StringVar(&upgradeSocket, "socket", "", "control API socket (defaults to control.socket_path in the config)")
+	upgradeCmd.MarkFlagRequired("binary")
+	rootCmd.AddCommand(upgradeCmd)
 }
 
 // Execute runs the root command for the Aeterna CLI.
@@ -2,6 +2,8 @@ package monitor
 
 import (
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -19,13 +21,103 @@ var (
 		Name: "aeterna_restarts_total",
 		Help: "Total number of process restarts",
 	}, []string{"reason"})
+	// StateTransferredBytes tracks the progress of the state relayed during a handover.
+	StateTransferredBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "aeterna_srp_transferred_bytes",
+		Help: "Bytes of the state relayed so far in the current or last handover",
+	})
+	// StateSizeBytes is the size of the state being handed over, if the sender announced it.
+	StateSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "aeterna_srp_state_size_bytes",
+		Help: "Size of the state in the current or last handover, 0 if unknown",
+	})
+	// StateBytesTotal counts the bytes of the states handed over, partitioned by transport.
+	StateBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aeterna_srp_state_bytes_total",
+		Help: "Total bytes of state handed over",
+	}, []string{"transport"})
+	// StateResumesTotal counts the state transfers resumed after a broken connection.
+	StateResumesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "aeterna_srp_resumes_total",
+		Help: "Total number of times a state transfer resumed after a broken connection",
+	})
+	// StateUncompressedBytesTotal and StateCompressedBytesTotal count the
+	// state data handed over before and after compression, partitioned by
+	// the negotiated compression ("none" if the state was not compressed).
+	StateUncompressedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aeterna_srp_uncompressed_bytes_total",
+		Help: "Total bytes of state data handed over, before compression",
+	}, []string{"compression"})
+	StateCompressedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aeterna_srp_compressed_bytes_total",
+		Help: "Total bytes of state data handed over, after compression",
+	}, []string{"compression"})
+	// SectionBytes and SectionDurationSeconds describe every section of the
+	// state in the current or last handover, if it was sent in sections.
+	// Unchanged sections, left out of a delta transfer, count 0 bytes.
+	SectionBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aeterna_srp_section_bytes",
+		Help: "Bytes of every state section in the current or last handover",
+	}, []string{"section"})
+	SectionDurationSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aeterna_srp_section_duration_seconds",
+		Help: "Time taken to relay every state section in the current or last handover",
+	}, []string{"section"})
+	// StateSnapshotReplaysTotal counts the spilled states offered to a
+	// cold-started process, by result: "acked", "failed" (not acknowledged or
+	// unreadable) or "stale" (older than the process it would replace).
+	StateSnapshotReplaysTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aeterna_srp_snapshot_replays_total",
+		Help: "Total number of spilled states offered to a cold-started process",
+	}, []string{"result"})
+	// CheckpointsTotal counts the checkpoints requested from the serving
+	// process, by result: "ok" or "failed".
+	CheckpointsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aeterna_srp_checkpoints_total",
+		Help: "Total number of state checkpoints requested from the serving process",
+	}, []string{"result"})
+	// CheckpointSizeBytes is the size of the newest checkpoint, see ObserveCheckpoint.
+	CheckpointSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "aeterna_srp_checkpoint_size_bytes",
+		Help: "Size of the newest state checkpoint, 0 if there is none",
+	})
+	// CheckpointAgeSeconds is the age of the newest checkpoint at scrape time.
+	CheckpointAgeSeconds = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "aeterna_srp_checkpoint_age_seconds",
+		Help: "Age of the newest state checkpoint, 0 if there is none",
+	}, checkpointAge)
+
+	checkpointCreated atomic.Int64 // Unix nanoseconds, 0 if there is no checkpoint
 )
 
+// ObserveCheckpoint records the newest checkpoint, taken at created, of size
+// bytes. A zero created means there is none left.
+func ObserveCheckpoint(created time.Time, size int) {
+	if created.IsZero() {
+		checkpointCreated.Store(0)
+	} else {
+		checkpointCreated.Store(created.UnixNano())
+	}
+	CheckpointSizeBytes.Set(float64(size))
+}
+
+func checkpointAge() float64 {
+	created := checkpointCreated.Load()
+	if created == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, created)).Seconds()
+}
+
 // InitMetrics registers Prometheus metrics and starts an HTTP server to expose them.
 // It takes an address string (e.g., ":9090") on which to listen for requests.
 func InitMetrics(addr string) {
 	prometheus.MustRegister(HandoverDuration)
 	prometheus.MustRegister(RestartTotal)
+	prometheus.MustRegister(StateTransferredBytes, StateSizeBytes, StateBytesTotal, StateResumesTotal)
+	prometheus.MustRegister(StateUncompressedBytesTotal, StateCompressedBytesTotal, StateSnapshotReplaysTotal)
+	prometheus.MustRegister(CheckpointsTotal, CheckpointSizeBytes, CheckpointAgeSeconds)
+	prometheus.MustRegister(SectionBytes, SectionDurationSeconds)
 
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
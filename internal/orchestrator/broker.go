@@ -0,0 +1,268 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"time"
+
+	"github.com/turtacn/Aeterna/internal/srp"
+	"github.com/turtacn/Aeterna/internal/supervisor"
+	"github.com/turtacn/Aeterna/pkg/srp/codec"
+	"github.com/turtacn/Aeterna/pkg/srp/compress"
+)
+
+// In relay mode the old process and the candidate must be connected to the
+// state socket at the same time. In broker mode Aeterna owns the rendezvous:
+// it receives the state of the old process itself (receiveState), holds it,
+// and serves it to the candidate once that one asks (serveState). Either
+// process deals with Aeterna alone, on its own timing, and Aeterna applies
+// the handshake, the timeouts and state_handoff.max_state_size in one place.
+// Checkpoints and replays after a crash use the same two halves.
+//
+// A state sent in sections is held whole, with its table of sections. With
+// state_handoff.delta, Aeterna offers the sections of its newest checkpoint
+// as the base of the transfer: the sections that did not change since are
+// not sent again, but taken from the checkpoint.
+
+// receiveState asks current for its state, for reason, and receives it
+// through the state socket, playing the receiver itself. The result
+// describes what was actually sent.
+func (e *Engine) receiveState(current *supervisor.ProcessManager, reason string) (*checkpoint, *srp.RelayResult, error) {
+	token, err := srp.NewToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := e.srp.PrepareSocket()
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening the state socket: %w", err)
+	}
+	// A coordinator of its own: the state is neither spilled nor reported as
+	// handover progress on its way to Aeterna.
+	sc := *e.srp
+	sc.Spill = nil
+	sc.Progress = nil
+	sc.Section = nil
+	sc.Sender = e.statePeer(current)
+	sc.Receiver = &srp.Peer{Pid: os.Getpid(), Token: token}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-current.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	hello := srp.Hello{
+		Token:         token,
+		Codecs:        codec.Names(),
+		SchemaVersion: math.MaxInt32, // Kept as sent, whatever its version
+		Transports:    []string{srp.TransportMemfd, srp.TransportChunked, srp.TransportStream},
+		Compressions:  []string{compress.Zstd, compress.Gzip, compress.None},
+		Sectioned:     true,
+	}
+	var base map[string][]byte
+	if e.cfg.Orchestration.StateHandoff.Delta {
+		if cp := e.newestCheckpoint(0); cp != nil && len(cp.Meta.Sections) > 0 {
+			base = make(map[string][]byte, len(cp.Meta.Sections))
+			hello.Have = make(map[string]string, len(cp.Meta.Sections))
+			for i, s := range splitSections(cp.Meta, cp.State) {
+				base[s.Name] = s.Data
+				hello.Have[s.Name] = cp.Meta.Sections[i].SHA256
+			}
+		}
+	}
+
+	timeout := e.stateTimeout()
+	type result struct {
+		state    []byte
+		sections []srp.SectionInfo
+		err      error
+	}
+	received := make(chan result, 1)
+	go func() {
+		max := e.cfg.Orchestration.StateHandoff.MaxStateSize
+		sink := &limitedBuffer{max: max}
+		rs, err := srp.ReceiveStateTo(sc.Path(), hello, sink, timeout)
+		if err != nil {
+			received <- result{err: err}
+			return
+		}
+		out := result{state: sink.data, sections: rs.Negotiated.Sections}
+		if len(out.sections) > 0 {
+			out.state, out.sections, out.err = assembleSections(out.sections, sink.data, base, max)
+		}
+		if out.err != nil {
+			rs.Reject()
+		} else {
+			rs.Ack()
+		}
+		received <- out
+	}()
+
+	if err := e.requestState(current, reason); err != nil {
+		l.Close()
+		e.srp.Close()
+		<-received
+		return nil, nil, fmt.Errorf("requesting the state: %w", err)
+	}
+	res, err := sc.Relay(ctx, l, timeout)
+	out := <-received
+	if out.err != nil {
+		// The receiving side knows best why the transfer failed.
+		err = out.err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &checkpoint{
+		Meta: srp.SnapshotMeta{
+			Generation:    e.generationOf(current).ID,
+			SenderPid:     res.SenderPid,
+			Created:       time.Now(),
+			Codec:         res.Negotiated.Codec,
+			SchemaVersion: res.Negotiated.SchemaVersion,
+			Sections:      out.sections,
+		},
+		State: out.state,
+	}, res, nil
+}
+
+// assembleSections returns the whole state of a transfer of the sections in
+// table, whose sections that were sent are in sent and the others in base,
+// and its table with no section left unchanged.
+func assembleSections(table []srp.SectionInfo, sent []byte, base map[string][]byte, max int64) ([]byte, []srp.SectionInfo, error) {
+	var size int64
+	for _, s := range table {
+		size += s.Size
+	}
+	if max > 0 && size > max {
+		return nil, nil, errStateTooLarge
+	}
+	state := make([]byte, 0, size)
+	whole := make([]srp.SectionInfo, len(table))
+	for i, s := range table {
+		if s.Unchanged {
+			data, ok := base[s.Name]
+			if !ok || int64(len(data)) != s.Size {
+				return nil, nil, fmt.Errorf("section %q is not held", s.Name)
+			}
+			state = append(state, data...)
+		} else {
+			if int64(len(sent)) < s.Size {
+				return nil, nil, fmt.Errorf("section %q is cut short", s.Name)
+			}
+			state = append(state, sent[:s.Size]...)
+			sent = sent[s.Size:]
+		}
+		whole[i] = s
+		whole[i].Unchanged = false
+	}
+	return state, whole, nil
+}
+
+// splitSections returns the sections of a state held whole, as described by
+// meta, or nil if it was not sent in sections.
+func splitSections(meta srp.SnapshotMeta, state []byte) []srp.Section {
+	var sections []srp.Section
+	for _, s := range meta.Sections {
+		if int64(len(state)) < s.Size {
+			return nil
+		}
+		sections = append(sections, srp.Section{Name: s.Name, Priority: s.Priority, SchemaVersion: s.SchemaVersion, Data: state[:s.Size:s.Size]})
+		state = state[s.Size:]
+	}
+	return sections
+}
+
+// serveState sends state, described by meta, through l to the receiver sc
+// expects, playing the sender itself. The state is migrated for the receiver
+// once it has connected. It returns once the receiver has acknowledged the
+// state, the transfer failed or ctx was canceled; a failed migration fails
+// with ErrCodeStateMigrationFailed.
+func (e *Engine) serveState(ctx context.Context, sc *srp.StateCoordinator, l net.Listener, meta srp.SnapshotMeta, state []byte) (*srp.RelayResult, error) {
+	token, err := srp.NewToken()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	sc.Sender = &srp.Peer{Pid: os.Getpid(), Token: token, Generation: meta.Generation}
+	receiving := make(chan srp.Hello, 1)
+	sc.Receiving = func(hello srp.Hello) {
+		select {
+		case receiving <- hello:
+		default:
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timeout := e.stateTimeout()
+	sent := make(chan error, 1)
+	var migrateErr error
+	go func() {
+		var receiver srp.Hello
+		select {
+		case receiver = <-receiving:
+		case <-ctx.Done():
+			sent <- ctx.Err()
+			return
+		}
+		sections := splitSections(meta, state)
+		whole := sections == nil
+		if whole {
+			sections = []srp.Section{{Data: state}}
+		}
+		for i := range sections {
+			if sections[i].SchemaVersion == 0 {
+				sections[i].SchemaVersion = meta.SchemaVersion
+			}
+		}
+		sections, err := e.migrateSections(receiver, meta.Codec, sections)
+		if err != nil {
+			migrateErr = err
+			sent <- err
+			cancel()
+			return
+		}
+		hello := srp.Hello{Token: token, Codecs: []string{meta.Codec}, SchemaVersion: meta.SchemaVersion}
+		if whole {
+			hello.SchemaVersion, hello.Size = sections[0].SchemaVersion, int64(len(sections[0].Data))
+			sent <- srp.SendState(sc.Path(), hello, func(srp.Hello) ([]byte, error) { return sections[0].Data, nil }, timeout)
+			return
+		}
+		sent <- srp.SendSections(sc.Path(), hello, sections, timeout)
+	}()
+	res, err := sc.Relay(ctx, l, timeout)
+	cancel() // Releases the sender if the receiver never connected
+	<-sent
+	if migrateErr != nil {
+		return nil, migrateErr
+	}
+	return res, err
+}
+
+// errStateTooLarge is returned for a state beyond state_handoff.max_state_size.
+var errStateTooLarge = errors.New("state exceeds state_handoff.max_state_size")
+
+// limitedBuffer collects a state of at most max bytes, if max is positive.
+type limitedBuffer struct {
+	max  int64
+	data []byte
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.max > 0 && int64(len(b.data)+len(p)) > b.max {
+		return 0, errStateTooLarge
+	}
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+// Personal.AI order the ending
@@ -0,0 +1,223 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/turtacn/Aeterna/internal/monitor"
+	"github.com/turtacn/Aeterna/internal/srp"
+	"github.com/turtacn/Aeterna/pkg/consts"
+	aerrors "github.com/turtacn/Aeterna/pkg/errors"
+	"github.com/turtacn/Aeterna/pkg/logger"
+)
+
+// A reload is the only time the serving process hands its state over, so a
+// process that crashes (e.g. killed by the OOM killer) takes everything since
+// the last reload with it. Checkpoints close that gap: the engine asks the
+// serving process for its state through the state socket, exactly as during
+// a reload, but receives it itself. It keeps the newest checkpoints in memory
+// and replays the newest one to the process restarted after a crash.
+
+// checkpoint is a state taken from the serving process. Meta.Generation is
+// the generation holding the state: the sender's, or the one that was
+// replayed the checkpoint and acknowledged it.
+type checkpoint struct {
+	Meta  srp.SnapshotMeta
+	State []byte // Encoded with Meta.Codec, uncompressed
+}
+
+// checkpointsEnabled reports whether state_handoff.checkpoint is enabled.
+func (e *Engine) checkpointsEnabled() bool {
+	cfg := e.cfg.Orchestration.StateHandoff
+	return cfg.Enabled && cfg.Checkpoint.Enabled
+}
+
+// checkpointableLocked refuses a checkpoint unless a single settled process is serving.
+func (e *Engine) checkpointableLocked() error {
+	if !e.checkpointsEnabled() {
+		return aerrors.New(aerrors.ErrCodeConfigInvalid, "Checkpoint", "state_handoff.checkpoint is disabled", nil)
+	}
+	if e.stopping {
+		return aerrors.New(aerrors.ErrCodeStateDumpTimeout, "Checkpoint", "shutdown in progress", nil)
+	}
+	if e.current == nil || e.candidate != nil {
+		return aerrors.New(aerrors.ErrCodeStateDumpTimeout, "Checkpoint", "no settled process to checkpoint", nil)
+	}
+	if state := consts.ProcessState(e.fsm.Current()); state != consts.StateRunning {
+		return aerrors.New(aerrors.ErrCodeStateDumpTimeout, "Checkpoint", "cannot checkpoint in state "+string(state), nil)
+	}
+	return nil
+}
+
+// checkpoint asks the serving process for its state and keeps it as the
+// newest checkpoint. It fails with ErrCodeStateDumpTimeout if another state
+// transfer is under way or the process does not send its state in time.
+func (e *Engine) checkpoint() (*checkpoint, error) {
+	if !e.stateMu.TryLock() {
+		return nil, aerrors.New(aerrors.ErrCodeStateDumpTimeout, "Checkpoint", "a state transfer is under way", nil)
+	}
+	defer e.stateMu.Unlock()
+
+	e.mu.Lock()
+	err := e.checkpointableLocked()
+	current := e.current
+	e.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	cp, res, err := e.receiveState(current, srp.RequestCheckpoint)
+	if err != nil {
+		monitor.CheckpointsTotal.WithLabelValues("failed").Inc()
+		return nil, aerrors.New(aerrors.ErrCodeStateDumpTimeout, "Checkpoint", "state not received from the serving process", err)
+	}
+	e.addCheckpoint(cp)
+	monitor.CheckpointsTotal.WithLabelValues("ok").Inc()
+	logger.Log.Info("State checkpointed", "pid", current.Pid(), "generation", cp.Meta.Generation, "bytes", len(cp.State),
+		"sent", res.Bytes, "sections", len(cp.Meta.Sections), "codec", cp.Meta.Codec, "schema_version", cp.Meta.SchemaVersion, "duration", time.Since(start))
+	return cp, nil
+}
+
+// checkpointLoop takes a checkpoint every state_handoff.checkpoint.interval
+// until ctx is done. Ticks that find a reload, a restart or another transfer
+// under way are skipped.
+func (e *Engine) checkpointLoop(ctx context.Context) {
+	interval, _ := time.ParseDuration(e.cfg.Orchestration.StateHandoff.Checkpoint.Interval)
+	if !e.checkpointsEnabled() || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		e.mu.Lock()
+		err := e.checkpointableLocked()
+		e.mu.Unlock()
+		if err != nil {
+			continue
+		}
+		if _, err := e.checkpoint(); err != nil {
+			logger.Log.Warn("Checkpoint failed", "err", err)
+		}
+	}
+}
+
+// addCheckpoint keeps cp as the newest checkpoint, forgetting the oldest
+// beyond state_handoff.checkpoint.keep.
+func (e *Engine) addCheckpoint(cp *checkpoint) {
+	keep := e.cfg.Orchestration.StateHandoff.Checkpoint.Keep
+	if keep <= 0 {
+		keep = consts.DefaultCheckpointKeep
+	}
+	e.cpMu.Lock()
+	defer e.cpMu.Unlock()
+	e.checkpoints = append([]*checkpoint{cp}, e.checkpoints...)
+	if len(e.checkpoints) > keep {
+		e.checkpoints = e.checkpoints[:keep]
+	}
+	e.observeCheckpointsLocked()
+}
+
+// newestCheckpoint returns the newest checkpoint that may be replayed in
+// place of the generation replaced, forgetting the stale ones.
+func (e *Engine) newestCheckpoint(replaced uint64) *checkpoint {
+	e.cpMu.Lock()
+	defer e.cpMu.Unlock()
+	kept := e.checkpoints[:0]
+	for _, cp := range e.checkpoints {
+		if cp.Meta.Generation < replaced {
+			monitor.StateSnapshotReplaysTotal.WithLabelValues("stale").Inc()
+			continue
+		}
+		kept = append(kept, cp)
+	}
+	e.checkpoints = kept
+	e.observeCheckpointsLocked()
+	if len(kept) == 0 {
+		return nil
+	}
+	cp := *kept[0]
+	return &cp
+}
+
+// dropCheckpoint forgets a checkpoint the restarted process did not accept.
+func (e *Engine) dropCheckpoint(cp *checkpoint) {
+	e.cpMu.Lock()
+	defer e.cpMu.Unlock()
+	for i, c := range e.checkpoints {
+		if c.Meta.Created.Equal(cp.Meta.Created) {
+			e.checkpoints = append(e.checkpoints[:i:i], e.checkpoints[i+1:]...)
+			break
+		}
+	}
+	e.observeCheckpointsLocked()
+}
+
+// adoptCheckpoint records that the state of r now lives in the process of
+// generation gen, so that it may be replayed again should that process crash
+// before its first checkpoint.
+func (e *Engine) adoptCheckpoint(r *replay, gen uint64) {
+	if !e.checkpointsEnabled() {
+		return
+	}
+	if r.checkpoint == nil {
+		meta := r.meta
+		meta.Generation = gen
+		e.addCheckpoint(&checkpoint{Meta: meta, State: r.state})
+		return
+	}
+	e.cpMu.Lock()
+	defer e.cpMu.Unlock()
+	for _, c := range e.checkpoints {
+		if c.Meta.Created.Equal(r.checkpoint.Meta.Created) {
+			c.Meta.Generation = gen
+		}
+	}
+}
+
+func (e *Engine) observeCheckpointsLocked() {
+	if len(e.checkpoints) == 0 {
+		monitor.ObserveCheckpoint(time.Time{}, 0)
+		return
+	}
+	newest := e.checkpoints[0]
+	monitor.ObserveCheckpoint(newest.Meta.Created, len(newest.State))
+}
+
+// handleCheckpoint takes a checkpoint on demand and describes it.
+func (e *Engine) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e.mu.Lock()
+	err := e.checkpointableLocked()
+	e.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	cp, err := e.checkpoint()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"generation":     cp.Meta.Generation,
+		"pid":            cp.Meta.SenderPid,
+		"created":        cp.Meta.Created,
+		"bytes":          len(cp.State),
+		"codec":          cp.Meta.Codec,
+		"schema_version": cp.Meta.SchemaVersion,
+	})
+}
+
+// Personal.AI order the ending
@@ -0,0 +1,220 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/turtacn/Aeterna/internal/monitor"
+	"github.com/turtacn/Aeterna/internal/srp"
+	"github.com/turtacn/Aeterna/internal/supervisor"
+	"github.com/turtacn/Aeterna/pkg/consts"
+	"github.com/turtacn/Aeterna/pkg/fsm"
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+// crash kills the current process of e, which restarts it, and returns the
+// restarted process once it has been replayed its state, if any.
+func crash(t *testing.T, e *Engine, readyDir string, env ...string) *supervisor.ProcessManager {
+	t.Helper()
+	e.mu.Lock()
+	e.cfg.Service.Env = append([]string{"SRP_PEER_READY_DIR=" + readyDir}, env...)
+	e.cfg.Orchestration.Startup.WarmupDelay = "10ms"
+	e.restarts = supervisor.NewRestartPolicy(protocol.RestartConfig{Policy: "on-failure", Backoff: "10ms", MaxRestarts: 1, Window: "1m"})
+	crashed := e.current
+	e.mu.Unlock()
+	crashed.Kill()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for e.currentProcess() == crashed && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	restarted := e.currentProcess()
+	if restarted == crashed {
+		t.Fatal("Expected the crashed process to be restarted")
+	}
+	// The replay is over once the restarted process has warmed up.
+	e.stateMu.Lock()
+	e.stateMu.Unlock()
+	return restarted
+}
+
+func checkpointCount(e *Engine) int {
+	e.cpMu.Lock()
+	defer e.cpMu.Unlock()
+	return len(e.checkpoints)
+}
+
+func TestEngine_CheckpointReplayedAfterCrash(t *testing.T) {
+	e, readyDir := newHandoffEngine(t, "")
+	e.cfg.Orchestration.StateHandoff.Checkpoint = protocol.CheckpointConfig{Enabled: true, Keep: 2}
+	ok := monitor.CheckpointsTotal.WithLabelValues("ok")
+	before := testutil.ToFloat64(ok)
+
+	for i := 0; i < 3; i++ {
+		cp, err := e.checkpoint()
+		if err != nil {
+			t.Fatalf("checkpoint failed: %v", err)
+		}
+		if string(cp.State) != `{"turns":1}` || cp.Meta.Codec != "json" || cp.Meta.Generation != 1 {
+			t.Fatalf("unexpected checkpoint %+v %q", cp.Meta, cp.State)
+		}
+	}
+	if n := checkpointCount(e); n != 2 {
+		t.Errorf("Expected 2 checkpoints to be kept, got %d", n)
+	}
+	if got := testutil.ToFloat64(ok); got != before+3 {
+		t.Errorf("Expected 3 checkpoints to be counted, got %v", got-before)
+	}
+	if got := testutil.ToFloat64(monitor.CheckpointSizeBytes); got != 11 {
+		t.Errorf("Expected the size of the newest checkpoint, got %v", got)
+	}
+	if age := testutil.ToFloat64(monitor.CheckpointAgeSeconds); age <= 0 || age > 5 {
+		t.Errorf("Expected the age of the newest checkpoint, got %v", age)
+	}
+
+	restarted := crash(t, e, readyDir)
+	if turns := waitForPeer(t, readyDir, restarted.Pid()); turns != "1" {
+		t.Errorf("Expected the restarted process to restore 1 turn, got %q", turns)
+	}
+	// The state lives in the restarted process now, and stays replayable
+	// should it crash before its first checkpoint.
+	if cp := e.newestCheckpoint(e.generationOf(restarted).ID); cp == nil {
+		t.Error("Expected the checkpoint to be adopted by the restarted process")
+	}
+}
+
+func TestEngine_CheckpointReplayedAfterCrashWhileStarting(t *testing.T) {
+	e, readyDir := newHandoffEngine(t, "")
+	e.cfg.Orchestration.StateHandoff.Checkpoint = protocol.CheckpointConfig{Enabled: true}
+	if _, err := e.checkpoint(); err != nil {
+		t.Fatalf("checkpoint failed: %v", err)
+	}
+	// The process crashes before it was declared stable.
+	e.fsm = fsm.New(fsm.State(consts.StateStarting))
+	e.setupFSM()
+
+	restarted := crash(t, e, readyDir)
+	if turns := waitForPeer(t, readyDir, restarted.Pid()); turns != "1" {
+		t.Errorf("Expected the restarted process to restore 1 turn, got %q", turns)
+	}
+}
+
+func TestEngine_CheckpointKeptWhenRestartedProcessDies(t *testing.T) {
+	e, readyDir := newHandoffEngine(t, "")
+	e.cfg.Orchestration.StateHandoff.Checkpoint = protocol.CheckpointConfig{Enabled: true}
+	if _, err := e.checkpoint(); err != nil {
+		t.Fatalf("checkpoint failed: %v", err)
+	}
+
+	// The first restart exits before taking the checkpoint, the second one
+	// comes up.
+	marker := filepath.Join(t.TempDir(), "failed")
+	e.mu.Lock()
+	e.cfg.Service.Command = []string{"sh", "-c", `if [ -f "$1" ]; then exec "$0" -test.run='^TestHelperSRPPeer$'; fi; touch "$1"; exit 1`, os.Args[0], marker}
+	e.cfg.Orchestration.Startup.WarmupDelay = "10ms"
+	e.restarts = supervisor.NewRestartPolicy(protocol.RestartConfig{Policy: "on-failure", Backoff: "10ms", MaxRestarts: 2, Window: "1m"})
+	crashed := e.current
+	e.mu.Unlock()
+	crashed.Kill()
+
+	replaced := func(pm *supervisor.ProcessManager) *supervisor.ProcessManager {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for e.currentProcess() == pm && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if e.currentProcess() == pm {
+			t.Fatal("Expected the process to be restarted")
+		}
+		return e.currentProcess()
+	}
+	restarted := replaced(replaced(crashed))
+	if turns := waitForPeer(t, readyDir, restarted.Pid()); turns != "1" {
+		t.Errorf("Expected the second restart to restore 1 turn, got %q", turns)
+	}
+}
+
+func TestEngine_RejectedCheckpointIsDropped(t *testing.T) {
+	e, readyDir := newHandoffEngine(t, "")
+	e.cfg.Orchestration.StateHandoff.Checkpoint = protocol.CheckpointConfig{Enabled: true}
+	for i := 0; i < 2; i++ {
+		if _, err := e.checkpoint(); err != nil {
+			t.Fatalf("checkpoint failed: %v", err)
+		}
+	}
+
+	restarted := crash(t, e, readyDir, "SRP_PEER_REJECT=1")
+	if turns := waitForPeer(t, readyDir, restarted.Pid()); turns != "0" {
+		t.Errorf("Expected the restarted process to start empty, got %q", turns)
+	}
+	// The next restart falls back to the previous checkpoint.
+	if n := checkpointCount(e); n != 1 {
+		t.Errorf("Expected the rejected checkpoint to be dropped, got %d left", n)
+	}
+}
+
+func TestEngine_HandleCheckpoint(t *testing.T) {
+	e, _ := newHandoffEngine(t, "")
+	srv := httptest.NewServer(e.ControlHandler())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/v1/checkpoint", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected checkpoints to be refused while disabled, got %d", resp.StatusCode)
+	}
+
+	e.cfg.Orchestration.StateHandoff.Checkpoint.Enabled = true
+	resp, err = http.Post(srv.URL+"/v1/checkpoint", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Generation uint64 `json:"generation"`
+		Bytes      int    `json:"bytes"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&body) != nil || body.Generation != 1 || body.Bytes != 11 {
+		t.Errorf("Expected the checkpoint to be described, got %d %+v", resp.StatusCode, body)
+	}
+}
+
+func TestEngine_DeltaCheckpoint(t *testing.T) {
+	e, readyDir := newHandoffEngine(t, "", "SRP_PEER_SECTIONS=1")
+	e.cfg.Orchestration.StateHandoff.Checkpoint = protocol.CheckpointConfig{Enabled: true}
+	e.cfg.Orchestration.StateHandoff.Delta = true
+
+	full, err := e.checkpoint()
+	if err != nil {
+		t.Fatalf("checkpoint failed: %v", err)
+	}
+	if len(full.Meta.Sections) != 2 || full.Meta.Sections[0].Name != "turns" || len(full.State) != 11+4098 {
+		t.Fatalf("Expected a checkpoint in two sections, got %+v", full.Meta.Sections)
+	}
+
+	// Nothing changed since: no section is sent again.
+	cp, res, err := e.receiveState(e.currentProcess(), srp.RequestCheckpoint)
+	if err != nil {
+		t.Fatalf("receiveState failed: %v", err)
+	}
+	if res.Bytes != 0 || len(res.Sections) != 2 || !res.Sections[0].Unchanged || !res.Sections[1].Unchanged {
+		t.Errorf("Expected the sections to be left out, got %d bytes %+v", res.Bytes, res.Sections)
+	}
+	if string(cp.State) != string(full.State) || cp.Meta.Sections[1].Unchanged {
+		t.Error("Expected the sections to be taken from the previous checkpoint")
+	}
+
+	restarted := crash(t, e, readyDir, "SRP_PEER_SECTIONS=1")
+	if turns := waitForPeer(t, readyDir, restarted.Pid()); turns != "1" {
+		t.Errorf("Expected the restarted process to restore 1 turn, got %q", turns)
+	}
+}
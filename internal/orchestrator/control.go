@@ -0,0 +1,132 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/turtacn/Aeterna/internal/srp"
+	"github.com/turtacn/Aeterna/pkg/consts"
+	"github.com/turtacn/Aeterna/pkg/logger"
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+// The control API makes Aeterna, PID 1 of the container, exec a binary or
+// export the state of the serving process, so it is served apart from the
+// metrics: on a Unix socket of mode 0600, to processes of Aeterna's user
+// (SO_PEERCRED), and only with the token of this run. The token is written
+// to a file of mode 0600, from which `aeterna upgrade` reads it.
+
+// ControlPaths returns the socket the control API of cfg is served on and
+// the file holding its token.
+func ControlPaths(cfg *protocol.Config) (socketPath, tokenFile string) {
+	socketPath = cfg.Control.SocketPath
+	if socketPath == "" {
+		socketPath = consts.DefaultControlSocketPath
+	}
+	tokenFile = cfg.Control.TokenFile
+	if tokenFile == "" {
+		tokenFile = socketPath + ".token"
+	}
+	return socketPath, tokenFile
+}
+
+// ControlHandler serves the control API of the engine.
+func (e *Engine) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/upgrade", e.handleUpgrade)
+	mux.HandleFunc("/v1/checkpoint", e.handleCheckpoint)
+	return mux
+}
+
+// connKey carries the connection of a request to authorizeControl.
+type connKey struct{}
+
+// startControl serves the control API on its socket in the background.
+func (e *Engine) startControl() error {
+	socketPath, tokenFile := ControlPaths(e.cfg)
+	token, err := srp.NewToken()
+	if err != nil {
+		return err
+	}
+	os.Remove(tokenFile)
+	if err := os.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+		return err
+	}
+	if _, err := os.Stat(socketPath); err == nil {
+		os.Remove(socketPath)
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		os.Remove(tokenFile)
+		return err
+	}
+	os.Chmod(socketPath, 0600)
+
+	srv := &http.Server{
+		Handler: authorizeControl(token, e.ControlHandler()),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
+	}
+	e.mu.Lock()
+	e.control = srv
+	e.mu.Unlock()
+
+	logger.Log.Info("Control API listening", "socket", socketPath)
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Log.Error("Control API failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+// stopControl stops the control API and removes its socket and token file.
+func (e *Engine) stopControl() {
+	e.mu.Lock()
+	srv := e.control
+	e.control = nil
+	e.mu.Unlock()
+	if srv == nil {
+		return
+	}
+	srv.Close()
+	socketPath, tokenFile := ControlPaths(e.cfg)
+	for _, path := range []string{socketPath, tokenFile} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Log.Warn("Failed to remove control API file", "path", path, "err", err)
+		}
+	}
+}
+
+// authorizeControl lets through the requests of processes of Aeterna's user
+// that present token as a bearer token.
+func authorizeControl(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uc, ok := r.Context().Value(connKey{}).(*net.UnixConn)
+		if !ok {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		pid, err := srp.PeerPid(uc)
+		if err != nil {
+			logger.Log.Warn("Control API request refused", "path", r.URL.Path, "err", err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		presented, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			logger.Log.Warn("Control API request refused", "path", r.URL.Path, "pid", pid, "err", "invalid token")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Personal.AI order the ending
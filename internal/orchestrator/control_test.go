@@ -0,0 +1,72 @@
+package orchestrator
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+func TestEngine_ControlAPIRequiresToken(t *testing.T) {
+	dir := t.TempDir()
+	e := NewEngine(&protocol.Config{Control: protocol.ControlConfig{SocketPath: filepath.Join(dir, "control.sock")}})
+	if err := e.startControl(); err != nil {
+		t.Fatalf("startControl failed: %v", err)
+	}
+	socketPath, tokenFile := ControlPaths(e.cfg)
+	for _, path := range []string{socketPath, tokenFile} {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("Expected %s with mode 0600, got %v", path, err)
+		}
+	}
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	post := func(auth string) int {
+		req, _ := http.NewRequest(http.MethodPost, "http://aeterna/v1/checkpoint", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, auth := range []string{"", "Bearer guess", strings.TrimSpace(string(token))} {
+		if code := post(auth); code != http.StatusUnauthorized {
+			t.Errorf("Expected %q to be refused, got %d", auth, code)
+		}
+	}
+	// Checkpoints are not enabled, but the request got through.
+	if code := post("Bearer " + strings.TrimSpace(string(token))); code != http.StatusConflict {
+		t.Errorf("Expected the request to reach the control API, got %d", code)
+	}
+
+	// The metrics server, on the default mux, does not serve it.
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/v1/upgrade", nil)
+	if _, pattern := http.DefaultServeMux.Handler(req); pattern != "" {
+		t.Errorf("Expected the control API off the default mux, found %q", pattern)
+	}
+
+	e.stopControl()
+	for _, path := range []string{socketPath, tokenFile} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", path, err)
+		}
+	}
+}
@@ -1,16 +1,27 @@
 package orchestrator
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/turtacn/Aeterna/internal/canary"
+	"github.com/turtacn/Aeterna/internal/monitor"
 	"github.com/turtacn/Aeterna/internal/resource"
 	"github.com/turtacn/Aeterna/internal/srp"
 	"github.com/turtacn/Aeterna/internal/supervisor"
 	"github.com/turtacn/Aeterna/pkg/consts"
+	aerrors "github.com/turtacn/Aeterna/pkg/errors"
 	"github.com/turtacn/Aeterna/pkg/fsm"
 	"github.com/turtacn/Aeterna/pkg/logger"
 	"github.com/turtacn/Aeterna/pkg/protocol"
@@ -20,22 +31,101 @@ import (
 // It manages the finite state machine, network resources, process lifecycle,
 // and the State Relay Protocol (SRP) for hot reloads.
 type Engine struct {
-	cfg     *protocol.Config
-	fsm     *fsm.StateMachine
-	socket  *resource.SocketManager
-	process *supervisor.ProcessManager // Current Process
-	srp     *srp.StateCoordinator
+	cfg    *protocol.Config
+	fsm    *fsm.StateMachine
+	socket *resource.SocketManager
+	srp    *srp.StateCoordinator
+	conns  *srp.ConnBroker // nil unless connection handoff is enabled
+	reaper *supervisor.Reaper
+
+	restarts *supervisor.RestartPolicy
+
+	mu         sync.Mutex
+	current    *supervisor.ProcessManager // Generation serving traffic
+	candidate  *supervisor.ProcessManager // Generation under soak during a reload
+	soakCancel context.CancelFunc         // Aborts the soak observer of the candidate
+	stopping   bool                       // Set once a shutdown has begun
+	reloading  atomic.Bool                // Set while a SIGHUP reload runs its synchronous phases
+	reloads    []ReloadRecord             // Outcome of recent reloads, oldest first
+	control    *http.Server               // Control API, nil unless serving
+	cleanOnce  sync.Once
+
+	// generations numbers every process the engine started or adopted
+	// (*supervisor.ProcessManager -> generation), lastGeneration being the
+	// highest number given out.
+	generations    sync.Map
+	lastGeneration atomic.Uint64
+
+	spillEnv string // KEY=VALUE of the spill key taken from the environment
+
+	// hookCtx bounds the pre-flight and migration hooks; Shutdown cancels it
+	// so that a reload in flight does not hold up the stop.
+	hookCtx    context.Context
+	hookCancel context.CancelFunc
+
+	// stateMu is held by the transfer using the state socket: a handover, a
+	// replay or a checkpoint. It is taken before mu.
+	stateMu     sync.Mutex
+	cpMu        sync.Mutex
+	checkpoints []*checkpoint // Newest first
+
+	// done receives the engine's final result once the current process is gone.
+	done chan error
+}
+
+// reloadHistoryLimit bounds the number of reloads kept in the history.
+const reloadHistoryLimit = 32
+
+// Reload outcomes recorded in the reload history.
+const (
+	ReloadPromoted   = "promoted"
+	ReloadRolledBack = "rolled_back"
+	ReloadAborted    = "aborted"
+)
+
+// ReloadRecord is the outcome of one reload.
+type ReloadRecord struct {
+	Time    time.Time `json:"time"`
+	Outcome string    `json:"outcome"`
+	Pid     int       `json:"pid,omitempty"` // Candidate process
+	Error   string    `json:"error,omitempty"`
 }
 
 // NewEngine creates a new Engine instance with the provided configuration.
 // It initializes the state machine, socket manager, process manager, and SRP coordinator.
 func NewEngine(cfg *protocol.Config) *Engine {
+	statePath := cfg.Orchestration.StateHandoff.SocketPath
+	if cfg.Orchestration.StateHandoff.Enabled && statePath == "" {
+		statePath = consts.DefaultStateSocketPath
+	}
 	e := &Engine{
-		cfg:     cfg,
-		fsm:     fsm.New(fsm.State(consts.StatePending)),
-		socket:  resource.NewSocketManager(),
-		process: supervisor.New(),
-		srp:     srp.NewCoordinator(cfg.Orchestration.StateHandoff.SocketPath),
+		cfg:    cfg,
+		fsm:    fsm.New(fsm.State(consts.StatePending)),
+		socket: resource.NewSocketManager(),
+		srp:    srp.NewCoordinator(statePath),
+		done:   make(chan error, 1),
+
+		restarts: supervisor.NewRestartPolicy(cfg.Service.Restart),
+	}
+	e.hookCtx, e.hookCancel = context.WithCancel(context.Background())
+	e.srp.MaxFrameSize = cfg.Orchestration.StateHandoff.MaxFrameSize
+	e.srp.Transport = cfg.Orchestration.StateHandoff.Transport
+	e.srp.MemfdThreshold = cfg.Orchestration.StateHandoff.MemfdThreshold
+	e.srp.ChunkSize = cfg.Orchestration.StateHandoff.ChunkSize
+	e.srp.Compression = cfg.Orchestration.StateHandoff.Compression
+	e.srp.CompressionLevel = cfg.Orchestration.StateHandoff.CompressionLevel
+	e.srp.CompressionThreshold = cfg.Orchestration.StateHandoff.CompressionThreshold
+	e.srp.Progress = func(transport string, transferred, size int64) {
+		monitor.StateTransferredBytes.Set(float64(transferred))
+		monitor.StateSizeBytes.Set(float64(size))
+	}
+	e.srp.Section = func(s srp.SectionStat) {
+		monitor.SectionBytes.WithLabelValues(s.Name).Set(float64(s.Bytes))
+		monitor.SectionDurationSeconds.WithLabelValues(s.Name).Set(s.Duration.Seconds())
+	}
+	if handoff := cfg.Orchestration.StateHandoff.Connections; handoff.Enabled {
+		timeout, _ := time.ParseDuration(handoff.Timeout)
+		e.conns = srp.NewConnBroker(handoff.SocketPath, timeout)
 	}
 	e.setupFSM()
 	return e
@@ -48,6 +138,10 @@ func (e *Engine) setupFSM() {
 	e.fsm.AddTransition(fsm.State(consts.StatePending), fsm.State(consts.StateStarting), "start", e.onStart)
 	e.fsm.AddTransition(fsm.State(consts.StateStarting), fsm.State(consts.StateRunning), "stable", nil)
 
+	// Crash Restart, also of a process that crashed while warming up
+	e.fsm.AddTransition(fsm.State(consts.StateRunning), fsm.State(consts.StateStarting), "crash", nil)
+	e.fsm.AddTransition(fsm.State(consts.StateStarting), fsm.State(consts.StateStarting), "crash", nil)
+
 	// Hot Reload Trigger
 	e.fsm.AddTransition(fsm.State(consts.StateRunning), fsm.State(consts.StatePreChecking), "reload", e.onReloadTriggered)
 
@@ -58,120 +152,852 @@ func (e *Engine) setupFSM() {
 	// Soak Outcome
 	e.fsm.AddTransition(fsm.State(consts.StateSoaking), fsm.State(consts.StateRunning), "rollback", e.onRollback)
 	e.fsm.AddTransition(fsm.State(consts.StateSoaking), fsm.State(consts.StateDraining), "success", e.onDrainOld)
+
+	// Drain Outcome
+	e.fsm.AddTransition(fsm.State(consts.StateDraining), fsm.State(consts.StateRunning), "drained", nil)
+
+	// Shutdown is allowed from every state
+	for _, state := range []consts.ProcessState{
+		consts.StatePending, consts.StateStarting, consts.StateRunning, consts.StatePreChecking,
+		consts.StateSoaking, consts.StateDraining, consts.StateFailed,
+	} {
+		e.fsm.AddTransition(fsm.State(state), fsm.State(consts.StateStopped), "stop", e.onStop)
+	}
 }
 
 // Start begins the orchestration process.
 // It sets up signal handling for SIGHUP (reload), SIGINT, and SIGTERM (shutdown),
 // and triggers the initial "start" event in the state machine.
+// It blocks until the serving process exits or the engine is shut down, releases
+// all resources and returns the serving process's exit status.
+// Started by Upgrade, it resumes the previous binary's state instead.
 func (e *Engine) Start() error {
+	if err := e.openSpill(); err != nil {
+		e.cleanup()
+		return err
+	}
+
+	// Adopt the serving process before the reaper could collect it
+	resumed := os.Getenv(consts.EnvUpgradeFD) != ""
+	if resumed {
+		if err := e.resume(os.Getenv(consts.EnvUpgradeFD)); err != nil {
+			e.cleanup()
+			return err
+		}
+	}
+
+	// PID 1 duties: collect orphans re-parented to us
+	if reaper, err := supervisor.StartReaper(); err != nil {
+		logger.Log.Warn("Zombie reaper unavailable", "err", err)
+	} else {
+		e.reaper = reaper
+	}
+
 	// Handle OS Signals
+	forwarded := e.forwardedSignals()
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, append([]os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM}, forwarded...)...)
 
 	go func() {
 		for sig := range sigCh {
 			switch sig {
 			case syscall.SIGHUP:
 				logger.Log.Info("Signal: SIGHUP received. Initiating UPHR-O workflow.")
-				e.fsm.Fire("reload")
+				if e.isStopping() {
+					logger.Log.Warn("Reload ignored: shutdown in progress")
+					continue
+				}
+				// Reload off the signal loop so that a stop signal is not held
+				// up behind the pre-flight hooks.
+				if !e.reloading.CompareAndSwap(false, true) {
+					logger.Log.Warn("Reload ignored: another reload is in progress")
+					continue
+				}
+				go func() {
+					defer e.reloading.Store(false)
+					if err := e.fsm.Fire("reload"); err != nil {
+						logger.Log.Error("Reload failed", "err", err)
+					}
+				}()
 			case syscall.SIGINT, syscall.SIGTERM:
-				logger.Log.Info("Signal: Stop received. Shutting down.")
-				e.process.Stop()
-				os.Exit(0)
+				logger.Log.Info("Signal: Stop received. Shutting down.", "signal", sig)
+				go e.Shutdown()
+			default:
+				if current := e.currentProcess(); current != nil {
+					if err := current.SignalGroup(sig.(syscall.Signal)); err != nil {
+						logger.Log.Warn("Signal forwarding failed", "signal", sig, "err", err)
+					}
+				}
 			}
 		}
 	}()
 
+	if e.conns != nil {
+		if err := e.conns.Start(); err != nil {
+			e.cleanup()
+			return aerrors.New(aerrors.ErrCodeSocketBindFailed, "Start", "failed to start the connection handoff broker", err)
+		}
+	}
+
+	if err := e.startControl(); err != nil {
+		e.cleanup()
+		return aerrors.New(aerrors.ErrCodeSocketBindFailed, "Start", "failed to start the control API", err)
+	}
+
 	// Initial bootstrap
-	return e.fsm.Fire("start")
+	if !resumed {
+		if err := e.fsm.Fire("start"); err != nil {
+			e.cleanup()
+			return err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.checkpointLoop(ctx)
+
+	err := <-e.done
+	e.cleanup()
+	return err
+}
+
+// Shutdown stops the engine in order: reloads are refused, the FSM moves to
+// STOPPED, a candidate under soak is discarded, the serving process is drained
+// under the drain timeout and the shutdown hooks run. Start then releases the
+// listeners and the SRP socket and returns. A second call kills the processes
+// immediately.
+func (e *Engine) Shutdown() {
+	e.mu.Lock()
+	if e.stopping {
+		current, candidate := e.current, e.candidate
+		e.mu.Unlock()
+		logger.Log.Warn("Shutdown already in progress. Forcing exit.")
+		for _, pm := range []*supervisor.ProcessManager{current, candidate} {
+			if pm != nil {
+				pm.Kill()
+			}
+		}
+		return
+	}
+	e.stopping = true
+	cancel := e.soakCancel
+	e.mu.Unlock()
+
+	e.hookCancel()
+	if cancel != nil {
+		cancel()
+	}
+	if err := e.fsm.Fire("stop"); err != nil {
+		logger.Log.Error("Shutdown failed", "err", err)
+		e.finish(err)
+	}
+}
+
+// recordReload appends a reload outcome to the history.
+func (e *Engine) recordReload(outcome string, pid int, err error) {
+	record := ReloadRecord{Time: time.Now(), Outcome: outcome, Pid: pid}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reloads = append(e.reloads, record)
+	if len(e.reloads) > reloadHistoryLimit {
+		e.reloads = e.reloads[len(e.reloads)-reloadHistoryLimit:]
+	}
+}
+
+func (e *Engine) isStopping() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stopping
+}
+
+// cleanup releases the resources owned by the engine. It is idempotent.
+func (e *Engine) cleanup() {
+	e.cleanOnce.Do(func() {
+		e.socket.Close()
+		if err := e.srp.Close(); err != nil {
+			logger.Log.Warn("Failed to remove SRP socket", "err", err)
+		}
+		if e.conns != nil {
+			if err := e.conns.Close(); err != nil {
+				logger.Log.Warn("Failed to remove connection handoff socket", "err", err)
+			}
+		}
+		e.stopControl()
+		if e.reaper != nil {
+			e.reaper.Stop()
+		}
+		logger.Log.Info("Engine stopped. Resources released.")
+	})
+}
+
+// forwardedSignals resolves service.forward_signals, skipping the signals the
+// engine handles itself.
+func (e *Engine) forwardedSignals() []os.Signal {
+	names := e.cfg.Service.ForwardSignals
+	if names == nil {
+		names = consts.DefaultForwardSignals
+	}
+
+	var sigs []os.Signal
+	for _, name := range names {
+		sig, err := supervisor.ParseSignal(name, 0)
+		if err != nil || sig == 0 {
+			logger.Log.Warn("Ignoring signal in forward_signals", "signal", name, "err", err)
+			continue
+		}
+		switch sig {
+		case syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL:
+			logger.Log.Warn("Signal is reserved by the engine and cannot be forwarded", "signal", name)
+			continue
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs
+}
+
+// currentProcess returns the generation that is currently serving traffic.
+func (e *Engine) currentProcess() *supervisor.ProcessManager {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.current
+}
+
+// spawn forks a new generation of the business process with all managed
+// listeners and starts watching it for exit.
+func (e *Engine) spawn() (*supervisor.ProcessManager, error) {
+	pm := supervisor.New()
+	files, fdEnv := e.socket.ExportFiles()
+	env := append(append([]string{}, e.cfg.Service.Env...), fdEnv...)
+	var token string
+	var control *srp.Control
+	if e.cfg.Orchestration.StateHandoff.Enabled || e.conns != nil {
+		var err error
+		if token, err = srp.NewToken(); err != nil {
+			return nil, err
+		}
+		env = append(env, consts.EnvStateToken+"="+token)
+	}
+	if handoff := e.cfg.Orchestration.StateHandoff; handoff.Enabled {
+		signal := handoff.Signal
+		if signal == "" {
+			signal = consts.DefaultStateSignal
+		}
+		env = append(env,
+			consts.EnvStateSocketPath+"="+e.srp.Path(),
+			consts.EnvStateSignal+"="+strings.ToUpper(signal))
+		if e.brokered() {
+			var err error
+			var child *os.File
+			if control, child, err = srp.NewControl(); err != nil {
+				return nil, err
+			}
+			defer child.Close()
+			pm.PassControl(child)
+		}
+	}
+	if e.conns != nil {
+		env = append(env, consts.EnvConnSocketPath+"="+e.conns.Path())
+	}
+	var probePort int
+	if canary.UsesProbePort(e.cfg.Orchestration.Canary) {
+		var err error
+		if probePort, err = canary.AllocateProbePort(); err != nil {
+			control.Close()
+			return nil, err
+		}
+		env = append(env, consts.EnvProbePort+"="+strconv.Itoa(probePort))
+	}
+	if err := pm.Start(e.cfg.Service.Command, env, files); err != nil {
+		control.Close()
+		return nil, err
+	}
+	e.generations.Store(pm, generation{ID: e.lastGeneration.Add(1), Token: token, Control: control, ProbePort: probePort})
+	e.expectConns(nil, pm)
+	go e.watch(pm)
+	return pm, nil
+}
+
+// generation identifies a process started by the engine.
+type generation struct {
+	ID      uint64
+	Token   string       // Token of the generation, empty unless state or connection handoff is enabled
+	Control *srp.Control // Control channel, nil unless in broker mode
+	// ProbePort is the port the canary probes reach the generation on, 0
+	// unless they use one.
+	ProbePort int
+}
+
+// generationOf returns the generation of pm.
+func (e *Engine) generationOf(pm *supervisor.ProcessManager) generation {
+	g, _ := e.generations.Load(pm)
+	gen, _ := g.(generation)
+	return gen
+}
+
+// expectConns lets the connection broker take connections from sender only,
+// none if nil, and hand them to receiver only.
+func (e *Engine) expectConns(sender, receiver *supervisor.ProcessManager) {
+	if e.conns == nil {
+		return
+	}
+	var from *srp.Peer
+	if sender != nil {
+		from = e.statePeer(sender)
+	}
+	e.conns.Expect(from, e.statePeer(receiver))
+}
+
+// statePeer returns what the state relay expects of pm.
+func (e *Engine) statePeer(pm *supervisor.ProcessManager) *srp.Peer {
+	gen := e.generationOf(pm)
+	return &srp.Peer{Pid: pm.Pid(), Token: gen.Token, Generation: gen.ID}
+}
+
+// watch waits for a process to exit. A crashed current generation is
+// restarted according to the restart policy, otherwise it ends the engine;
+// a candidate exiting is judged by the soak observer instead.
+func (e *Engine) watch(pm *supervisor.ProcessManager) {
+	err := pm.Wait()
+	e.mu.Lock()
+	gen := e.generationOf(pm)
+	e.generations.Delete(pm)
+	isCurrent, stopping := pm == e.current, e.stopping
+	e.mu.Unlock()
+	gen.Control.Close()
+
+	if !isCurrent || stopping {
+		// Retired generations and processes stopped by Shutdown are expected to exit.
+		logger.Log.Info("Supervisor: Retired process exited", "pid", pm.Pid(), "err", err)
+		return
+	}
+	logger.Log.Warn("Supervisor: Current process exited", "pid", pm.Pid(), "err", err)
+
+	delay, rerr := e.restarts.Next(err, time.Now())
+	if rerr != nil {
+		logger.Log.Error("Supervisor: Not restarting process", "reason", rerr)
+		e.finish(err)
+		return
+	}
+	e.restart(pm, gen.ID, delay)
+}
+
+// restart replaces a crashed current process, of generation replaced, after
+// delay. The new process inherits the listeners held by the SocketManager, so
+// the ports stay bound between crashes, and is replayed the spilled or
+// checkpointed state, if any.
+func (e *Engine) restart(crashed *supervisor.ProcessManager, replaced uint64, delay time.Duration) {
+	// Outside a reload the FSM goes back to STARTING until the new process has
+	// warmed up; a reload in flight keeps its own state.
+	warm := e.fsm.Fire("crash") == nil
+	logger.Log.Info("Supervisor: Restarting crashed process", "pid", crashed.Pid(), "delay", delay)
+	time.Sleep(delay)
+
+	// The replay waits for the state transfer of a reload in flight, if any.
+	e.stateMu.Lock()
+	e.mu.Lock()
+	if e.current != crashed || e.stopping {
+		// Superseded meanwhile, e.g. by a promoted candidate or a shutdown.
+		e.mu.Unlock()
+		e.stateMu.Unlock()
+		return
+	}
+	r := e.prepareReplay(replaced)
+	pm, err := e.spawn()
+	if err != nil {
+		e.mu.Unlock()
+		r.close()
+		e.stateMu.Unlock()
+		logger.Log.Error("Supervisor: Restart failed", "err", err)
+		e.finish(err)
+		return
+	}
+	e.current = pm
+	gen := e.generationOf(pm).ID
+	e.mu.Unlock()
+
+	monitor.RestartTotal.WithLabelValues("crash").Inc()
+	go e.startUp(r, pm, gen, warm)
+}
+
+// startUp replays the spilled or checkpointed state, if any, to a
+// cold-started process of generation gen and releases the state socket taken
+// by the caller. With warm set it then waits for the process to warm up; the
+// FSM stays STARTING meanwhile, so no reload competes for the state socket.
+func (e *Engine) startUp(r *replay, pm *supervisor.ProcessManager, gen uint64, warm bool) {
+	if r != nil {
+		e.replay(r, pm, gen)
+	}
+	e.stateMu.Unlock()
+	if warm {
+		e.warmup(pm)
+	}
+}
+
+// warmup declares pm, the freshly started current process, stable after the
+// configured warmup delay. A process that exited or was replaced meanwhile is
+// left alone: the restart that follows warms up its own process.
+func (e *Engine) warmup(pm *supervisor.ProcessManager) {
+	delay, _ := time.ParseDuration(e.cfg.Orchestration.Startup.WarmupDelay)
+	if delay <= 0 {
+		delay = consts.DefaultWarmupDelay
+	}
+	time.Sleep(delay)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	select {
+	case <-pm.Done():
+		return
+	default:
+	}
+	if e.current == pm {
+		e.fsm.Fire("stable")
+	}
+}
+
+// finish hands the engine's final result to Start.
+func (e *Engine) finish(err error) {
+	select {
+	case e.done <- err:
+	default:
+	}
 }
 
 // onStart handles the initial cold start
 func (e *Engine) onStart(event fsm.Event, args ...interface{}) error {
 	logger.Log.Info("Phase: Cold Start")
 
-	// 1. Bind Socket
-	_, err := e.socket.EnsureListener(":8080") // In real code, parse from config
+	// 1. Bind Sockets
+	if err := e.bindListeners(); err != nil {
+		return err
+	}
+
+	// 2. Start Process, replaying the state spilled by a previous run
+	e.stateMu.Lock()
+	r := e.prepareReplay(0)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var err error
+	e.current, err = e.spawn()
 	if err != nil {
+		r.close()
+		e.stateMu.Unlock()
 		return err
 	}
 
-	// 2. Start Process
-	files := e.socket.GetFiles()
+	go e.startUp(r, e.current, e.generationOf(e.current).ID, true)
 
-	err = e.process.Start(e.cfg.Service.Command, e.cfg.Service.Env, files)
+	return nil
+}
+
+// bindListeners binds every configured listener in declaration order, so each
+// generation finds them at the same FDs starting from 3.
+func (e *Engine) bindListeners() error {
+	specs, err := listenerSpecs(e.cfg.Listeners)
 	if err != nil {
 		return err
 	}
+	for _, spec := range specs {
+		if err := e.socket.Bind(spec); err != nil {
+			return aerrors.New(aerrors.ErrCodeSocketBindFailed, "ColdStart",
+				fmt.Sprintf("failed to bind listener %q on %s", spec.Name, spec.Address), err)
+		}
+	}
+	return nil
+}
 
-	go func() {
-		time.Sleep(2 * time.Second) // Simple warmup
-		e.fsm.Fire("stable")
-	}()
+// listenerSpecs validates the listeners section. Without one, Aeterna binds a
+// single "main" listener on consts.DefaultListenAddr.
+func listenerSpecs(listeners []protocol.ListenerConfig) ([]resource.ListenerSpec, error) {
+	if len(listeners) == 0 {
+		return []resource.ListenerSpec{{Name: "main", Network: "tcp", Address: consts.DefaultListenAddr}}, nil
+	}
+
+	specs := make([]resource.ListenerSpec, 0, len(listeners))
+	names := make(map[string]bool, len(listeners))
+	for i, l := range listeners {
+		name := l.Name
+		if name == "" {
+			name = fmt.Sprintf("listener%d", i)
+		}
+		if strings.ContainsAny(name, ":, \t\n") {
+			return nil, aerrors.New(aerrors.ErrCodeConfigInvalid, "ColdStart",
+				fmt.Sprintf("listener name %q must not contain separators or whitespace", name), nil)
+		}
+		if names[name] {
+			return nil, aerrors.New(aerrors.ErrCodeConfigInvalid, "ColdStart",
+				fmt.Sprintf("duplicate listener name %q", name), nil)
+		}
+		names[name] = true
 
-	// Block and wait for process
-	return e.process.Wait()
+		if l.Address == "" {
+			return nil, aerrors.New(aerrors.ErrCodeConfigInvalid, "ColdStart",
+				fmt.Sprintf("listener %q has no address", name), nil)
+		}
+		if l.Backlog < 0 {
+			return nil, aerrors.New(aerrors.ErrCodeConfigInvalid, "ColdStart",
+				fmt.Sprintf("listener %q has a negative backlog", name), nil)
+		}
+		network := l.Network
+		switch network {
+		case "":
+			network = "tcp"
+		case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "unix", "unixpacket", "unixgram":
+		default:
+			return nil, aerrors.New(aerrors.ErrCodeConfigInvalid, "ColdStart",
+				fmt.Sprintf("listener %q has unsupported network %q", name, l.Network), nil)
+		}
+		specs = append(specs, resource.ListenerSpec{Name: name, Network: network, Address: l.Address, Backlog: l.Backlog})
+	}
+	return specs, nil
 }
 
 // onReloadTriggered: Phase 1 - Pre-flight Checks
 func (e *Engine) onReloadTriggered(event fsm.Event, args ...interface{}) error {
 	logger.Log.Info("Phase 1: Pre-flight Checks")
 
-	for _, hook := range e.cfg.Orchestration.PreFlight {
-		logger.Log.Info("Running hook", "name", hook.Name)
-		cmd := exec.Command(hook.Command[0], hook.Command[1:]...)
-		if err := cmd.Run(); err != nil {
-			logger.Log.Error("Pre-flight check failed. Aborting reload.", "hook", hook.Name, "err", err)
-			e.fsm.Fire("abort")
-			return nil // Return nil to state machine, effectively handled
+	if err := runHooks(e.hookCtx, "PreFlight", aerrors.ErrCodePreCheckFailed, e.cfg.Orchestration.PreFlight); err != nil {
+		logger.Log.Error("Pre-flight check failed. Aborting reload.", "err", err)
+		e.recordReload(ReloadAborted, 0, err)
+		if abortErr := e.fsm.Fire("abort"); abortErr != nil {
+			return abortErr
 		}
+		return err
 	}
 
 	logger.Log.Info("Pre-flight checks passed.")
-	e.fsm.Fire("proceed")
-	return nil
+	return e.fsm.Fire("proceed")
 }
 
 // onSoakStart: Phase 2 & 3 - Fork, Exec & Soak
+// The candidate is forked next to the current process with the same listeners,
+// so both generations accept connections while the candidate is observed.
+// With state handoff enabled, the soak only starts once the candidate has
+// acknowledged the state of the current process.
 func (e *Engine) onSoakStart(event fsm.Event, args ...interface{}) error {
 	logger.Log.Info("Phase 2 & 3: Forking New Process & Soaking")
 
-	// Note: In a real implementation, we need to manage Two ProcessManagers (old and new).
-	// For this blueprint, we simulate the decision logic.
+	// The state socket must exist before the candidate looks for it. A
+	// checkpoint under way is let finish first. In broker mode the state of
+	// the old process is taken before the candidate is even started.
+	var stateSock net.Listener
+	var held *checkpoint
+	if handoff := e.cfg.Orchestration.StateHandoff; handoff.Enabled {
+		e.stateMu.Lock()
+		if e.brokered() {
+			e.mu.Lock()
+			current := e.current
+			e.mu.Unlock()
+			cp, res, err := e.receiveState(current, srp.RequestReload)
+			if err != nil {
+				e.stateMu.Unlock()
+				logger.Log.Error("Failed to take the state of the serving process", "pid", current.Pid(), "err", err)
+				return e.fsm.Fire("rollback", aerrors.New(aerrors.ErrCodeStateDumpTimeout, "StateHandoff", "state not received from the serving process", err))
+			}
+			logger.Log.Info("State held for the candidate", "pid", current.Pid(), "bytes", len(cp.State), "sent", res.Bytes,
+				"sections", len(cp.Meta.Sections), "codec", cp.Meta.Codec)
+			held = cp
+		}
+		l, err := e.srp.PrepareSocket()
+		if err != nil {
+			e.stateMu.Unlock()
+			logger.Log.Error("Failed to open the state socket", "err", err)
+			return e.fsm.Fire("rollback", aerrors.New(aerrors.ErrCodeStateLoadFail, "StateHandoff", "failed to open the state socket", err))
+		}
+		stateSock = l
+	}
 
-	soakDuration, _ := time.ParseDuration(e.cfg.Orchestration.Canary.SoakTime)
-	if soakDuration == 0 {
-		soakDuration = consts.DefaultSoakTime
+	candidate, err := e.spawn()
+	if err != nil {
+		logger.Log.Error("Failed to fork candidate process", "err", err)
+		if stateSock != nil {
+			stateSock.Close()
+			e.srp.Close()
+			e.stateMu.Unlock()
+		}
+		return e.fsm.Fire("rollback", err)
 	}
 
-	go func() {
-		logger.Log.Info("Soaking...", "duration", soakDuration)
-		// Monitoring simulation
-		time.Sleep(soakDuration)
+	ctx, cancel := context.WithCancel(context.Background())
+	e.mu.Lock()
+	e.candidate = candidate
+	e.soakCancel = cancel
+	current := e.current
+	e.mu.Unlock()
+	e.expectConns(current, candidate)
+	logger.Log.Info("Candidate forked", "current_pid", current.Pid(), "candidate_pid", candidate.Pid())
 
-		// If metrics are good:
-		success := true
+	warmup, _ := time.ParseDuration(e.cfg.Orchestration.Startup.WarmupDelay)
+	observer := canary.NewObserver(e.cfg.Orchestration.Canary, warmup,
+		canary.Target{Pid: candidate.Pid(), ProbePort: e.generationOf(candidate).ProbePort})
 
-		if success {
-			e.fsm.Fire("success")
-		} else {
-			e.fsm.Fire("rollback")
+	go func() {
+		defer cancel()
+		if stateSock != nil {
+			err := e.handoverState(ctx, stateSock, current, candidate, held)
+			e.stateMu.Unlock()
+			if err != nil {
+				if ctx.Err() != nil {
+					logger.Log.Info("State handoff aborted", "pid", candidate.Pid())
+					return
+				}
+				if err := e.fsm.Fire("rollback", err); err != nil {
+					logger.Log.Error("Rollback failed", "err", err)
+				}
+				return
+			}
 		}
+
+		logger.Log.Info("Soaking...", "duration", observer.Duration, "probes", len(observer.Probes))
+		if err := observer.Soak(ctx, candidate); err != nil {
+			if ctx.Err() != nil {
+				logger.Log.Info("Soak aborted", "pid", candidate.Pid())
+				return
+			}
+			if err := e.fsm.Fire("rollback", err); err != nil {
+				logger.Log.Error("Rollback failed", "err", err)
+			}
+			return
+		}
+		logger.Log.Info("Canary verdict: promote", "pid", candidate.Pid())
+		e.fsm.Fire("success")
 	}()
 
 	return nil
 }
 
+// handoverState asks the current process for its state and relays it to the
+// candidate. Only these two processes, presenting their state tokens, may
+// connect to the relay. In broker mode the state was taken beforehand and
+// held is served to the candidate instead, migrated as it needs. It fails
+// with ErrCodeStateMigrationFailed if the state cannot be brought to a schema
+// version the candidate reads, and with ErrCodeStateLoadFail unless the
+// candidate acknowledged the state, with no step of the transfer taking
+// longer than state_handoff.timeout.
+func (e *Engine) handoverState(ctx context.Context, l net.Listener, current, candidate *supervisor.ProcessManager, held *checkpoint) error {
+	timeout := e.stateTimeout()
+	start := time.Now()
+	monitor.StateTransferredBytes.Set(0)
+	monitor.StateSizeBytes.Set(0)
+	monitor.SectionBytes.Reset()
+	monitor.SectionDurationSeconds.Reset()
+
+	var res *srp.RelayResult
+	var err error
+	if held != nil {
+		logger.Log.Info("Phase 2.5: SRP Handover", "mode", consts.StateModeBroker, "pid", candidate.Pid(), "timeout", timeout)
+		sc := *e.srp
+		sc.Receiver = e.statePeer(candidate)
+		res, err = e.serveState(ctx, &sc, l, held.Meta, held.State)
+	} else {
+		logger.Log.Info("Phase 2.5: SRP Handover", "mode", consts.StateModeRelay, "pid", current.Pid(), "timeout", timeout)
+		e.srp.Sender, e.srp.Receiver = e.statePeer(current), e.statePeer(candidate)
+		if err := e.requestState(current, srp.RequestReload); err != nil {
+			l.Close()
+			e.srp.Close()
+			return aerrors.New(aerrors.ErrCodeStateLoadFail, "StateHandoff", "failed to request the state", err)
+		}
+		res, err = e.srp.Relay(ctx, l, timeout)
+	}
+	var aerr *aerrors.AeternaError
+	switch {
+	case errors.Is(err, srp.ErrNoMigrationPath):
+		return aerrors.New(aerrors.ErrCodeStateMigrationFailed, "StateHandoff", "the candidate cannot read the state", err)
+	case errors.As(err, &aerr) && aerr.Code == aerrors.ErrCodeStateMigrationFailed:
+		return err
+	case err != nil:
+		return aerrors.New(aerrors.ErrCodeStateLoadFail, "StateHandoff", "state not acknowledged by the candidate", err)
+	}
+
+	for _, s := range res.Sections {
+		logger.Log.Info("State section handed over", "section", s.Name, "priority", s.Priority, "bytes", s.Bytes,
+			"unchanged", s.Unchanged, "duration", s.Duration)
+	}
+	monitor.HandoverDuration.Observe(time.Since(start).Seconds())
+	monitor.StateBytesTotal.WithLabelValues(res.Transport).Add(float64(res.Bytes))
+	monitor.StateResumesTotal.Add(float64(res.Resumes))
+	monitor.StateUncompressedBytesTotal.WithLabelValues(res.Negotiated.Compression).Add(float64(res.Bytes))
+	monitor.StateCompressedBytesTotal.WithLabelValues(res.Negotiated.Compression).Add(float64(res.WireBytes))
+	logger.Log.Info("State handed over", "bytes", res.Bytes, "wire_bytes", res.WireBytes, "transport", res.Transport,
+		"codec", res.Negotiated.Codec, "compression", res.Negotiated.Compression,
+		"schema_version", res.Negotiated.SchemaVersion, "resumes", res.Resumes, "duration", time.Since(start))
+	return nil
+}
+
+// requestState asks pm to send its state to the state socket: on its control
+// channel in broker mode, else with the state signal.
+func (e *Engine) requestState(pm *supervisor.ProcessManager, reason string) error {
+	if control := e.generationOf(pm).Control; control != nil {
+		return control.RequestState(reason, e.stateTimeout())
+	}
+	return pm.Signal(e.stateSignal())
+}
+
+// stateSignal asks the serving process to send its state.
+func (e *Engine) stateSignal() syscall.Signal {
+	sig, err := supervisor.ParseSignal(e.cfg.Orchestration.StateHandoff.Signal, syscall.SIGUSR1)
+	if err != nil {
+		logger.Log.Warn("Invalid state handoff signal, using SIGUSR1", "err", err)
+		return syscall.SIGUSR1
+	}
+	return sig
+}
+
+// stateTimeout bounds each step of a state transfer.
+func (e *Engine) stateTimeout() time.Duration {
+	timeout, _ := time.ParseDuration(e.cfg.Orchestration.StateHandoff.Timeout)
+	if timeout <= 0 {
+		timeout = consts.DefaultSRPTimeout
+	}
+	return timeout
+}
+
+// onRollback discards the candidate and keeps the previous generation serving.
+// The listeners stay owned by the SocketManager, so the surviving process keeps
+// accepting connections. The optional first argument is the reason for the rollback.
+// A rollback is an expected outcome of a reload and is logged once, as a warning;
+// it only returns an error if the candidate could not be terminated.
 func (e *Engine) onRollback(event fsm.Event, args ...interface{}) error {
-	logger.Log.Warn("Phase: Rollback. Killing new process.")
-	// Logic to kill new process
+	logger.Log.Info("Phase: Rollback. Killing new process.")
+
+	var cause error
+	if len(args) > 0 {
+		cause, _ = args[0].(error)
+	}
+	reason := rollbackReason(cause)
+
+	e.mu.Lock()
+	candidate := e.candidate
+	e.candidate = nil
+	e.mu.Unlock()
+
+	pid := 0
+	var discardErr error
+	if candidate != nil {
+		pid = candidate.Pid()
+		e.recordReload(ReloadRolledBack, pid, reason)
+		discardErr = e.discard(candidate)
+	} else {
+		e.recordReload(ReloadRolledBack, 0, reason)
+	}
+	monitor.RestartTotal.WithLabelValues("rollback").Inc()
+
+	if err := runHooks(context.Background(), "OnFailure", aerrors.ErrCodeHookFailed, e.cfg.Orchestration.PostProcess.OnFailure); err != nil {
+		logger.Log.Error("Post-processing hook failed", "err", err)
+	}
+
+	if discardErr != nil {
+		return aerrors.New(aerrors.ErrCodeSoakFailed, "Rollback", "failed to terminate the candidate", discardErr)
+	}
+	logger.Log.Warn("Reload rolled back, previous generation restored", "pid", pid, "err", reason)
 	return nil
 }
 
+// rollbackReason returns the error recorded for a rollback. Causes that
+// already carry an Aeterna code keep it; anything else is reported as a
+// failed soak.
+func rollbackReason(cause error) error {
+	var aerr *aerrors.AeternaError
+	if errors.As(cause, &aerr) {
+		return cause
+	}
+	if cause == nil {
+		return aerrors.New(aerrors.ErrCodeSoakFailed, "Rollback", "candidate rejected", nil)
+	}
+	return aerrors.New(aerrors.ErrCodeSoakFailed, "Rollback", "candidate rejected", cause)
+}
+
+// onDrainOld promotes the candidate and drains the previous generation.
+// The old process receives the configured stop signal and gets up to
+// drain.timeout to finish its in-flight connections before it is killed.
 func (e *Engine) onDrainOld(event fsm.Event, args ...interface{}) error {
 	logger.Log.Info("Phase 5: Drain. Stopping old process.")
-	// Logic to signal old process to exit
-	// Trigger Post-processing hooks
+
+	// Promote the candidate before signalling the old generation so that its
+	// exit is not mistaken for a crash of the serving process.
+	e.mu.Lock()
+	old, promoted := e.current, e.candidate
+	if promoted == nil {
+		e.mu.Unlock()
+		return e.fsm.Fire("drained")
+	}
+	e.current = promoted
+	e.candidate = nil
+	e.mu.Unlock()
+
+	logger.Log.Info("Candidate promoted", "pid", promoted.Pid(), "old_pid", old.Pid())
+	e.recordReload(ReloadPromoted, promoted.Pid(), nil)
+	e.drain(old)
+
+	// Phase 6: Post-processing
+	if err := runHooks(context.Background(), "OnSuccess", aerrors.ErrCodeHookFailed, e.cfg.Orchestration.PostProcess.OnSuccess); err != nil {
+		logger.Log.Error("Post-processing hook failed", "err", err)
+	}
+
+	return e.fsm.Fire("drained")
+}
+
+// discard terminates a rejected candidate, escalating to SIGKILL after the
+// rollback grace period.
+func (e *Engine) discard(candidate *supervisor.ProcessManager) error {
+	grace, _ := time.ParseDuration(e.cfg.Orchestration.Canary.RollbackGrace)
+	if grace <= 0 {
+		grace = consts.DefaultRollbackGrace
+	}
+	if err := candidate.Terminate(syscall.SIGTERM, grace); err != nil {
+		logger.Log.Error("Failed to terminate candidate", "pid", candidate.Pid(), "err", err)
+		return err
+	}
+	return nil
+}
+
+// drain stops a process with the configured drain signal and kills it if it
+// has not exited after drain.timeout.
+func (e *Engine) drain(pm *supervisor.ProcessManager) {
+	sig, err := supervisor.ParseSignal(e.cfg.Orchestration.Drain.Signal, syscall.SIGTERM)
+	if err != nil {
+		logger.Log.Warn("Invalid drain signal, using SIGTERM", "err", err)
+		sig = syscall.SIGTERM
+	}
+	timeout, _ := time.ParseDuration(e.cfg.Orchestration.Drain.Timeout)
+	if timeout <= 0 {
+		timeout = consts.DefaultDrainTimeout
+	}
+
+	logger.Log.Info("Draining process", "pid", pm.Pid(), "signal", sig, "timeout", timeout)
+	if err := pm.Terminate(sig, timeout); err != nil {
+		logger.Log.Error("Failed to drain process", "pid", pm.Pid(), "err", err)
+	}
+}
+
+// onStop performs the ordered shutdown started by Shutdown and hands the
+// serving process's exit status to Start.
+func (e *Engine) onStop(event fsm.Event, args ...interface{}) error {
+	logger.Log.Info("Phase: Shutdown")
+
+	e.mu.Lock()
+	current, candidate := e.current, e.candidate
+	e.candidate = nil
+	e.mu.Unlock()
+
+	if candidate != nil {
+		e.discard(candidate)
+	}
+
+	var exitErr error
+	if current != nil {
+		e.drain(current)
+		exitErr = current.Wait()
+	}
+
+	if err := runHooks(context.Background(), "OnShutdown", aerrors.ErrCodeHookFailed, e.cfg.Orchestration.PostProcess.OnShutdown); err != nil {
+		logger.Log.Error("Shutdown hook failed", "err", err)
+	}
+
+	e.finish(exitErr)
 	return nil
 }
 
@@ -1,10 +1,23 @@
 package orchestrator
 
 import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
-	"github.com/turtacn/Aeterna/pkg/protocol"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/turtacn/Aeterna/internal/monitor"
+	"github.com/turtacn/Aeterna/internal/supervisor"
 	"github.com/turtacn/Aeterna/pkg/consts"
+	aerrors "github.com/turtacn/Aeterna/pkg/errors"
 	"github.com/turtacn/Aeterna/pkg/fsm"
+	"github.com/turtacn/Aeterna/pkg/protocol"
 )
 
 func TestNewEngine(t *testing.T) {
@@ -48,3 +61,538 @@ func TestEngine_InitialState(t *testing.T) {
 		t.Errorf("Expected PENDING, got %v", e.fsm.Current())
 	}
 }
+
+func TestEngine_BindListenersInDeclarationOrder(t *testing.T) {
+	cfg := &protocol.Config{
+		Listeners: []protocol.ListenerConfig{
+			{Name: "admin", Address: "127.0.0.1:0"},
+			{Name: "http", Network: "tcp4", Address: "127.0.0.2:0", Backlog: 16},
+		},
+	}
+	e := NewEngine(cfg)
+	t.Cleanup(e.socket.Close)
+
+	if err := e.bindListeners(); err != nil {
+		t.Fatalf("bindListeners failed: %v", err)
+	}
+
+	files := e.socket.GetFiles()
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+	var ports []int
+	for _, f := range files {
+		l, err := net.FileListener(f)
+		if err != nil {
+			t.Fatalf("FileListener failed: %v", err)
+		}
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+	}
+	if ports[0] == ports[1] {
+		t.Fatalf("expected distinct listeners, got %v", ports)
+	}
+
+	// Re-binding in a second pass must reuse the sockets and keep the order.
+	if err := e.bindListeners(); err != nil {
+		t.Fatalf("second bindListeners failed: %v", err)
+	}
+	if again := e.socket.GetFiles(); len(again) != 2 || again[0] != files[0] || again[1] != files[1] {
+		t.Errorf("listener order changed between generations")
+	}
+}
+
+func TestListenerSpecs(t *testing.T) {
+	specs, err := listenerSpecs(nil)
+	if err != nil || len(specs) != 1 || specs[0].Address != consts.DefaultListenAddr {
+		t.Errorf("expected default listener, got %v, %v", specs, err)
+	}
+
+	specs, err = listenerSpecs([]protocol.ListenerConfig{
+		{Address: ":80"},
+		{Name: "grpc", Address: ":9090"},
+		{Name: "syslog", Network: "unixgram", Address: "/run/aeterna/syslog.sock"},
+		{Name: "dns", Network: "udp", Address: ":53"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if specs[0].Name != "listener0" || specs[0].Network != "tcp" || specs[1].Name != "grpc" || specs[3].Network != "udp" {
+		t.Errorf("unexpected specs: %+v", specs)
+	}
+
+	invalid := [][]protocol.ListenerConfig{
+		{{Name: "a", Address: ":80"}, {Name: "a", Address: ":81"}},
+		{{Name: "a"}},
+		{{Name: "a", Address: ":80", Network: "sctp"}},
+		{{Name: "a", Address: ":80", Backlog: -1}},
+	}
+	for _, listeners := range invalid {
+		_, err := listenerSpecs(listeners)
+		var ae *aerrors.AeternaError
+		if !errors.As(err, &ae) || ae.Code != aerrors.ErrCodeConfigInvalid {
+			t.Errorf("expected ErrCodeConfigInvalid for %+v, got %v", listeners, err)
+		}
+	}
+}
+
+// newRunningEngine returns an engine in the RUNNING state that already serves
+// a first generation of the configured command.
+func newRunningEngine(t *testing.T, cfg *protocol.Config) *Engine {
+	t.Helper()
+	e := NewEngine(cfg)
+	e.fsm = fsm.New(fsm.State(consts.StateRunning))
+	e.setupFSM()
+
+	if _, err := e.socket.EnsureListener("127.0.0.1:0"); err != nil {
+		t.Fatalf("EnsureListener failed: %v", err)
+	}
+	t.Cleanup(e.socket.Close)
+
+	current, err := e.spawn()
+	if err != nil {
+		t.Fatalf("spawn failed: %v", err)
+	}
+	e.current = current
+	t.Cleanup(func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		for _, pm := range []*supervisor.ProcessManager{e.current, e.candidate} {
+			if pm != nil {
+				pm.Kill()
+			}
+		}
+	})
+	return e
+}
+
+func waitForState(t *testing.T, e *Engine, state consts.ProcessState, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if e.fsm.Current() == fsm.State(state) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected state %v, still in %v", state, e.fsm.Current())
+}
+
+func TestEngine_ReloadPromotesCandidate(t *testing.T) {
+	cfg := &protocol.Config{
+		Service: protocol.ServiceConfig{Command: []string{"sleep", "10"}},
+		Orchestration: protocol.OrchestrationConfig{
+			Canary: protocol.CanaryConfig{SoakTime: "100ms"},
+		},
+	}
+	e := newRunningEngine(t, cfg)
+	old := e.currentProcess()
+
+	if err := e.fsm.Fire("reload"); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	e.mu.Lock()
+	candidate := e.candidate
+	e.mu.Unlock()
+	if candidate == nil || candidate.Pid() == old.Pid() {
+		t.Fatal("Expected a second process to be forked during the soak")
+	}
+
+	waitForState(t, e, consts.StateRunning, 2*time.Second)
+	if e.currentProcess() != candidate {
+		t.Error("Expected the candidate to be promoted to current")
+	}
+
+	select {
+	case <-old.Done():
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the old process to be stopped after promotion")
+	}
+}
+
+func TestEngine_ReloadDiscardsDeadCandidate(t *testing.T) {
+	cfg := &protocol.Config{
+		Service: protocol.ServiceConfig{Command: []string{"sleep", "10"}},
+		Orchestration: protocol.OrchestrationConfig{
+			Canary: protocol.CanaryConfig{SoakTime: "200ms"},
+		},
+	}
+	e := newRunningEngine(t, cfg)
+	old := e.currentProcess()
+
+	// The new release exits immediately.
+	e.cfg.Service.Command = []string{"true"}
+	if err := e.fsm.Fire("reload"); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	waitForState(t, e, consts.StateRunning, 2*time.Second)
+	if e.currentProcess() != old {
+		t.Error("Expected the old process to keep serving after a failed soak")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.candidate != nil {
+		t.Error("Expected the candidate to be discarded")
+	}
+}
+
+func TestEngine_RollbackRestoresPreviousGeneration(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "on_failure")
+	cfg := &protocol.Config{
+		Service: protocol.ServiceConfig{Command: []string{"sleep", "10"}},
+		Orchestration: protocol.OrchestrationConfig{
+			Canary: protocol.CanaryConfig{SoakTime: "10s", RollbackGrace: "200ms"},
+			PostProcess: protocol.PostProcessConfig{
+				OnFailure: []protocol.Hook{{Name: "mark", Command: []string{"touch", marker}}},
+			},
+		},
+	}
+	e := newRunningEngine(t, cfg)
+	old := e.currentProcess()
+
+	// Move to SOAKING with a live candidate, then reject it.
+	e.fsm.Fire("reload")
+	e.mu.Lock()
+	candidate := e.candidate
+	e.mu.Unlock()
+
+	before := testutil.ToFloat64(monitor.RestartTotal.WithLabelValues("rollback"))
+	if err := e.fsm.Fire("rollback", errors.New("probe failed")); err != nil {
+		t.Fatalf("Expected a handled rollback not to fail, got %v", err)
+	}
+	e.mu.Lock()
+	reloads := append([]ReloadRecord(nil), e.reloads...)
+	e.mu.Unlock()
+	if len(reloads) != 1 || reloads[0].Outcome != ReloadRolledBack || !strings.HasPrefix(reloads[0].Error, "[4001]") ||
+		!strings.Contains(reloads[0].Error, "probe failed") {
+		t.Errorf("Expected the soak failure to be recorded with its cause, got %+v", reloads)
+	}
+	select {
+	case <-candidate.Done():
+	default:
+		t.Error("Expected the candidate to be terminated")
+	}
+	if e.currentProcess() != old {
+		t.Error("Expected the previous generation to keep serving")
+	}
+	if got := testutil.ToFloat64(monitor.RestartTotal.WithLabelValues("rollback")); got != before+1 {
+		t.Errorf("Expected rollback counter to be incremented, got %v", got)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Expected on_failure hook to run: %v", err)
+	}
+
+	// The listeners are still owned by Aeterna and keep accepting connections.
+	l, err := e.socket.EnsureListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("EnsureListener failed: %v", err)
+	}
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Listener stopped accepting after rollback: %v", err)
+	}
+	conn.Close()
+}
+
+func TestEngine_DrainEscalatesAndRunsHooks(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "on_success")
+	cfg := &protocol.Config{
+		// The old generation ignores the stop signal and has to be killed.
+		Service: protocol.ServiceConfig{Command: []string{"sh", "-c", "trap '' TERM; while :; do sleep 0.1; done"}},
+		Orchestration: protocol.OrchestrationConfig{
+			Canary: protocol.CanaryConfig{SoakTime: "100ms"},
+			Drain:  protocol.DrainConfig{Timeout: "300ms", Signal: "SIGTERM"},
+			PostProcess: protocol.PostProcessConfig{
+				OnSuccess: []protocol.Hook{{Name: "mark", Command: []string{"touch", marker}}},
+			},
+		},
+	}
+	e := newRunningEngine(t, cfg)
+	old := e.currentProcess()
+	time.Sleep(100 * time.Millisecond) // let the shell install its trap
+
+	e.cfg.Service.Command = []string{"sleep", "10"}
+	start := time.Now()
+	if err := e.fsm.Fire("reload"); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	select {
+	case <-old.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the old process to be killed after the drain timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected the drain to wait for its timeout, old process exited after %v", elapsed)
+	}
+
+	waitForState(t, e, consts.StateRunning, 2*time.Second)
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Expected on_success hook to run: %v", err)
+	}
+}
+
+func TestEngine_PreFlightFailureAborts(t *testing.T) {
+	cfg := &protocol.Config{
+		Service: protocol.ServiceConfig{Command: []string{"sleep", "10"}},
+		Orchestration: protocol.OrchestrationConfig{
+			PreFlight: []protocol.Hook{{Name: "Database Schema Check", Command: []string{"sleep", "10"}, Timeout: "100ms"}},
+		},
+	}
+	e := newRunningEngine(t, cfg)
+
+	err := e.fsm.Fire("reload")
+	var aerr *aerrors.AeternaError
+	if !errors.As(err, &aerr) || aerr.Code != aerrors.ErrCodePreCheckFailed {
+		t.Fatalf("Expected ErrCodePreCheckFailed, got %v", err)
+	}
+	if e.fsm.Current() != fsm.State(consts.StateRunning) {
+		t.Errorf("Expected the reload to be aborted back to RUNNING, got %v", e.fsm.Current())
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.candidate != nil {
+		t.Error("No candidate should be forked when pre-flight checks fail")
+	}
+}
+
+func TestEngine_ForwardedSignals(t *testing.T) {
+	e := NewEngine(&protocol.Config{})
+	if got := e.forwardedSignals(); len(got) != len(consts.DefaultForwardSignals) {
+		t.Errorf("Expected default forwarded signals, got %v", got)
+	}
+
+	e = NewEngine(&protocol.Config{Service: protocol.ServiceConfig{
+		ForwardSignals: []string{"SIGUSR1", "SIGTERM", "SIGBOGUS"},
+	}})
+	got := e.forwardedSignals()
+	if len(got) != 1 || got[0] != syscall.SIGUSR1 {
+		t.Errorf("Expected only SIGUSR1 to be forwarded, got %v", got)
+	}
+
+	e = NewEngine(&protocol.Config{Service: protocol.ServiceConfig{ForwardSignals: []string{}}})
+	if got := e.forwardedSignals(); len(got) != 0 {
+		t.Errorf("Expected forwarding to be disabled, got %v", got)
+	}
+}
+
+func TestEngine_CrashRestartReusesListeners(t *testing.T) {
+	cfg := &protocol.Config{
+		Service: protocol.ServiceConfig{
+			Command: []string{"sleep", "10"},
+			Restart: protocol.RestartConfig{Policy: "on-failure", Backoff: "10ms", MaxRestarts: 1, Window: "1m"},
+		},
+		Orchestration: protocol.OrchestrationConfig{
+			Startup: protocol.StartupConfig{WarmupDelay: "10ms"},
+		},
+	}
+	e := newRunningEngine(t, cfg)
+	l, _ := e.socket.EnsureListener("127.0.0.1:0")
+	crashed := e.currentProcess()
+	before := testutil.ToFloat64(monitor.RestartTotal.WithLabelValues("crash"))
+
+	crashed.Kill()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for e.currentProcess() == crashed && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	restarted := e.currentProcess()
+	if restarted == crashed {
+		t.Fatal("Expected the crashed process to be restarted")
+	}
+	if got := testutil.ToFloat64(monitor.RestartTotal.WithLabelValues("crash")); got != before+1 {
+		t.Errorf("Expected crash counter to be incremented, got %v", got)
+	}
+	waitForState(t, e, consts.StateRunning, 2*time.Second)
+
+	// The port stayed bound across the crash.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Listener lost across the restart: %v", err)
+	}
+	conn.Close()
+
+	// The second crash exceeds max_restarts and ends the engine.
+	restarted.Kill()
+	select {
+	case err := <-e.done:
+		if err == nil {
+			t.Error("Expected the crash error to be reported")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the engine to give up after max_restarts")
+	}
+}
+
+func TestEngine_CrashDuringWarmup(t *testing.T) {
+	cfg := &protocol.Config{
+		Service: protocol.ServiceConfig{
+			Command: []string{"sleep", "10"},
+			Restart: protocol.RestartConfig{Policy: "on-failure", Backoff: "400ms", MaxRestarts: 1, Window: "1m"},
+		},
+		Orchestration: protocol.OrchestrationConfig{
+			Startup: protocol.StartupConfig{WarmupDelay: "300ms"},
+		},
+	}
+	e := newRunningEngine(t, cfg)
+	e.fsm = fsm.New(fsm.State(consts.StateStarting))
+	e.setupFSM()
+	crashed := e.currentProcess()
+	start := time.Now()
+	go e.warmup(crashed)
+
+	crashed.Kill()
+
+	// The warmup of the crashed process is over, the one of its replacement
+	// not yet: the restart keeps the engine STARTING.
+	time.Sleep(time.Until(start.Add(500 * time.Millisecond)))
+	if got := consts.ProcessState(e.fsm.Current()); got != consts.StateStarting {
+		t.Errorf("Expected the engine to stay STARTING until the replacement warmed up, got %s", got)
+	}
+	waitForState(t, e, consts.StateRunning, 2*time.Second)
+	if e.currentProcess() == crashed {
+		t.Error("Expected the process that crashed while warming up to be restarted")
+	}
+}
+
+func TestEngine_ShutdownIsOrdered(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "on_shutdown")
+	socketPath := filepath.Join(dir, "srp.sock")
+	cfg := &protocol.Config{
+		// The business process exits with its own code once asked to stop.
+		Service: protocol.ServiceConfig{Command: []string{"sh", "-c", "trap 'exit 7' TERM; while :; do sleep 0.05; done"}},
+		Orchestration: protocol.OrchestrationConfig{
+			Canary: protocol.CanaryConfig{SoakTime: "10s"},
+			Drain:  protocol.DrainConfig{Timeout: "2s"},
+			PostProcess: protocol.PostProcessConfig{
+				OnShutdown: []protocol.Hook{{Name: "mark", Command: []string{"touch", marker}}},
+			},
+			StateHandoff: protocol.StateHandoffConfig{SocketPath: socketPath},
+		},
+	}
+	e := newRunningEngine(t, cfg)
+	l, _ := e.socket.EnsureListener("127.0.0.1:0")
+	os.WriteFile(socketPath, nil, 0600)
+	time.Sleep(100 * time.Millisecond) // let the shell install its trap
+
+	// A reload is in flight when the stop signal arrives.
+	e.fsm.Fire("reload")
+	e.mu.Lock()
+	candidate := e.candidate
+	e.mu.Unlock()
+
+	e.Shutdown()
+	var exitErr error
+	select {
+	case exitErr = <-e.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not complete")
+	}
+	e.cleanup()
+
+	if e.fsm.Current() != fsm.State(consts.StateStopped) {
+		t.Errorf("Expected STOPPED, got %v", e.fsm.Current())
+	}
+	if code := supervisor.ExitCode(exitErr); code != 7 {
+		t.Errorf("Expected the child's exit code 7, got %d (%v)", code, exitErr)
+	}
+	select {
+	case <-candidate.Done():
+	default:
+		t.Error("Expected the candidate to be stopped")
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Expected on_shutdown hook to run: %v", err)
+	}
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Error("Expected the SRP socket to be removed")
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("Expected the listeners to be closed")
+	}
+	if err := e.fsm.Fire("reload"); err == nil {
+		t.Error("Reloads must be refused after shutdown")
+	}
+}
+
+func TestEngine_ConnectionHandoffSocketIsPassedToChildren(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "env")
+	cfg := &protocol.Config{
+		Service: protocol.ServiceConfig{
+			Command: []string{"sh", "-c", `echo "$AETERNA_CONN_SOCK" > "$OUT"`},
+			Env:     []string{"OUT=" + out},
+		},
+		Orchestration: protocol.OrchestrationConfig{
+			StateHandoff: protocol.StateHandoffConfig{
+				Connections: protocol.ConnHandoffConfig{Enabled: true, SocketPath: filepath.Join(dir, "conns.sock")},
+			},
+		},
+	}
+	e := NewEngine(cfg)
+	if e.conns == nil {
+		t.Fatal("Expected a connection broker when handoff is enabled")
+	}
+	if err := e.conns.Start(); err != nil {
+		t.Fatalf("broker Start failed: %v", err)
+	}
+	t.Cleanup(e.cleanup)
+
+	pm, err := e.spawn()
+	if err != nil {
+		t.Fatalf("spawn failed: %v", err)
+	}
+	pm.Wait()
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if got := strings.TrimSpace(string(data)); got != filepath.Join(dir, "conns.sock") {
+		t.Errorf("AETERNA_CONN_SOCK = %q", got)
+	}
+
+	if NewEngine(&protocol.Config{}).conns != nil {
+		t.Error("Connection handoff must be opt-in")
+	}
+}
+
+func TestEngine_CandidateGetsProbePort(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+	cfg := &protocol.Config{
+		Service: protocol.ServiceConfig{
+			Command: []string{"sh", "-c", `echo "$AETERNA_PROBE_PORT" > "$OUT.tmp" && mv "$OUT.tmp" "$OUT" && exec sleep 10`},
+			Env:     []string{"OUT=" + out},
+		},
+		Orchestration: protocol.OrchestrationConfig{
+			Canary: protocol.CanaryConfig{
+				HealthCheck: protocol.HealthCheckConfig{HTTPGet: "http://127.0.0.1:{probe_port}/health"},
+			},
+		},
+	}
+	e := NewEngine(cfg)
+	pm, err := e.spawn()
+	if err != nil {
+		t.Fatalf("spawn failed: %v", err)
+	}
+	t.Cleanup(func() { pm.Kill() })
+	port := e.generationOf(pm).ProbePort
+
+	var data []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, err = os.ReadFile(out); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if got := strings.TrimSpace(string(data)); port == 0 || got != strconv.Itoa(port) {
+		t.Errorf("AETERNA_PROBE_PORT = %q, expected the port of the generation %d", got, port)
+	}
+}
@@ -0,0 +1,327 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/turtacn/Aeterna/internal/monitor"
+	"github.com/turtacn/Aeterna/internal/srp"
+	"github.com/turtacn/Aeterna/pkg/consts"
+	aerrors "github.com/turtacn/Aeterna/pkg/errors"
+	"github.com/turtacn/Aeterna/pkg/fsm"
+	"github.com/turtacn/Aeterna/pkg/logger"
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+// TestHelperSRPPeer is not a test: it is the business process of the state
+// handoff tests. It loads the state of its predecessor if there is one and
+// sends its own when asked to, like an application using an SDK. With
+// SRP_PEER_SECTIONS set, it sends its state in two sections: the turns, then
+// a constant cache.
+func TestHelperSRPPeer(t *testing.T) {
+	readyDir := os.Getenv("SRP_PEER_READY_DIR")
+	if readyDir == "" {
+		t.Skip("helper process")
+	}
+	logger.InitLogger("error")
+	path := os.Getenv(consts.EnvStateSocketPath)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+
+	// With SRP_PEER_SCHEMA=2 the turns are laid out as {"count":N}, and
+	// must be handed over in that layout.
+	schema, _ := strconv.Atoi(os.Getenv("SRP_PEER_SCHEMA"))
+	turns := 0
+	if _, err := os.Stat(path); err == nil {
+		var state struct{ Turns, Count int }
+		var hello srp.Hello
+		if schema != 0 {
+			hello.Schemas = map[string]int{"turns": schema}
+		}
+		rs, err := srp.ReceiveSections(path, hello, func(s srp.Section) error {
+			if s.Name == "cache" {
+				return nil
+			}
+			return json.Unmarshal(s.Data, &state)
+		}, 5*time.Second)
+		if err != nil {
+			os.Exit(2)
+		}
+		if os.Getenv("SRP_PEER_REJECT") != "" {
+			rs.Reject()
+		} else {
+			turns = state.Turns + state.Count
+			rs.Ack()
+		}
+	}
+	// Renamed into place, so that waitForPeer never reads a partial file.
+	ready := filepath.Join(readyDir, strconv.Itoa(os.Getpid()))
+	os.WriteFile(ready+".tmp", []byte(strconv.Itoa(turns)), 0600)
+	os.Rename(ready+".tmp", ready)
+
+	// In broker mode the state is requested on the control channel instead.
+	if control, err := srp.OpenControl(); err == nil && control != nil {
+		go func() {
+			for {
+				if _, err := control.Next(); err != nil {
+					return
+				}
+				sigCh <- syscall.SIGUSR1
+			}
+		}()
+	}
+
+	for range sigCh {
+		key := "turns"
+		if schema == 2 {
+			key = "count"
+		}
+		state, _ := json.Marshal(map[string]int{key: turns + 1})
+		if os.Getenv("SRP_PEER_SECTIONS") != "" {
+			srp.SendSections(path, srp.Hello{}, []srp.Section{
+				{Name: "cache", Priority: 1, Data: []byte(`"` + strings.Repeat("x", 4096) + `"`)},
+				{Name: "turns", SchemaVersion: schema, Data: state},
+			}, 5*time.Second)
+			continue
+		}
+		srp.SendState(path, srp.Hello{}, func(srp.Hello) ([]byte, error) { return state, nil }, 5*time.Second)
+	}
+}
+
+// newHandoffEngine runs an engine whose business process is TestHelperSRPPeer.
+func newHandoffEngine(t *testing.T, transport string, env ...string) (*Engine, string) {
+	t.Helper()
+	readyDir := t.TempDir()
+	cfg := &protocol.Config{
+		Service: protocol.ServiceConfig{
+			Command: []string{os.Args[0], "-test.run=^TestHelperSRPPeer$"},
+			Env:     append([]string{"SRP_PEER_READY_DIR=" + readyDir}, env...),
+		},
+		Orchestration: protocol.OrchestrationConfig{
+			Canary: protocol.CanaryConfig{SoakTime: "100ms"},
+			StateHandoff: protocol.StateHandoffConfig{
+				Enabled:    true,
+				SocketPath: filepath.Join(t.TempDir(), "state.sock"),
+				Timeout:    "3s",
+				Transport:  transport,
+			},
+		},
+	}
+	e := newRunningEngine(t, cfg)
+	waitForPeer(t, readyDir, e.currentProcess().Pid())
+	return e, readyDir
+}
+
+// waitForPeer waits until the helper process pid is ready and returns the
+// number of turns it restored.
+func waitForPeer(t *testing.T, readyDir string, pid int) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if data, err := os.ReadFile(filepath.Join(readyDir, strconv.Itoa(pid))); err == nil {
+			return string(data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("helper process %d did not become ready", pid)
+	return ""
+}
+
+func TestEngine_ReloadHandsStateOver(t *testing.T) {
+	for _, transport := range []string{srp.TransportStream, srp.TransportMemfd, srp.TransportChunked} {
+		t.Run(transport, func(t *testing.T) {
+			e, readyDir := newHandoffEngine(t, transport)
+			old := e.currentProcess()
+			relayed := monitor.StateBytesTotal.WithLabelValues(transport)
+			before := testutil.ToFloat64(relayed)
+			// Compression is off unless configured.
+			uncompressed := monitor.StateUncompressedBytesTotal.WithLabelValues("none")
+			compressed := monitor.StateCompressedBytesTotal.WithLabelValues("none")
+			beforeUncompressed, beforeCompressed := testutil.ToFloat64(uncompressed), testutil.ToFloat64(compressed)
+
+			if err := e.fsm.Fire("reload"); err != nil {
+				t.Fatalf("reload failed: %v", err)
+			}
+			waitForState(t, e, consts.StateRunning, 5*time.Second)
+
+			promoted := e.currentProcess()
+			if promoted == old {
+				t.Fatal("Expected the candidate to be promoted after acknowledging the state")
+			}
+			if turns := waitForPeer(t, readyDir, promoted.Pid()); turns != "1" {
+				t.Errorf("Expected the candidate to restore 1 turn, got %q", turns)
+			}
+			select {
+			case <-old.Done():
+			case <-time.After(3 * time.Second):
+				t.Error("Expected the old process to be drained after the ACK")
+			}
+			if got := testutil.ToFloat64(relayed); got != before+float64(len(`{"turns":1}`)) {
+				t.Errorf("Expected the state bytes to be counted under %s, got %v more", transport, got-before)
+			}
+			if testutil.ToFloat64(uncompressed)-beforeUncompressed != 11 || testutil.ToFloat64(compressed)-beforeCompressed != 11 {
+				t.Error("Expected the state bytes to be counted as uncompressed")
+			}
+		})
+	}
+}
+
+func TestEngine_BrokerHandsStateOver(t *testing.T) {
+	e, readyDir := newHandoffEngine(t, "")
+	e.cfg.Orchestration.StateHandoff.Mode = consts.StateModeBroker
+	// The first process was started in relay mode, without a control channel.
+	restarted := crash(t, e, readyDir)
+	if e.generationOf(restarted).Control == nil {
+		t.Fatal("Expected a control channel in broker mode")
+	}
+	waitForPeer(t, readyDir, restarted.Pid())
+	waitForState(t, e, consts.StateRunning, 5*time.Second)
+
+	if err := e.fsm.Fire("reload"); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	waitForState(t, e, consts.StateRunning, 5*time.Second)
+	promoted := e.currentProcess()
+	if promoted == restarted {
+		t.Fatal("Expected the candidate to be promoted after acknowledging the state")
+	}
+	if turns := waitForPeer(t, readyDir, promoted.Pid()); turns != "1" {
+		t.Errorf("Expected the candidate to restore 1 turn, got %q", turns)
+	}
+	select {
+	case <-restarted.Done():
+	case <-time.After(3 * time.Second):
+		t.Error("Expected the old process to be drained after the ACK")
+	}
+}
+
+func TestEngine_BrokerRefusesOversizedState(t *testing.T) {
+	e, readyDir := newHandoffEngine(t, "")
+	e.cfg.Orchestration.StateHandoff.Mode = consts.StateModeBroker
+	e.cfg.Orchestration.StateHandoff.MaxStateSize = 4
+	old := crash(t, e, readyDir)
+	waitForPeer(t, readyDir, old.Pid())
+	waitForState(t, e, consts.StateRunning, 5*time.Second)
+
+	// The state is refused before the candidate is started, so the reload
+	// is rolled back at once.
+	if err := e.fsm.Fire("reload"); err != nil {
+		t.Fatalf("Expected the rollback to be handled, got %v", err)
+	}
+	e.mu.Lock()
+	reloads := append([]ReloadRecord(nil), e.reloads...)
+	e.mu.Unlock()
+	if len(reloads) != 1 || reloads[0].Outcome != ReloadRolledBack {
+		t.Fatalf("Expected a rolled back reload, got %+v", reloads)
+	}
+	if want := fmt.Sprintf("[%d]", aerrors.ErrCodeStateDumpTimeout); !strings.HasPrefix(reloads[0].Error, want) {
+		t.Errorf("Expected ErrCodeStateDumpTimeout, got %q", reloads[0].Error)
+	}
+	if e.currentProcess() != old {
+		t.Error("Expected the old process to keep serving")
+	}
+}
+
+func TestEngine_ReloadHandsSectionsOver(t *testing.T) {
+	e, readyDir := newHandoffEngine(t, srp.TransportChunked, "SRP_PEER_SECTIONS=1")
+	e.srp.ChunkSize = 1024
+
+	if err := e.fsm.Fire("reload"); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	waitForState(t, e, consts.StateRunning, 5*time.Second)
+	if turns := waitForPeer(t, readyDir, e.currentProcess().Pid()); turns != "1" {
+		t.Errorf("Expected the candidate to restore 1 turn, got %q", turns)
+	}
+	if got := testutil.ToFloat64(monitor.SectionBytes.WithLabelValues("turns")); got != 11 {
+		t.Errorf("Expected the size of the turns section, got %v", got)
+	}
+	if got := testutil.ToFloat64(monitor.SectionBytes.WithLabelValues("cache")); got != 4098 {
+		t.Errorf("Expected the size of the cache section, got %v", got)
+	}
+}
+
+func TestEngine_UnacknowledgedStateRollsBack(t *testing.T) {
+	e, _ := newHandoffEngine(t, "", "SRP_PEER_REJECT=1")
+	old := e.currentProcess()
+
+	if err := e.fsm.Fire("reload"); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	// The FSM is back in RUNNING before the rollback handler has finished.
+	var reloads []ReloadRecord
+	for deadline := time.Now().Add(5 * time.Second); len(reloads) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		e.mu.Lock()
+		reloads = append([]ReloadRecord(nil), e.reloads...)
+		e.mu.Unlock()
+	}
+	if e.fsm.Current() != fsm.State(consts.StateRunning) || e.currentProcess() != old {
+		t.Fatal("Expected the previous generation to keep serving")
+	}
+	select {
+	case <-old.Done():
+		t.Fatal("The old process must not be drained without an ACK")
+	default:
+	}
+
+	if len(reloads) != 1 || reloads[0].Outcome != ReloadRolledBack {
+		t.Fatalf("Expected a rolled back reload, got %+v", reloads)
+	}
+	if want := fmt.Sprintf("[%d]", aerrors.ErrCodeStateLoadFail); !strings.HasPrefix(reloads[0].Error, want) {
+		t.Errorf("Expected ErrCodeStateLoadFail, got %q", reloads[0].Error)
+	}
+}
+
+func TestEngine_CrashReplaysSpilledState(t *testing.T) {
+	e, readyDir := newHandoffEngine(t, "", "SRP_PEER_REJECT=1")
+	keyFile := filepath.Join(t.TempDir(), "spill.key")
+	os.WriteFile(keyFile, []byte(strings.Repeat("42", 32)), 0600)
+	e.cfg.Orchestration.StateHandoff.Spill = protocol.SpillConfig{Enabled: true, Dir: t.TempDir(), KeyFile: keyFile}
+	if err := e.openSpill(); err != nil {
+		t.Fatalf("openSpill failed: %v", err)
+	}
+	acked := monitor.StateSnapshotReplaysTotal.WithLabelValues("acked")
+	before := testutil.ToFloat64(acked)
+
+	// The candidate rejects the state, which stays on disk.
+	if err := e.fsm.Fire("reload"); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		e.mu.Lock()
+		n := len(e.reloads)
+		e.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("reload did not finish")
+		}
+	}
+	if sn, _ := e.srp.Spill.Latest(time.Now()); sn == nil {
+		t.Fatal("Expected the rejected state to be spilled")
+	}
+
+	// The process restarted after a crash is replayed the spilled state.
+	restarted := crash(t, e, readyDir)
+	if turns := waitForPeer(t, readyDir, restarted.Pid()); turns != "1" {
+		t.Errorf("Expected the restarted process to restore 1 turn, got %q", turns)
+	}
+	if sn, _ := e.srp.Spill.Latest(time.Now()); sn != nil {
+		t.Error("Expected the snapshot to be deleted after the ACK")
+	}
+	if got := testutil.ToFloat64(acked); got != before+1 {
+		t.Errorf("Expected an acknowledged replay, got %v", got-before)
+	}
+}
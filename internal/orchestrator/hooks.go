@@ -0,0 +1,122 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/turtacn/Aeterna/internal/supervisor"
+	"github.com/turtacn/Aeterna/pkg/consts"
+	aerrors "github.com/turtacn/Aeterna/pkg/errors"
+	"github.com/turtacn/Aeterna/pkg/logger"
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+// maxHookOutput bounds how much of a hook's output is attached to logs and errors.
+const maxHookOutput = 2048
+
+// runHooks executes the hooks of an orchestration phase in order.
+// It stops at the first failing hook and returns an AeternaError with the given
+// code that carries the hook's captured output. Cancelling ctx kills the
+// running hook and skips the remaining ones.
+func runHooks(ctx context.Context, phase string, code aerrors.ErrorCode, hooks []protocol.Hook) error {
+	for _, hook := range hooks {
+		logger.Log.Info("Running hook", "phase", phase, "name", hook.Name)
+		output, err := runHook(ctx, hook)
+		if err != nil {
+			logger.Log.Error("Hook failed", "phase", phase, "name", hook.Name, "err", err, "output", output)
+			msg := fmt.Sprintf("hook %q failed", hook.Name)
+			if output != "" {
+				msg += ": " + output
+			}
+			return aerrors.New(code, phase, msg, err)
+		}
+	}
+	return nil
+}
+
+// runHook runs a single hook, retrying it up to hook.Retries times.
+// Every attempt is bounded by the hook's timeout.
+func runHook(ctx context.Context, hook protocol.Hook) (string, error) {
+	return runHookWith(ctx, hook, nil)
+}
+
+// runHookWith is runHook with setup, if not nil, called on the command of
+// every attempt before it starts, e.g. to feed its stdin.
+func runHookWith(ctx context.Context, hook protocol.Hook, setup func(*exec.Cmd)) (string, error) {
+	if len(hook.Command) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+	timeout, _ := time.ParseDuration(hook.Timeout)
+	if timeout <= 0 {
+		timeout = consts.DefaultHookTimeout
+	}
+
+	var output string
+	var err error
+	for attempt := 0; attempt <= hook.Retries; attempt++ {
+		if attempt > 0 {
+			logger.Log.Warn("Retrying hook", "name", hook.Name, "attempt", attempt+1, "err", err)
+			select {
+			case <-time.After(consts.DefaultHookRetryDelay):
+			case <-ctx.Done():
+				return output, ctx.Err()
+			}
+		}
+		output, err = runHookOnce(ctx, hook, timeout, setup)
+		if err == nil {
+			return output, nil
+		}
+	}
+	return output, err
+}
+
+func runHookOnce(parent context.Context, hook protocol.Hook, timeout time.Duration, setup func(*exec.Cmd)) (string, error) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = append(os.Environ(), hook.Env...)
+	cmd.Dir = hook.Dir
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	// Run the hook in its own process group so that a timeout also kills any
+	// subprocess it spawned, and do not wait forever on pipes they inherited.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+	if setup != nil {
+		setup(cmd)
+	}
+
+	err := supervisor.StartCmd(cmd)
+	if err == nil {
+		err = supervisor.WaitCmd(cmd)
+	}
+	if err != nil && parent.Err() != nil {
+		err = fmt.Errorf("cancelled: %w", parent.Err())
+	} else if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+	return tail(out.String(), maxHookOutput), err
+}
+
+// tail returns at most n trailing bytes of s, trimmed of surrounding whitespace.
+func tail(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if len(s) > n {
+		s = "..." + s[len(s)-n:]
+	}
+	return s
+}
+
+// Personal.AI order the ending
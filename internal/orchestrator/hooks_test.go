@@ -0,0 +1,99 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	aerrors "github.com/turtacn/Aeterna/pkg/errors"
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+func TestRunHooks_Timeout(t *testing.T) {
+	hooks := []protocol.Hook{{Name: "stuck", Command: []string{"sh", "-c", "sleep 10"}, Timeout: "200ms"}}
+
+	start := time.Now()
+	err := runHooks(context.Background(), "PreFlight", aerrors.ErrCodePreCheckFailed, hooks)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the hook to be killed after its timeout, took %v", elapsed)
+	}
+
+	var aerr *aerrors.AeternaError
+	if !errors.As(err, &aerr) || aerr.Code != aerrors.ErrCodePreCheckFailed {
+		t.Fatalf("Expected ErrCodePreCheckFailed, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected a timeout error, got %v", err)
+	}
+}
+
+func TestRunHooks_EnvDirAndOutput(t *testing.T) {
+	dir := t.TempDir()
+	hooks := []protocol.Hook{{
+		Name:    "check",
+		Command: []string{"sh", "-c", "echo \"db=$DB_URL\"; pwd; exit 3"},
+		Env:     []string{"DB_URL=postgres://test"},
+		Dir:     dir,
+	}}
+
+	err := runHooks(context.Background(), "PreFlight", aerrors.ErrCodePreCheckFailed, hooks)
+	if err == nil {
+		t.Fatal("Expected the hook to fail")
+	}
+	for _, want := range []string{"db=postgres://test", filepath.Base(dir), "exit status 3"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q, got %v", want, err)
+		}
+	}
+}
+
+func TestRunHooks_Cancel(t *testing.T) {
+	hooks := []protocol.Hook{{Name: "stuck", Command: []string{"sh", "-c", "sleep 10"}, Timeout: "30s", Retries: 3}}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := runHooks(ctx, "PreFlight", aerrors.ErrCodePreCheckFailed, hooks)
+	if err == nil {
+		t.Fatal("Expected a cancelled hook to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the cancellation to stop the hook and its retries, took %v", elapsed)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancellation to be reported, got %v", err)
+	}
+}
+
+func TestRunHooks_Retries(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "attempts")
+	// Fails on the first attempt and succeeds on the second one.
+	script := "if [ -f " + counter + " ]; then exit 0; fi; touch " + counter + "; exit 1"
+	hooks := []protocol.Hook{{Name: "flaky", Command: []string{"sh", "-c", script}, Retries: 1}}
+
+	if err := runHooks(context.Background(), "PreFlight", aerrors.ErrCodePreCheckFailed, hooks); err != nil {
+		t.Errorf("Expected the retry to succeed, got %v", err)
+	}
+	if _, err := os.Stat(counter); err != nil {
+		t.Errorf("Expected the first attempt to run: %v", err)
+	}
+}
+
+func TestRunHooks_StopsAtFirstFailure(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "second")
+	hooks := []protocol.Hook{
+		{Name: "first", Command: []string{"false"}},
+		{Name: "second", Command: []string{"touch", marker}},
+	}
+
+	if err := runHooks(context.Background(), "OnSuccess", aerrors.ErrCodeHookFailed, hooks); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("Expected hooks after a failure to be skipped")
+	}
+}
@@ -0,0 +1,121 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	"github.com/turtacn/Aeterna/internal/srp"
+	"github.com/turtacn/Aeterna/pkg/consts"
+	aerrors "github.com/turtacn/Aeterna/pkg/errors"
+	"github.com/turtacn/Aeterna/pkg/logger"
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+// A candidate may need its state at another schema version than the one it
+// was written with (see internal/srp/migrate.go). Aeterna runs the commands
+// of state_handoff.migrations on a state it holds once the receiver has told
+// which versions it needs, before serving it. It can only do so for a state
+// it holds, so migrations broker every reload. Sections the receiver can
+// neither read nor migrate itself, and that no command migrates, are left
+// for the relay to refuse, which rolls the reload back with
+// ErrCodeStateMigrationFailed.
+
+// brokered reports whether Aeterna takes the state of a reload itself
+// rather than relaying it.
+func (e *Engine) brokered() bool {
+	handoff := e.cfg.Orchestration.StateHandoff
+	return handoff.Mode == consts.StateModeBroker || len(handoff.Migrations) > 0
+}
+
+// migrateSections runs the commands of state_handoff.migrations on the
+// sections that receiver needs at another schema version, and returns the
+// sections as they are to be sent.
+func (e *Engine) migrateSections(receiver srp.Hello, codec string, sections []srp.Section) ([]srp.Section, error) {
+	configured := e.cfg.Orchestration.StateHandoff.Migrations
+	if len(configured) == 0 {
+		return sections, nil
+	}
+	own := make([]srp.Migration, len(configured))
+	for i, m := range configured {
+		own[i] = srp.Migration{Section: m.Section, From: m.From, To: m.To}
+	}
+
+	out := make([]srp.Section, len(sections))
+	for i, s := range sections {
+		for _, step := range migrationPlan(own, receiver, s.Name, s.SchemaVersion) {
+			for _, m := range configured {
+				if m.Section != step.Section || m.From != step.From || m.To != step.To {
+					continue
+				}
+				data, err := runMigration(e.hookCtx, m, codec, s.Data)
+				if err != nil {
+					return nil, aerrors.New(aerrors.ErrCodeStateMigrationFailed, "StateMigration",
+						fmt.Sprintf("migration %s failed", step), err)
+				}
+				logger.Log.Info("State migrated", "section", s.Name, "from", step.From, "to", step.To,
+					"bytes", len(s.Data), "migrated_bytes", len(data))
+				s.Data, s.SchemaVersion = data, step.To
+				break
+			}
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+// migrationPlan returns the steps of own to run on a section of schema
+// version v so that receiver gets it at the version it needs, or at one it
+// can migrate from itself. It prefers migrating the section all the way and
+// returns nil when the receiver takes it as it is.
+func migrationPlan(own []srp.Migration, receiver srp.Hello, section string, v int) []srp.Migration {
+	want, strict := receiver.TargetSchema(section)
+	if path := srp.MigrationPath(own, section, v, want); path != nil {
+		return path
+	}
+	if (!strict && v < want) || srp.MigrationPath(receiver.Migrations, section, v, want) != nil {
+		return nil
+	}
+	var best []srp.Migration
+	for _, m := range receiver.Migrations {
+		if m.Section != section || srp.MigrationPath(receiver.Migrations, section, m.From, want) == nil {
+			continue
+		}
+		if path := srp.MigrationPath(own, section, v, m.From); path != nil && (best == nil || len(path) < len(best)) {
+			best = path
+		}
+	}
+	return best
+}
+
+// runMigration runs the command of m on data, a section encoded with codec,
+// and returns what it wrote to stdout. Its stderr is attached to the error.
+func runMigration(ctx context.Context, m protocol.StateMigration, codec string, data []byte) ([]byte, error) {
+	hook := m.Hook
+	if hook.Name == "" {
+		hook.Name = srp.Migration{Section: m.Section, From: m.From, To: m.To}.String()
+	}
+	hook.Env = append(append([]string{}, hook.Env...),
+		consts.EnvMigrationSection+"="+m.Section,
+		consts.EnvMigrationFrom+"="+strconv.Itoa(m.From),
+		consts.EnvMigrationTo+"="+strconv.Itoa(m.To),
+		consts.EnvStateCodec+"="+codec)
+
+	var out bytes.Buffer
+	output, err := runHookWith(ctx, hook, func(cmd *exec.Cmd) {
+		out.Reset()
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stdout = &out
+	})
+	if err != nil {
+		if output != "" {
+			err = fmt.Errorf("%w: %s", err, output)
+		}
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Personal.AI order the ending
@@ -0,0 +1,150 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turtacn/Aeterna/internal/srp"
+	"github.com/turtacn/Aeterna/pkg/consts"
+	aerrors "github.com/turtacn/Aeterna/pkg/errors"
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+// reloadWithSchema reloads e into a candidate that needs schema version 2 of
+// the turns section, and returns the record of the reload.
+func reloadWithSchema(t *testing.T, e *Engine, readyDir string) ReloadRecord {
+	t.Helper()
+	e.mu.Lock()
+	e.cfg.Service.Env = []string{"SRP_PEER_READY_DIR=" + readyDir, "SRP_PEER_SECTIONS=1", "SRP_PEER_SCHEMA=2"}
+	e.mu.Unlock()
+	e.fsm.Fire("reload")
+
+	var reloads []ReloadRecord
+	for deadline := time.Now().Add(5 * time.Second); len(reloads) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		e.mu.Lock()
+		reloads = append([]ReloadRecord(nil), e.reloads...)
+		e.mu.Unlock()
+	}
+	if len(reloads) != 1 {
+		t.Fatalf("Expected one reload, got %+v", reloads)
+	}
+	waitForState(t, e, consts.StateRunning, 5*time.Second)
+	return reloads[0]
+}
+
+func TestEngine_MigratesHeldState(t *testing.T) {
+	e, readyDir := newHandoffEngine(t, "", "SRP_PEER_SECTIONS=1")
+	e.cfg.Orchestration.StateHandoff.Migrations = []protocol.StateMigration{
+		{Section: "turns", From: 0, To: 1, Hook: protocol.Hook{Command: []string{"sed", "s/turns/count/"}}},
+		{Section: "turns", From: 1, To: 2, Hook: protocol.Hook{Command: []string{"cat"}}},
+	}
+	// Migrations broker the reload, which needs a control channel.
+	old := crash(t, e, readyDir, "SRP_PEER_SECTIONS=1")
+	waitForPeer(t, readyDir, old.Pid())
+	waitForState(t, e, consts.StateRunning, 5*time.Second)
+
+	if rec := reloadWithSchema(t, e, readyDir); rec.Outcome != ReloadPromoted {
+		t.Fatalf("Expected the candidate to be promoted, got %+v", rec)
+	}
+	if turns := waitForPeer(t, readyDir, e.currentProcess().Pid()); turns != "1" {
+		t.Errorf("Expected the candidate to restore 1 turn from the migrated section, got %q", turns)
+	}
+}
+
+func TestEngine_NoMigrationPathRollsBack(t *testing.T) {
+	e, readyDir := newHandoffEngine(t, "", "SRP_PEER_SECTIONS=1")
+	old := e.currentProcess()
+
+	rec := reloadWithSchema(t, e, readyDir)
+	if rec.Outcome != ReloadRolledBack {
+		t.Fatalf("Expected a rolled back reload, got %+v", rec)
+	}
+	if want := fmt.Sprintf("[%d]", aerrors.ErrCodeStateMigrationFailed); !strings.HasPrefix(rec.Error, want) {
+		t.Errorf("Expected ErrCodeStateMigrationFailed, got %q", rec.Error)
+	}
+	if e.currentProcess() != old {
+		t.Error("Expected the old process to keep serving")
+	}
+}
+
+func TestEngine_FailedMigrationRollsBack(t *testing.T) {
+	e, readyDir := newHandoffEngine(t, "", "SRP_PEER_SECTIONS=1")
+	e.cfg.Orchestration.StateHandoff.Mode = consts.StateModeBroker
+	e.cfg.Orchestration.StateHandoff.Migrations = []protocol.StateMigration{
+		{Section: "turns", From: 0, To: 2, Hook: protocol.Hook{Command: []string{"sh", "-c", "echo bad layout >&2; exit 1"}}},
+	}
+	old := crash(t, e, readyDir, "SRP_PEER_SECTIONS=1")
+	waitForPeer(t, readyDir, old.Pid())
+	waitForState(t, e, consts.StateRunning, 5*time.Second)
+
+	rec := reloadWithSchema(t, e, readyDir)
+	if rec.Outcome != ReloadRolledBack || !strings.Contains(rec.Error, "bad layout") {
+		t.Fatalf("Expected a rollback carrying the output of the migration, got %+v", rec)
+	}
+	if want := fmt.Sprintf("[%d]", aerrors.ErrCodeStateMigrationFailed); !strings.HasPrefix(rec.Error, want) {
+		t.Errorf("Expected ErrCodeStateMigrationFailed, got %q", rec.Error)
+	}
+	if e.currentProcess() != old {
+		t.Error("Expected the old process to keep serving")
+	}
+}
+
+func TestMigrationPlan(t *testing.T) {
+	own := []srp.Migration{{Section: "s", From: 1, To: 2}, {Section: "s", From: 2, To: 3}}
+	tests := []struct {
+		name     string
+		receiver srp.Hello
+		from     int
+		want     int // Steps of own to run
+	}{
+		{"all the way", srp.Hello{Schemas: map[string]int{"s": 3}}, 1, 2},
+		{"same version", srp.Hello{Schemas: map[string]int{"s": 1}}, 1, 0},
+		{"older read by the receiver", srp.Hello{SchemaVersion: 5}, 1, 0},
+		{"receiver finishes", srp.Hello{Schemas: map[string]int{"s": 4}, Migrations: []srp.Migration{{Section: "s", From: 3, To: 4}}}, 1, 2},
+		{"receiver does it all", srp.Hello{Schemas: map[string]int{"s": 4}, Migrations: []srp.Migration{{Section: "s", From: 1, To: 4}}}, 1, 0},
+		{"no path", srp.Hello{Schemas: map[string]int{"s": 9}}, 1, 0},
+	}
+	for _, tt := range tests {
+		if got := migrationPlan(own, tt.receiver, "s", tt.from); len(got) != tt.want {
+			t.Errorf("%s: expected %d steps, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestServeState_ReceiverNeverConnects(t *testing.T) {
+	e := NewEngine(&protocol.Config{
+		Orchestration: protocol.OrchestrationConfig{
+			StateHandoff: protocol.StateHandoffConfig{
+				Enabled:    true,
+				SocketPath: filepath.Join(t.TempDir(), "state.sock"),
+				Timeout:    "200ms",
+			},
+		},
+	})
+	l, err := e.srp.PrepareSocket()
+	if err != nil {
+		t.Fatalf("PrepareSocket failed: %v", err)
+	}
+	sc := *e.srp
+	sc.Receiver = &srp.Peer{Pid: os.Getpid()}
+
+	served := make(chan error, 1)
+	go func() {
+		_, err := e.serveState(context.Background(), &sc, l, srp.SnapshotMeta{Codec: "json"}, []byte(`{}`))
+		served <- err
+	}()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("Expected serveState to fail without a receiver")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("serveState did not return once the receiver timed out")
+	}
+}
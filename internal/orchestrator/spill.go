@@ -0,0 +1,207 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/turtacn/Aeterna/internal/monitor"
+	"github.com/turtacn/Aeterna/internal/srp"
+	"github.com/turtacn/Aeterna/internal/supervisor"
+	"github.com/turtacn/Aeterna/pkg/consts"
+	aerrors "github.com/turtacn/Aeterna/pkg/errors"
+	"github.com/turtacn/Aeterna/pkg/logger"
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+// openSpill opens the snapshot store if state_handoff.spill is enabled. A key
+// taken from the environment is removed from it, so that no business process
+// inherits it.
+func (e *Engine) openSpill() error {
+	cfg := e.cfg.Orchestration.StateHandoff
+	if !cfg.Enabled || !cfg.Spill.Enabled {
+		return nil
+	}
+	key, err := e.spillKey(cfg.Spill)
+	if err != nil {
+		return aerrors.New(aerrors.ErrCodeConfigInvalid, "Start", "invalid state_handoff.spill key", err)
+	}
+	dir := cfg.Spill.Dir
+	if dir == "" {
+		dir = consts.DefaultSpillDir
+	}
+	ttl, _ := time.ParseDuration(cfg.Spill.TTL)
+	store, err := srp.NewSpillStore(dir, key, ttl)
+	if err != nil {
+		return aerrors.New(aerrors.ErrCodeConfigInvalid, "Start", "cannot open the state spill directory", err)
+	}
+	e.srp.Spill = store
+
+	// Generations keep counting from the snapshot a previous run left behind.
+	if sn, _ := store.Latest(time.Now()); sn != nil && sn.Meta.Generation > e.lastGeneration.Load() {
+		e.lastGeneration.Store(sn.Meta.Generation)
+	}
+	logger.Log.Info("State spill enabled", "dir", dir)
+	return nil
+}
+
+// spillKey reads the key from key_file, or else from the key_env variable.
+func (e *Engine) spillKey(cfg protocol.SpillConfig) ([]byte, error) {
+	if cfg.KeyFile != "" {
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return srp.ParseSpillKey(data)
+	}
+	if cfg.KeyEnv == "" {
+		return nil, errors.New("key_file or key_env is required")
+	}
+	value, ok := os.LookupEnv(cfg.KeyEnv)
+	if !ok {
+		return nil, errors.New(cfg.KeyEnv + " is not set")
+	}
+	os.Unsetenv(cfg.KeyEnv)
+	// Upgrade hands it to the next Aeterna binary only.
+	e.spillEnv = cfg.KeyEnv + "=" + value
+	return srp.ParseSpillKey([]byte(value))
+}
+
+// replay is a spilled state or a checkpoint waiting for a cold-started
+// process.
+type replay struct {
+	meta       srp.SnapshotMeta
+	state      []byte
+	snapshot   *srp.Snapshot // Set if the state was spilled to disk
+	checkpoint *checkpoint   // Set if the state is a checkpoint
+	listener   net.Listener
+}
+
+// source names where the replayed state comes from.
+func (r *replay) source() string {
+	if r.checkpoint != nil {
+		return "checkpoint"
+	}
+	return "snapshot"
+}
+
+// close gives up a replay that was not started.
+func (r *replay) close() {
+	if r != nil {
+		r.listener.Close()
+	}
+}
+
+// prepareReplay returns the newest state to replay to a process cold-started
+// in place of the generation replaced (0 on the first start), spilled or
+// checkpointed, with the state socket open for it to find, or nil. A state
+// older than the replaced generation is stale: that process served past it.
+func (e *Engine) prepareReplay(replaced uint64) *replay {
+	cp := e.newestCheckpoint(replaced)
+	var r *replay
+	if sn := e.latestSnapshot(replaced); sn != nil && (cp == nil || sn.Meta.Created.After(cp.Meta.Created)) {
+		r = readSnapshot(sn)
+	}
+	if r == nil && cp != nil {
+		r = &replay{meta: cp.Meta, state: cp.State, checkpoint: cp}
+	}
+	if r == nil {
+		return nil
+	}
+	l, err := e.srp.PrepareSocket()
+	if err != nil {
+		logger.Log.Warn("Cannot replay the state", "source", r.source(), "err", err)
+		return nil
+	}
+	r.listener = l
+	return r
+}
+
+// latestSnapshot returns the spilled state that may be replayed in place of
+// the generation replaced, if any.
+func (e *Engine) latestSnapshot(replaced uint64) *srp.Snapshot {
+	store := e.srp.Spill
+	if store == nil {
+		return nil
+	}
+	sn, err := store.Latest(time.Now())
+	if err != nil || sn == nil {
+		return nil
+	}
+	if sn.Meta.Generation < replaced {
+		logger.Log.Info("Discarding stale state snapshot", "generation", sn.Meta.Generation, "replaced", replaced)
+		monitor.StateSnapshotReplaysTotal.WithLabelValues("stale").Inc()
+		sn.Remove()
+		return nil
+	}
+	return sn
+}
+
+// readSnapshot returns the replay of sn, or nil if it cannot be read.
+func readSnapshot(sn *srp.Snapshot) *replay {
+	state, err := sn.ReadAll()
+	if err != nil {
+		logger.Log.Warn("Discarding unreadable state snapshot", "err", err)
+		monitor.StateSnapshotReplaysTotal.WithLabelValues("failed").Inc()
+		sn.Remove()
+		return nil
+	}
+	return &replay{meta: sn.Meta, state: state, snapshot: sn}
+}
+
+// replay hands the spilled or checkpointed state to pm, of generation gen,
+// through the state socket, playing the sender itself. Once pm has
+// acknowledged it, a snapshot is deleted and the state becomes the newest
+// checkpoint of pm. A snapshot that was not acknowledged is kept until it
+// expires or goes stale. A checkpoint pm refused is dropped, so that the next
+// restart falls back to the previous one; if pm died first, it is kept for the
+// process restarted in its place.
+func (e *Engine) replay(r *replay, pm *supervisor.ProcessManager, gen uint64) {
+	meta := r.meta
+	// A coordinator of its own, so that the replayed state is not spilled again.
+	sc := *e.srp
+	sc.Spill = nil
+	sc.Progress = nil
+	sc.Section = nil
+	sc.Receiver = e.statePeer(pm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-pm.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	logger.Log.Info("Replaying state", "source", r.source(), "pid", pm.Pid(), "generation", meta.Generation, "age", time.Since(meta.Created))
+	res, err := e.serveState(ctx, &sc, r.listener, meta, r.state)
+	if err != nil {
+		logger.Log.Warn("Replayed state not acknowledged", "source", r.source(), "pid", pm.Pid(), "err", err)
+		monitor.StateSnapshotReplaysTotal.WithLabelValues("failed").Inc()
+		select {
+		case <-pm.Done():
+			// The process died before taking the state, which is still the
+			// newest one: keep it for the process restarted in its place.
+			e.adoptCheckpoint(r, gen)
+		default:
+			if r.checkpoint != nil {
+				e.dropCheckpoint(r.checkpoint)
+			}
+		}
+		return
+	}
+	if r.snapshot != nil {
+		if err := r.snapshot.Remove(); err != nil {
+			logger.Log.Warn("Cannot remove the state snapshot", "err", err)
+		}
+	}
+	e.adoptCheckpoint(r, gen)
+	monitor.StateSnapshotReplaysTotal.WithLabelValues("acked").Inc()
+	logger.Log.Info("State replayed", "source", r.source(), "pid", pm.Pid(), "bytes", res.Bytes, "transport", res.Transport)
+}
+
+// Personal.AI order the ending
@@ -0,0 +1,292 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/turtacn/Aeterna/internal/srp"
+	"github.com/turtacn/Aeterna/internal/supervisor"
+	"github.com/turtacn/Aeterna/pkg/consts"
+	aerrors "github.com/turtacn/Aeterna/pkg/errors"
+	"github.com/turtacn/Aeterna/pkg/fsm"
+	"github.com/turtacn/Aeterna/pkg/logger"
+	"golang.org/x/sys/unix"
+)
+
+// upgradeDelay leaves the control API time to answer before the re-exec.
+const upgradeDelay = 100 * time.Millisecond
+
+// upgradeState is what the running Aeterna hands to the binary replacing it.
+// It travels in a memfd inherited across the exec, next to the socket FDs.
+type upgradeState struct {
+	State    consts.ProcessState `json:"state"`
+	ChildPid int                 `json:"child_pid"`
+	Token    string              `json:"token,omitempty"` // State token of the serving process
+	// ControlFD is Aeterna's end of the control channel of the serving
+	// process, in broker mode.
+	ControlFD int `json:"control_fd,omitempty"`
+	// Generation numbers the serving process; LastGeneration is the highest
+	// number given out so far.
+	Generation     uint64          `json:"generation,omitempty"`
+	LastGeneration uint64          `json:"last_generation,omitempty"`
+	Sockets        []upgradeSocket `json:"sockets"`
+	Reloads        []ReloadRecord  `json:"reloads,omitempty"`
+	Restarts       []time.Time     `json:"restarts,omitempty"`
+}
+
+// upgradeSocket is a listener kept open across the exec.
+type upgradeSocket struct {
+	FD      int    `json:"fd"`
+	Name    string `json:"name"`
+	Network string `json:"network"`
+	Address string `json:"address"`
+}
+
+// Upgrade replaces the running Aeterna with binary without releasing the
+// listeners or stopping the serving process. The binary is exec'd in place
+// with the same arguments, so it keeps the PID and stays the parent of the
+// serving process, which it adopts instead of starting a new one.
+// Upgrade only returns if the upgrade could not be started.
+func (e *Engine) Upgrade(binary string) error {
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return aerrors.New(aerrors.ErrCodeUpgradeFailed, "Upgrade", "binary is not executable", err)
+	}
+
+	// Hold the lock across the exec so that no reload or restart slips in
+	// between the snapshot and the exec.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.upgradableLocked(); err != nil {
+		return err
+	}
+	state := e.snapshotLocked()
+
+	stateFD, err := writeUpgradeState(state)
+	if err != nil {
+		return aerrors.New(aerrors.ErrCodeUpgradeFailed, "Upgrade", "failed to write the upgrade state", err)
+	}
+	for _, s := range state.Sockets {
+		unix.FcntlInt(uintptr(s.FD), unix.F_SETFD, 0)
+	}
+	if state.ControlFD > 0 {
+		unix.FcntlInt(uintptr(state.ControlFD), unix.F_SETFD, 0)
+	}
+
+	logger.Log.Info("Upgrade: Re-executing Aeterna", "binary", path, "pid", state.ChildPid, "sockets", len(state.Sockets))
+	env := append(os.Environ(), fmt.Sprintf("%s=%d", consts.EnvUpgradeFD, stateFD))
+	if e.spillEnv != "" {
+		env = append(env, e.spillEnv)
+	}
+	err = syscall.Exec(path, append([]string{path}, os.Args[1:]...), env)
+
+	// Still here: the exec failed and this binary keeps running.
+	for _, s := range state.Sockets {
+		syscall.CloseOnExec(s.FD)
+	}
+	if state.ControlFD > 0 {
+		syscall.CloseOnExec(state.ControlFD)
+	}
+	unix.Close(stateFD)
+	return aerrors.New(aerrors.ErrCodeUpgradeFailed, "Upgrade", "failed to exec "+path, err)
+}
+
+// upgradableLocked refuses an upgrade while a reload, a restart or a shutdown
+// is under way.
+func (e *Engine) upgradableLocked() error {
+	if e.stopping {
+		return aerrors.New(aerrors.ErrCodeUpgradeFailed, "Upgrade", "shutdown in progress", nil)
+	}
+	if e.current == nil || e.candidate != nil {
+		return aerrors.New(aerrors.ErrCodeUpgradeFailed, "Upgrade", "no settled process to hand over", nil)
+	}
+	// A crashed process stays current until its restart replaces it, so the
+	// next binary would be handed a dead process to adopt.
+	select {
+	case <-e.current.Done():
+		return aerrors.New(aerrors.ErrCodeUpgradeFailed, "Upgrade", "serving process exited, restart pending", nil)
+	default:
+	}
+	switch state := consts.ProcessState(e.fsm.Current()); state {
+	case consts.StateRunning, consts.StateStarting:
+		return nil
+	default:
+		return aerrors.New(aerrors.ErrCodeUpgradeFailed, "Upgrade", "cannot upgrade in state "+string(state), nil)
+	}
+}
+
+// snapshotLocked captures the state handed to the next binary.
+func (e *Engine) snapshotLocked() *upgradeState {
+	state := &upgradeState{
+		State:    consts.ProcessState(e.fsm.Current()),
+		ChildPid: e.current.Pid(),
+		Reloads:  append([]ReloadRecord(nil), e.reloads...),
+		Restarts: e.restarts.History(),
+
+		LastGeneration: e.lastGeneration.Load(),
+	}
+	gen := e.generationOf(e.current)
+	state.Generation, state.Token = gen.ID, gen.Token
+	if gen.Control != nil {
+		state.ControlFD = gen.Control.Fd()
+	}
+	for _, s := range e.socket.Sockets() {
+		state.Sockets = append(state.Sockets, upgradeSocket{
+			FD:      int(s.File.Fd()),
+			Name:    s.Name,
+			Network: s.Network,
+			Address: s.Address,
+		})
+	}
+	return state
+}
+
+// resume picks up the state left by the Aeterna binary this one replaced.
+func (e *Engine) resume(value string) error {
+	os.Unsetenv(consts.EnvUpgradeFD)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return aerrors.New(aerrors.ErrCodeUpgradeFailed, "Resume", "invalid "+consts.EnvUpgradeFD, err)
+	}
+	state, err := readUpgradeState(fd)
+	if err != nil {
+		return aerrors.New(aerrors.ErrCodeUpgradeFailed, "Resume", "failed to read the upgrade state", err)
+	}
+	return e.restore(state)
+}
+
+// restore adopts the listeners and the serving process described by state.
+func (e *Engine) restore(state *upgradeState) error {
+	fds := make([]int, 0, len(state.Sockets))
+	names := make([]string, 0, len(state.Sockets))
+	for _, s := range state.Sockets {
+		// Kept open for the exec only; children get them through ExtraFiles.
+		syscall.CloseOnExec(s.FD)
+		fds = append(fds, s.FD)
+		names = append(names, s.Name)
+	}
+	e.socket.Adopt(fds, names)
+
+	// Claims the adopted sockets back in declaration order.
+	if err := e.bindListeners(); err != nil {
+		return err
+	}
+
+	pm, err := supervisor.Adopt(state.ChildPid)
+	if err != nil {
+		return aerrors.New(aerrors.ErrCodeUpgradeFailed, "Resume", "cannot adopt the serving process", err)
+	}
+
+	gen := generation{ID: state.Generation, Token: state.Token}
+	if state.ControlFD > 0 {
+		gen.Control = srp.AdoptControl(state.ControlFD)
+	}
+	e.generations.Store(pm, gen)
+	if state.LastGeneration > e.lastGeneration.Load() {
+		e.lastGeneration.Store(state.LastGeneration)
+	}
+	e.mu.Lock()
+	e.current = pm
+	e.reloads = append([]ReloadRecord(nil), state.Reloads...)
+	e.mu.Unlock()
+	e.restarts.Restore(state.Restarts)
+
+	e.fsm = fsm.New(fsm.State(state.State))
+	e.setupFSM()
+
+	logger.Log.Info("Upgrade: Resumed", "state", state.State, "pid", pm.Pid(), "sockets", len(state.Sockets))
+	go e.watch(pm)
+	if state.State == consts.StateStarting {
+		go e.warmup(pm)
+	}
+	return nil
+}
+
+// writeUpgradeState stores state in a memfd that survives the exec.
+func writeUpgradeState(state *upgradeState) (int, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return -1, err
+	}
+	fd, err := unix.MemfdCreate("aeterna-upgrade", 0)
+	if err != nil {
+		return -1, err
+	}
+	for rest := data; len(rest) > 0; {
+		n, err := unix.Write(fd, rest)
+		if err != nil {
+			unix.Close(fd)
+			return -1, err
+		}
+		rest = rest[n:]
+	}
+	if _, err := unix.Seek(fd, 0, 0); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// readUpgradeState reads and closes the memfd written by writeUpgradeState.
+func readUpgradeState(fd int) (*upgradeState, error) {
+	f := os.NewFile(uintptr(fd), "aeterna-upgrade")
+	defer f.Close()
+
+	var state upgradeState
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// upgradeRequest is the body of POST /v1/upgrade.
+type upgradeRequest struct {
+	Binary string `json:"binary"`
+}
+
+// handleUpgrade accepts an upgrade and starts it once the response is out.
+func (e *Engine) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req upgradeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Binary == "" {
+		http.Error(w, "expected {\"binary\": \"<path>\"}", http.StatusBadRequest)
+		return
+	}
+	path, err := exec.LookPath(req.Binary)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e.mu.Lock()
+	err = e.upgradableLocked()
+	e.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "upgrading", "binary": path})
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	go func() {
+		time.Sleep(upgradeDelay)
+		if err := e.Upgrade(path); err != nil {
+			logger.Log.Error("Upgrade failed", "err", err)
+		}
+	}()
+}
+
+// Personal.AI order the ending
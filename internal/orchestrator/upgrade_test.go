@@ -0,0 +1,160 @@
+package orchestrator
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/turtacn/Aeterna/internal/supervisor"
+	"github.com/turtacn/Aeterna/pkg/consts"
+	aerrors "github.com/turtacn/Aeterna/pkg/errors"
+	"github.com/turtacn/Aeterna/pkg/fsm"
+	"github.com/turtacn/Aeterna/pkg/protocol"
+	"golang.org/x/sys/unix"
+)
+
+func TestUpgradeState_MemfdRoundTrip(t *testing.T) {
+	state := &upgradeState{
+		State:    consts.StateRunning,
+		ChildPid: 42,
+		Token:    "secret",
+		Sockets:  []upgradeSocket{{FD: 3, Name: "http", Network: "tcp", Address: "127.0.0.1:8080"}},
+		Reloads:  []ReloadRecord{{Outcome: ReloadPromoted, Pid: 42}},
+	}
+	fd, err := writeUpgradeState(state)
+	if err != nil {
+		t.Fatalf("writeUpgradeState failed: %v", err)
+	}
+	if flags, _ := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); flags&unix.FD_CLOEXEC != 0 {
+		t.Error("Expected the state memfd to survive exec")
+	}
+
+	got, err := readUpgradeState(fd)
+	if err != nil {
+		t.Fatalf("readUpgradeState failed: %v", err)
+	}
+	if got.ChildPid != 42 || got.Token != "secret" || got.State != consts.StateRunning || len(got.Sockets) != 1 || got.Sockets[0] != state.Sockets[0] {
+		t.Errorf("Unexpected state %+v", got)
+	}
+	if len(got.Reloads) != 1 || got.Reloads[0].Outcome != ReloadPromoted {
+		t.Errorf("Unexpected reload history %+v", got.Reloads)
+	}
+}
+
+func TestEngine_SnapshotAndRestore(t *testing.T) {
+	cfg := &protocol.Config{
+		Service:   protocol.ServiceConfig{Command: []string{"sleep", "10"}},
+		Listeners: []protocol.ListenerConfig{{Name: "http", Address: "127.0.0.1:0"}},
+	}
+	old := NewEngine(cfg)
+	old.fsm = fsm.New(fsm.State(consts.StateRunning))
+	old.setupFSM()
+	if err := old.bindListeners(); err != nil {
+		t.Fatalf("bindListeners failed: %v", err)
+	}
+	t.Cleanup(old.socket.Close)
+	current, err := old.spawn()
+	if err != nil {
+		t.Fatalf("spawn failed: %v", err)
+	}
+	t.Cleanup(func() { current.Kill() })
+	old.recordReload(ReloadPromoted, current.Pid(), nil)
+
+	old.mu.Lock()
+	old.current = current
+	state := old.snapshotLocked()
+	old.mu.Unlock()
+
+	if state.ChildPid != current.Pid() || state.State != consts.StateRunning || len(state.Sockets) != 1 {
+		t.Fatalf("Unexpected snapshot %+v", state)
+	}
+	addr := state.Sockets[0].Address
+
+	// The new binary would receive the same descriptors and an unwaited
+	// child; duplicates and a fresh child stand in for them here.
+	fd, err := unix.Dup(state.Sockets[0].FD)
+	if err != nil {
+		t.Fatalf("Dup failed: %v", err)
+	}
+	state.Sockets[0].FD = fd
+	child := exec.Command("sleep", "10")
+	if err := child.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	state.ChildPid = child.Process.Pid
+	state.Token = "secret"
+
+	e := NewEngine(cfg)
+	t.Cleanup(e.socket.Close)
+	if err := e.restore(state); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	if e.fsm.Current() != fsm.State(consts.StateRunning) {
+		t.Errorf("Expected RUNNING, got %v", e.fsm.Current())
+	}
+	if pm := e.currentProcess(); pm == nil || pm.Pid() != child.Process.Pid {
+		t.Fatal("Expected the child to be adopted as the current process")
+	}
+	if peer := e.statePeer(e.currentProcess()); peer.Token != "secret" {
+		t.Errorf("Expected the state token to carry over, got %q", peer.Token)
+	}
+	if len(e.reloads) != 1 || e.reloads[0].Pid != current.Pid() {
+		t.Errorf("Expected the reload history to carry over, got %+v", e.reloads)
+	}
+	sockets := e.socket.Sockets()
+	if len(sockets) != 1 || sockets[0].Name != "http" || sockets[0].Address != addr {
+		t.Errorf("Expected the http listener on %s to be adopted, got %+v", addr, sockets)
+	}
+	if flags, _ := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); flags&unix.FD_CLOEXEC == 0 {
+		t.Error("Expected the adopted socket to be close-on-exec again")
+	}
+
+	// The adopted process is supervised like one the engine started.
+	child.Process.Kill()
+	select {
+	case err := <-e.done:
+		if supervisor.ExitCode(err) == 0 {
+			t.Errorf("Expected the killed process's status, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the engine to notice the adopted process exiting")
+	}
+}
+
+func TestEngine_UpgradeRefused(t *testing.T) {
+	cfg := &protocol.Config{
+		Service: protocol.ServiceConfig{Command: []string{"sleep", "10"}},
+	}
+	e := newRunningEngine(t, cfg)
+
+	var aerr *aerrors.AeternaError
+	if err := e.Upgrade("/nonexistent/aeterna"); !errors.As(err, &aerr) || aerr.Code != aerrors.ErrCodeUpgradeFailed {
+		t.Errorf("Expected ErrCodeUpgradeFailed for a missing binary, got %v", err)
+	}
+
+	// A reload in progress keeps the current binary.
+	e.mu.Lock()
+	e.candidate = supervisor.New()
+	e.mu.Unlock()
+	if err := e.Upgrade("true"); !errors.As(err, &aerr) || aerr.Code != aerrors.ErrCodeUpgradeFailed {
+		t.Errorf("Expected ErrCodeUpgradeFailed during a reload, got %v", err)
+	}
+	e.mu.Lock()
+	e.candidate = nil
+	e.mu.Unlock()
+
+	// A crashed process waiting out its restart backoff cannot be adopted.
+	e.restarts = supervisor.NewRestartPolicy(protocol.RestartConfig{Policy: "always", Backoff: "10s"})
+	crashed := e.currentProcess()
+	crashed.Kill()
+	<-crashed.Done()
+	e.mu.Lock()
+	err := e.upgradableLocked()
+	e.stopping = true // Call off the restart
+	e.mu.Unlock()
+	if !errors.As(err, &aerr) || aerr.Code != aerrors.ErrCodeUpgradeFailed {
+		t.Errorf("Expected ErrCodeUpgradeFailed while a restart is pending, got %v", err)
+	}
+}
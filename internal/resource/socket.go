@@ -1,11 +1,13 @@
 package resource
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 
@@ -13,38 +15,109 @@ import (
 	"github.com/turtacn/Aeterna/pkg/logger"
 )
 
-// SocketManager manages network listeners and their corresponding file descriptors.
-// It supports socket inheritance, allowing listeners to be passed from a parent
-// process to a child process during a hot reload.
+// ListenerSpec declares a socket managed by the SocketManager.
+type ListenerSpec struct {
+	Name string
+	// Network is one of "tcp" (default), "tcp4", "tcp6", "unix" and "unixpacket"
+	// for listeners, or "udp", "udp4", "udp6" and "unixgram" for packet sockets.
+	Network string
+	Address string // host:port, or a filesystem path for Unix sockets
+	Backlog int    // Accept queue length of listeners; 0 keeps the system default
+}
+
+// SocketManager manages network listeners and packet sockets and their corresponding
+// file descriptors. It supports socket inheritance, allowing them to be passed from a
+// parent process to a child process during a hot reload.
 type SocketManager struct {
 	mu sync.Mutex
 
-	// Active listeners keyed by address
-	listeners map[string]net.Listener
-	files     map[string]*os.File
+	// Active sockets keyed by network family and address, including aliases
+	active map[string]*managedSocket
+
+	// Active sockets in the order they were first bound or claimed
+	ordered []*managedSocket
 
-	// Inherited but not yet claimed listeners
-	inherited map[string]*inheritedSocket
+	// Inherited but not yet claimed sockets, keyed by their canonical address
+	inherited map[string]*managedSocket
 
 	discovered bool
 	baseFD     int
 }
 
-type inheritedSocket struct {
+// managedSocket is either a stream listener or a packet socket.
+type managedSocket struct {
+	name     string
+	family   string // tcp, udp, unix, unixpacket or unixgram
 	listener net.Listener
+	packet   net.PacketConn
 	file     *os.File
 }
 
+func (ms *managedSocket) addr() net.Addr {
+	if ms.listener != nil {
+		return ms.listener.Addr()
+	}
+	return ms.packet.LocalAddr()
+}
+
+func (ms *managedSocket) key() string {
+	return socketKey(ms.family, ms.addr().String())
+}
+
+func (ms *managedSocket) close() {
+	if ms.listener != nil {
+		ms.listener.Close()
+	} else {
+		ms.packet.Close()
+	}
+	ms.file.Close()
+}
+
+// fileSocket is implemented by every listener and packet conn whose FD can be passed on.
+type fileSocket interface {
+	File() (*os.File, error)
+	SyscallConn() (syscall.RawConn, error)
+}
+
 // NewSocketManager creates and initializes a new SocketManager.
 func NewSocketManager() *SocketManager {
 	return &SocketManager{
-		listeners: make(map[string]net.Listener),
-		files:     make(map[string]*os.File),
-		inherited: make(map[string]*inheritedSocket),
-		baseFD:    3,
+		active:    make(map[string]*managedSocket),
+		inherited: make(map[string]*managedSocket),
+		baseFD:    consts.ListenFDsStart,
 	}
 }
 
+// networkFamily folds the IP version variants of a network into one family,
+// so that "tcp4" and "tcp" listeners on the same address are the same socket.
+func networkFamily(network string) string {
+	switch network {
+	case "", "tcp", "tcp4", "tcp6":
+		return "tcp"
+	case "udp", "udp4", "udp6":
+		return "udp"
+	}
+	return network
+}
+
+// IsPacketNetwork reports whether network is served by a net.PacketConn
+// rather than a net.Listener.
+func IsPacketNetwork(network string) bool {
+	switch networkFamily(network) {
+	case "udp", "unixgram":
+		return true
+	}
+	return false
+}
+
+func isIPFamily(family string) bool {
+	return family == "tcp" || family == "udp"
+}
+
+func socketKey(family, addr string) string {
+	return family + " " + addr
+}
+
 func isSocket(fd uintptr) bool {
 	var stat syscall.Stat_t
 	err := syscall.Fstat(int(fd), &stat)
@@ -54,70 +127,157 @@ func isSocket(fd uintptr) bool {
 	return (stat.Mode & syscall.S_IFMT) == syscall.S_IFSOCK
 }
 
+// setNonblock puts the socket back into non-blocking mode for the Go runtime
+// poller; File() and inheritance leave it blocking. A positive backlog is
+// applied by calling listen(2) again, which only resizes the accept queue.
+func setNonblock(s fileSocket, backlog int) {
+	if rawConn, err := s.SyscallConn(); err == nil {
+		rawConn.Control(func(fd uintptr) {
+			_ = syscall.SetNonblock(int(fd), true)
+			if backlog > 0 {
+				_ = syscall.Listen(int(fd), backlog)
+			}
+		})
+	}
+}
+
 func (sm *SocketManager) discoverInherited() {
 	if sm.discovered {
 		return
 	}
 	sm.discovered = true
 
-	fds := os.Getenv(consts.EnvInheritedFDs)
-	if fds == "" {
+	count, names := inheritedEnv()
+	if count <= 0 {
 		return
 	}
 
-	count, err := strconv.Atoi(fds)
-	if err != nil || count <= 0 {
-		return
-	}
-
-	// Clear it so children of this process don't see it unless we set it again
-	os.Unsetenv(consts.EnvInheritedFDs)
-
-	logger.Log.Info("Hot Relay: Discovering inherited sockets", "count", count)
+	logger.Log.Info("Hot Relay: Discovering inherited sockets", "count", count, "names", names)
 
 	for i := 0; i < count; i++ {
 		// ExtraFiles start at baseFD (usually 3)
-		fd := sm.baseFD + i
-		if !isSocket(uintptr(fd)) {
-			logger.Log.Warn("Hot Relay: FD is not a socket, skipping", "fd", fd)
-			continue
+		name := ""
+		if i < len(names) {
+			name = names[i]
 		}
+		sm.inheritFD(sm.baseFD+i, name)
+	}
+}
+
+// Adopt registers sockets inherited on arbitrary FDs, such as the ones kept
+// open across an upgrade re-exec, instead of discovering them from the
+// environment. names are matched to fds by position.
+func (sm *SocketManager) Adopt(fds []int, names []string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 
-		f := os.NewFile(uintptr(fd), "listener")
-		if f == nil {
-			continue
+	sm.discovered = true
+	for i, fd := range fds {
+		name := ""
+		if i < len(names) {
+			name = names[i]
 		}
+		sm.inheritFD(fd, name)
+	}
+}
+
+func (sm *SocketManager) inheritFD(fd int, name string) {
+	if !isSocket(uintptr(fd)) {
+		logger.Log.Warn("Hot Relay: FD is not a socket, skipping", "fd", fd)
+		return
+	}
+
+	sotype, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		logger.Log.Warn("Hot Relay: Cannot determine socket type, skipping", "fd", fd, "err", err)
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "listener")
+	if f == nil {
+		return
+	}
 
+	// Both calls dup the FD; f keeps the original so it can be passed on.
+	ms := &managedSocket{file: f}
+	if sotype == syscall.SOCK_DGRAM {
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			logger.Log.Error("Hot Relay: Failed to create packet conn from FD", "fd", fd, "err", err)
+			return
+		}
+		ms.packet = pc
+		ms.family = pc.LocalAddr().Network()
+		setNonblock(pc.(fileSocket), 0)
+	} else {
 		l, err := net.FileListener(f)
 		if err != nil {
 			logger.Log.Error("Hot Relay: Failed to create listener from FD", "fd", fd, "err", err)
 			// We don't close f here because if it failed, we might not truly "own" this FD
 			// especially in test environments.
-			continue
+			return
 		}
+		ms.listener = l
+		ms.family = l.Addr().Network()
+		setNonblock(l.(fileSocket), 0)
+	}
 
-		// Ensure non-blocking mode for Go runtime poller
-		if tcpL, ok := l.(*net.TCPListener); ok {
-			if rawConn, err := tcpL.SyscallConn(); err == nil {
-				rawConn.Control(func(fd uintptr) {
-					_ = syscall.SetNonblock(int(fd), true)
-				})
-			}
+	ms.name = name
+	if ms.name == "" {
+		ms.name = consts.UnnamedFD
+	}
+	sm.inherited[ms.key()] = ms
+	logger.Log.Info("Hot Relay: Discovered inherited socket", "name", ms.name, "network", ms.family, "addr", ms.addr().String(), "fd", fd)
+}
+
+// inheritedEnv returns the number and names of the sockets passed by the parent.
+// Aeterna's own variables take precedence over systemd's LISTEN_FDS, which is
+// ignored when LISTEN_PID names another process. All of them are cleared so
+// that they do not leak to processes started later.
+func inheritedEnv() (int, []string) {
+	defer func() {
+		for _, key := range []string{consts.EnvInheritedFDs, consts.EnvFDNames, consts.EnvFDAddrs,
+			consts.EnvListenFDs, consts.EnvListenFDNames, consts.EnvListenPID} {
+			os.Unsetenv(key)
 		}
+	}()
 
-		addr := l.Addr().String()
-		sm.inherited[addr] = &inheritedSocket{
-			listener: l,
-			file:     f,
+	if fds := os.Getenv(consts.EnvInheritedFDs); fds != "" {
+		count, err := strconv.Atoi(fds)
+		if err != nil {
+			return 0, nil
 		}
-		logger.Log.Info("Hot Relay: Discovered inherited socket", "addr", addr, "fd", fd)
+		return count, splitNames(os.Getenv(consts.EnvFDNames), ",")
+	}
+
+	if fds := os.Getenv(consts.EnvListenFDs); fds != "" {
+		if pid := os.Getenv(consts.EnvListenPID); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+			return 0, nil
+		}
+		count, err := strconv.Atoi(fds)
+		if err != nil {
+			return 0, nil
+		}
+		return count, splitNames(os.Getenv(consts.EnvListenFDNames), ":")
+	}
+	return 0, nil
+}
+
+func splitNames(names, sep string) []string {
+	if names == "" {
+		return nil
 	}
+	return strings.Split(names, sep)
 }
 
-func (sm *SocketManager) addressesMatch(a, b string) bool {
+func (sm *SocketManager) addressesMatch(family, a, b string) bool {
 	if a == b {
 		return true
 	}
+	if !isIPFamily(family) {
+		// Unix socket paths only match exactly
+		return false
+	}
 	ra, err1 := net.ResolveTCPAddr("tcp", a)
 	rb, err2 := net.ResolveTCPAddr("tcp", b)
 	if err1 != nil || err2 != nil {
@@ -137,168 +297,296 @@ func (sm *SocketManager) addressesMatch(a, b string) bool {
 	return ra.IP.Equal(rb.IP)
 }
 
-func (sm *SocketManager) findListenerLocked(addr string) (net.Listener, *os.File) {
-	if l, ok := sm.listeners[addr]; ok {
-		return l, sm.files[addr]
+func isRandomPort(family, addr string) bool {
+	if !isIPFamily(family) {
+		return false
+	}
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port == "0"
+}
+
+func (sm *SocketManager) findActiveLocked(family, addr string) *managedSocket {
+	if ms, ok := sm.active[socketKey(family, addr)]; ok {
+		return ms
 	}
 
 	// For random port (0), we never match an existing listener unless it's by exact string key (which is unlikely for :0)
-	if _, port, err := net.SplitHostPort(addr); err == nil && port == "0" {
-		return nil, nil
+	if isRandomPort(family, addr) {
+		return nil
 	}
 
-	for can, l := range sm.listeners {
-		if sm.addressesMatch(addr, can) {
-			return l, sm.files[can]
+	for _, ms := range sm.ordered {
+		if ms.family == family && sm.addressesMatch(family, addr, ms.addr().String()) {
+			return ms
 		}
 	}
-	return nil, nil
+	return nil
 }
 
-func (sm *SocketManager) findInheritedLocked(addr string) *inheritedSocket {
-	if is, ok := sm.inherited[addr]; ok {
-		return is
+func (sm *SocketManager) findInheritedLocked(name, family, addr string) *managedSocket {
+	// A socket passed under the same name is preferred as long as it still
+	// serves the requested address; a random port matches any port on the host.
+	if name != "" {
+		for _, ms := range sm.inherited {
+			if ms.name != name {
+				continue
+			}
+			can := ms.addr().String()
+			want := addr
+			if host, _, err := net.SplitHostPort(addr); err == nil && isRandomPort(family, addr) {
+				if _, port, err := net.SplitHostPort(can); err == nil {
+					want = net.JoinHostPort(host, port)
+				}
+			}
+			if ms.family == family && sm.addressesMatch(family, want, can) {
+				return ms
+			}
+			logger.Log.Warn("Hot Relay: Inherited socket does not serve its configured address", "name", name,
+				"inherited", socketKey(ms.family, can), "requested", socketKey(family, addr))
+		}
+	}
+
+	if ms, ok := sm.inherited[socketKey(family, addr)]; ok {
+		return ms
 	}
 
 	// For random port (0), we can't match an inherited socket by address unless it's exact match
-	if _, port, err := net.SplitHostPort(addr); err == nil && port == "0" {
+	if isRandomPort(family, addr) {
 		return nil
 	}
 
-	for can, is := range sm.inherited {
-		if sm.addressesMatch(addr, can) {
-			return is
+	for _, ms := range sm.inherited {
+		if ms.family == family && sm.addressesMatch(family, addr, ms.addr().String()) {
+			return ms
 		}
 	}
 	return nil
 }
 
-// EnsureListener returns a net.Listener for the given address.
+// EnsureListener returns a net.Listener for the given TCP address.
 // It first checks if a listener for the address is already active or was inherited
 // from a parent process. If not, it creates a new listener.
 // It returns the listener or an error if one occurred.
 func (sm *SocketManager) EnsureListener(addr string) (net.Listener, error) {
+	return sm.Listen(ListenerSpec{Address: addr})
+}
+
+// Listen returns the stream listener declared by spec, reusing an active or
+// inherited socket for the same network and address before binding a new one.
+func (sm *SocketManager) Listen(spec ListenerSpec) (net.Listener, error) {
+	if IsPacketNetwork(spec.Network) {
+		return nil, fmt.Errorf("network %q of listener %q is a packet network", spec.Network, spec.Name)
+	}
+	ms, err := sm.bind(spec)
+	if err != nil {
+		return nil, err
+	}
+	return ms.listener, nil
+}
+
+// ListenPacket returns the packet socket declared by spec, reusing an active or
+// inherited socket for the same network and address before binding a new one.
+func (sm *SocketManager) ListenPacket(spec ListenerSpec) (net.PacketConn, error) {
+	if !IsPacketNetwork(spec.Network) {
+		return nil, fmt.Errorf("network %q of listener %q is not a packet network", spec.Network, spec.Name)
+	}
+	ms, err := sm.bind(spec)
+	if err != nil {
+		return nil, err
+	}
+	return ms.packet, nil
+}
+
+// Bind makes sure the socket declared by spec is active, whatever its network.
+func (sm *SocketManager) Bind(spec ListenerSpec) error {
+	_, err := sm.bind(spec)
+	return err
+}
+
+func (sm *SocketManager) bind(spec ListenerSpec) (*managedSocket, error) {
+	switch spec.Network {
+	case "":
+		spec.Network = "tcp"
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "unix", "unixpacket", "unixgram":
+	default:
+		return nil, fmt.Errorf("unsupported network %q for listener %q", spec.Network, spec.Name)
+	}
+	family := networkFamily(spec.Network)
+
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
+	addr := spec.Address
+	key := socketKey(family, addr)
+
 	// 1. Check if we already have it active
-	if l, f := sm.findListenerLocked(addr); l != nil {
-		// Map this alias for future lookups and inheritance
-		sm.listeners[addr] = l
-		if f != nil {
-			sm.files[addr] = f
-		}
-		return l, nil
+	if ms := sm.findActiveLocked(family, addr); ms != nil {
+		// Map this alias for future lookups
+		sm.active[key] = ms
+		return ms, nil
 	}
 
 	// 2. Try to discover inherited sockets if not already done
 	sm.discoverInherited()
 
 	// 3. Check if it was inherited
-	if is := sm.findInheritedLocked(addr); is != nil {
-		canonicalAddr := is.listener.Addr().String()
-		logger.Log.Info("Hot Relay: Claiming inherited socket", "requested", addr, "canonical", canonicalAddr)
-		sm.listeners[addr] = is.listener
-		sm.files[addr] = is.file
-		if canonicalAddr != addr {
-			sm.listeners[canonicalAddr] = is.listener
-			sm.files[canonicalAddr] = is.file
+	if ms := sm.findInheritedLocked(spec.Name, family, addr); ms != nil {
+		canonicalKey := ms.key()
+		logger.Log.Info("Hot Relay: Claiming inherited socket", "name", ms.name, "requested", key, "canonical", canonicalKey)
+		delete(sm.inherited, canonicalKey)
+		if spec.Name != "" {
+			ms.name = spec.Name
 		}
-		delete(sm.inherited, canonicalAddr)
-		return is.listener, nil
+		sm.active[key] = ms
+		sm.active[canonicalKey] = ms
+		sm.ordered = append(sm.ordered, ms)
+		return ms, nil
 	}
 
 	// 4. Cold start
-	logger.Log.Info("Cold Start: Binding new listener", "addr", addr)
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		return nil, err
+	logger.Log.Info("Cold Start: Binding new socket", "name", spec.Name, "network", spec.Network, "addr", addr)
+	if family == "unix" || family == "unixpacket" || family == "unixgram" {
+		removeStaleUnixSocket(family, addr)
+	}
+
+	ms := &managedSocket{name: spec.Name, family: family}
+	var fs fileSocket
+	if IsPacketNetwork(spec.Network) {
+		pc, err := net.ListenPacket(spec.Network, addr)
+		if err != nil {
+			return nil, err
+		}
+		ms.packet = pc
+		fs, _ = pc.(fileSocket)
+	} else {
+		l, err := net.Listen(spec.Network, addr)
+		if err != nil {
+			return nil, err
+		}
+		ms.listener = l
+		fs, _ = l.(fileSocket)
 	}
 
 	// Get the file descriptor for future inheritance
-	tcpL, ok := l.(*net.TCPListener)
-	if !ok {
-		l.Close()
-		return nil, fmt.Errorf("listener is not a TCP listener")
+	var err error
+	if fs == nil {
+		err = fmt.Errorf("%s socket cannot be passed on", spec.Network)
+	} else {
+		ms.file, err = fs.File()
 	}
-	f, err := tcpL.File()
 	if err != nil {
-		l.Close()
+		if ms.listener != nil {
+			ms.listener.Close()
+		} else {
+			ms.packet.Close()
+		}
 		return nil, err
 	}
 
-	// File() sets the socket to blocking mode. We need to set it back to non-blocking
-	if rawConn, err := tcpL.SyscallConn(); err == nil {
-		rawConn.Control(func(fd uintptr) {
-			_ = syscall.SetNonblock(int(fd), true)
-		})
-	}
+	// File() sets the socket to blocking mode. We need to set it back to non-blocking.
+	setNonblock(fs, spec.Backlog)
 
-	sm.listeners[addr] = l
-	sm.files[addr] = f
-	canonicalAddr := l.Addr().String()
-	if canonicalAddr != addr {
-		sm.listeners[canonicalAddr] = l
-		sm.files[canonicalAddr] = f
+	sm.active[key] = ms
+	sm.active[ms.key()] = ms
+	sm.ordered = append(sm.ordered, ms)
+	return ms, nil
+}
+
+// removeStaleUnixSocket removes a socket file left behind by a process that
+// exited without unlinking it, so that binding the path does not fail. A path
+// something still listens on is left alone.
+func removeStaleUnixSocket(family, path string) {
+	if path == "" || path[0] == '@' {
+		// Abstract sockets have no file
+		return
+	}
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.Dial(family, path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		logger.Log.Warn("Cold Start: Removing stale unix socket", "path", path)
+		os.Remove(path)
 	}
-	return l, nil
 }
 
-// GetFiles returns a slice of *os.File representing all managed listeners' file descriptors.
-// This is used to pass file descriptors to a child process. The results are sorted
-// by address for deterministic behavior.
+// GetFiles returns a slice of *os.File representing all managed sockets' file descriptors.
+// This is used to pass file descriptors to a child process. Active sockets come
+// first, in the order they were bound or claimed, so the child finds them at
+// FD 3, 4, ... in declaration order. Inherited sockets that were never claimed
+// follow, sorted by network and address for deterministic behavior.
 func (sm *SocketManager) GetFiles() []*os.File {
+	files, _ := sm.ExportFiles()
+	return files
+}
+
+// SocketInfo describes a managed socket.
+type SocketInfo struct {
+	Name    string
+	Network string
+	Address string
+	File    *os.File
+}
+
+// Sockets describes the managed sockets in the order of GetFiles.
+func (sm *SocketManager) Sockets() []SocketInfo {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
 	// Ensure we've discovered all inherited sockets so they can be passed down
 	sm.discoverInherited()
 
-	// Use a map to deduplicate files since a listener might be stored under multiple keys
-	uniqueFiles := make(map[uintptr]*os.File)
-	addrMap := make(map[uintptr]string)
-
-	// Include both active files and inherited but unclaimed files
-	allSources := make(map[string]*os.File)
-	for addr, f := range sm.files {
-		allSources[addr] = f
+	sockets := append([]*managedSocket(nil), sm.ordered...)
+	keys := make([]string, 0, len(sm.inherited))
+	for key := range sm.inherited {
+		keys = append(keys, key)
 	}
-	for addr, is := range sm.inherited {
-		allSources[addr] = is.file
+	sort.Strings(keys)
+	for _, key := range keys {
+		sockets = append(sockets, sm.inherited[key])
 	}
 
-	for addr, f := range allSources {
-		fd := f.Fd()
-		if _, ok := uniqueFiles[fd]; !ok {
-			uniqueFiles[fd] = f
-			addrMap[fd] = addr
-		} else {
-			// If we have multiple addresses for the same FD, prefer the canonical one (longer usually)
-			// or just stay consistent. Canonical addresses are often longer e.g. [::]:8080 vs :8080
-			if len(addr) > len(addrMap[fd]) {
-				addrMap[fd] = addr
-			}
+	infos := make([]SocketInfo, 0, len(sockets))
+	for _, ms := range sockets {
+		name := ms.name
+		if name == "" {
+			name = consts.UnnamedFD
 		}
+		infos = append(infos, SocketInfo{Name: name, Network: ms.family, Address: ms.addr().String(), File: ms.file})
 	}
+	return infos
+}
 
-	// Sort by address for determinism
-	type fileWithAddr struct {
-		f    *os.File
-		addr string
+// ExportFiles returns the same files as GetFiles together with the environment
+// that describes them to the child: their names in both the Aeterna and the
+// systemd (LISTEN_FDNAMES) form, and their addresses. The counts are set by
+// the supervisor, which knows how many files it actually passes.
+func (sm *SocketManager) ExportFiles() ([]*os.File, []string) {
+	sockets := sm.Sockets()
+	if len(sockets) == 0 {
+		return nil, nil
 	}
-	sorted := make([]fileWithAddr, 0, len(uniqueFiles))
-	for fd, f := range uniqueFiles {
-		sorted = append(sorted, fileWithAddr{f, addrMap[fd]})
+
+	files := make([]*os.File, 0, len(sockets))
+	names := make([]string, 0, len(sockets))
+	addrs := make([]string, 0, len(sockets))
+	for _, si := range sockets {
+		files = append(files, si.File)
+		names = append(names, si.Name)
+		addrs = append(addrs, si.Address)
 	}
-	sort.Slice(sorted, func(i, j int) bool {
-		return sorted[i].addr < sorted[j].addr
-	})
 
-	files := make([]*os.File, 0, len(sorted))
-	for _, s := range sorted {
-		files = append(files, s.f)
+	env := []string{
+		consts.EnvFDNames + "=" + strings.Join(names, ","),
+		consts.EnvFDAddrs + "=" + strings.Join(addrs, ","),
+		consts.EnvListenFDNames + "=" + strings.Join(names, ":"),
 	}
-	return files
+	return files, env
 }
 
 // GetFile returns the first managed file descriptor.
@@ -311,25 +599,21 @@ func (sm *SocketManager) GetFile() *os.File {
 	return nil
 }
 
-// Close closes all managed listeners and their associated file descriptors.
+// Close closes all managed sockets and their associated file descriptors.
 func (sm *SocketManager) Close() {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	for addr, l := range sm.listeners {
-		l.Close()
-		if f, ok := sm.files[addr]; ok {
-			f.Close()
-		}
+	for _, ms := range sm.ordered {
+		ms.close()
 	}
-	sm.listeners = make(map[string]net.Listener)
-	sm.files = make(map[string]*os.File)
+	sm.active = make(map[string]*managedSocket)
+	sm.ordered = nil
 
-	for _, is := range sm.inherited {
-		is.listener.Close()
-		is.file.Close()
+	for _, ms := range sm.inherited {
+		ms.close()
 	}
-	sm.inherited = make(map[string]*inheritedSocket)
+	sm.inherited = make(map[string]*managedSocket)
 }
 
 // Personal.AI order the ending
@@ -0,0 +1,87 @@
+package resource
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/Aeterna/pkg/consts"
+)
+
+// passListeners duplicates the listeners onto consecutive FDs starting at
+// base, the way a parent hands them to a child.
+func passListeners(t *testing.T, base int, ls ...*net.TCPListener) {
+	t.Helper()
+	for i, l := range ls {
+		f, err := l.File()
+		require.NoError(t, err)
+		require.NoError(t, syscall.Dup2(int(f.Fd()), base+i))
+		f.Close()
+		l.Close()
+	}
+}
+
+func TestSocketManager_ClaimsInheritedSocketsByName(t *testing.T) {
+	admin, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	http, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	httpAddr := http.Addr().String()
+	passListeners(t, 100, admin, http)
+
+	t.Setenv(consts.EnvListenFDs, "2")
+	t.Setenv(consts.EnvListenPID, strconv.Itoa(os.Getpid()))
+	t.Setenv(consts.EnvListenFDNames, "admin:http")
+
+	sm := NewSocketManager()
+	sm.baseFD = 100
+	defer sm.Close()
+
+	// A random port is satisfied by the socket passed under the same name.
+	l, err := sm.Listen(ListenerSpec{Name: "http", Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	assert.Equal(t, httpAddr, l.Addr().String())
+
+	for _, key := range []string{consts.EnvListenFDs, consts.EnvListenPID, consts.EnvListenFDNames} {
+		assert.Empty(t, os.Getenv(key), "%s should be cleared after discovery", key)
+	}
+
+	// Claimed sockets come first, the unclaimed one keeps its name.
+	files, env := sm.ExportFiles()
+	require.Len(t, files, 2)
+	assert.Contains(t, env, consts.EnvFDNames+"=http,admin")
+	assert.Contains(t, env, consts.EnvListenFDNames+"=http:admin")
+	assert.Contains(t, env, consts.EnvFDAddrs+"="+httpAddr+","+admin.Addr().String())
+}
+
+func TestSocketManager_IgnoresListenFDsForAnotherProcess(t *testing.T) {
+	t.Setenv(consts.EnvListenFDs, "1")
+	t.Setenv(consts.EnvListenPID, strconv.Itoa(os.Getpid()+1))
+
+	sm := NewSocketManager()
+	sm.baseFD = 100
+	defer sm.Close()
+
+	files, env := sm.ExportFiles()
+	assert.Empty(t, files)
+	assert.Empty(t, env)
+	assert.Empty(t, os.Getenv(consts.EnvListenFDs))
+}
+
+func TestSocketManager_ExportFilesNamesUnnamedListeners(t *testing.T) {
+	sm := NewSocketManager()
+	defer sm.Close()
+
+	_, err := sm.Listen(ListenerSpec{Name: "main", Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	_, err = sm.EnsureListener("127.0.0.2:0")
+	require.NoError(t, err)
+
+	files, env := sm.ExportFiles()
+	require.Len(t, files, 2)
+	assert.Contains(t, env, consts.EnvListenFDNames+"=main:"+consts.UnnamedFD)
+}
@@ -0,0 +1,131 @@
+package resource
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/turtacn/Aeterna/pkg/consts"
+)
+
+func TestSocketManager_UDPAndTCPOnTheSamePort(t *testing.T) {
+	sm := NewSocketManager()
+	defer sm.Close()
+
+	l, err := sm.Listen(ListenerSpec{Name: "dns-tcp", Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+
+	pc, err := sm.ListenPacket(ListenerSpec{Name: "dns-udp", Network: "udp", Address: addr})
+	require.NoError(t, err, "a UDP socket must not be confused with the TCP listener on the same port")
+	assert.Equal(t, addr, pc.LocalAddr().String())
+
+	again, err := sm.ListenPacket(ListenerSpec{Network: "udp4", Address: addr})
+	require.NoError(t, err)
+	assert.Same(t, pc, again)
+
+	_, err = sm.ListenPacket(ListenerSpec{Network: "tcp", Address: addr})
+	assert.Error(t, err)
+
+	files, env := sm.ExportFiles()
+	require.Len(t, files, 2)
+	assert.Contains(t, env, consts.EnvFDNames+"=dns-tcp,dns-udp")
+}
+
+func TestSocketManager_UnixSockets(t *testing.T) {
+	dir := t.TempDir()
+	stream := filepath.Join(dir, "agent.sock")
+	dgram := filepath.Join(dir, "syslog.sock")
+
+	// A socket file left behind by a dead process must not block the bind.
+	stale, err := net.Listen("unix", stream)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	sm := NewSocketManager()
+	defer sm.Close()
+
+	l, err := sm.Listen(ListenerSpec{Name: "agent", Network: "unix", Address: stream, Backlog: 4})
+	require.NoError(t, err)
+	pc, err := sm.ListenPacket(ListenerSpec{Name: "syslog", Network: "unixgram", Address: dgram})
+	require.NoError(t, err)
+
+	conn, err := net.Dial("unix", stream)
+	require.NoError(t, err)
+	conn.Close()
+	accepted, err := l.Accept()
+	require.NoError(t, err)
+	accepted.Close()
+
+	client, err := net.Dial("unixgram", dgram)
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("<13>hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 64)
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "<13>hello", string(buf[:n]))
+
+	again, err := sm.Listen(ListenerSpec{Network: "unix", Address: stream})
+	require.NoError(t, err)
+	assert.Same(t, l, again)
+	assert.Len(t, sm.GetFiles(), 2)
+}
+
+func TestSocketManager_InheritsPacketAndUnixSockets(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	udpAddr := udp.LocalAddr().String()
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	unix, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	unix.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	for i, s := range []fileSocket{udp.(fileSocket), unix.(fileSocket)} {
+		f, err := s.File()
+		require.NoError(t, err)
+		require.NoError(t, syscall.Dup2(int(f.Fd()), 110+i))
+		f.Close()
+	}
+	udp.Close()
+	unix.Close()
+
+	t.Setenv(consts.EnvInheritedFDs, "2")
+	t.Setenv(consts.EnvFDNames, "dns,agent")
+
+	sm := NewSocketManager()
+	sm.baseFD = 110
+	defer sm.Close()
+
+	// Matched by network and address: a TCP request for the UDP address binds anew.
+	pc, err := sm.ListenPacket(ListenerSpec{Network: "udp", Address: udpAddr})
+	require.NoError(t, err)
+	assert.Equal(t, udpAddr, pc.LocalAddr().String())
+
+	l, err := sm.Listen(ListenerSpec{Network: "unix", Address: path})
+	require.NoError(t, err)
+	assert.Equal(t, path, l.Addr().String())
+
+	_, env := sm.ExportFiles()
+	assert.Contains(t, env, consts.EnvFDNames+"=dns,agent")
+
+	// The inherited packet socket still works.
+	client, err := net.Dial("udp", udpAddr)
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 8)
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf[:n]))
+	assert.Empty(t, os.Getenv(consts.EnvInheritedFDs))
+}
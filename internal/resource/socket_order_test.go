@@ -1,6 +1,8 @@
 package resource
 
 import (
+	"fmt"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -41,3 +43,45 @@ func TestSocketManager_GetFiles_Order_Deterministic(t *testing.T) {
 		assert.Equal(t, orders[0], orders[i], "GetFiles() order should be deterministic")
 	}
 }
+
+func TestSocketManager_GetFiles_RegistrationOrder(t *testing.T) {
+	sm := NewSocketManager()
+	defer sm.Close()
+
+	// Bound out of address order: GetFiles must follow the bind order.
+	addrs := []string{"127.0.0.1:9097", "127.0.0.1:9096", "127.0.0.1:9098"}
+	var ports []int
+	for i, addr := range addrs {
+		l, err := sm.Listen(ListenerSpec{Name: fmt.Sprintf("l%d", i), Address: addr, Backlog: 8})
+		require.NoError(t, err)
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+
+	files := sm.GetFiles()
+	require.Len(t, files, len(addrs))
+	for i, f := range files {
+		l, err := net.FileListener(f)
+		require.NoError(t, err)
+		assert.Equal(t, ports[i], l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+	}
+}
+
+func TestSocketManager_Listen_Validation(t *testing.T) {
+	sm := NewSocketManager()
+	defer sm.Close()
+
+	_, err := sm.Listen(ListenerSpec{Name: "dgram", Network: "udp", Address: "127.0.0.1:0"})
+	assert.Error(t, err)
+
+	l, err := sm.Listen(ListenerSpec{Name: "v4", Network: "tcp4", Address: "127.0.0.1:0", Backlog: 1})
+	require.NoError(t, err)
+
+	// A backlog of one must still accept connections.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	accepted, err := l.Accept()
+	require.NoError(t, err)
+	accepted.Close()
+}
@@ -0,0 +1,133 @@
+package srp
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/turtacn/Aeterna/pkg/consts"
+	"golang.org/x/sys/unix"
+)
+
+// The state socket is only reachable by processes running as the engine's
+// user, but that is not enough: the state carries user conversations, and a
+// sidecar of the same user must neither read nor replace it. The relay
+// therefore checks the credentials the kernel attached to every connection
+// (SO_PEERCRED) against the processes the engine forked, and every peer
+// proves with a random token, handed to its generation in the environment,
+// that it is the process the engine started rather than one that raced it.
+
+// Peer is a process the relay expects in one role of a transfer: the
+// process the engine forked, or one in the process group it leads, so that a
+// wrapper script may run the application as its child.
+type Peer struct {
+	Pid        int
+	Token      string // Empty if the process was not given a token
+	Generation uint64 // Recorded in the snapshot of a state it sends
+}
+
+// NewToken returns a random token for a new generation.
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// peerCred returns the credentials of the process at the other end of conn,
+// as recorded by the kernel when it connected.
+func peerCred(conn *net.UnixConn) (*unix.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var cerr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, cerr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	return cred, cerr
+}
+
+// expected returns the process the relay expects in role, or nil if any
+// process of the engine's user may take it.
+func (sc *StateCoordinator) expected(role string) *Peer {
+	if role == RoleReceiver {
+		return sc.Receiver
+	}
+	return sc.Sender
+}
+
+// authenticate checks that the peer on conn, which introduced itself with
+// hello, is allowed to take its role. On success the Pid of hello is the one
+// reported by the kernel.
+func (sc *StateCoordinator) authenticate(conn *net.UnixConn, hello *Hello) error {
+	if err := checkPeerCred(conn, hello); err != nil {
+		return err
+	}
+	return sc.checkExpected(*hello)
+}
+
+// checkPeerCred checks that the peer on conn runs as the engine's user and
+// group, and records its pid in hello. The pid a peer claims is not trusted:
+// it may also differ from the kernel's if the peer runs in a pid namespace.
+func checkPeerCred(conn *net.UnixConn, hello *Hello) error {
+	cred, err := peerCred(conn)
+	if err != nil {
+		return fmt.Errorf("reading the peer credentials: %w", err)
+	}
+	if int(cred.Uid) != os.Getuid() || int(cred.Gid) != os.Getgid() {
+		return fmt.Errorf("peer runs as uid %d gid %d", cred.Uid, cred.Gid)
+	}
+	hello.Pid = int(cred.Pid)
+	return nil
+}
+
+// PeerPid checks that the peer on conn runs as the engine's user and group,
+// like a peer of the relay, and returns its pid as reported by the kernel.
+func PeerPid(conn *net.UnixConn) (int, error) {
+	var hello Hello
+	if err := checkPeerCred(conn, &hello); err != nil {
+		return 0, err
+	}
+	return hello.Pid, nil
+}
+
+// checkExpected checks that the peer introduced by hello, whose pid has been
+// checked, is the process the relay expects in its role and knows its token.
+func (sc *StateCoordinator) checkExpected(hello Hello) error {
+	return checkPeer(sc.expected(hello.Role), hello)
+}
+
+// checkPeer checks that the peer introduced by hello, whose pid has been
+// checked, is want, or in the process group it leads, and knows its token.
+// Any peer passes if want is nil.
+func checkPeer(want *Peer, hello Hello) error {
+	if want == nil {
+		return nil
+	}
+	if want.Pid != 0 && want.Pid != hello.Pid {
+		if pgid, err := unix.Getpgid(hello.Pid); err != nil || pgid != want.Pid {
+			return fmt.Errorf("pid %d is not the expected %s", hello.Pid, hello.Role)
+		}
+	}
+	if want.Token != "" && subtle.ConstantTimeCompare([]byte(want.Token), []byte(hello.Token)) != 1 {
+		return fmt.Errorf("%s pid %d presented an invalid token", hello.Role, hello.Pid)
+	}
+	return nil
+}
+
+// tokenFromEnv fills in the token of this generation if hello carries none.
+func tokenFromEnv(hello *Hello) {
+	if hello.Token == "" {
+		hello.Token = os.Getenv(consts.EnvStateToken)
+	}
+}
+
+// Personal.AI order the ending
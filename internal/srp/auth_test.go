@@ -0,0 +1,121 @@
+package srp
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/consts"
+	"github.com/turtacn/Aeterna/pkg/srp/wire"
+)
+
+// otherProcess starts a process that leads its own process group, standing
+// in for a generation other than the test itself.
+func otherProcess(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("sleep", "10")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start a process: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return cmd.Process.Pid
+}
+
+func TestRelay_AuthenticatesPeers(t *testing.T) {
+	senderToken, _ := NewToken()
+	receiverToken, _ := NewToken()
+	if len(senderToken) != 64 || senderToken == receiverToken {
+		t.Fatalf("expected distinct random tokens, got %q and %q", senderToken, receiverToken)
+	}
+	sc, relayed := startRelay(t, 2*time.Second, func(sc *StateCoordinator) {
+		sc.Sender = &Peer{Pid: os.Getpid(), Token: senderToken}
+		sc.Receiver = &Peer{Pid: os.Getpid(), Token: receiverToken}
+	})
+
+	// A process that does not know the receiver's token cannot take its place.
+	for _, token := range []string{"", senderToken, receiverToken[:32]} {
+		_, err := ReceiveState(sc.Path(), Hello{Token: token}, 2*time.Second)
+		if err == nil || !strings.Contains(err.Error(), "invalid token") {
+			t.Errorf("expected token %q to be refused, got %v", token, err)
+		}
+	}
+
+	// The token of a generation comes from its environment.
+	t.Setenv(consts.EnvStateToken, receiverToken)
+	received := make(chan *ReceivedState, 1)
+	go func() {
+		rs, err := ReceiveState(sc.Path(), Hello{}, 2*time.Second)
+		if err != nil {
+			t.Errorf("ReceiveState failed: %v", err)
+		}
+		received <- rs
+	}()
+	sent := sendAsync(sc.Path(), Hello{Token: senderToken, Pid: 1}, map[string]interface{}{"turns": 3})
+	rs := <-received
+	if rs == nil {
+		t.FailNow()
+	}
+	rs.Ack()
+	if err := <-sent; err != nil {
+		t.Fatalf("SendState failed: %v", err)
+	}
+	out := <-relayed
+	if out.err != nil {
+		t.Fatalf("Relay failed: %v", out.err)
+	}
+	// The pid comes from the kernel, not from what the peer claims.
+	if out.res.SenderPid != os.Getpid() || out.res.Negotiated.Token != "" {
+		t.Errorf("unexpected result %+v", out.res)
+	}
+}
+
+func TestRelay_RejectsOtherProcesses(t *testing.T) {
+	sc, relayed := startRelay(t, 500*time.Millisecond, func(sc *StateCoordinator) {
+		sc.Sender = &Peer{Pid: otherProcess(t)}
+	})
+
+	// The test is not in the process group of the expected sender.
+	err := SendState(sc.Path(), Hello{}, func(Hello) ([]byte, error) { return []byte("{}"), nil }, 2*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "not the expected sender") {
+		t.Errorf("expected the sender to be refused, got %v", err)
+	}
+	if out := <-relayed; out.err == nil {
+		t.Error("expected the relay to fail without the expected sender")
+	}
+}
+
+func TestStateCoordinator_WaitStateTransfer_RequiresToken(t *testing.T) {
+	token, _ := NewToken()
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"no hello", frames(t, []wire.Type{wire.TypeStateJSON}, `{"turns":3}`), false},
+		{"wrong token", frames(t, []wire.Type{wire.TypeHello, wire.TypeStateJSON}, `{"token":"guess"}`, `{"turns":3}`), false},
+		{"token", frames(t, []wire.Type{wire.TypeHello, wire.TypeStateJSON}, `{"token":"`+token+`"}`, `{"turns":3}`), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socketPath := filepath.Join(t.TempDir(), "srp.sock")
+			sc := NewCoordinator(socketPath)
+			sc.Sender = &Peer{Pid: os.Getpid(), Token: token}
+
+			state, err := transferFrames(t, sc, socketPath, tt.data)
+			if tt.ok && (err != nil || state["turns"] != 3.0) {
+				t.Errorf("expected the state, got %v (%v)", state, err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("expected the sender to be refused")
+			}
+		})
+	}
+}
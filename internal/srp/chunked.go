@@ -0,0 +1,312 @@
+package srp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/logger"
+	"github.com/turtacn/Aeterna/pkg/srp/compress"
+	"github.com/turtacn/Aeterna/pkg/srp/wire"
+)
+
+// A chunked state is streamed as STATE_CHUNK frames followed by a STATE_END
+// frame (see pkg/srp/wire). Neither side needs to hold the whole state, and
+// every step only has to complete within the timeout, so a large transfer is
+// not cut short while it makes progress. If a peer's connection breaks, it
+// reconnects with a new Hello and the transfer resumes: a receiver announces
+// the Offset it has, and the relay tells a sender the Offset to go on from.
+// Offsets count the state data before compression; if a compression was
+// agreed, the data of every chunk is a compressed block of its own.
+
+const (
+	maxResumes    = 8
+	resumeBackoff = 50 * time.Millisecond
+)
+
+// interrupted reports whether err is a broken connection, after which the
+// transfer can resume, rather than a protocol violation or a stalled peer.
+func interrupted(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// relayChunks forwards a chunked state, starting with its first frame. It
+// checks every chunk and waits for a peer whose connection broke to resume.
+// It returns the size of the state and the chunk data relayed.
+func (s *relaySession) relayChunks(ctx context.Context, f wire.Frame) (int64, int64, error) {
+	var forwarded, relayed int64
+	for {
+		var data, sent int64
+		var chunk []byte
+		switch f.Type {
+		case wire.TypeStateChunk:
+			c, err := wire.DecodeChunk(f.Payload)
+			if err != nil {
+				return 0, 0, fmt.Errorf("sender sent a bad chunk: %w", err)
+			}
+			if int64(c.Offset) != forwarded {
+				return 0, 0, fmt.Errorf("sender sent a chunk at offset %d, expected %d", c.Offset, forwarded)
+			}
+			if data, err = blockSize(s.agreed, c.Data); err != nil {
+				return 0, 0, fmt.Errorf("sender sent a bad chunk: %w", err)
+			}
+			if data > int64(s.agreed.ChunkSize) {
+				return 0, 0, fmt.Errorf("sender sent a chunk of %d bytes, larger than the agreed %d", data, s.agreed.ChunkSize)
+			}
+			sent, chunk = int64(len(c.Data)), c.Data
+		case wire.TypeStateEnd:
+			var end wire.End
+			if err := json.Unmarshal(f.Payload, &end); err != nil || end.Size != forwarded {
+				return 0, 0, fmt.Errorf("sender ended the state after %d bytes with %q", forwarded, f.Payload)
+			}
+			s.commitSpill()
+		default:
+			return 0, 0, fmt.Errorf("sender sent a %s frame during a chunked transfer", f.Type)
+		}
+		if len(s.sender.conn.fds) > 0 {
+			return 0, 0, fmt.Errorf("sender passed descriptors with a %s frame", f.Type)
+		}
+
+		rewound, err := s.forward(ctx, f, forwarded)
+		switch {
+		case err != nil:
+			return 0, 0, err
+		case rewound >= 0:
+			forwarded = rewound
+		case f.Type == wire.TypeStateEnd:
+			s.sections.advance(forwarded)
+			return forwarded, relayed, nil
+		default:
+			s.spill.writeBlock(s.agreed, forwarded, chunk)
+			forwarded += data
+			relayed += sent
+			s.sc.progress(TransportChunked, forwarded, s.agreed.Size)
+			s.sections.advance(forwarded)
+		}
+
+		f, err = s.sender.readFrame(s.timeout)
+		for err != nil {
+			if !interrupted(err) {
+				return 0, 0, fmt.Errorf("reading the state: %w", err)
+			}
+			if _, err = s.resume(ctx, RoleSender, err, forwarded); err != nil {
+				return 0, 0, err
+			}
+			f, err = s.sender.readFrame(s.timeout)
+		}
+	}
+}
+
+// forward passes f, which starts at offset, to the receiver. If the receiver
+// has to resume from an earlier offset, the sender is made to resume from
+// there too and forward returns that offset; otherwise it returns -1.
+func (s *relaySession) forward(ctx context.Context, f wire.Frame, offset int64) (int64, error) {
+	for {
+		err := s.receiver.writeFrame(s.timeout, f.Type, f.Payload)
+		if err == nil {
+			return -1, nil
+		}
+		if !interrupted(err) {
+			return 0, fmt.Errorf("forwarding the state: %w", err)
+		}
+		resumed, err := s.resume(ctx, RoleReceiver, err, offset)
+		if err != nil {
+			return 0, err
+		}
+		if resumed < offset {
+			// The receiver lost chunks it had been sent.
+			if _, err := s.resume(ctx, RoleSender, errors.New("rewinding"), resumed); err != nil {
+				return 0, err
+			}
+			return resumed, nil
+		}
+	}
+}
+
+// resume replaces the peer of role by one that reconnects within the timeout
+// and returns the offset the transfer resumes from: the receiver's, which
+// may not exceed offset, or offset for a sender.
+func (s *relaySession) resume(ctx context.Context, role string, cause error, offset int64) (int64, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if s.resumes >= maxResumes {
+		return 0, fmt.Errorf("%s connection lost after %d resumes: %w", role, s.resumes, cause)
+	}
+	s.resumes++
+	logger.Log.Warn("SRP: Connection lost, waiting for the peer to resume", "role", role, "offset", offset, "err", cause)
+
+	s.drop(role)
+	if err := s.connect(ctx); err != nil {
+		return 0, fmt.Errorf("%s connection lost (%v), %w", role, cause, err)
+	}
+	s.mu.Lock()
+	p := *s.slot(role)
+	s.mu.Unlock()
+
+	if role == RoleReceiver {
+		if p.hello.Offset < 0 || p.hello.Offset > offset {
+			err := fmt.Errorf("receiver resumed at offset %d, but %d bytes were sent", p.hello.Offset, offset)
+			p.w.WriteFrame(wire.TypeHello, mustJSON(Hello{Role: RoleRelay, Error: err.Error()}))
+			return 0, err
+		}
+		offset = p.hello.Offset
+	}
+	reply := s.agreed
+	reply.Offset = offset
+	if err := p.writeFrame(s.timeout, wire.TypeHello, mustJSON(reply)); err != nil {
+		return 0, fmt.Errorf("answering the resumed %s: %w", role, err)
+	}
+	return offset, nil
+}
+
+// StreamState hands the size bytes of src to the next generation in chunks,
+// without holding the state in memory. src must already be encoded with a
+// codec the receiver accepts, so hello.Codecs should only name that one.
+// Parts of src are read again if the transfer resumes. Like SendState, it
+// returns nil only once the receiver has acknowledged the state.
+func StreamState(path string, hello Hello, src io.ReaderAt, size int64, timeout time.Duration) error {
+	hello.Role = RoleSender
+	hello.Size = size
+	hello.Transports = []string{TransportChunked}
+	conn, _, w, agreed, err := dialRelay(path, hello, timeout)
+	if err != nil {
+		return err
+	}
+	if err := sendChunked(path, hello, conn, w, agreed, src, size, timeout); err != nil {
+		return err
+	}
+	logger.Log.Info("SRP: State acknowledged by the next generation", "bytes", size, "transport", TransportChunked)
+	return nil
+}
+
+// sendChunked sends src on conn, the connection of a completed handshake,
+// reconnecting to resume the transfer if the connection breaks, and waits
+// for the ACK.
+func sendChunked(path string, hello Hello, conn *rightsConn, w *wire.Writer, agreed Hello, src io.ReaderAt, size int64, timeout time.Duration) error {
+	chunkSize := agreed.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = wire.DefaultChunkSize
+	}
+	buf := make([]byte, chunkSize)
+	digest := wire.NewDigest()
+	comp, err := newCompressor(agreed)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	for resumes := 0; ; resumes++ {
+		err := writeChunks(conn, w, src, size, agreed.Offset, buf, comp, digest, timeout)
+		if err == nil {
+			return awaitAck(conn, wire.NewReader(conn, 0), timeout)
+		}
+		conn.Close()
+		conn.discard()
+		if !interrupted(err) || resumes >= maxResumes {
+			return fmt.Errorf("srp: sending the state: %w", err)
+		}
+		logger.Log.Warn("SRP: State transfer interrupted, resuming", "err", err)
+		time.Sleep(resumeBackoff)
+		if conn, _, w, agreed, err = dialRelay(path, hello, timeout); err != nil {
+			return fmt.Errorf("srp: resuming the state transfer: %w", err)
+		}
+	}
+}
+
+// writeChunks writes src from offset on, then the end frame. At least one
+// chunk is written, so that an empty state is recognized as chunked too. The
+// data of every chunk is compressed with comp, unless it is nil.
+func writeChunks(conn *rightsConn, w *wire.Writer, src io.ReaderAt, size, offset int64, buf []byte, comp *compress.Compressor, digest *wire.Digest, timeout time.Duration) error {
+	if offset < 0 || offset > size {
+		return fmt.Errorf("relay asked to resume at offset %d of %d", offset, size)
+	}
+	for first := true; first || offset < size; first = false {
+		n := int64(len(buf))
+		if rest := size - offset; rest < n {
+			n = rest
+		}
+		data := buf[:n]
+		if k, err := src.ReadAt(data, offset); k < len(data) {
+			return fmt.Errorf("reading the state at offset %d: %w", offset, err)
+		}
+		if err := digest.Write(offset, data); err != nil {
+			return err
+		}
+		refreshDeadline(conn, timeout)
+		if err := w.WriteFrame(wire.TypeStateChunk, wire.EncodeChunk(uint64(offset), block(comp, data))); err != nil {
+			return err
+		}
+		offset += n
+	}
+	refreshDeadline(conn, timeout)
+	return w.WriteFrame(wire.TypeStateEnd, mustJSON(digest.End()))
+}
+
+// receiveChunked writes the chunked state of the agreed transfer that starts
+// with f to sink, reconnecting to resume the transfer if the connection
+// breaks. It returns the connection to acknowledge the state on.
+func receiveChunked(path string, hello, agreed Hello, conn *rightsConn, r *wire.Reader, w *wire.Writer, f wire.Frame, sink io.Writer, timeout time.Duration) (*rightsConn, *wire.Writer, error) {
+	digest := wire.NewDigest()
+	fail := func(err error) (*rightsConn, *wire.Writer, error) {
+		conn.Close()
+		conn.discard()
+		return nil, nil, err
+	}
+
+	for resumes := 0; ; {
+		switch f.Type {
+		case wire.TypeStateChunk:
+			c, err := wire.DecodeChunk(f.Payload)
+			if err != nil {
+				return fail(err)
+			}
+			if int64(c.Offset) != digest.Size() {
+				return fail(fmt.Errorf("srp: chunk at offset %d, expected %d", c.Offset, digest.Size()))
+			}
+			data, err := openBlock(agreed, c.Data, int64(agreed.ChunkSize))
+			if err != nil {
+				return fail(err)
+			}
+			if _, err := sink.Write(data); err != nil {
+				return fail(err)
+			}
+			digest.Write(int64(c.Offset), data)
+		case wire.TypeStateEnd:
+			if err := digest.Verify(f.Payload); err != nil {
+				return fail(err)
+			}
+			return conn, w, nil
+		default:
+			return fail(fmt.Errorf("srp: unexpected %s frame in a chunked state", f.Type))
+		}
+
+		refreshDeadline(conn, timeout)
+		var err error
+		f, err = r.ReadFrame()
+		for err != nil {
+			if !interrupted(err) || resumes >= maxResumes {
+				return fail(fmt.Errorf("srp: receiving the state: %w", err))
+			}
+			resumes++
+			conn.Close()
+			conn.discard()
+			logger.Log.Warn("SRP: State transfer interrupted, resuming", "offset", digest.Size(), "err", err)
+			time.Sleep(resumeBackoff)
+
+			hello.Offset = digest.Size()
+			if conn, r, w, _, err = dialRelay(path, hello, timeout); err != nil {
+				return nil, nil, fmt.Errorf("srp: resuming the state transfer: %w", err)
+			}
+			refreshDeadline(conn, timeout)
+			f, err = r.ReadFrame()
+		}
+	}
+}
+
+// Personal.AI order the ending
@@ -0,0 +1,219 @@
+package srp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/srp/wire"
+)
+
+func randomState(t *testing.T, size int) []byte {
+	t.Helper()
+	state := make([]byte, size)
+	if _, err := rand.Read(state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestRelay_ChunkedTransferReportsProgress(t *testing.T) {
+	state := randomState(t, 10_000)
+	var mu sync.Mutex
+	var progress []int64
+	rs, got, res := transfer(t, state, func(sc *StateCoordinator) {
+		sc.Transport = TransportChunked
+		sc.ChunkSize = 1000
+		sc.Progress = func(transport string, transferred, size int64) {
+			mu.Lock()
+			progress = append(progress, transferred)
+			mu.Unlock()
+		}
+	})
+
+	if rs.Transport != TransportChunked || res.Transport != TransportChunked || res.Negotiated.ChunkSize != 1000 {
+		t.Errorf("expected a chunked transfer, got %s/%s %+v", rs.Transport, res.Transport, res.Negotiated)
+	}
+	if !bytes.Equal(got, state) || res.Bytes != int64(len(state)) {
+		t.Fatalf("state changed in transit: %d bytes received, %d relayed", len(got), res.Bytes)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(progress) != 10 || progress[0] != 1000 || progress[9] != 10_000 {
+		t.Errorf("unexpected progress %v", progress)
+	}
+}
+
+func TestStreamState_ToSink(t *testing.T) {
+	state := randomState(t, 5000)
+	sc, relayed := startRelay(t, 2*time.Second, func(sc *StateCoordinator) { sc.ChunkSize = 512 })
+	sent := make(chan error, 1)
+	go func() {
+		sent <- StreamState(sc.Path(), Hello{}, bytes.NewReader(state), int64(len(state)), 2*time.Second)
+	}()
+
+	var sink bytes.Buffer
+	rs, err := ReceiveStateTo(sc.Path(), Hello{}, &sink, 2*time.Second)
+	if err != nil {
+		t.Fatalf("ReceiveStateTo failed: %v", err)
+	}
+	if rs.Payload != nil || !bytes.Equal(sink.Bytes(), state) || rs.Negotiated.Size != int64(len(state)) {
+		t.Fatalf("expected the state in the sink only, got %d bytes in Payload, %d in the sink", len(rs.Payload), sink.Len())
+	}
+	rs.Ack()
+	if err := <-sent; err != nil {
+		t.Errorf("StreamState failed: %v", err)
+	}
+	if out := <-relayed; out.err != nil || out.res.Transport != TransportChunked {
+		t.Errorf("unexpected relay outcome %+v %v", out.res, out.err)
+	}
+}
+
+// slowReader yields its state slowly, like a state encoded on the fly.
+type slowReader struct {
+	*bytes.Reader
+	delay time.Duration
+}
+
+func (r slowReader) ReadAt(p []byte, off int64) (int, error) {
+	time.Sleep(r.delay)
+	return r.Reader.ReadAt(p, off)
+}
+
+func TestRelay_SlowTransferIsNotCutShort(t *testing.T) {
+	state := randomState(t, 100)
+	timeout := 300 * time.Millisecond
+	sc, relayed := startRelay(t, timeout, func(sc *StateCoordinator) { sc.ChunkSize = 10 })
+	sent := make(chan error, 1)
+	go func() {
+		// 10 chunks take about 1s in total, each well within the timeout.
+		src := slowReader{bytes.NewReader(state), 100 * time.Millisecond}
+		sent <- StreamState(sc.Path(), Hello{}, src, int64(len(state)), timeout)
+	}()
+
+	rs, err := ReceiveState(sc.Path(), Hello{}, timeout)
+	if err != nil {
+		t.Fatalf("ReceiveState failed: %v", err)
+	}
+	if !bytes.Equal(rs.Payload, state) {
+		t.Error("state changed in transit")
+	}
+	rs.Ack()
+	if err := <-sent; err != nil {
+		t.Errorf("StreamState failed: %v", err)
+	}
+	if out := <-relayed; out.err != nil {
+		t.Errorf("Relay failed: %v", out.err)
+	}
+}
+
+func TestRelay_ChunkedResumesAfterSenderDisconnect(t *testing.T) {
+	state := randomState(t, 3000)
+	sc, relayed := startRelay(t, 2*time.Second, func(sc *StateCoordinator) { sc.Transport = TransportChunked })
+	received := make(chan *ReceivedState, 1)
+	go func() {
+		rs, err := ReceiveState(sc.Path(), Hello{}, 2*time.Second)
+		if err != nil {
+			t.Errorf("ReceiveState failed: %v", err)
+		}
+		received <- rs
+	}()
+
+	// The first connection breaks after two chunks.
+	conn, _, w, _, err := dialRelay(sc.Path(), Hello{Role: RoleSender}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dialRelay failed: %v", err)
+	}
+	w.WriteFrame(wire.TypeStateChunk, wire.EncodeChunk(0, state[:1000]))
+	w.WriteFrame(wire.TypeStateChunk, wire.EncodeChunk(1000, state[1000:2000]))
+	conn.Close()
+
+	conn, r, w, agreed, err := dialRelay(sc.Path(), Hello{Role: RoleSender}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("resuming failed: %v", err)
+	}
+	if agreed.Offset != 2000 {
+		t.Fatalf("expected to resume at offset 2000, got %d", agreed.Offset)
+	}
+	digest := wire.NewDigest()
+	digest.Write(0, state[:2000])
+	if err := writeChunks(conn, w, bytes.NewReader(state), int64(len(state)), agreed.Offset, make([]byte, 1000), nil, digest, time.Second); err != nil {
+		t.Fatalf("writeChunks failed: %v", err)
+	}
+
+	rs := <-received
+	if rs == nil {
+		t.FailNow()
+	}
+	if !bytes.Equal(rs.Payload, state) {
+		t.Error("state changed in transit")
+	}
+	rs.Ack()
+	if err := awaitAck(conn, r, time.Second); err != nil {
+		t.Errorf("expected the resumed sender to be acknowledged, got %v", err)
+	}
+	if out := <-relayed; out.err != nil || out.res.Resumes != 1 {
+		t.Errorf("unexpected relay outcome %+v %v", out.res, out.err)
+	}
+}
+
+func TestRelay_ChunkedRewindsForReceiver(t *testing.T) {
+	// Large enough not to fit in the socket buffers, so the relay notices
+	// when the first receiver goes away.
+	state := randomState(t, 4<<20)
+	sc, relayed := startRelay(t, 2*time.Second, func(sc *StateCoordinator) {
+		sc.Transport = TransportChunked
+		sc.ChunkSize = 64 << 10
+	})
+	sent := make(chan error, 1)
+	go func() {
+		sent <- SendState(sc.Path(), Hello{}, func(Hello) ([]byte, error) { return state, nil }, 2*time.Second)
+	}()
+
+	// The first receiver reads a chunk and goes away.
+	conn, r, _, _, err := dialRelay(sc.Path(), Hello{Role: RoleReceiver}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dialRelay failed: %v", err)
+	}
+	if f, err := r.ReadFrame(); err != nil || f.Type != wire.TypeStateChunk {
+		t.Fatalf("expected a chunk, got %v %v", f.Type, err)
+	}
+	conn.Close()
+
+	// A receiver that has nothing makes the sender start over.
+	rs, err := ReceiveState(sc.Path(), Hello{}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("ReceiveState failed: %v", err)
+	}
+	if !bytes.Equal(rs.Payload, state) {
+		t.Error("state changed in transit")
+	}
+	rs.Ack()
+	if err := <-sent; err != nil {
+		t.Errorf("SendState failed: %v", err)
+	}
+	if out := <-relayed; out.err != nil || out.res.Resumes != 2 {
+		t.Errorf("expected the receiver and the sender to resume, got %+v %v", out.res, out.err)
+	}
+}
+
+func TestRelay_ChunkedRejectsCorruptChunk(t *testing.T) {
+	sc, relayed := startRelay(t, 2*time.Second)
+	go ReceiveState(sc.Path(), Hello{}, 2*time.Second)
+
+	conn, _, w, _, err := dialRelay(sc.Path(), Hello{Role: RoleSender}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dialRelay failed: %v", err)
+	}
+	defer conn.Close()
+	chunk := wire.EncodeChunk(0, []byte("state"))
+	chunk[len(chunk)-1] ^= 0x01
+	w.WriteFrame(wire.TypeStateChunk, chunk)
+
+	if out := <-relayed; out.err == nil || !strings.Contains(out.err.Error(), "checksum mismatch") {
+		t.Errorf("expected the relay to refuse the chunk, got %v", out.err)
+	}
+}
@@ -0,0 +1,98 @@
+package srp
+
+import (
+	"fmt"
+
+	"github.com/turtacn/Aeterna/pkg/srp/compress"
+)
+
+// CompressionAuto lets the relay use the compression the peers prefer. Every
+// peer can do without compression, so a compression the peers do not share
+// falls back to none rather than failing the handshake.
+const CompressionAuto = "auto"
+
+// compressions lists the compressions this package implements, in order of
+// preference.
+var compressions = []string{compress.Zstd, compress.Gzip, compress.None}
+
+// restrictCompression picks the compression of the transfer among the ones
+// the peers agreed on, as allowed by the relay's Compression setting, and
+// announces the level and threshold the sender compresses with.
+func (sc *StateCoordinator) restrictCompression(agreed *Hello) error {
+	var allowed []string
+	switch sc.Compression {
+	case "", compress.None:
+	case CompressionAuto:
+		allowed = compress.Algorithms
+	case compress.Zstd, compress.Gzip:
+		allowed = []string{sc.Compression}
+	default:
+		return fmt.Errorf("unknown compression %q", sc.Compression)
+	}
+
+	agreed.Compression = compress.None
+	for _, c := range agreed.Compressions {
+		if contains(allowed, c) {
+			agreed.Compression = c
+			break
+		}
+	}
+	agreed.Compressions = nil
+	agreed.CompressionLevel, agreed.CompressionThreshold = 0, 0
+	if agreed.compressed() {
+		agreed.CompressionLevel = sc.CompressionLevel
+		agreed.CompressionThreshold = sc.CompressionThreshold
+		if agreed.CompressionThreshold <= 0 {
+			agreed.CompressionThreshold = compress.DefaultThreshold
+		}
+	}
+	return nil
+}
+
+// compressed reports whether the state data of the agreed transfer travels in
+// compressed blocks.
+func (h Hello) compressed() bool {
+	return h.Compression != "" && h.Compression != compress.None
+}
+
+// newCompressor returns the compressor a sender uses for the agreed
+// transfer, or nil if the state is not compressed.
+func newCompressor(agreed Hello) (*compress.Compressor, error) {
+	if !agreed.compressed() {
+		return nil, nil
+	}
+	return compress.NewCompressor(agreed.Compression, agreed.CompressionLevel, agreed.CompressionThreshold)
+}
+
+// block returns data as the sender of the agreed transfer sends it.
+func block(comp *compress.Compressor, data []byte) []byte {
+	if comp == nil {
+		return data
+	}
+	return comp.Block(data)
+}
+
+// openBlock returns the state data carried by data, decompressing it if the
+// agreed transfer is compressed. limit bounds the decompressed size if
+// positive.
+func openBlock(agreed Hello, data []byte, limit int64) ([]byte, error) {
+	if !agreed.compressed() {
+		return data, nil
+	}
+	return compress.Open(agreed.Compression, data, limit)
+}
+
+// blockSize returns the size of the state data carried by data, before
+// compression. The relay checks block headers only; receivers check the data.
+func blockSize(agreed Hello, data []byte) (int64, error) {
+	if !agreed.compressed() {
+		return int64(len(data)), nil
+	}
+	h, err := compress.ParseHeader(agreed.Compression, data)
+	if err != nil {
+		return 0, err
+	}
+	return h.Size, nil
+}
+
+// Personal.AI order the ending
@@ -0,0 +1,83 @@
+package srp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/srp/compress"
+)
+
+func TestRelay_CompressesInEveryTransport(t *testing.T) {
+	history := bytes.Repeat([]byte(`{"role":"assistant","content":"Sure, here is the summary."},`), 2000)
+	for _, transport := range []string{TransportStream, TransportMemfd, TransportChunked} {
+		for _, alg := range compress.Algorithms {
+			t.Run(transport+"/"+alg, func(t *testing.T) {
+				rs, got, res := transfer(t, history, func(sc *StateCoordinator) {
+					sc.Transport = transport
+					sc.ChunkSize = 16 << 10
+					sc.Compression = alg
+				})
+				defer rs.Close()
+
+				if res.Negotiated.Compression != alg || rs.Negotiated.CompressionThreshold != compress.DefaultThreshold {
+					t.Errorf("expected %s to be agreed, got %+v", alg, res.Negotiated)
+				}
+				if !bytes.Equal(got, history) || res.Bytes != int64(len(history)) {
+					t.Fatalf("state changed in transit: %d bytes received, %d relayed", len(got), res.Bytes)
+				}
+				if res.WireBytes >= res.Bytes/5 {
+					t.Errorf("expected the state to be compressed, %d of %d bytes relayed", res.WireBytes, res.Bytes)
+				}
+			})
+		}
+	}
+}
+
+func TestRelay_CompressionFallsBackToNone(t *testing.T) {
+	state := bytes.Repeat([]byte("x"), 64<<10)
+	tests := []struct {
+		name    string
+		setting string
+		peers   []string
+	}{
+		{"disabled by default", "", nil},
+		{"peer without compression", CompressionAuto, []string{compress.None}},
+		{"peer without zstd", compress.Zstd, []string{compress.Gzip, compress.None}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, relayed := startRelay(t, 2*time.Second, func(sc *StateCoordinator) { sc.Compression = tt.setting })
+			sent := make(chan error, 1)
+			go func() {
+				sent <- SendState(sc.Path(), Hello{Compressions: tt.peers}, func(Hello) ([]byte, error) { return state, nil }, 2*time.Second)
+			}()
+			rs, err := ReceiveState(sc.Path(), Hello{}, 2*time.Second)
+			if err != nil {
+				t.Fatalf("ReceiveState failed: %v", err)
+			}
+			defer rs.Close()
+			if !bytes.Equal(rs.Payload, state) {
+				t.Error("state changed in transit")
+			}
+			rs.Ack()
+			if err := <-sent; err != nil {
+				t.Fatalf("SendState failed: %v", err)
+			}
+			out := <-relayed
+			if out.err != nil || out.res.Negotiated.Compression != compress.None || out.res.WireBytes != out.res.Bytes {
+				t.Errorf("expected an uncompressed transfer, got %+v %v", out.res, out.err)
+			}
+		})
+	}
+}
+
+func TestRelay_RefusesUnknownCompressionSetting(t *testing.T) {
+	sc, relayed := startRelay(t, 2*time.Second, func(sc *StateCoordinator) { sc.Compression = "lz4" })
+	go SendState(sc.Path(), Hello{}, func(Hello) ([]byte, error) { return nil, nil }, 2*time.Second)
+	go ReceiveState(sc.Path(), Hello{}, 2*time.Second)
+
+	if out := <-relayed; out.err == nil {
+		t.Error("expected the relay to refuse an unknown compression")
+	}
+}
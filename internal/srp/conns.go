@@ -0,0 +1,573 @@
+package srp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/consts"
+	"github.com/turtacn/Aeterna/pkg/logger"
+)
+
+// Connection handoff lets the old process pass its established connections to
+// the new one, so that long-lived streams survive a reload. Both generations
+// talk to the ConnBroker run by the engine: the new process registers as a
+// receiver when it starts, the old process sends its connections when it is
+// drained, and the broker forwards them once both sides are there.
+//
+// Every message on the handoff socket is a 4-byte big-endian length followed
+// by a JSON connMessage. The FDs of the connections it describes travel with
+// it as SCM_RIGHTS ancillary data, in the same order.
+//
+// The connections are those of live clients, so the broker authenticates its
+// peers like the state relay (see auth.go): by SO_PEERCRED and by the token of
+// their generation, against the processes the engine told it to Expect.
+
+const (
+	RoleSender   = "sender"
+	RoleReceiver = "receiver"
+
+	maxConnsPerMessage = 64 // Well below the kernel's SCM_MAX_FD (253)
+	maxConnMessageSize = 1 << 20
+)
+
+// ConnMeta describes a connection handed from the old process to the new one.
+type ConnMeta struct {
+	Network    string `json:"network"` // tcp or unix
+	Local      string `json:"local"`
+	Peer       string `json:"peer"`
+	SessionKey string `json:"session_key,omitempty"` // App-defined, opaque to Aeterna
+}
+
+type connMessage struct {
+	Role  string     `json:"role,omitempty"`  // First message of a peer only
+	Token string     `json:"token,omitempty"` // First message of a peer only
+	Conns []ConnMeta `json:"conns,omitempty"`
+	Done  bool       `json:"done,omitempty"`
+}
+
+// HandoffConn is an established connection handed to the next generation.
+type HandoffConn struct {
+	Conn       net.Conn
+	SessionKey string
+}
+
+// HandedConn is a connection received from the previous generation.
+type HandedConn struct {
+	Conn net.Conn
+	Meta ConnMeta
+}
+
+func writeConnMessage(uc *net.UnixConn, msg connMessage, fds []int) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[4:], payload)
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	n, _, err := uc.WriteMsgUnix(buf, oob, nil)
+	if err == nil && n < len(buf) {
+		_, err = uc.Write(buf[n:])
+	}
+	return err
+}
+
+// readConnMessage reads one message and the FDs attached to it. The FDs are
+// closed again if the message turns out to be invalid.
+func readConnMessage(uc *net.UnixConn) (connMessage, []int, error) {
+	var msg connMessage
+	var fds []int
+	oob := make([]byte, syscall.CmsgSpace(maxConnsPerMessage*4))
+
+	read := func(buf []byte) error {
+		for off := 0; off < len(buf); {
+			n, oobn, flags, _, err := uc.ReadMsgUnix(buf[off:], oob)
+			if oobn > 0 {
+				received, perr := parseRights(oob[:oobn])
+				fds = append(fds, received...)
+				if perr != nil {
+					return perr
+				}
+			}
+			if flags&syscall.MSG_CTRUNC != 0 {
+				return errors.New("srp: too many descriptors in one message")
+			}
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				if off == 0 {
+					return io.EOF
+				}
+				return io.ErrUnexpectedEOF
+			}
+			off += n
+		}
+		return nil
+	}
+
+	fail := func(err error) (connMessage, []int, error) {
+		closeFDs(fds)
+		return connMessage{}, nil, err
+	}
+
+	header := make([]byte, 4)
+	if err := read(header); err != nil {
+		return fail(err)
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxConnMessageSize {
+		return fail(fmt.Errorf("srp: message of %d bytes exceeds the limit", size))
+	}
+	payload := make([]byte, size)
+	if err := read(payload); err != nil {
+		return fail(err)
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return fail(err)
+	}
+	if len(fds) != len(msg.Conns) {
+		return fail(fmt.Errorf("srp: message describes %d connections but carries %d descriptors", len(msg.Conns), len(fds)))
+	}
+	return msg, fds, nil
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
+
+func dialBroker(path string, role string, timeout time.Duration) (*net.UnixConn, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	uc := conn.(*net.UnixConn)
+	if timeout > 0 {
+		uc.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := writeConnMessage(uc, connMessage{Role: role, Token: os.Getenv(consts.EnvStateToken)}, nil); err != nil {
+		uc.Close()
+		return nil, err
+	}
+	return uc, nil
+}
+
+// SendConns passes conns to the broker at path, which forwards them to the
+// next generation. It returns once the broker holds them; the caller still
+// owns conns and should close them, the receiver gets its own copies.
+func SendConns(path string, conns []HandoffConn, timeout time.Duration) error {
+	uc, err := dialBroker(path, RoleSender, timeout)
+	if err != nil {
+		return err
+	}
+	defer uc.Close()
+
+	for start := 0; start < len(conns); start += maxConnsPerMessage {
+		end := start + maxConnsPerMessage
+		if end > len(conns) {
+			end = len(conns)
+		}
+
+		var msg connMessage
+		var files []*os.File
+		for _, hc := range conns[start:end] {
+			fc, ok := hc.Conn.(interface{ File() (*os.File, error) })
+			if !ok {
+				closeFiles(files)
+				return fmt.Errorf("srp: %T cannot be handed off", hc.Conn)
+			}
+			f, err := fc.File()
+			if err != nil {
+				closeFiles(files)
+				return err
+			}
+			files = append(files, f)
+			msg.Conns = append(msg.Conns, ConnMeta{
+				Network:    hc.Conn.LocalAddr().Network(),
+				Local:      hc.Conn.LocalAddr().String(),
+				Peer:       hc.Conn.RemoteAddr().String(),
+				SessionKey: hc.SessionKey,
+			})
+		}
+
+		fds := make([]int, len(files))
+		for i, f := range files {
+			fds[i] = int(f.Fd())
+		}
+		err = writeConnMessage(uc, msg, fds)
+		closeFiles(files)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := writeConnMessage(uc, connMessage{Done: true}, nil); err != nil {
+		return err
+	}
+	reply, fds, err := readConnMessage(uc)
+	closeFDs(fds)
+	if err != nil {
+		return err
+	}
+	if !reply.Done {
+		return errors.New("srp: broker did not confirm the handoff")
+	}
+	logger.Log.Info("SRP: Connections handed off", "count", len(conns))
+	return nil
+}
+
+// ReceiveConns registers with the broker at path and waits until the previous
+// generation has handed over its connections. A zero timeout waits forever.
+func ReceiveConns(path string, timeout time.Duration) ([]HandedConn, error) {
+	uc, err := dialBroker(path, RoleReceiver, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer uc.Close()
+
+	var handed []HandedConn
+	fail := func(err error) ([]HandedConn, error) {
+		for _, hc := range handed {
+			hc.Conn.Close()
+		}
+		return nil, err
+	}
+
+	for {
+		msg, fds, err := readConnMessage(uc)
+		if err != nil {
+			return fail(err)
+		}
+		for i, fd := range fds {
+			f := os.NewFile(uintptr(fd), "conn")
+			conn, err := net.FileConn(f)
+			f.Close()
+			if err != nil {
+				closeFDs(fds[i+1:])
+				return fail(err)
+			}
+			handed = append(handed, HandedConn{Conn: conn, Meta: msg.Conns[i]})
+		}
+		if msg.Done {
+			logger.Log.Info("SRP: Connections received", "count", len(handed))
+			return handed, nil
+		}
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+type handedFile struct {
+	meta ConnMeta
+	file *os.File
+}
+
+// ConnBroker is the engine side of the connection handoff. It holds the
+// connections handed by a sender until a receiver takes them, and drops them
+// if no receiver shows up within the timeout.
+type ConnBroker struct {
+	socketPath string
+	timeout    time.Duration
+
+	mu        sync.Mutex
+	listener  net.Listener
+	sender    *Peer // Expected peers, nil if none
+	receiver  *Peer
+	receivers []connPeer // Waiting receivers, newest last
+	pending   []handedFile
+	expire    *time.Timer
+}
+
+// connPeer is a receiver waiting for connections, as it introduced itself.
+type connPeer struct {
+	conn  *net.UnixConn
+	hello Hello
+}
+
+// NewConnBroker creates a ConnBroker listening on path once started. Handed
+// connections wait up to timeout for a receiver.
+func NewConnBroker(path string, timeout time.Duration) *ConnBroker {
+	if path == "" {
+		path = consts.DefaultConnSocketPath
+	}
+	if timeout <= 0 {
+		timeout = consts.DefaultConnHandoffTimeout
+	}
+	return &ConnBroker{socketPath: path, timeout: timeout}
+}
+
+// Path returns the path of the handoff socket.
+func (b *ConnBroker) Path() string {
+	return b.socketPath
+}
+
+// Expect makes the broker take connections from sender only and hand them
+// to receiver only, the old and the new generation of a reload. A role with
+// no peer expected is refused, as are both until Expect is called.
+func (b *ConnBroker) Expect(sender, receiver *Peer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sender, b.receiver = sender, receiver
+}
+
+// checkExpectedConnPeer checks that the peer introduced by hello, whose pid
+// has been checked, is want.
+func checkExpectedConnPeer(want *Peer, hello Hello) error {
+	if want == nil {
+		return fmt.Errorf("no %s expected", hello.Role)
+	}
+	return checkPeer(want, hello)
+}
+
+// Start binds the handoff socket and serves peers in the background.
+func (b *ConnBroker) Start() error {
+	if _, err := os.Stat(b.socketPath); err == nil {
+		os.Remove(b.socketPath)
+	}
+	l, err := net.Listen("unix", b.socketPath)
+	if err != nil {
+		return err
+	}
+	os.Chmod(b.socketPath, 0600)
+
+	b.mu.Lock()
+	b.listener = l
+	b.mu.Unlock()
+
+	logger.Log.Info("SRP: Connection broker listening", "socket", b.socketPath)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn.(*net.UnixConn))
+		}
+	}()
+	return nil
+}
+
+func (b *ConnBroker) serve(uc *net.UnixConn) {
+	uc.SetReadDeadline(time.Now().Add(b.timeout))
+	msg, fds, err := readConnMessage(uc)
+	if err != nil || len(fds) > 0 {
+		closeFDs(fds)
+		logger.Log.Warn("SRP: Invalid handoff peer", "err", err)
+		uc.Close()
+		return
+	}
+	hello := Hello{Role: msg.Role, Token: msg.Token}
+	if err := checkPeerCred(uc, &hello); err != nil {
+		logger.Log.Warn("SRP: Handoff peer refused", "role", msg.Role, "err", err)
+		uc.Close()
+		return
+	}
+
+	switch msg.Role {
+	case RoleReceiver:
+		// The receiver is checked once connections are there: the engine may
+		// not know the pid of a new process when it registers.
+		uc.SetReadDeadline(time.Time{})
+		b.mu.Lock()
+		b.receivers = append(b.receivers, connPeer{conn: uc, hello: hello})
+		b.deliverLocked()
+		b.mu.Unlock()
+		b.watchReceiver(uc)
+	case RoleSender:
+		b.mu.Lock()
+		err := checkExpectedConnPeer(b.sender, hello)
+		b.mu.Unlock()
+		if err != nil {
+			logger.Log.Warn("SRP: Handoff peer refused", "role", msg.Role, "err", err)
+			uc.Close()
+			return
+		}
+		b.collect(uc)
+	default:
+		logger.Log.Warn("SRP: Unknown handoff role", "role", msg.Role)
+		uc.Close()
+	}
+}
+
+// watchReceiver forgets a receiver that goes away before connections arrive,
+// e.g. a candidate that was rolled back.
+func (b *ConnBroker) watchReceiver(uc *net.UnixConn) {
+	buf := make([]byte, 1)
+	uc.Read(buf)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, r := range b.receivers {
+		if r.conn == uc {
+			b.receivers = append(b.receivers[:i], b.receivers[i+1:]...)
+			break
+		}
+	}
+	uc.Close()
+}
+
+// collect reads the connections of a sender and queues them for delivery.
+func (b *ConnBroker) collect(uc *net.UnixConn) {
+	defer uc.Close()
+
+	var handed []handedFile
+	for {
+		uc.SetReadDeadline(time.Now().Add(b.timeout))
+		msg, fds, err := readConnMessage(uc)
+		if err != nil {
+			logger.Log.Warn("SRP: Connection handoff from sender failed", "err", err)
+			for _, h := range handed {
+				h.file.Close()
+			}
+			return
+		}
+		for i, fd := range fds {
+			handed = append(handed, handedFile{meta: msg.Conns[i], file: os.NewFile(uintptr(fd), "conn")})
+		}
+		if msg.Done {
+			break
+		}
+	}
+	if err := writeConnMessage(uc, connMessage{Done: true}, nil); err != nil {
+		logger.Log.Warn("SRP: Failed to confirm handoff to sender", "err", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(b.pending, handed...)
+	logger.Log.Info("SRP: Connections handed by the old process", "count", len(handed), "pending", len(b.pending))
+	b.deliverLocked()
+	if len(b.pending) > 0 && b.expire == nil {
+		b.expire = time.AfterFunc(b.timeout, b.expirePending)
+	}
+}
+
+// deliverLocked hands the pending connections to the newest live receiver
+// that is the one expected.
+func (b *ConnBroker) deliverLocked() {
+	for len(b.pending) > 0 && len(b.receivers) > 0 {
+		r := b.receivers[len(b.receivers)-1]
+		b.receivers = b.receivers[:len(b.receivers)-1]
+		uc := r.conn
+		if err := checkExpectedConnPeer(b.receiver, r.hello); err != nil {
+			logger.Log.Warn("SRP: Handoff peer refused", "role", RoleReceiver, "err", err)
+			uc.Close()
+			continue
+		}
+
+		err := b.send(uc, b.pending)
+		uc.Close()
+		if err != nil {
+			logger.Log.Warn("SRP: Receiver went away during handoff", "err", err)
+			continue
+		}
+
+		logger.Log.Info("SRP: Connections delivered to the new process", "count", len(b.pending))
+		for _, h := range b.pending {
+			h.file.Close()
+		}
+		b.pending = nil
+		if b.expire != nil {
+			b.expire.Stop()
+			b.expire = nil
+		}
+	}
+}
+
+func (b *ConnBroker) send(uc *net.UnixConn, handed []handedFile) error {
+	uc.SetWriteDeadline(time.Now().Add(b.timeout))
+	for start := 0; start < len(handed); start += maxConnsPerMessage {
+		end := start + maxConnsPerMessage
+		if end > len(handed) {
+			end = len(handed)
+		}
+		var msg connMessage
+		var fds []int
+		for _, h := range handed[start:end] {
+			msg.Conns = append(msg.Conns, h.meta)
+			fds = append(fds, int(h.file.Fd()))
+		}
+		if err := writeConnMessage(uc, msg, fds); err != nil {
+			return err
+		}
+	}
+	return writeConnMessage(uc, connMessage{Done: true}, nil)
+}
+
+func (b *ConnBroker) expirePending() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.pending) > 0 {
+		logger.Log.Warn("SRP: No new process took the handed connections, dropping them", "count", len(b.pending))
+	}
+	for _, h := range b.pending {
+		h.file.Close()
+	}
+	b.pending = nil
+	b.expire = nil
+}
+
+// Close stops the broker, drops connections nobody took and removes the socket file.
+func (b *ConnBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.listener != nil {
+		b.listener.Close()
+		b.listener = nil
+	}
+	for _, r := range b.receivers {
+		r.conn.Close()
+	}
+	b.receivers = nil
+	for _, h := range b.pending {
+		h.file.Close()
+	}
+	b.pending = nil
+	if b.expire != nil {
+		b.expire.Stop()
+		b.expire = nil
+	}
+
+	if err := os.Remove(b.socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Personal.AI order the ending
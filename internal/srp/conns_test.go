@@ -0,0 +1,252 @@
+package srp
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/consts"
+)
+
+// tcpPair returns both ends of an established TCP connection.
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func startBroker(t *testing.T, timeout time.Duration) *ConnBroker {
+	t.Helper()
+	b := NewConnBroker(filepath.Join(t.TempDir(), "conns.sock"), timeout)
+	if err := b.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	// The test plays both generations.
+	b.Expect(&Peer{Pid: os.Getpid()}, &Peer{Pid: os.Getpid()})
+	return b
+}
+
+func receiveAsync(path string) <-chan []HandedConn {
+	ch := make(chan []HandedConn, 1)
+	go func() {
+		handed, err := ReceiveConns(path, 5*time.Second)
+		if err != nil {
+			handed = nil
+		}
+		ch <- handed
+	}()
+	return ch
+}
+
+// assertServes checks that the handed connection still talks to the client.
+func assertServes(t *testing.T, client net.Conn, handed net.Conn) {
+	t.Helper()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	handed.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("client write failed: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(handed, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("handed conn read %q, %v", buf, err)
+	}
+	if _, err := handed.Write([]byte("pong")); err != nil {
+		t.Fatalf("handed conn write failed: %v", err)
+	}
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("client read %q, %v", buf, err)
+	}
+}
+
+func TestConnBroker_ReceiverWaitsForSender(t *testing.T) {
+	b := startBroker(t, 2*time.Second)
+	client, server := tcpPair(t)
+
+	received := receiveAsync(b.Path())
+	time.Sleep(50 * time.Millisecond)
+
+	if err := SendConns(b.Path(), []HandoffConn{{Conn: server, SessionKey: "session-42"}}, time.Second); err != nil {
+		t.Fatalf("SendConns failed: %v", err)
+	}
+	// The old process lets go of its copy.
+	server.Close()
+
+	handed := <-received
+	if len(handed) != 1 {
+		t.Fatalf("expected 1 handed connection, got %d", len(handed))
+	}
+	defer handed[0].Conn.Close()
+
+	meta := handed[0].Meta
+	if meta.SessionKey != "session-42" || meta.Network != "tcp" || meta.Peer != client.LocalAddr().String() {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+	assertServes(t, client, handed[0].Conn)
+}
+
+func TestConnBroker_SenderBeforeReceiver(t *testing.T) {
+	b := startBroker(t, 2*time.Second)
+
+	var clients []net.Conn
+	var conns []HandoffConn
+	// More connections than fit in a single message
+	for i := 0; i < maxConnsPerMessage+3; i++ {
+		client, server := tcpPair(t)
+		clients = append(clients, client)
+		conns = append(conns, HandoffConn{Conn: server})
+	}
+	if err := SendConns(b.Path(), conns, time.Second); err != nil {
+		t.Fatalf("SendConns failed: %v", err)
+	}
+	for _, hc := range conns {
+		hc.Conn.Close()
+	}
+
+	handed := <-receiveAsync(b.Path())
+	if len(handed) != len(conns) {
+		t.Fatalf("expected %d handed connections, got %d", len(conns), len(handed))
+	}
+	for i, hc := range handed {
+		defer hc.Conn.Close()
+		if hc.Meta.Peer != clients[i].LocalAddr().String() {
+			t.Fatalf("connection %d out of order: %+v", i, hc.Meta)
+		}
+	}
+	assertServes(t, clients[len(clients)-1], handed[len(handed)-1].Conn)
+}
+
+func TestConnBroker_SkipsReceiverThatWentAway(t *testing.T) {
+	b := startBroker(t, 2*time.Second)
+	client, server := tcpPair(t)
+
+	// A candidate that registers and is then rolled back
+	gone, err := dialBroker(b.Path(), RoleReceiver, time.Second)
+	if err != nil {
+		t.Fatalf("dialBroker failed: %v", err)
+	}
+	received := receiveAsync(b.Path())
+	time.Sleep(50 * time.Millisecond)
+	gone.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := SendConns(b.Path(), []HandoffConn{{Conn: server}}, time.Second); err != nil {
+		t.Fatalf("SendConns failed: %v", err)
+	}
+	server.Close()
+
+	handed := <-received
+	if len(handed) != 1 {
+		t.Fatalf("expected the live receiver to get the connection, got %d", len(handed))
+	}
+	defer handed[0].Conn.Close()
+	assertServes(t, client, handed[0].Conn)
+}
+
+func TestConnBroker_DropsConnectionsWithoutReceiver(t *testing.T) {
+	b := startBroker(t, 100*time.Millisecond)
+	client, server := tcpPair(t)
+
+	if err := SendConns(b.Path(), []HandoffConn{{Conn: server}}, time.Second); err != nil {
+		t.Fatalf("SendConns failed: %v", err)
+	}
+	server.Close()
+
+	// Once the broker gives up, the peer sees the connection close.
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF after the handoff expired, got %v", err)
+	}
+}
+
+func TestConnBroker_RejectsMissingDescriptors(t *testing.T) {
+	broker := startBroker(t, time.Second)
+	uc, err := dialBroker(broker.Path(), RoleSender, time.Second)
+	if err != nil {
+		t.Fatalf("dialBroker failed: %v", err)
+	}
+	defer uc.Close()
+
+	// Describes a connection but attaches no descriptor: the broker hangs up.
+	if err := writeConnMessage(uc, connMessage{Conns: []ConnMeta{{Network: "tcp"}}}, nil); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if _, _, err := readConnMessage(uc); err == nil {
+		t.Error("expected the broker to reject the message")
+	}
+}
+
+func TestConnBroker_AuthenticatesPeers(t *testing.T) {
+	b := startBroker(t, 2*time.Second)
+	senderToken, _ := NewToken()
+	receiverToken, _ := NewToken()
+	b.Expect(&Peer{Pid: os.Getpid(), Token: senderToken}, &Peer{Pid: os.Getpid(), Token: receiverToken})
+	client, server := tcpPair(t)
+
+	t.Setenv(consts.EnvStateToken, receiverToken)
+	received := receiveAsync(b.Path())
+	time.Sleep(50 * time.Millisecond)
+	// A process of the same user registering last does not get the
+	// connections without the token of the new generation.
+	t.Setenv(consts.EnvStateToken, "guess")
+	impostor := receiveAsync(b.Path())
+	time.Sleep(50 * time.Millisecond)
+
+	t.Setenv(consts.EnvStateToken, receiverToken)
+	if err := SendConns(b.Path(), []HandoffConn{{Conn: server}}, time.Second); err == nil {
+		t.Fatal("expected a sender without the token of the old generation to be refused")
+	}
+	t.Setenv(consts.EnvStateToken, senderToken)
+	if err := SendConns(b.Path(), []HandoffConn{{Conn: server}}, time.Second); err != nil {
+		t.Fatalf("SendConns failed: %v", err)
+	}
+	server.Close()
+
+	if handed := <-impostor; len(handed) != 0 {
+		t.Errorf("expected the impostor to be refused, got %d connections", len(handed))
+	}
+	handed := <-received
+	if len(handed) != 1 {
+		t.Fatalf("expected the new generation to get the connection, got %d", len(handed))
+	}
+	defer handed[0].Conn.Close()
+	assertServes(t, client, handed[0].Conn)
+}
+
+func TestConnBroker_RefusesUnexpectedRoles(t *testing.T) {
+	b := NewConnBroker(filepath.Join(t.TempDir(), "conns.sock"), time.Second)
+	if err := b.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	_, server := tcpPair(t)
+
+	if err := SendConns(b.Path(), []HandoffConn{{Conn: server}}, time.Second); err == nil {
+		t.Error("expected the sender to be refused before any generation is expected")
+	}
+	b.Expect(nil, &Peer{Pid: otherProcess(t)})
+	if err := SendConns(b.Path(), []HandoffConn{{Conn: server}}, time.Second); err == nil {
+		t.Error("expected the sender to be refused with no old generation")
+	}
+}
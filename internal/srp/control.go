@@ -0,0 +1,138 @@
+package srp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/consts"
+	"github.com/turtacn/Aeterna/pkg/srp/wire"
+	"golang.org/x/sys/unix"
+)
+
+// In broker mode every process gets one end of a socket pair as its control
+// FD (AETERNA_CONTROL_FD). Aeterna writes a STATE_REQUEST frame on it when it
+// wants the process's state; the process answers by sending its state to the
+// state socket, as it does on the state signal in relay mode. The channel
+// belongs to the pair alone, so no other process can trigger a dump, and the
+// process needs no signal handler.
+
+// Reasons given in a StateRequest.
+const (
+	RequestReload     = "reload"
+	RequestCheckpoint = "checkpoint"
+)
+
+// StateRequest is the payload of a STATE_REQUEST frame.
+type StateRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Control is Aeterna's end of the control channel of a process.
+type Control struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *wire.Writer
+}
+
+// NewControl returns Aeterna's end of a new control channel and the end to
+// pass to the process, which the caller closes once the process is started.
+func NewControl() (*Control, *os.File, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return AdoptControl(fds[0]), os.NewFile(uintptr(fds[1]), "aeterna-control"), nil
+}
+
+// AdoptControl returns the Control of fd, Aeterna's end of a control
+// channel inherited across an upgrade.
+func AdoptControl(fd int) *Control {
+	// Non-blocking, so that writes honor deadlines.
+	unix.SetNonblock(fd, true)
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "aeterna-control")
+	return &Control{f: f, w: wire.NewWriter(f, 0)}
+}
+
+// Fd returns the descriptor of Aeterna's end, leaving it non-blocking.
+func (c *Control) Fd() int {
+	fd := -1
+	if raw, err := c.f.SyscallConn(); err == nil {
+		raw.Control(func(s uintptr) { fd = int(s) })
+	}
+	return fd
+}
+
+// RequestState asks the process for its state. It fails if the process has
+// exited or does not take the request within timeout.
+func (c *Control) RequestState(reason string, timeout time.Duration) error {
+	if c == nil {
+		return fmt.Errorf("srp: no control channel")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if timeout > 0 {
+		c.f.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	return c.w.WriteFrame(wire.TypeStateRequest, mustJSON(StateRequest{Reason: reason}))
+}
+
+// Close closes Aeterna's end; the process reads EOF.
+func (c *Control) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.f.Close()
+}
+
+// ControlClient is a process's end of its control channel.
+type ControlClient struct {
+	f *os.File
+	r *wire.Reader
+}
+
+// OpenControl returns the control channel named by AETERNA_CONTROL_FD, or
+// nil if Aeterna did not give the process one.
+func OpenControl() (*ControlClient, error) {
+	value := os.Getenv(consts.EnvControlFD)
+	if value == "" {
+		return nil, nil
+	}
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("srp: invalid %s: %w", consts.EnvControlFD, err)
+	}
+	// The processes this one starts must not take requests meant for it.
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "aeterna-control")
+	return &ControlClient{f: f, r: wire.NewReader(f, 0)}, nil
+}
+
+// Next waits for the next state request. It returns io.EOF once Aeterna has
+// closed the channel.
+func (c *ControlClient) Next() (StateRequest, error) {
+	var req StateRequest
+	f, err := c.r.ReadFrame()
+	if err != nil {
+		return req, err
+	}
+	if f.Type != wire.TypeStateRequest {
+		return req, fmt.Errorf("srp: unexpected %s frame on the control channel", f.Type)
+	}
+	if err := json.Unmarshal(f.Payload, &req); err != nil {
+		return req, fmt.Errorf("srp: malformed state request: %w", err)
+	}
+	return req, nil
+}
+
+// Close closes the process's end of the channel.
+func (c *ControlClient) Close() error {
+	return c.f.Close()
+}
+
+// Personal.AI order the ending
@@ -0,0 +1,74 @@
+package srp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/consts"
+)
+
+func TestControl_RequestsState(t *testing.T) {
+	ctl, child, err := NewControl()
+	if err != nil {
+		t.Fatalf("NewControl failed: %v", err)
+	}
+	defer ctl.Close()
+	// OpenControl takes the FD over, as a process does its inherited one.
+	fd, err := syscall.Dup(int(child.Fd()))
+	child.Close()
+	if err != nil {
+		t.Fatalf("Dup failed: %v", err)
+	}
+	t.Setenv(consts.EnvControlFD, strconv.Itoa(fd))
+	cc, err := OpenControl()
+	if err != nil || cc == nil {
+		t.Fatalf("OpenControl failed: %v", err)
+	}
+	defer cc.Close()
+
+	for _, reason := range []string{RequestReload, RequestCheckpoint} {
+		if err := ctl.RequestState(reason, time.Second); err != nil {
+			t.Fatalf("RequestState failed: %v", err)
+		}
+		if req, err := cc.Next(); err != nil || req.Reason != reason {
+			t.Errorf("expected a %s request, got %+v (%v)", reason, req, err)
+		}
+	}
+
+	ctl.Close()
+	if _, err := cc.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF once Aeterna closed the channel, got %v", err)
+	}
+}
+
+func TestControl_RequestTimesOut(t *testing.T) {
+	ctl, child, err := NewControl()
+	if err != nil {
+		t.Fatalf("NewControl failed: %v", err)
+	}
+	defer ctl.Close()
+	defer child.Close()
+
+	// A process that never reads its control FD does not block Aeterna.
+	for i := 0; i < 1<<20; i++ {
+		if err := ctl.RequestState(RequestCheckpoint, 10*time.Millisecond); err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("expected a timeout, got %v", err)
+			}
+			return
+		}
+	}
+	t.Fatal("expected the requests to time out")
+}
+
+func TestOpenControl_WithoutChannel(t *testing.T) {
+	t.Setenv(consts.EnvControlFD, "")
+	if cc, err := OpenControl(); cc != nil || err != nil {
+		t.Errorf("expected no control channel, got %v (%v)", cc, err)
+	}
+}
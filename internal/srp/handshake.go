@@ -0,0 +1,862 @@
+package srp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/logger"
+	"github.com/turtacn/Aeterna/pkg/srp/codec"
+	"github.com/turtacn/Aeterna/pkg/srp/compress"
+	"github.com/turtacn/Aeterna/pkg/srp/wire"
+	"golang.org/x/sys/unix"
+)
+
+// During a reload the engine relays the state of the old process to the new
+// one. Both connect to the state socket and introduce themselves with a Hello
+// frame; the engine answers both with the negotiated parameters, forwards the
+// sender's state frame to the receiver and passes the receiver's ACK back.
+// The receiver only acknowledges once the application has loaded the state,
+// so the old process is not drained before its state is safe.
+
+// RoleRelay identifies the engine in the Hello frames it sends.
+const RoleRelay = "aeterna"
+
+// maxPrealloc bounds the memory reserved up front for a chunked state of the
+// announced size; a larger state grows the buffer as its chunks arrive.
+const maxPrealloc = 64 << 20
+
+// Hello is the JSON payload of a Hello frame. Peers list what they support;
+// the engine answers with the negotiated Version, Codec and SchemaVersion, or
+// with Error if they cannot agree.
+type Hello struct {
+	Role          string   `json:"role"`
+	Pid           int      `json:"pid,omitempty"`
+	Versions      []uint8  `json:"versions,omitempty"`     // Default [1]
+	Codecs        []string `json:"codecs,omitempty"`       // Registered in pkg/srp/codec, in order of preference, default ["json"]
+	SchemaVersion int      `json:"schema_version"`         // Written by the sender, highest readable by the receiver
+	Transports    []string `json:"transports,omitempty"`   // Default ["stream"]
+	Size          int64    `json:"size,omitempty"`         // Size of the state, if the sender knows it up front
+	Offset        int64    `json:"offset,omitempty"`       // Where a chunked transfer resumes
+	Compressions  []string `json:"compressions,omitempty"` // In order of preference, default ["none"]
+	Token         string   `json:"token,omitempty"`        // From AETERNA_STATE_TOKEN, never sent back
+	// Sections lists the sections of a sectioned state (see sections.go); the
+	// relay answers with them in sending order. A receiver that accepts such
+	// a state sets Sectioned, and lists the sections it holds in Have, by
+	// name, with their hex SHA-256.
+	Sections  []SectionInfo     `json:"sections,omitempty"`
+	Sectioned bool              `json:"sectioned,omitempty"`
+	Have      map[string]string `json:"have,omitempty"`
+	// A receiver may name in Schemas the exact schema version it needs of
+	// a section ("" for a whole state), and lists in Migrations the steps it
+	// runs itself (see migrate.go).
+	Schemas    map[string]int `json:"schemas,omitempty"`
+	Migrations []Migration    `json:"migrations,omitempty"`
+
+	Version              uint8  `json:"version,omitempty"`
+	Codec                string `json:"codec,omitempty"`
+	MemfdThreshold       int64  `json:"memfd_threshold,omitempty"` // State size from which the sender avoids the stream transport
+	ChunkSize            int    `json:"chunk_size,omitempty"`      // Largest chunk of a chunked transfer
+	Compression          string `json:"compression,omitempty"`     // Of the state data, see pkg/srp/compress
+	CompressionLevel     int    `json:"compression_level,omitempty"`
+	CompressionThreshold int    `json:"compression_threshold,omitempty"` // Data size below which blocks are stored
+	Error                string `json:"error,omitempty"`
+}
+
+func (h Hello) versions() []uint8 {
+	if len(h.Versions) == 0 {
+		return []uint8{wire.Version}
+	}
+	return h.Versions
+}
+
+func (h Hello) codecs() []string {
+	if len(h.Codecs) == 0 {
+		return []string{codec.JSON}
+	}
+	return h.Codecs
+}
+
+func (h Hello) compressions() []string {
+	if len(h.Compressions) == 0 {
+		return []string{compress.None}
+	}
+	return h.Compressions
+}
+
+func (h Hello) transports() []string {
+	if len(h.Transports) == 0 {
+		return []string{TransportStream}
+	}
+	return h.Transports
+}
+
+// Negotiate agrees on the parameters of a transfer: the highest protocol
+// version all three parties speak, the sender's most preferred codec that the
+// receiver can decode, the transports and compressions both support, and the
+// sender's schema versions, which the receiver must read or be able to migrate
+// from. The relay then picks the transports and the compression it allows.
+func Negotiate(sender, receiver Hello) (Hello, error) {
+	if sender.Size < 0 {
+		return Hello{}, fmt.Errorf("sender announces a state of %d bytes", sender.Size)
+	}
+	agreed := Hello{Role: RoleRelay, SchemaVersion: sender.SchemaVersion, Size: sender.Size}
+
+	for _, v := range sender.versions() {
+		if v == wire.Version && contains(receiver.versions(), v) && v > agreed.Version {
+			agreed.Version = v
+		}
+	}
+	if agreed.Version == 0 {
+		return Hello{}, fmt.Errorf("no common protocol version (sender %v, receiver %v, relay [%d])",
+			sender.versions(), receiver.versions(), wire.Version)
+	}
+
+	for _, c := range sender.codecs() {
+		if _, known := codec.Get(c); known && contains(receiver.codecs(), c) {
+			agreed.Codec = c
+			break
+		}
+	}
+	if agreed.Codec == "" {
+		return Hello{}, fmt.Errorf("no common codec (sender %v, receiver %v)", sender.codecs(), receiver.codecs())
+	}
+
+	for _, t := range sender.transports() {
+		if contains(transports, t) && contains(receiver.transports(), t) && !contains(agreed.Transports, t) {
+			agreed.Transports = append(agreed.Transports, t)
+		}
+	}
+	if len(agreed.Transports) == 0 {
+		return Hello{}, fmt.Errorf("no common transport (sender %v, receiver %v)", sender.transports(), receiver.transports())
+	}
+
+	for _, c := range sender.compressions() {
+		if compress.Known(c) && contains(receiver.compressions(), c) && !contains(agreed.Compressions, c) {
+			agreed.Compressions = append(agreed.Compressions, c)
+		}
+	}
+
+	if len(sender.Sections) == 0 {
+		if err := checkSchema(receiver, "", sender.SchemaVersion); err != nil {
+			return Hello{}, err
+		}
+		return agreed, nil
+	}
+	if !receiver.Sectioned {
+		return Hello{}, errors.New("the receiver does not accept a state in sections")
+	}
+	var err error
+	if agreed.Sections, agreed.Size, err = orderSections(sender.Sections, receiver.Have); err != nil {
+		return Hello{}, err
+	}
+	for _, s := range agreed.Sections {
+		// The receiver holds an unchanged section at its own version.
+		if !s.Unchanged {
+			if err := checkSchema(receiver, s.Name, s.SchemaVersion); err != nil {
+				return Hello{}, err
+			}
+		}
+	}
+	return agreed, nil
+}
+
+func contains[T comparable](list []T, v T) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// RelayResult describes a completed state transfer.
+type RelayResult struct {
+	Negotiated  Hello
+	SenderPid   int
+	ReceiverPid int
+	Transport   string
+	Bytes       int64         // Size of the state
+	WireBytes   int64         // State data relayed, after compression
+	Resumes     int           // Times a peer reconnected during a chunked transfer
+	Sections    []SectionStat // Of a sectioned state, in sending order
+}
+
+// statePeer is a peer connected to the relay, after its Hello frame.
+type statePeer struct {
+	conn  *rightsConn
+	hello Hello
+	r     *wire.Reader
+	w     *wire.Writer
+}
+
+// readFrame reads the next frame, giving the peer timeout to send it.
+func (p *statePeer) readFrame(timeout time.Duration) (wire.Frame, error) {
+	if timeout > 0 {
+		p.conn.SetDeadline(time.Now().Add(timeout))
+	}
+	return p.r.ReadFrame()
+}
+
+// writeFrame writes a frame, giving the peer timeout to take it.
+func (p *statePeer) writeFrame(timeout time.Duration, t wire.Type, payload []byte) error {
+	if timeout > 0 {
+		p.conn.SetDeadline(time.Now().Add(timeout))
+	}
+	return p.w.WriteFrame(t, payload)
+}
+
+// relaySession is a transfer in progress. Its peers change when one of them
+// reconnects to resume a chunked transfer.
+type relaySession struct {
+	sc       *StateCoordinator
+	peers    <-chan *statePeer
+	timeout  time.Duration
+	agreed   Hello
+	resumes  int
+	spill    *snapshotWriter // nil unless the state is spilled
+	snapshot *Snapshot       // Once the spilled state is complete
+	sections *sectionTracker
+
+	mu       sync.Mutex
+	sender   *statePeer
+	receiver *statePeer
+	closed   bool
+}
+
+// slot returns the field holding the peer of role. s.mu must be held.
+func (s *relaySession) slot(role string) **statePeer {
+	if role == RoleReceiver {
+		return &s.receiver
+	}
+	return &s.sender
+}
+
+// drop disconnects the peer of role, if any.
+func (s *relaySession) drop(role string) {
+	s.mu.Lock()
+	p := *s.slot(role)
+	*s.slot(role) = nil
+	s.mu.Unlock()
+	if p != nil {
+		p.conn.Close()
+		p.conn.discard()
+	}
+}
+
+// closePeers unblocks the reads and writes on the peers when the transfer
+// ends or is aborted. Peers that connect afterwards are closed right away.
+func (s *relaySession) closePeers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, p := range []*statePeer{s.sender, s.receiver} {
+		if p != nil {
+			p.conn.Close()
+		}
+	}
+}
+
+// connect waits until both a sender and a receiver are connected, refusing
+// any second peer of the same role.
+func (s *relaySession) connect(ctx context.Context) error {
+	var timer <-chan time.Time
+	if s.timeout > 0 {
+		t := time.NewTimer(s.timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	for {
+		s.mu.Lock()
+		missing := ""
+		if s.sender == nil {
+			missing = RoleSender
+		} else if s.receiver == nil {
+			missing = RoleReceiver
+		}
+		s.mu.Unlock()
+		if missing == "" {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for the %s: %w", missing, ctx.Err())
+		case <-timer:
+			return fmt.Errorf("waiting for the %s: %w", missing, context.DeadlineExceeded)
+		case p := <-s.peers:
+			s.mu.Lock()
+			slot := s.slot(p.hello.Role)
+			taken := *slot != nil
+			slotted := !taken && !s.closed
+			if slotted {
+				*slot = p
+			}
+			s.mu.Unlock()
+			if slotted && p.hello.Role == RoleReceiver && s.sc.Receiving != nil {
+				s.sc.Receiving(p.hello)
+			}
+			if taken {
+				p.w.WriteFrame(wire.TypeHello, mustJSON(Hello{Role: RoleRelay, Error: "another " + p.hello.Role + " is already connected"}))
+			}
+			if taken || s.closed {
+				p.conn.Close()
+				p.conn.discard()
+			}
+		}
+	}
+}
+
+// Relay runs one state transfer on l, which it closes, removing the socket,
+// before returning. It returns once the receiver has acknowledged the state,
+// the transfer failed or ctx was canceled. timeout bounds the wait for the
+// peers and every step of the transfer, but not the transfer as a whole: a
+// chunked transfer may take as long as it needs while it makes progress.
+func (sc *StateCoordinator) Relay(ctx context.Context, l net.Listener, timeout time.Duration) (*RelayResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	peers := make(chan *statePeer)
+	go sc.acceptPeers(ctx, l, timeout, peers)
+
+	s := &relaySession{sc: sc, peers: peers, timeout: timeout}
+	defer func() {
+		l.Close()
+		os.Remove(sc.socketPath)
+		s.drop(RoleSender)
+		s.drop(RoleReceiver)
+	}()
+
+	// Stop accepting and unblock the peers when the transfer ends or is aborted.
+	stopAccept := context.AfterFunc(ctx, func() { l.Close() })
+	defer stopAccept()
+	stop := context.AfterFunc(ctx, s.closePeers)
+	defer stop()
+
+	if err := s.connect(ctx); err != nil {
+		return nil, err
+	}
+
+	agreed, err := Negotiate(s.sender.hello, s.receiver.hello)
+	if err == nil {
+		err = sc.restrictTransports(&agreed)
+	}
+	if err == nil {
+		err = sc.restrictCompression(&agreed)
+	}
+	if err != nil {
+		reply := mustJSON(Hello{Role: RoleRelay, Error: err.Error()})
+		s.sender.w.WriteFrame(wire.TypeHello, reply)
+		s.receiver.w.WriteFrame(wire.TypeHello, reply)
+		return nil, err
+	}
+	s.agreed = agreed
+	reply := mustJSON(agreed)
+	for _, p := range []*statePeer{s.sender, s.receiver} {
+		if err := p.writeFrame(timeout, wire.TypeHello, reply); err != nil {
+			return nil, fmt.Errorf("answering the %s: %w", p.hello.Role, relayErr(ctx, err))
+		}
+	}
+	logger.Log.Info("SRP: Handshake complete", "version", agreed.Version, "codec", agreed.Codec,
+		"schema_version", agreed.SchemaVersion, "transports", agreed.Transports, "compression", agreed.Compression,
+		"sender_pid", s.sender.hello.Pid, "receiver_pid", s.receiver.hello.Pid)
+
+	s.spill = sc.startSpill(agreed, s.sender.hello.Pid)
+	defer s.spill.abort()
+	s.sections = sc.trackSections(agreed)
+
+	res := &RelayResult{
+		Negotiated:  agreed,
+		SenderPid:   s.sender.hello.Pid,
+		ReceiverPid: s.receiver.hello.Pid,
+		Transport:   TransportStream,
+	}
+	state, err := s.sender.readFrame(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("reading the state: %w", relayErr(ctx, err))
+	}
+	switch {
+	case state.Type == wire.TypeStateMemfd && contains(agreed.Transports, TransportMemfd):
+		res.Transport = TransportMemfd
+		if res.Bytes, res.WireBytes, err = s.forwardMemfd(state); err != nil {
+			return nil, fmt.Errorf("forwarding the state: %w", relayErr(ctx, err))
+		}
+		sc.progress(res.Transport, res.Bytes, res.Bytes)
+		s.sections.advance(res.Bytes)
+	case state.Type == wire.TypeStateChunk && contains(agreed.Transports, TransportChunked):
+		res.Transport = TransportChunked
+		if res.Bytes, res.WireBytes, err = s.relayChunks(ctx, state); err != nil {
+			return nil, relayErr(ctx, err)
+		}
+		res.Resumes = s.resumes
+	default:
+		if want := codec.FrameType(agreed.Codec); state.Type != want || !contains(agreed.Transports, TransportStream) {
+			return nil, fmt.Errorf("sender sent a %s frame, which was not agreed", state.Type)
+		}
+		if len(s.sender.conn.fds) > 0 {
+			return nil, fmt.Errorf("sender passed descriptors with a %s frame", state.Type)
+		}
+		if res.Bytes, err = blockSize(agreed, state.Payload); err != nil {
+			return nil, fmt.Errorf("sender sent a bad state: %w", err)
+		}
+		s.spill.writeBlock(agreed, 0, state.Payload)
+		s.commitSpill()
+		if err := s.receiver.writeFrame(timeout, state.Type, state.Payload); err != nil {
+			return nil, fmt.Errorf("forwarding the state: %w", relayErr(ctx, err))
+		}
+		res.WireBytes = int64(len(state.Payload))
+		sc.progress(res.Transport, res.Bytes, res.Bytes)
+		s.sections.advance(res.Bytes)
+	}
+	res.SenderPid, res.ReceiverPid = s.sender.hello.Pid, s.receiver.hello.Pid
+	if len(agreed.Sections) > 0 && res.Bytes != agreed.Size {
+		return nil, fmt.Errorf("sender sent %d bytes for sections of %d", res.Bytes, agreed.Size)
+	}
+	res.Sections = s.sections.stats
+
+	ack, err := s.receiver.readFrame(timeout)
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.New("receiver closed the connection without acknowledging the state")
+		}
+		return nil, fmt.Errorf("waiting for the ACK: %w", relayErr(ctx, err))
+	}
+	if ack.Type != wire.TypeACK {
+		return nil, fmt.Errorf("receiver sent a %s frame, expected %s", ack.Type, wire.TypeACK)
+	}
+	// The sender learns that it may let go of its state. The transfer is
+	// complete even if it has gone away meanwhile.
+	s.sender.writeFrame(timeout, wire.TypeACK, nil)
+	if s.snapshot != nil {
+		if err := s.snapshot.Remove(); err != nil {
+			logger.Log.Warn("SRP: Cannot remove the state snapshot", "err", err)
+		}
+	}
+	return res, nil
+}
+
+// progress reports the bytes of the state relayed so far.
+func (sc *StateCoordinator) progress(transport string, transferred, size int64) {
+	if sc.Progress != nil {
+		sc.Progress(transport, transferred, size)
+	}
+}
+
+// forwardMemfd checks the memfd attached to a STATE_MEMFD frame, spills it
+// and passes it on to the receiver. It returns the size of the state and of
+// the memfd.
+func (s *relaySession) forwardMemfd(state wire.Frame) (int64, int64, error) {
+	agreed := s.agreed
+	fd, err := s.sender.conn.takeFD()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer syscall.Close(fd)
+
+	desc, err := decodeMemfdState(state)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := checkStateMemfd(fd, desc); err != nil {
+		return 0, 0, err
+	}
+	size := desc.Size
+	if agreed.compressed() {
+		if size, err = memfdBlockSize(fd, agreed, desc); err != nil {
+			return 0, 0, err
+		}
+	}
+	s.spill.writeMemfd(agreed, fd, desc)
+	s.commitSpill()
+	return size, desc.Size, writeFrameWithFD(s.receiver.conn.UnixConn, state.Type, state.Payload, fd)
+}
+
+// acceptPeers accepts connections until l is closed and passes on the ones
+// that introduce themselves with a valid Hello within timeout.
+func (sc *StateCoordinator) acceptPeers(ctx context.Context, l net.Listener, timeout time.Duration, peers chan<- *statePeer) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			rc := &rightsConn{UnixConn: conn.(*net.UnixConn)}
+			p := &statePeer{conn: rc, r: wire.NewReader(rc, sc.MaxFrameSize), w: wire.NewWriter(rc, sc.MaxFrameSize)}
+			f, err := p.readFrame(timeout)
+			var hello Hello
+			if err == nil {
+				hello, err = decodeHello(f)
+			}
+			if err == nil && hello.Role != RoleSender && hello.Role != RoleReceiver {
+				err = fmt.Errorf("unknown role %q", hello.Role)
+			}
+			if err == nil {
+				err = sc.authenticate(rc.UnixConn, &hello)
+			}
+			if err != nil {
+				logger.Log.Warn("SRP: Rejecting peer", "role", hello.Role, "err", err)
+				p.w.WriteFrame(wire.TypeHello, mustJSON(Hello{Role: RoleRelay, Error: err.Error()}))
+				conn.Close()
+				rc.discard()
+				return
+			}
+			p.hello = hello
+			select {
+			case peers <- p:
+			case <-ctx.Done():
+				conn.Close()
+				rc.discard()
+			}
+		}()
+	}
+}
+
+func readHello(r *wire.Reader) (Hello, error) {
+	f, err := r.ReadFrame()
+	if err != nil {
+		return Hello{}, err
+	}
+	return decodeHello(f)
+}
+
+func decodeHello(f wire.Frame) (Hello, error) {
+	if f.Type != wire.TypeHello {
+		return Hello{}, fmt.Errorf("expected a %s frame, got %s", wire.TypeHello, f.Type)
+	}
+	var hello Hello
+	if err := json.Unmarshal(f.Payload, &hello); err != nil {
+		return Hello{}, fmt.Errorf("decoding %s payload: %w", f.Type, err)
+	}
+	return hello, nil
+}
+
+// relayErr reports an aborted transfer as the reason it was aborted rather
+// than as the resulting I/O error.
+func relayErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func mustJSON(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// dialRelay connects to the state socket and performs the handshake. Unless
+// hello lists its transports and compressions, all of them are offered, and
+// unless it carries a token, the one in AETERNA_STATE_TOKEN is presented.
+func dialRelay(path string, hello Hello, timeout time.Duration) (*rightsConn, *wire.Reader, *wire.Writer, Hello, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, nil, nil, Hello{}, err
+	}
+	rc := &rightsConn{UnixConn: conn.(*net.UnixConn)}
+	refreshDeadline(rc, timeout)
+	r, w := wire.NewReader(rc, 0), wire.NewWriter(rc, 0)
+	if hello.Pid == 0 {
+		hello.Pid = os.Getpid()
+	}
+	tokenFromEnv(&hello)
+	if hello.Transports == nil {
+		hello.Transports = transports
+	}
+	if hello.Compressions == nil {
+		hello.Compressions = compressions
+	}
+	if err := w.WriteFrame(wire.TypeHello, mustJSON(hello)); err != nil {
+		rc.Close()
+		return nil, nil, nil, Hello{}, err
+	}
+	agreed, err := readHello(r)
+	if err == nil && agreed.Error != "" {
+		err = fmt.Errorf("srp: handshake refused: %s", agreed.Error)
+	}
+	if err != nil {
+		rc.Close()
+		rc.discard()
+		return nil, nil, nil, Hello{}, err
+	}
+	return rc, r, w, agreed, nil
+}
+
+// refreshDeadline gives the next step of a transfer timeout to complete.
+func refreshDeadline(conn net.Conn, timeout time.Duration) {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+}
+
+// SendState hands state, encoded with encode for the negotiated codec, to
+// the next generation through the relay at path. States of at least the
+// agreed threshold travel in a sealed memfd, or in chunks, rather than in a
+// single frame. It returns nil only once the receiver has acknowledged the
+// state; until then the caller must keep serving with it.
+func SendState(path string, hello Hello, encode func(agreed Hello) ([]byte, error), timeout time.Duration) error {
+	hello.Role = RoleSender
+	conn, r, w, agreed, err := dialRelay(path, hello, timeout)
+	if err != nil {
+		return err
+	}
+
+	payload, err := encode(agreed)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return sendState(path, hello, conn, r, w, agreed, payload, timeout)
+}
+
+// sendState sends payload, the whole state, on conn, the connection of a
+// completed handshake with hello, and waits for the ACK.
+func sendState(path string, hello Hello, conn *rightsConn, r *wire.Reader, w *wire.Writer, agreed Hello, payload []byte, timeout time.Duration) error {
+	comp, err := newCompressor(agreed)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	transport := chooseTransport(agreed, len(payload))
+	switch transport {
+	case TransportChunked:
+		if err := sendChunked(path, hello, conn, w, agreed, bytes.NewReader(payload), int64(len(payload)), timeout); err != nil {
+			return err
+		}
+		logger.Log.Info("SRP: State acknowledged by the next generation", "bytes", len(payload), "transport", transport)
+		return nil
+	case TransportMemfd:
+		data := block(comp, payload)
+		fd, err := createStateMemfd(data)
+		if err == nil {
+			err = writeFrameWithFD(conn.UnixConn, wire.TypeStateMemfd, mustJSON(memfdState{Size: int64(len(data))}), fd)
+			syscall.Close(fd)
+		}
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	default:
+		if err := w.WriteFrame(codec.FrameType(agreed.Codec), block(comp, payload)); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if err := awaitAck(conn, r, timeout); err != nil {
+		return err
+	}
+	logger.Log.Info("SRP: State acknowledged by the next generation", "bytes", len(payload), "transport", transport)
+	return nil
+}
+
+// Encode returns an encode function for SendState that encodes v with the
+// negotiated codec.
+func Encode(v interface{}) func(agreed Hello) ([]byte, error) {
+	return func(agreed Hello) ([]byte, error) {
+		c, ok := codec.Get(agreed.Codec)
+		if !ok {
+			return nil, fmt.Errorf("srp: unknown codec %q", agreed.Codec)
+		}
+		return c.Marshal(v)
+	}
+}
+
+// awaitAck waits for the receiver's ACK and closes conn.
+func awaitAck(conn *rightsConn, r *wire.Reader, timeout time.Duration) error {
+	defer conn.Close()
+	refreshDeadline(conn, timeout)
+	ack, err := r.ReadFrame()
+	conn.discard()
+	if err != nil {
+		return fmt.Errorf("srp: state not acknowledged: %w", err)
+	}
+	if ack.Type != wire.TypeACK {
+		return fmt.Errorf("srp: expected %s, got %s", wire.TypeACK, ack.Type)
+	}
+	return nil
+}
+
+// ReceivedState is the state handed over by the previous generation. The
+// receiver must call Ack once it has loaded it, or Reject if it cannot.
+// A state that arrived in a memfd is mapped read-only: Payload stays valid
+// until Close or Reject.
+type ReceivedState struct {
+	Negotiated Hello
+	Transport  string
+	Payload    []byte // nil if the state was written to the sink of ReceiveStateTo
+
+	conn    net.Conn
+	w       *wire.Writer
+	mapping []byte
+}
+
+// ReceiveState connects to the relay at path and waits for the previous
+// generation's state, migrated to the schema version hello needs with the
+// registered migrations, unless hello lists its own. Negotiated.SchemaVersion
+// is that of Payload.
+func ReceiveState(path string, hello Hello, timeout time.Duration) (*ReceivedState, error) {
+	if hello.Migrations == nil {
+		hello.Migrations = Migrations()
+	}
+	rs, err := receiveState(path, hello, nil, timeout)
+	if err != nil {
+		return nil, err
+	}
+	data, v, err := migrate(hello, "", rs.Negotiated.Codec, rs.Negotiated.SchemaVersion, rs.Payload)
+	if err != nil {
+		rs.Reject()
+		return nil, err
+	}
+	if v != rs.Negotiated.SchemaVersion {
+		rs.Close()
+		rs.Payload, rs.Negotiated.SchemaVersion = data, v
+	}
+	return rs, nil
+}
+
+// ReceiveStateTo is ReceiveState for states too large to hold twice: a
+// chunked state is written to sink as it arrives rather than collected in
+// Payload. timeout bounds every step of the transfer, not the whole of it.
+// A state that did not arrive in chunks is written to sink at the end.
+// The state is not migrated: hello must read the sender's schema version.
+func ReceiveStateTo(path string, hello Hello, sink io.Writer, timeout time.Duration) (*ReceivedState, error) {
+	rs, err := receiveState(path, hello, func(Hello) io.Writer { return sink }, timeout)
+	if err != nil || rs.Payload == nil {
+		return rs, err
+	}
+	_, err = sink.Write(rs.Payload)
+	rs.Close()
+	rs.Payload = nil
+	if err != nil {
+		rs.Reject()
+		return nil, err
+	}
+	return rs, nil
+}
+
+// receiveState receives a state. A chunked state is written to the sink
+// newSink returns for the agreed transfer as it arrives, or collected in
+// Payload if newSink is nil; any other state ends up in Payload.
+func receiveState(path string, hello Hello, newSink func(agreed Hello) io.Writer, timeout time.Duration) (*ReceivedState, error) {
+	hello.Role = RoleReceiver
+	conn, r, w, agreed, err := dialRelay(path, hello, timeout)
+	if err != nil {
+		return nil, err
+	}
+	rs := &ReceivedState{Negotiated: agreed, Transport: TransportStream, conn: conn, w: w}
+	refreshDeadline(conn, timeout)
+	f, err := r.ReadFrame()
+	if err == nil {
+		switch {
+		case f.Type == wire.TypeStateMemfd && contains(agreed.Transports, TransportMemfd):
+			rs.Transport = TransportMemfd
+			if err = rs.mapMemfd(conn, f); err == nil && agreed.compressed() {
+				err = rs.inflateMemfd()
+			}
+		case f.Type == wire.TypeStateChunk && contains(agreed.Transports, TransportChunked):
+			rs.Transport = TransportChunked
+			var buf *bytes.Buffer
+			var sink io.Writer
+			if newSink != nil {
+				sink = newSink(agreed)
+			} else {
+				buf = new(bytes.Buffer)
+				if agreed.Size > 0 {
+					buf.Grow(int(min(agreed.Size, maxPrealloc)))
+				}
+				sink = buf
+			}
+			if conn, w, err = receiveChunked(path, hello, agreed, conn, r, w, f, sink, timeout); err == nil {
+				rs.conn, rs.w = conn, w
+				if buf != nil {
+					rs.Payload = buf.Bytes()
+				}
+			}
+		default:
+			if want := codec.FrameType(agreed.Codec); f.Type != want {
+				err = fmt.Errorf("srp: expected a %s frame, got %s", want, f.Type)
+			} else {
+				rs.Payload, err = openBlock(agreed, f.Payload, 0)
+			}
+		}
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+			conn.discard()
+		}
+		return nil, err
+	}
+	conn.discard()
+	return rs, nil
+}
+
+func (rs *ReceivedState) mapMemfd(conn *rightsConn, f wire.Frame) error {
+	fd, err := conn.takeFD()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	desc, err := decodeMemfdState(f)
+	if err != nil {
+		return err
+	}
+	if err := checkStateMemfd(fd, desc); err != nil {
+		return err
+	}
+	if rs.Payload, err = mapStateMemfd(fd, desc); err != nil {
+		return err
+	}
+	if desc.Size > 0 {
+		rs.mapping = rs.Payload
+	}
+	return nil
+}
+
+// Decode decodes the state into v with the negotiated codec. It fails for a
+// state that was written to a sink.
+func (rs *ReceivedState) Decode(v interface{}) error {
+	if rs.Payload == nil {
+		return errors.New("srp: the state was written to the sink")
+	}
+	c, ok := codec.Get(rs.Negotiated.Codec)
+	if !ok {
+		return fmt.Errorf("srp: unknown codec %q", rs.Negotiated.Codec)
+	}
+	return c.Unmarshal(rs.Payload, v)
+}
+
+// Ack confirms that the state was loaded, which lets the engine proceed.
+func (rs *ReceivedState) Ack() error {
+	defer rs.conn.Close()
+	// Loading the state may have taken longer than any transfer timeout.
+	rs.conn.SetDeadline(time.Time{})
+	return rs.w.WriteFrame(wire.TypeACK, nil)
+}
+
+// Reject refuses the state, which rolls the reload back.
+func (rs *ReceivedState) Reject() error {
+	rs.Close()
+	return rs.conn.Close()
+}
+
+// Close releases a state mapped from a memfd. Payload must not be used
+// afterwards. It does not acknowledge the state.
+func (rs *ReceivedState) Close() error {
+	mapping := rs.mapping
+	rs.mapping, rs.Payload = nil, nil
+	if mapping == nil {
+		return nil
+	}
+	return unix.Munmap(mapping)
+}
+
+// Personal.AI order the ending
@@ -0,0 +1,268 @@
+package srp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/srp/codec"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name     string
+		sender   Hello
+		receiver Hello
+		want     Hello
+		wantErr  string
+	}{
+		{
+			name: "defaults",
+			want: Hello{Role: RoleRelay, Version: 1, Codec: codec.JSON},
+		},
+		{
+			name:     "sender preference wins",
+			sender:   Hello{Codecs: []string{codec.Protobuf, codec.JSON}, SchemaVersion: 2},
+			receiver: Hello{Codecs: []string{codec.JSON, codec.Protobuf}, SchemaVersion: 3},
+			want:     Hello{Role: RoleRelay, Version: 1, Codec: codec.Protobuf, SchemaVersion: 2},
+		},
+		{
+			name:     "unknown codec is skipped",
+			sender:   Hello{Codecs: []string{"cbor", codec.JSON}},
+			receiver: Hello{Codecs: []string{"cbor", codec.JSON}},
+			want:     Hello{Role: RoleRelay, Version: 1, Codec: codec.JSON},
+		},
+		{
+			name:     "no common version",
+			sender:   Hello{Versions: []uint8{2}},
+			receiver: Hello{Versions: []uint8{1, 2}},
+			wantErr:  "no common protocol version",
+		},
+		{
+			name:     "no common codec",
+			sender:   Hello{Codecs: []string{codec.Protobuf}},
+			receiver: Hello{Codecs: []string{codec.JSON}},
+			wantErr:  "no common codec",
+		},
+		{
+			name:    "negative size",
+			sender:  Hello{Size: -1},
+			wantErr: "announces a state of -1 bytes",
+		},
+		{
+			name:     "no common transport",
+			sender:   Hello{Transports: []string{TransportMemfd}},
+			receiver: Hello{Transports: []string{TransportStream}},
+			wantErr:  "no common transport",
+		},
+		{
+			name:     "schema from the future",
+			sender:   Hello{SchemaVersion: 4},
+			receiver: Hello{SchemaVersion: 3},
+			wantErr:  "schema version 4 is newer",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Negotiate(tt.sender, tt.receiver)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Negotiate failed: %v", err)
+			}
+			if got.Role != tt.want.Role || got.Version != tt.want.Version || got.Codec != tt.want.Codec || got.SchemaVersion != tt.want.SchemaVersion {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+type relayOutcome struct {
+	res *RelayResult
+	err error
+}
+
+func startRelay(t *testing.T, timeout time.Duration, configure ...func(*StateCoordinator)) (*StateCoordinator, <-chan relayOutcome) {
+	t.Helper()
+	sc := NewCoordinator(filepath.Join(t.TempDir(), "state.sock"))
+	for _, f := range configure {
+		f(sc)
+	}
+	l, err := sc.PrepareSocket()
+	if err != nil {
+		t.Fatalf("PrepareSocket failed: %v", err)
+	}
+	ch := make(chan relayOutcome, 1)
+	go func() {
+		res, err := sc.Relay(context.Background(), l, timeout)
+		ch <- relayOutcome{res, err}
+	}()
+	return sc, ch
+}
+
+func sendAsync(path string, hello Hello, state interface{}) <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- SendState(path, hello, func(Hello) ([]byte, error) { return json.Marshal(state) }, 2*time.Second)
+	}()
+	return ch
+}
+
+func TestRelay_StateIsCommittedByAck(t *testing.T) {
+	sc, relayed := startRelay(t, 2*time.Second)
+
+	// The receiver usually connects first, while the old process is still serving.
+	received := make(chan *ReceivedState, 1)
+	go func() {
+		rs, err := ReceiveState(sc.Path(), Hello{SchemaVersion: 2}, 2*time.Second)
+		if err != nil {
+			t.Errorf("ReceiveState failed: %v", err)
+		}
+		received <- rs
+	}()
+	time.Sleep(50 * time.Millisecond)
+	sent := sendAsync(sc.Path(), Hello{SchemaVersion: 1}, map[string]interface{}{"turns": 3})
+
+	rs := <-received
+	if rs == nil {
+		t.FailNow()
+	}
+	if rs.Negotiated.Codec != codec.JSON || rs.Negotiated.SchemaVersion != 1 || string(rs.Payload) != `{"turns":3}` {
+		t.Fatalf("unexpected state %+v %q", rs.Negotiated, rs.Payload)
+	}
+
+	// The sender is held until the receiver commits.
+	select {
+	case err := <-sent:
+		t.Fatalf("sender returned before the ACK: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := rs.Ack(); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+
+	if err := <-sent; err != nil {
+		t.Errorf("SendState failed: %v", err)
+	}
+	out := <-relayed
+	if out.err != nil {
+		t.Fatalf("Relay failed: %v", out.err)
+	}
+	if out.res.Bytes != int64(len(rs.Payload)) || out.res.Negotiated.Version != 1 {
+		t.Errorf("unexpected result %+v", out.res)
+	}
+}
+
+func TestRelay_TypedStateSurvivesInEveryTransport(t *testing.T) {
+	embedding := make([]byte, 4096)
+	for i := range embedding {
+		embedding[i] = byte(i * 7)
+	}
+	state := map[string]interface{}{"embedding": embedding, "counter": int64(1<<62 + 1)}
+
+	for _, transport := range []string{TransportStream, TransportMemfd, TransportChunked} {
+		t.Run(transport, func(t *testing.T) {
+			sc, relayed := startRelay(t, 2*time.Second, func(sc *StateCoordinator) {
+				sc.Transport = transport
+				sc.ChunkSize = 1000
+			})
+			codecs := []string{codec.MessagePack, codec.JSON}
+			sent := make(chan error, 1)
+			go func() { sent <- SendState(sc.Path(), Hello{Codecs: codecs}, Encode(state), 2*time.Second) }()
+
+			rs, err := ReceiveState(sc.Path(), Hello{Codecs: codecs}, 2*time.Second)
+			if err != nil {
+				t.Fatalf("ReceiveState failed: %v", err)
+			}
+			var got map[string]interface{}
+			if err := rs.Decode(&got); err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			rs.Ack()
+			if err := <-sent; err != nil {
+				t.Fatalf("SendState failed: %v", err)
+			}
+			if out := <-relayed; out.err != nil || out.res.Negotiated.Codec != codec.MessagePack || out.res.Transport != transport {
+				t.Fatalf("unexpected relay outcome %+v %v", out.res, out.err)
+			}
+
+			if b, _ := got["embedding"].([]byte); !bytes.Equal(b, embedding) {
+				t.Errorf("expected the bytes to survive bit for bit, got %T", got["embedding"])
+			}
+			if got["counter"] != int64(1<<62+1) {
+				t.Errorf("expected the counter to stay exact, got %v", got["counter"])
+			}
+		})
+	}
+}
+
+func TestRelay_RejectedStateFailsBothSides(t *testing.T) {
+	sc, relayed := startRelay(t, 2*time.Second)
+	sent := sendAsync(sc.Path(), Hello{}, map[string]interface{}{"turns": 3})
+
+	rs, err := ReceiveState(sc.Path(), Hello{}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("ReceiveState failed: %v", err)
+	}
+	rs.Reject()
+
+	if out := <-relayed; out.err == nil || !strings.Contains(out.err.Error(), "without acknowledging") {
+		t.Errorf("expected the relay to fail without an ACK, got %v", out.err)
+	}
+	if err := <-sent; err == nil {
+		t.Error("expected the sender to learn that the state was not acknowledged")
+	}
+}
+
+func TestRelay_NegotiationFailureIsReported(t *testing.T) {
+	sc, relayed := startRelay(t, 2*time.Second)
+	sent := sendAsync(sc.Path(), Hello{SchemaVersion: 5}, map[string]interface{}{})
+
+	_, err := ReceiveState(sc.Path(), Hello{SchemaVersion: 4}, 2*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "handshake refused") {
+		t.Errorf("expected the receiver to be refused, got %v", err)
+	}
+	if err := <-sent; err == nil || !strings.Contains(err.Error(), "handshake refused") {
+		t.Errorf("expected the sender to be refused, got %v", err)
+	}
+	if out := <-relayed; out.err == nil {
+		t.Error("expected the relay to fail")
+	}
+}
+
+func TestRelay_TimesOutWithoutSender(t *testing.T) {
+	sc, relayed := startRelay(t, 200*time.Millisecond)
+	go ReceiveState(sc.Path(), Hello{}, time.Second)
+
+	out := <-relayed
+	if !errors.Is(out.err, context.DeadlineExceeded) || !strings.Contains(out.err.Error(), RoleSender) {
+		t.Errorf("expected a timeout waiting for the sender, got %v", out.err)
+	}
+}
+
+func TestRelay_RejectsSecondReceiver(t *testing.T) {
+	sc, relayed := startRelay(t, 2*time.Second)
+	go func() {
+		if rs, err := ReceiveState(sc.Path(), Hello{}, 2*time.Second); err == nil {
+			rs.Ack()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := ReceiveState(sc.Path(), Hello{}, 2*time.Second); err == nil || !strings.Contains(err.Error(), "already connected") {
+		t.Errorf("expected the second receiver to be refused, got %v", err)
+	}
+	sendAsync(sc.Path(), Hello{}, map[string]interface{}{})
+	if out := <-relayed; out.err != nil {
+		t.Errorf("expected the first receiver to complete the transfer, got %v", out.err)
+	}
+}
@@ -0,0 +1,184 @@
+package srp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/turtacn/Aeterna/pkg/srp/compress"
+	"github.com/turtacn/Aeterna/pkg/srp/wire"
+	"golang.org/x/sys/unix"
+)
+
+// Large states are not streamed through the relay. The sender writes them into
+// a memfd, seals it so that it can no longer change, and sends a STATE_MEMFD
+// frame with the FD attached as SCM_RIGHTS. The relay checks the seals and
+// passes the FD on; the receiver maps it read-only, so the state is never
+// copied through the socket.
+
+// requiredSeals make a memfd immutable. F_SEAL_SEAL is not required: the
+// other seals cannot be removed anyway.
+const requiredSeals = unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE
+
+// memfdState is the payload of a STATE_MEMFD frame. The state is encoded with
+// the negotiated codec and, if a compression was agreed, held as one block.
+type memfdState struct {
+	Size int64 `json:"size"`
+}
+
+// createStateMemfd returns a sealed memfd holding payload.
+func createStateMemfd(payload []byte) (int, error) {
+	fd, err := unix.MemfdCreate("aeterna-state", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return -1, err
+	}
+	for rest := payload; len(rest) > 0; {
+		n, err := unix.Write(fd, rest)
+		if err != nil {
+			unix.Close(fd)
+			return -1, err
+		}
+		rest = rest[n:]
+	}
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, requiredSeals|unix.F_SEAL_SEAL); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("sealing the memfd: %w", err)
+	}
+	return fd, nil
+}
+
+// checkStateMemfd verifies that fd is a sealed memfd of the announced size.
+func checkStateMemfd(fd int, desc memfdState) error {
+	seals, err := unix.FcntlInt(uintptr(fd), unix.F_GET_SEALS, 0)
+	if err != nil {
+		return fmt.Errorf("srp: state descriptor is not a memfd: %w", err)
+	}
+	if seals&requiredSeals != requiredSeals {
+		return fmt.Errorf("srp: state memfd is not sealed (seals 0x%x)", seals)
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Size != desc.Size {
+		return fmt.Errorf("srp: state memfd holds %d bytes, %d announced", st.Size, desc.Size)
+	}
+	return nil
+}
+
+// mapStateMemfd maps the state in fd read-only. The mapping stays valid after
+// fd is closed.
+func mapStateMemfd(fd int, desc memfdState) ([]byte, error) {
+	if desc.Size == 0 {
+		return []byte{}, nil
+	}
+	if desc.Size < 0 || desc.Size != int64(int(desc.Size)) {
+		return nil, fmt.Errorf("srp: cannot map %d bytes", desc.Size)
+	}
+	return unix.Mmap(fd, 0, int(desc.Size), unix.PROT_READ, unix.MAP_SHARED)
+}
+
+// memfdBlockSize reads the size of the state from the header of the block in
+// fd, without mapping the state.
+func memfdBlockSize(fd int, agreed Hello, desc memfdState) (int64, error) {
+	hdr := make([]byte, compress.MaxHeaderSize)
+	if desc.Size < int64(len(hdr)) {
+		hdr = hdr[:desc.Size]
+	}
+	n, err := unix.Pread(fd, hdr, 0)
+	if err != nil {
+		return 0, err
+	}
+	return blockSize(agreed, hdr[:n])
+}
+
+// inflateMemfd replaces a compressed state mapped from a memfd by the
+// decompressed state, releasing the mapping. A stored block stays mapped.
+func (rs *ReceivedState) inflateMemfd() error {
+	h, err := compress.ParseHeader(rs.Negotiated.Compression, rs.Payload)
+	if err != nil {
+		return err
+	}
+	data, err := openBlock(rs.Negotiated, rs.Payload, 0)
+	if err != nil {
+		return err
+	}
+	if h.Compressed {
+		rs.Close()
+	}
+	rs.Payload = data
+	return nil
+}
+
+func decodeMemfdState(f wire.Frame) (memfdState, error) {
+	var desc memfdState
+	if err := json.Unmarshal(f.Payload, &desc); err != nil {
+		return memfdState{}, fmt.Errorf("decoding %s payload: %w", f.Type, err)
+	}
+	if desc.Size < 0 {
+		return memfdState{}, fmt.Errorf("%s payload announces %d bytes", f.Type, desc.Size)
+	}
+	return desc, nil
+}
+
+// rightsConn is a Unix connection whose reads keep the FDs passed with the
+// data, for the frame that announces them.
+type rightsConn struct {
+	*net.UnixConn
+	fds []int
+}
+
+func (c *rightsConn) Read(p []byte) (int, error) {
+	oob := make([]byte, syscall.CmsgSpace(4*4))
+	n, oobn, flags, _, err := c.ReadMsgUnix(p, oob)
+	if n == 0 && err == nil && len(p) > 0 {
+		err = io.EOF
+	}
+	if oobn > 0 {
+		fds, perr := parseRights(oob[:oobn])
+		c.fds = append(c.fds, fds...)
+		if perr != nil && err == nil {
+			err = perr
+		}
+	}
+	if flags&syscall.MSG_CTRUNC != 0 && err == nil {
+		err = errors.New("srp: too many descriptors in one message")
+	}
+	return n, err
+}
+
+// takeFD returns the single FD received since the last call. Any other FDs
+// are closed.
+func (c *rightsConn) takeFD() (int, error) {
+	fds := c.fds
+	c.fds = nil
+	if len(fds) != 1 {
+		closeFDs(fds)
+		return -1, fmt.Errorf("srp: expected one descriptor, received %d", len(fds))
+	}
+	return fds[0], nil
+}
+
+// discard closes the FDs nobody took. It must not race with Read.
+func (c *rightsConn) discard() {
+	closeFDs(c.fds)
+	c.fds = nil
+}
+
+// writeFrameWithFD writes a frame with fd attached as SCM_RIGHTS.
+func writeFrameWithFD(uc *net.UnixConn, t wire.Type, payload []byte, fd int) error {
+	buf, err := wire.Encode(t, payload, 0)
+	if err != nil {
+		return err
+	}
+	n, _, err := uc.WriteMsgUnix(buf, syscall.UnixRights(fd), nil)
+	if err == nil && n < len(buf) {
+		_, err = uc.Write(buf[n:])
+	}
+	return err
+}
+
+// Personal.AI order the ending
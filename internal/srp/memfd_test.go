@@ -0,0 +1,147 @@
+package srp
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/srp/wire"
+	"golang.org/x/sys/unix"
+)
+
+func TestChooseTransport(t *testing.T) {
+	both := Hello{Transports: []string{TransportStream, TransportMemfd}, MemfdThreshold: 100}
+	tests := []struct {
+		name   string
+		agreed Hello
+		size   int
+		want   string
+	}{
+		{"below the threshold", both, 99, TransportStream},
+		{"at the threshold", both, 100, TransportMemfd},
+		{"stream only", Hello{Transports: []string{TransportStream}}, 1 << 30, TransportStream},
+		{"memfd only", Hello{Transports: []string{TransportMemfd}}, 1, TransportMemfd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chooseTransport(tt.agreed, tt.size); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// transfer relays payload from a sender to a receiver that acknowledges it.
+func transfer(t *testing.T, payload []byte, configure func(*StateCoordinator)) (*ReceivedState, []byte, *RelayResult) {
+	t.Helper()
+	sc, relayed := startRelay(t, 2*time.Second, configure)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- SendState(sc.Path(), Hello{}, func(Hello) ([]byte, error) { return payload, nil }, 2*time.Second)
+	}()
+
+	rs, err := ReceiveState(sc.Path(), Hello{}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("ReceiveState failed: %v", err)
+	}
+	got := append([]byte(nil), rs.Payload...)
+	if err := rs.Ack(); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("SendState failed: %v", err)
+	}
+	out := <-relayed
+	if out.err != nil {
+		t.Fatalf("Relay failed: %v", out.err)
+	}
+	return rs, got, out.res
+}
+
+func TestRelay_TransportIsChosenBySize(t *testing.T) {
+	small := []byte(`{"turns":1}`)
+	large := bytes.Repeat([]byte("x"), 4096)
+	tests := []struct {
+		name      string
+		transport string
+		payload   []byte
+		want      string
+	}{
+		{"small state is streamed", TransportAuto, small, TransportStream},
+		{"large state uses a memfd", TransportAuto, large, TransportMemfd},
+		{"stream forced", TransportStream, large, TransportStream},
+		{"memfd forced", TransportMemfd, small, TransportMemfd},
+		{"empty state in a memfd", TransportMemfd, []byte{}, TransportMemfd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, got, res := transfer(t, tt.payload, func(sc *StateCoordinator) {
+				sc.Transport = tt.transport
+				sc.MemfdThreshold = 1024
+			})
+			defer rs.Close()
+
+			if rs.Transport != tt.want || res.Transport != tt.want {
+				t.Errorf("expected %s, receiver used %s and relay %s", tt.want, rs.Transport, res.Transport)
+			}
+			if !bytes.Equal(got, tt.payload) || res.Bytes != int64(len(tt.payload)) {
+				t.Errorf("state changed in transit: %d bytes received, %d relayed, %d sent", len(got), res.Bytes, len(tt.payload))
+			}
+		})
+	}
+}
+
+func TestReceivedState_MemfdIsReadOnly(t *testing.T) {
+	rs, _, _ := transfer(t, bytes.Repeat([]byte("x"), 64), func(sc *StateCoordinator) { sc.Transport = TransportMemfd })
+	if rs.mapping == nil {
+		t.Fatal("expected the state to be mapped")
+	}
+	// A writable mapping would let the receiver corrupt what the sender keeps serving with.
+	if err := unix.Mprotect(rs.mapping, unix.PROT_READ|unix.PROT_WRITE); err == nil {
+		t.Error("expected the mapping of a sealed memfd to stay read-only")
+	}
+	if err := rs.Close(); err != nil || rs.Payload != nil {
+		t.Errorf("expected Close to release the mapping, got %v", err)
+	}
+}
+
+func TestRelay_RejectsUnsealedMemfd(t *testing.T) {
+	sc, relayed := startRelay(t, 2*time.Second, func(sc *StateCoordinator) { sc.Transport = TransportMemfd })
+	go ReceiveState(sc.Path(), Hello{}, 2*time.Second)
+
+	conn, _, _, _, err := dialRelay(sc.Path(), Hello{Role: RoleSender}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dialRelay failed: %v", err)
+	}
+	defer conn.Close()
+	fd, err := unix.MemfdCreate("unsealed", unix.MFD_CLOEXEC)
+	if err != nil {
+		t.Fatalf("MemfdCreate failed: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := writeFrameWithFD(conn.UnixConn, wire.TypeStateMemfd, []byte(`{"size":0}`), fd); err != nil {
+		t.Fatalf("writeFrameWithFD failed: %v", err)
+	}
+
+	if out := <-relayed; out.err == nil || !strings.Contains(out.err.Error(), "not sealed") {
+		t.Errorf("expected the relay to refuse an unsealed memfd, got %v", out.err)
+	}
+}
+
+func TestRelay_RejectsMemfdFrameWithoutDescriptor(t *testing.T) {
+	sc, relayed := startRelay(t, 2*time.Second)
+	go ReceiveState(sc.Path(), Hello{}, 2*time.Second)
+
+	conn, _, w, _, err := dialRelay(sc.Path(), Hello{Role: RoleSender}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dialRelay failed: %v", err)
+	}
+	defer conn.Close()
+	w.WriteFrame(wire.TypeStateMemfd, []byte(`{"size":1}`))
+
+	if out := <-relayed; out.err == nil || !strings.Contains(out.err.Error(), "expected one descriptor") {
+		t.Errorf("expected the relay to refuse the frame, got %v", out.err)
+	}
+}
@@ -0,0 +1,170 @@
+package srp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Every section of a state carries the schema version it was written with
+// (SectionInfo.SchemaVersion; a whole state has Hello.SchemaVersion). The
+// receiver declares, in Schemas, the exact version it needs of a section, or
+// only the highest it reads, in SchemaVersion. When the versions differ the
+// state is migrated, step by step, by Migrations: Aeterna runs the ones it is
+// configured with before it serves a state it holds, and the receiver runs
+// the Go functions registered with RegisterMigration once the state arrived.
+// The relay refuses a state that cannot be brought to a version the receiver
+// reads with ErrNoMigrationPath.
+
+// ErrNoMigrationPath is returned when a state cannot be migrated to a schema
+// version the receiver reads.
+var ErrNoMigrationPath = errors.New("no migration path")
+
+// Migration is a step that rewrites a section, or a whole state if Section
+// is empty, from schema version From to To.
+type Migration struct {
+	Section string `json:"section,omitempty"`
+	From    int    `json:"from"`
+	To      int    `json:"to"`
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%q %d>%d", m.Section, m.From, m.To)
+}
+
+// MigrateFunc rewrites the data of a section, encoded with codec, for the
+// schema version of its Migration.
+type MigrateFunc func(data []byte, codec string) ([]byte, error)
+
+var (
+	migrationsMu sync.RWMutex
+	migrations   = make(map[Migration]MigrateFunc)
+)
+
+// RegisterMigration makes ReceiveState and ReceiveSections run fn on the
+// section of m, or the whole state, received with schema version m.From, on
+// the way to the version the receiver needs. It panics if m goes nowhere or
+// is already registered.
+func RegisterMigration(m Migration, fn MigrateFunc) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	if m.From == m.To {
+		panic("srp: RegisterMigration from a version to itself")
+	}
+	if _, dup := migrations[m]; dup {
+		panic("srp: RegisterMigration called twice for " + m.String())
+	}
+	migrations[m] = fn
+}
+
+// Migrations returns the registered migrations, sorted.
+func Migrations() []Migration {
+	migrationsMu.RLock()
+	defer migrationsMu.RUnlock()
+	steps := make([]Migration, 0, len(migrations))
+	for m := range migrations {
+		steps = append(steps, m)
+	}
+	sort.Slice(steps, func(i, j int) bool {
+		a, b := steps[i], steps[j]
+		if a.Section != b.Section {
+			return a.Section < b.Section
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+	return steps
+}
+
+// MigrationPath returns the shortest sequence of steps that takes section
+// from schema version from to to, empty if the versions are the same, or
+// nil if there is none.
+func MigrationPath(steps []Migration, section string, from, to int) []Migration {
+	if from == to {
+		return []Migration{}
+	}
+	via := map[int]Migration{}
+	queue := []int{from}
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+		for _, m := range steps {
+			if _, seen := via[m.To]; m.Section != section || m.From != v || m.To == from || seen {
+				continue
+			}
+			via[m.To] = m
+			if m.To == to {
+				path := []Migration{m}
+				for path[0].From != from {
+					path = append([]Migration{via[path[0].From]}, path...)
+				}
+				return path
+			}
+			queue = append(queue, m.To)
+		}
+	}
+	return nil
+}
+
+// TargetSchema returns the schema version the receiver greeting with hello
+// needs of section, or the highest it reads if not strict.
+func (h Hello) TargetSchema(section string) (version int, strict bool) {
+	if v, ok := h.Schemas[section]; ok {
+		return v, true
+	}
+	return h.SchemaVersion, false
+}
+
+// checkSchema refuses a section, or whole state, of schema version v that
+// the receiver neither reads nor can migrate to a version it reads.
+func checkSchema(receiver Hello, section string, v int) error {
+	want, strict := receiver.TargetSchema(section)
+	if v == want || (!strict && v < want) || MigrationPath(receiver.Migrations, section, v, want) != nil {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("%w for %s from schema version %d to %d", ErrNoMigrationPath, sectionLabel(section), v, want)
+	}
+	return fmt.Errorf("%w for %s: schema version %d is newer than the receiver's %d", ErrNoMigrationPath, sectionLabel(section), v, want)
+}
+
+// migrate brings data, a section or whole state of schema version v, to the
+// version the receiver greeting with hello needs, with the registered
+// migrations it offered. It returns the data and its schema version.
+func migrate(hello Hello, section, codecName string, v int, data []byte) ([]byte, int, error) {
+	want, strict := hello.TargetSchema(section)
+	path := MigrationPath(hello.Migrations, section, v, want)
+	if path == nil {
+		if strict || v > want {
+			return nil, v, fmt.Errorf("srp: %w for %s from schema version %d to %d", ErrNoMigrationPath, sectionLabel(section), v, want)
+		}
+		return data, v, nil // The receiver reads older versions itself
+	}
+	for _, m := range path {
+		migrationsMu.RLock()
+		fn := migrations[m]
+		migrationsMu.RUnlock()
+		if fn == nil {
+			return nil, v, fmt.Errorf("srp: migration %s is not registered", m)
+		}
+		out, err := fn(data, codecName)
+		if err != nil {
+			return nil, v, fmt.Errorf("srp: migration %s: %w", m, err)
+		}
+		data, v = out, m.To
+	}
+	return data, v, nil
+}
+
+// sectionLabel names a section, or the whole state, in messages.
+func sectionLabel(section string) string {
+	if section == "" {
+		return "the state"
+	}
+	return fmt.Sprintf("section %q", section)
+}
+
+// Personal.AI order the ending
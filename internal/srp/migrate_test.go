@@ -0,0 +1,124 @@
+package srp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMigrationPath(t *testing.T) {
+	steps := []Migration{
+		{Section: "a", From: 1, To: 2},
+		{Section: "a", From: 2, To: 3},
+		{Section: "a", From: 1, To: 3},
+		{Section: "a", From: 3, To: 1},
+		{Section: "b", From: 3, To: 4},
+	}
+	if path := MigrationPath(steps, "a", 1, 3); len(path) != 1 || path[0] != steps[2] {
+		t.Errorf("expected the shortest path, got %v", path)
+	}
+	if path := MigrationPath(steps, "a", 2, 1); len(path) != 2 || path[1] != steps[3] {
+		t.Errorf("expected 2>3>1, got %v", path)
+	}
+	if path := MigrationPath(steps, "a", 2, 2); path == nil || len(path) != 0 {
+		t.Errorf("expected an empty path, got %v", path)
+	}
+	if path := MigrationPath(steps, "a", 3, 4); path != nil {
+		t.Errorf("expected no path across sections, got %v", path)
+	}
+}
+
+func TestNegotiate_SchemaVersions(t *testing.T) {
+	table := []SectionInfo{
+		{Name: "sessions", Size: 1, SHA256: Describe([]Section{{Data: []byte("x")}})[0].SHA256, SchemaVersion: 1},
+	}
+	tests := []struct {
+		name     string
+		sender   Hello
+		receiver Hello
+		ok       bool
+	}{
+		{"older read by the receiver", Hello{SchemaVersion: 1}, Hello{SchemaVersion: 2}, true},
+		{"newer", Hello{SchemaVersion: 3}, Hello{SchemaVersion: 2}, false},
+		{"newer migrated down", Hello{SchemaVersion: 3}, Hello{SchemaVersion: 2, Migrations: []Migration{{From: 3, To: 2}}}, true},
+		{"exact version needed", Hello{SchemaVersion: 1}, Hello{Schemas: map[string]int{"": 2}}, false},
+		{"exact version migrated to", Hello{SchemaVersion: 1}, Hello{Schemas: map[string]int{"": 2}, Migrations: []Migration{{From: 1, To: 2}}}, true},
+		{"section", Hello{Sections: table}, Hello{Sectioned: true, Schemas: map[string]int{"sessions": 2}}, false},
+		{"section migrated", Hello{Sections: table}, Hello{Sectioned: true, Schemas: map[string]int{"sessions": 2},
+			Migrations: []Migration{{Section: "sessions", From: 1, To: 2}}}, true},
+		{"section held", Hello{Sections: table}, Hello{Sectioned: true, Schemas: map[string]int{"sessions": 2},
+			Have: map[string]string{"sessions": table[0].SHA256}}, true},
+	}
+	for _, tt := range tests {
+		_, err := Negotiate(tt.sender, tt.receiver)
+		if tt.ok && err != nil {
+			t.Errorf("%s: Negotiate failed: %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrNoMigrationPath) {
+			t.Errorf("%s: expected ErrNoMigrationPath, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestReceiveSections_Migrates(t *testing.T) {
+	RegisterMigration(Migration{Section: "migrated", From: 1, To: 2}, func(data []byte, codec string) ([]byte, error) {
+		if codec != "json" {
+			t.Errorf("expected the codec of the transfer, got %q", codec)
+		}
+		return bytes.ToUpper(data), nil
+	})
+	RegisterMigration(Migration{Section: "migrated", From: 2, To: 3}, func(data []byte, _ string) ([]byte, error) {
+		return append(data, '!'), nil
+	})
+	sections := []Section{
+		{Name: "migrated", SchemaVersion: 1, Data: []byte(`"abc"`)},
+		{Name: "kept", Data: []byte(`"xyz"`)},
+	}
+	loaded, _ := transferSections(t, sections, Hello{SchemaVersion: 5, Schemas: map[string]int{"migrated": 3}}, func(*StateCoordinator) {})
+
+	if len(loaded) != 2 || string(loaded[0].Data) != `"ABC"!` || loaded[0].SchemaVersion != 3 {
+		t.Fatalf("expected the section to be migrated to version 3, got %+v", loaded)
+	}
+	if string(loaded[1].Data) != `"xyz"` || loaded[1].SchemaVersion != 0 {
+		t.Errorf("expected the other section as sent, got %+v", loaded[1])
+	}
+}
+
+func TestReceiveState_Migrates(t *testing.T) {
+	RegisterMigration(Migration{From: 7, To: 8}, func(data []byte, _ string) ([]byte, error) {
+		return []byte(`{"turns":8}`), nil
+	})
+	sc, relayed := startRelay(t, 2*time.Second)
+	sent := sendAsync(sc.Path(), Hello{SchemaVersion: 7}, map[string]int{"turns": 7})
+
+	rs, err := ReceiveState(sc.Path(), Hello{Schemas: map[string]int{"": 8}}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("ReceiveState failed: %v", err)
+	}
+	rs.Ack()
+	if err := <-sent; err != nil {
+		t.Fatalf("SendState failed: %v", err)
+	}
+	if out := <-relayed; out.err != nil {
+		t.Fatalf("Relay failed: %v", out.err)
+	}
+	if string(rs.Payload) != `{"turns":8}` || rs.Negotiated.SchemaVersion != 8 {
+		t.Errorf("expected the state migrated to version 8, got %q at %d", rs.Payload, rs.Negotiated.SchemaVersion)
+	}
+}
+
+func TestRelay_RefusesStateWithoutMigrationPath(t *testing.T) {
+	sc, relayed := startRelay(t, 2*time.Second)
+	sent := sendAsync(sc.Path(), Hello{SchemaVersion: 1}, map[string]int{"turns": 1})
+
+	if _, err := ReceiveState(sc.Path(), Hello{Schemas: map[string]int{"": 2}}, 2*time.Second); err == nil {
+		t.Fatal("expected the receiver to be refused")
+	}
+	if err := <-sent; err == nil {
+		t.Error("expected the sender to be refused")
+	}
+	if out := <-relayed; !errors.Is(out.err, ErrNoMigrationPath) {
+		t.Errorf("expected ErrNoMigrationPath, got %v", out.err)
+	}
+}
@@ -1,19 +1,64 @@
 package srp
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"os"
 	"time"
 
+	aerrors "github.com/turtacn/Aeterna/pkg/errors"
 	"github.com/turtacn/Aeterna/pkg/logger"
+	"github.com/turtacn/Aeterna/pkg/srp/codec"
+	"github.com/turtacn/Aeterna/pkg/srp/compress"
+	"github.com/turtacn/Aeterna/pkg/srp/wire"
 )
 
 // StateCoordinator manages the State Relay Protocol (SRP) process.
 // It uses a Unix domain socket to facilitate memory context transfer between
 // an old process and a new process during a hot reload.
+// The state travels in SRP frames (see pkg/srp/wire).
 type StateCoordinator struct {
 	socketPath string
+
+	// MaxFrameSize bounds the frames accepted from the sender.
+	// 0 means wire.DefaultMaxFrameSize.
+	MaxFrameSize int
+	// Transport restricts how the state travels: TransportAuto (or empty),
+	// TransportStream, TransportMemfd or TransportChunked.
+	Transport string
+	// MemfdThreshold is the state size from which TransportAuto uses a memfd,
+	// or chunks where a memfd is not available. 0 means DefaultMemfdThreshold.
+	MemfdThreshold int64
+	// ChunkSize is the data size of a chunk. 0 means wire.DefaultChunkSize.
+	ChunkSize int
+	// Compression is the compression of the state data: compress.None (or
+	// empty), CompressionAuto for the peers' preferred one, or compress.Zstd
+	// or compress.Gzip if the peers support it. The sender compresses every
+	// chunk, or the whole state, of at least CompressionThreshold bytes
+	// (0 means compress.DefaultThreshold) at CompressionLevel (0 means the
+	// algorithm's default).
+	Compression          string
+	CompressionLevel     int
+	CompressionThreshold int
+	// Progress, if set, is called as the state is relayed with the bytes
+	// relayed so far and the size announced by the sender, 0 if unknown.
+	Progress func(transport string, transferred, size int64)
+	// Section, if set, is called as every section of a sectioned state has
+	// been relayed.
+	Section func(SectionStat)
+	// Receiving, if set, is called with the Hello of the receiver as it
+	// connects, before the handshake is answered.
+	Receiving func(Hello)
+	// Sender and Receiver, if set, are the only processes allowed to connect
+	// in each role. Peers of any role must run as the engine's user and group.
+	Sender, Receiver *Peer
+	// Spill, if set, keeps an encrypted snapshot of every relayed state until
+	// the receiver acknowledges it.
+	Spill *SpillStore
 }
 
 // NewCoordinator creates a new StateCoordinator with the specified socket path.
@@ -36,9 +81,30 @@ func (sc *StateCoordinator) PrepareSocket() (net.Listener, error) {
 	return l, nil
 }
 
+// Path returns the path of the state socket.
+func (sc *StateCoordinator) Path() string {
+	return sc.socketPath
+}
+
+// Close removes the coordinator's socket file if it still exists.
+func (sc *StateCoordinator) Close() error {
+	if sc.socketPath == "" {
+		return nil
+	}
+	if err := os.Remove(sc.socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 // WaitStateTransfer waits for the old process to dump its state via the Unix socket.
 // It returns the decoded state data or an error if the transfer fails or times out.
+// The old process has timeout to connect and then to send each frame, so a
+// large chunked state is not cut short while it makes progress.
 // This is typically called by the new process during its startup phase.
+//
+// Deprecated: the new process connects to the state socket as a client, like
+// the SDKs do (ReceiveState), and Aeterna relays or brokers the state.
 func (sc *StateCoordinator) WaitStateTransfer(timeout time.Duration) (map[string]interface{}, error) {
 	logger.Log.Info("SRP: Waiting for state handover...", "socket", sc.socketPath)
 
@@ -49,40 +115,145 @@ func (sc *StateCoordinator) WaitStateTransfer(timeout time.Duration) (map[string
 	defer l.Close()
 	defer os.Remove(sc.socketPath)
 
-	type result struct {
-		data map[string]interface{}
-		err  error
+	l.(*net.UnixListener).SetDeadline(time.Now().Add(timeout))
+	conn, err := l.Accept()
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, os.ErrDeadlineExceeded
+		}
+		return nil, err
 	}
-	ch := make(chan result, 1)
+	defer conn.Close()
 
-	go func() {
-		conn, err := l.Accept()
+	state, err := sc.readState(conn.(*net.UnixConn), timeout)
+	if err != nil {
+		return nil, aerrors.New(aerrors.ErrCodeStateLoadFail, "WaitStateTransfer", "invalid state transfer", err)
+	}
+	logger.Log.Info("SRP: Context received", "keys", len(state))
+	return state, nil
+}
+
+// readState reads frames up to the state, which is either a single frame or
+// a chunked state. The sender may introduce itself with a single Hello frame
+// first, whose first codec is the one of a STATE_DATA frame or a chunked
+// state (JSON by default), and whose compression, if any, is the one of the
+// state data. The sender is authenticated like a peer of the relay; if a
+// sender is expected, it must introduce itself. Each frame must arrive within
+// timeout.
+func (sc *StateCoordinator) readState(conn *net.UnixConn, timeout time.Duration) (map[string]interface{}, error) {
+	// Credentials are checked up front, the token once the sender has had
+	// the chance to introduce itself.
+	hello := Hello{Role: RoleSender}
+	if err := checkPeerCred(conn, &hello); err != nil {
+		return nil, err
+	}
+	fr := wire.NewReader(conn, sc.MaxFrameSize)
+	helloSeen, authenticated := false, false
+	codecName := codec.JSON
+	var chunks *bytes.Buffer
+	var digest *wire.Digest
+	for {
+		refreshDeadline(conn, timeout)
+		f, err := fr.ReadFrame()
+		if err == io.EOF {
+			return nil, fmt.Errorf("connection closed before the state frame")
+		}
 		if err != nil {
-			ch <- result{nil, err}
-			return
+			return nil, err
 		}
-		defer conn.Close()
-
-		conn.SetReadDeadline(time.Now().Add(timeout))
-
-		var state map[string]interface{}
-		// In production, use Protobuf for efficiency. Here using JSON for readability.
-		decoder := json.NewDecoder(conn)
-		if err := decoder.Decode(&state); err != nil {
-			ch <- result{nil, err}
-			return
+		if chunks != nil && f.Type != wire.TypeStateChunk && f.Type != wire.TypeStateEnd {
+			return nil, fmt.Errorf("unexpected %s frame in a chunked state", f.Type)
+		}
+		if f.Type != wire.TypeHello && !authenticated {
+			if err := sc.checkExpected(hello); err != nil {
+				return nil, err
+			}
+			authenticated = true
 		}
 
-		logger.Log.Info("SRP: Context received", "keys", len(state))
-		ch <- result{state, nil}
-	}()
+		switch f.Type {
+		case wire.TypeHello:
+			if helloSeen {
+				return nil, fmt.Errorf("duplicate %s frame", f.Type)
+			}
+			helloSeen = true
+			pid := hello.Pid
+			hello = Hello{}
+			if err := json.Unmarshal(f.Payload, &hello); err != nil {
+				return nil, fmt.Errorf("decoding %s payload: %w", f.Type, err)
+			}
+			hello.Role, hello.Pid = RoleSender, pid
+			if err := sc.checkExpected(hello); err != nil {
+				return nil, err
+			}
+			authenticated = true
+			if !compress.Known(hello.Compression) && hello.Compression != "" {
+				return nil, fmt.Errorf("unknown compression %q", hello.Compression)
+			}
+			codecName = hello.codecs()[0]
+			logger.Log.Info("SRP: Sender connected", "pid", hello.Pid, "codecs", hello.Codecs,
+				"schema_version", hello.SchemaVersion, "compression", hello.Compression)
+		case wire.TypeStateChunk:
+			c, err := wire.DecodeChunk(f.Payload)
+			if err != nil {
+				return nil, err
+			}
+			if chunks == nil {
+				chunks, digest = new(bytes.Buffer), wire.NewDigest()
+			}
+			if int64(c.Offset) != digest.Size() {
+				return nil, fmt.Errorf("chunk at offset %d, expected %d", c.Offset, digest.Size())
+			}
+			data, err := openBlock(hello, c.Data, 0)
+			if err != nil {
+				return nil, err
+			}
+			chunks.Write(data)
+			digest.Write(int64(c.Offset), data)
+		case wire.TypeStateEnd:
+			if chunks == nil {
+				return nil, fmt.Errorf("unexpected %s frame", f.Type)
+			}
+			if err := digest.Verify(f.Payload); err != nil {
+				return nil, err
+			}
+			return decodeState(codecName, chunks.Bytes())
+		case wire.TypeStateJSON, wire.TypeStateProtobuf, wire.TypeStateData:
+			name := codecName
+			switch f.Type {
+			case wire.TypeStateJSON:
+				name = codec.JSON
+			case wire.TypeStateProtobuf:
+				name = codec.Protobuf
+			}
+			if codec.FrameType(name) != f.Type {
+				return nil, fmt.Errorf("unexpected %s frame for codec %q", f.Type, name)
+			}
+			data, err := openBlock(hello, f.Payload, 0)
+			if err != nil {
+				return nil, err
+			}
+			return decodeState(name, data)
+		default:
+			return nil, fmt.Errorf("unexpected %s frame", f.Type)
+		}
+	}
+}
 
-	select {
-	case res := <-ch:
-		return res.data, res.err
-	case <-time.After(timeout):
-		return nil, os.ErrDeadlineExceeded
+// decodeState decodes a state encoded with the codec name, which must be an object.
+func decodeState(name string, payload []byte) (map[string]interface{}, error) {
+	c, ok := codec.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	var state map[string]interface{}
+	if err := c.Unmarshal(payload, &state); err != nil {
+		return nil, fmt.Errorf("decoding %s state: %w", name, err)
+	}
+	if state == nil {
+		return nil, fmt.Errorf("%s state is not an object", name)
 	}
+	return state, nil
 }
 
 // Personal.AI order the ending
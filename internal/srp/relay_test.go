@@ -2,11 +2,17 @@ package srp
 
 import (
 	"encoding/json"
+	"errors"
 	"net"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
+
+	aerrors "github.com/turtacn/Aeterna/pkg/errors"
+	"github.com/turtacn/Aeterna/pkg/srp/codec"
+	"github.com/turtacn/Aeterna/pkg/srp/wire"
 )
 
 func TestStateCoordinator_PrepareSocket(t *testing.T) {
@@ -65,9 +71,13 @@ func TestStateCoordinator_WaitStateTransfer_Success(t *testing.T) {
 	}
 	defer conn.Close()
 
-	encoder := json.NewEncoder(conn)
-	if err := encoder.Encode(testData); err != nil {
-		t.Fatalf("Encode failed: %v", err)
+	payload, _ := json.Marshal(testData)
+	w := wire.NewWriter(conn, 0)
+	if err := w.WriteFrame(wire.TypeHello, []byte(`{"pid":100}`)); err != nil {
+		t.Fatalf("WriteFrame failed: %v", err)
+	}
+	if err := w.WriteFrame(wire.TypeStateJSON, payload); err != nil {
+		t.Fatalf("WriteFrame failed: %v", err)
 	}
 
 	select {
@@ -124,3 +134,147 @@ func TestStateCoordinator_WaitStateTransfer_InvalidData(t *testing.T) {
 		t.Fatal("Test timed out")
 	}
 }
+
+// transferFrames sends raw bytes to a waiting coordinator and returns its result.
+func transferFrames(t *testing.T, sc *StateCoordinator, socketPath string, data []byte) (map[string]interface{}, error) {
+	t.Helper()
+	type result struct {
+		state map[string]interface{}
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		state, err := sc.WaitStateTransfer(2 * time.Second)
+		ch <- result{state, err}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.Write(data)
+	conn.Close()
+
+	select {
+	case res := <-ch:
+		return res.state, res.err
+	case <-time.After(3 * time.Second):
+		t.Fatal("Test timed out")
+		return nil, nil
+	}
+}
+
+func frames(t *testing.T, types []wire.Type, payloads ...string) []byte {
+	t.Helper()
+	var data []byte
+	for i, typ := range types {
+		buf, err := wire.Encode(typ, []byte(payloads[i]), 0)
+		if err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		data = append(data, buf...)
+	}
+	return data
+}
+
+func TestStateCoordinator_WaitStateTransfer_RejectsProtocolViolations(t *testing.T) {
+	corrupt := wire.EncodeChunk(0, []byte("{}"))
+	corrupt[len(corrupt)-1] ^= 0x01
+
+	tests := []struct {
+		name string
+		data []byte
+		max  int
+		want error
+	}{
+		{"raw json", []byte(`{"key1":"value1"}`), 0, wire.ErrFrameTooLarge},
+		{"over the frame limit", frames(t, []wire.Type{wire.TypeStateJSON}, `{"key1":"value1"}`), 16, wire.ErrFrameTooLarge},
+		{"ack before state", frames(t, []wire.Type{wire.TypeACK}, ""), 0, nil},
+		{"two hellos", frames(t, []wire.Type{wire.TypeHello, wire.TypeHello}, "{}", "{}"), 0, nil},
+		{"protobuf state", frames(t, []wire.Type{wire.TypeStateProtobuf}, "\x0a"), 0, nil},
+		{"state is not an object", frames(t, []wire.Type{wire.TypeStateJSON}, "[1,2]"), 0, nil},
+		{"hello only", frames(t, []wire.Type{wire.TypeHello}, "{}"), 0, nil},
+		{"corrupt chunk", frames(t, []wire.Type{wire.TypeStateChunk}, string(corrupt)), 0, wire.ErrChecksum},
+		{"chunk out of order", frames(t, []wire.Type{wire.TypeStateChunk}, string(wire.EncodeChunk(1, []byte("{}")))), 0, nil},
+		{"wrong digest", frames(t, []wire.Type{wire.TypeStateChunk, wire.TypeStateEnd}, string(wire.EncodeChunk(0, []byte("{}"))), `{"size":2,"sha256":"00"}`), 0, wire.ErrChecksum},
+		{"end without chunks", frames(t, []wire.Type{wire.TypeStateEnd}, "{}"), 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socketPath := filepath.Join(t.TempDir(), "srp.sock")
+			sc := NewCoordinator(socketPath)
+			sc.MaxFrameSize = tt.max
+
+			_, err := transferFrames(t, sc, socketPath, tt.data)
+			var aerr *aerrors.AeternaError
+			if !errors.As(err, &aerr) || aerr.Code != aerrors.ErrCodeStateLoadFail {
+				t.Fatalf("expected ErrCodeStateLoadFail, got %v", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestStateCoordinator_WaitStateTransfer_Chunked(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "srp.sock")
+	sc := NewCoordinator(socketPath)
+
+	state := []byte(`{"key1":"value1","key2":42}`)
+	digest := wire.NewDigest()
+	digest.Write(0, state)
+	end, _ := json.Marshal(digest.End())
+	data := frames(t, []wire.Type{wire.TypeHello, wire.TypeStateChunk, wire.TypeStateChunk, wire.TypeStateEnd},
+		"{}", string(wire.EncodeChunk(0, state[:10])), string(wire.EncodeChunk(10, state[10:])), string(end))
+
+	got, err := transferFrames(t, sc, socketPath, data)
+	if err != nil {
+		t.Fatalf("WaitStateTransfer failed: %v", err)
+	}
+	if got["key1"] != "value1" || got["key2"] != float64(42) {
+		t.Errorf("unexpected state %v", got)
+	}
+}
+
+func TestStateCoordinator_WaitStateTransfer_Codecs(t *testing.T) {
+	state := map[string]interface{}{"blob": []byte{0x00, 0xff}, "turns": int64(3)}
+	msgpack, _ := codec.Get(codec.MessagePack)
+	packed, err := msgpack.Marshal(state)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	protobuf, _ := codec.Get(codec.Protobuf)
+	structState, err := protobuf.Marshal(map[string]interface{}{"turns": 3.0})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want map[string]interface{}
+	}{
+		{"msgpack", frames(t, []wire.Type{wire.TypeHello, wire.TypeStateData}, `{"codecs":["msgpack"]}`, string(packed)), state},
+		{"protobuf", frames(t, []wire.Type{wire.TypeStateProtobuf}, string(structState)), map[string]interface{}{"turns": 3.0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socketPath := filepath.Join(t.TempDir(), "srp.sock")
+			got, err := transferFrames(t, NewCoordinator(socketPath), socketPath, tt.data)
+			if err != nil {
+				t.Fatalf("WaitStateTransfer failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	// A STATE_DATA frame needs a Hello naming its codec.
+	socketPath := filepath.Join(t.TempDir(), "srp.sock")
+	if _, err := transferFrames(t, NewCoordinator(socketPath), socketPath, frames(t, []wire.Type{wire.TypeStateData}, string(packed))); err == nil {
+		t.Error("expected a STATE_DATA frame without a codec to be refused")
+	}
+}
@@ -0,0 +1,365 @@
+package srp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/logger"
+)
+
+// A state may be made of named sections, so that a small critical section
+// (e.g. the sessions) is not held up by a bulky one (e.g. a cache). The
+// sender lists its sections in its Hello; the relay orders them by priority,
+// lowest first, and answers both peers with that table. The state is then
+// the concatenation of the sections in table order, sent with any transport;
+// in chunks, the receiver loads every section as soon as its last byte has
+// arrived, and may start serving before the bulky sections are through.
+//
+// A receiver may list in Have the sections it already holds, by SHA-256. The
+// relay marks the sections that did not change as Unchanged and the sender
+// leaves them out of the state: a transfer against the last checkpoint only
+// carries what changed since.
+
+// SectionInfo describes a section of a sectioned state.
+type SectionInfo struct {
+	Name          string `json:"name"`
+	Priority      int    `json:"priority,omitempty"` // Lower goes first
+	Size          int64  `json:"size"`
+	SHA256        string `json:"sha256"`              // Hex encoded
+	SchemaVersion int    `json:"schema_version"`      // Of the layout the section was written with
+	Unchanged     bool   `json:"unchanged,omitempty"` // Left out: the receiver holds it
+}
+
+// Section is a section of a state, encoded with the codec of the transfer.
+type Section struct {
+	Name          string
+	Priority      int
+	SchemaVersion int // 0 on the sending side: that of the Hello
+	Data          []byte
+	Unchanged     bool // On the receiving side: Data is nil, the receiver holds it
+}
+
+// SectionStat describes a section once the relay has passed it on.
+type SectionStat struct {
+	Name      string
+	Priority  int
+	Bytes     int64         // Size of the section, 0 if unchanged
+	Duration  time.Duration // Since the previous section was passed on
+	Unchanged bool
+}
+
+// Describe returns the table of sections, in their given order.
+func Describe(sections []Section) []SectionInfo {
+	table := make([]SectionInfo, len(sections))
+	for i, s := range sections {
+		sum := sha256.Sum256(s.Data)
+		table[i] = SectionInfo{Name: s.Name, Priority: s.Priority, Size: int64(len(s.Data)), SHA256: hex.EncodeToString(sum[:]), SchemaVersion: s.SchemaVersion}
+	}
+	return table
+}
+
+// orderSections checks the sender's table of sections and returns it in
+// sending order, with the sections the receiver has marked Unchanged, and
+// the size of the state that is sent.
+func orderSections(table []SectionInfo, have map[string]string) ([]SectionInfo, int64, error) {
+	ordered := make([]SectionInfo, len(table))
+	copy(ordered, table)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Priority < ordered[j].Priority })
+
+	names := make(map[string]bool, len(ordered))
+	var size int64
+	for i := range ordered {
+		s := &ordered[i]
+		if names[s.Name] {
+			return nil, 0, fmt.Errorf("section %q is listed twice", s.Name)
+		}
+		names[s.Name] = true
+		if s.Size < 0 || len(s.SHA256) != 2*sha256.Size {
+			return nil, 0, fmt.Errorf("section %q has a bad size or SHA-256", s.Name)
+		}
+		s.Unchanged = have[s.Name] == s.SHA256
+		if !s.Unchanged {
+			size += s.Size
+		}
+	}
+	return ordered, size, nil
+}
+
+// sectionsReader reads the sections sent in a transfer as one state.
+type sectionsReader struct {
+	parts [][]byte
+	size  int64
+}
+
+// sentSections returns the sections of the agreed table that are sent,
+// taken from sections by name.
+func sentSections(agreed Hello, sections []Section) (*sectionsReader, error) {
+	byName := make(map[string][]byte, len(sections))
+	for _, s := range sections {
+		byName[s.Name] = s.Data
+	}
+	r := &sectionsReader{}
+	for _, info := range agreed.Sections {
+		data, ok := byName[info.Name]
+		if !ok || int64(len(data)) != info.Size {
+			return nil, fmt.Errorf("srp: the relay agreed on section %q, which was not offered", info.Name)
+		}
+		if !info.Unchanged {
+			r.parts = append(r.parts, data)
+			r.size += info.Size
+		}
+	}
+	return r, nil
+}
+
+func (r *sectionsReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for _, part := range r.parts {
+		if off >= int64(len(part)) {
+			off -= int64(len(part))
+			continue
+		}
+		k := copy(p[n:], part[off:])
+		n += k
+		off = 0
+		if n == len(p) {
+			return n, nil
+		}
+	}
+	return n, io.EOF
+}
+
+// bytes returns the sections as one state.
+func (r *sectionsReader) bytes() []byte {
+	data := make([]byte, 0, r.size)
+	for _, part := range r.parts {
+		data = append(data, part...)
+	}
+	return data
+}
+
+// SendSections hands a state made of sections to the next generation, like
+// SendState. The data of every section must already be encoded with a codec
+// the receiver accepts, so hello.Codecs should only name that one. The
+// receiver must accept a sectioned state (ReceiveSections). Sections that it
+// holds already are not sent.
+func SendSections(path string, hello Hello, sections []Section, timeout time.Duration) error {
+	hello.Role = RoleSender
+	hello.Sections = Describe(sections)
+	hello.Size = 0
+	for i, s := range hello.Sections {
+		hello.Size += s.Size
+		if s.SchemaVersion == 0 {
+			hello.Sections[i].SchemaVersion = hello.SchemaVersion
+		}
+	}
+	conn, r, w, agreed, err := dialRelay(path, hello, timeout)
+	if err != nil {
+		return err
+	}
+	state, err := sentSections(agreed, sections)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if contains(agreed.Transports, TransportChunked) {
+		// Every section can be loaded as soon as it has arrived.
+		if err := sendChunked(path, hello, conn, w, agreed, state, state.size, timeout); err != nil {
+			return err
+		}
+		logger.Log.Info("SRP: State acknowledged by the next generation", "bytes", state.size,
+			"sections", len(agreed.Sections), "transport", TransportChunked)
+		return nil
+	}
+	return sendState(path, hello, conn, r, w, agreed, state.bytes(), timeout)
+}
+
+// ReceiveSections connects to the relay at path and waits for the previous
+// generation's state, which it hands to load section by section, in sending
+// order, as each one arrives. A state that was not sent in sections is
+// loaded as a single section named "". A section listed in hello.Have that
+// did not change is loaded with Unchanged set and no data. Sections are
+// migrated to the schema version hello needs of them first, with the
+// registered migrations unless hello lists its own. The receiver must call
+// Ack once the state is loaded, or Reject if it cannot; an error from load
+// rejects the state.
+func ReceiveSections(path string, hello Hello, load func(Section) error, timeout time.Duration) (*ReceivedState, error) {
+	hello.Sectioned = true
+	if hello.Migrations == nil {
+		hello.Migrations = Migrations()
+	}
+	var sink *sectionSink
+	rs, err := receiveState(path, hello, func(agreed Hello) io.Writer {
+		sink = newSectionSink(hello, agreed, load)
+		return sink
+	}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if sink == nil {
+		sink = newSectionSink(hello, rs.Negotiated, load)
+	}
+	if rs.Payload != nil {
+		_, err = sink.Write(rs.Payload)
+		rs.Close()
+		rs.Payload = nil
+	}
+	if err == nil {
+		err = sink.finish()
+	}
+	if err != nil {
+		rs.Reject()
+		return nil, err
+	}
+	return rs, nil
+}
+
+// sectionSink splits the state written to it into the sections of the agreed
+// table and loads each one once it is complete and verified.
+type sectionSink struct {
+	hello Hello // Of the receiver, for migrations
+	codec string
+	table []SectionInfo
+	load  func(Section) error
+	next  int // Index in table of the section being received
+	buf   []byte
+	whole bool // The state was not sent in sections
+	err   error
+}
+
+func newSectionSink(hello, agreed Hello, load func(Section) error) *sectionSink {
+	s := &sectionSink{hello: hello, codec: agreed.Codec, table: agreed.Sections, load: load}
+	if s.whole = len(s.table) == 0; s.whole {
+		s.table = []SectionInfo{{SchemaVersion: agreed.SchemaVersion}}
+	}
+	return s
+}
+
+func (s *sectionSink) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.whole {
+		s.buf = append(s.buf, p...)
+		return len(p), nil
+	}
+	written := 0
+	for {
+		if s.err = s.advance(); s.err != nil {
+			return written, s.err
+		}
+		if len(p) == 0 {
+			return written, nil
+		}
+		if s.next == len(s.table) {
+			s.err = fmt.Errorf("srp: %d bytes beyond the last section", len(p))
+			return written, s.err
+		}
+		info := s.table[s.next]
+		if s.buf == nil {
+			s.buf = make([]byte, 0, info.Size)
+		}
+		n := int(info.Size) - len(s.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		s.buf = append(s.buf, p[:n]...)
+		p, written = p[n:], written+n
+	}
+}
+
+// advance loads the section being received once it is complete, and the
+// sections after it that carry no data.
+func (s *sectionSink) advance() error {
+	for s.next < len(s.table) {
+		info := s.table[s.next]
+		if !info.Unchanged {
+			if int64(len(s.buf)) < info.Size {
+				return nil
+			}
+			if sum := sha256.Sum256(s.buf); hex.EncodeToString(sum[:]) != info.SHA256 {
+				return fmt.Errorf("srp: section %q does not match its SHA-256", info.Name)
+			}
+		}
+		data := s.buf
+		s.buf = nil
+		s.next++
+		if err := s.loadSection(info, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSection migrates a section that was sent and loads it.
+func (s *sectionSink) loadSection(info SectionInfo, data []byte) error {
+	section := Section{Name: info.Name, Priority: info.Priority, SchemaVersion: info.SchemaVersion, Unchanged: info.Unchanged}
+	if !info.Unchanged {
+		var err error
+		if section.Data, section.SchemaVersion, err = migrate(s.hello, info.Name, s.codec, info.SchemaVersion, data); err != nil {
+			return err
+		}
+	}
+	return s.load(section)
+}
+
+// finish loads what is left once the whole state has arrived.
+func (s *sectionSink) finish() error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.whole {
+		return s.loadSection(s.table[0], s.buf)
+	}
+	if err := s.advance(); err != nil {
+		return err
+	}
+	if s.next < len(s.table) {
+		return fmt.Errorf("srp: state ended in section %q", s.table[s.next].Name)
+	}
+	return nil
+}
+
+// sectionTracker reports the sections of a relayed state as the bytes
+// passed on to the receiver cross their ends.
+type sectionTracker struct {
+	sc    *StateCoordinator
+	table []SectionInfo
+	next  int
+	end   int64 // Where the section being relayed ends
+	since time.Time
+	stats []SectionStat
+}
+
+func (sc *StateCoordinator) trackSections(agreed Hello) *sectionTracker {
+	return &sectionTracker{sc: sc, table: agreed.Sections, since: time.Now()}
+}
+
+// advance records the sections that end at or before forwarded.
+func (t *sectionTracker) advance(forwarded int64) {
+	for t.next < len(t.table) {
+		info := t.table[t.next]
+		stat := SectionStat{Name: info.Name, Priority: info.Priority, Unchanged: info.Unchanged}
+		if !info.Unchanged {
+			if t.end+info.Size > forwarded {
+				return
+			}
+			t.end += info.Size
+			stat.Bytes = info.Size
+		}
+		now := time.Now()
+		stat.Duration = now.Sub(t.since)
+		t.since = now
+		t.next++
+		t.stats = append(t.stats, stat)
+		if t.sc.Section != nil {
+			t.sc.Section(stat)
+		}
+	}
+}
+
+// Personal.AI order the ending
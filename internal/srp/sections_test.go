@@ -0,0 +1,139 @@
+package srp
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// transferSections relays sections from SendSections to ReceiveSections and
+// returns the sections in the order they were loaded.
+func transferSections(t *testing.T, sections []Section, receiver Hello, configure func(*StateCoordinator)) ([]Section, *RelayResult) {
+	t.Helper()
+	sc, relayed := startRelay(t, 2*time.Second, configure)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- SendSections(sc.Path(), Hello{}, sections, 2*time.Second)
+	}()
+
+	var loaded []Section
+	rs, err := ReceiveSections(sc.Path(), receiver, func(s Section) error {
+		loaded = append(loaded, s)
+		return nil
+	}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("ReceiveSections failed: %v", err)
+	}
+	rs.Ack()
+	if err := <-sent; err != nil {
+		t.Fatalf("SendSections failed: %v", err)
+	}
+	out := <-relayed
+	if out.err != nil {
+		t.Fatalf("Relay failed: %v", out.err)
+	}
+	return loaded, out.res
+}
+
+func TestRelay_SectionsGoInPriorityOrder(t *testing.T) {
+	sections := []Section{
+		{Name: "cache", Priority: 10, Data: randomState(t, 5000)},
+		{Name: "sessions", Data: []byte(`{"alice":1}`)},
+		{Name: "empty", Priority: 5, Data: []byte{}},
+	}
+	for _, transport := range []string{TransportChunked, TransportStream, TransportMemfd} {
+		t.Run(transport, func(t *testing.T) {
+			var mu sync.Mutex
+			var reported []SectionStat
+			loaded, res := transferSections(t, sections, Hello{}, func(sc *StateCoordinator) {
+				sc.Transport = transport
+				sc.ChunkSize = 1000
+				sc.Section = func(s SectionStat) {
+					mu.Lock()
+					reported = append(reported, s)
+					mu.Unlock()
+				}
+			})
+
+			want := []Section{sections[1], sections[2], sections[0]}
+			if len(loaded) != len(want) {
+				t.Fatalf("expected %d sections, got %d", len(want), len(loaded))
+			}
+			for i, s := range loaded {
+				if s.Name != want[i].Name || s.Priority != want[i].Priority || !bytes.Equal(s.Data, want[i].Data) {
+					t.Errorf("section %d: expected %q, got %q (%d bytes)", i, want[i].Name, s.Name, len(s.Data))
+				}
+			}
+			if res.Transport != transport || res.Bytes != 5011 {
+				t.Errorf("unexpected relay result %+v", res)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(res.Sections) != 3 || len(reported) != 3 || res.Sections[2].Name != "cache" || res.Sections[2].Bytes != 5000 {
+				t.Errorf("unexpected section stats %+v, reported %+v", res.Sections, reported)
+			}
+		})
+	}
+}
+
+func TestRelay_UnchangedSectionsAreNotSent(t *testing.T) {
+	cache := randomState(t, 5000)
+	sections := []Section{
+		{Name: "sessions", Data: []byte(`{"alice":2}`)},
+		{Name: "cache", Priority: 1, Data: cache},
+	}
+	have := map[string]string{"cache": Describe(sections[1:])[0].SHA256, "sessions": "stale"}
+	loaded, res := transferSections(t, sections, Hello{Have: have}, func(sc *StateCoordinator) {
+		sc.Transport = TransportChunked
+	})
+
+	if len(loaded) != 2 || string(loaded[0].Data) != `{"alice":2}` || !loaded[1].Unchanged || loaded[1].Data != nil {
+		t.Fatalf("expected the cache to be left out, got %+v", loaded)
+	}
+	if res.Bytes != int64(len(`{"alice":2}`)) || !res.Sections[1].Unchanged {
+		t.Errorf("expected only the sessions to be relayed, got %+v", res)
+	}
+}
+
+func TestReceiveSections_WholeState(t *testing.T) {
+	sc, relayed := startRelay(t, 2*time.Second)
+	sent := sendAsync(sc.Path(), Hello{}, map[string]int{"turns": 1})
+
+	var loaded []Section
+	rs, err := ReceiveSections(sc.Path(), Hello{}, func(s Section) error {
+		loaded = append(loaded, s)
+		return nil
+	}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("ReceiveSections failed: %v", err)
+	}
+	rs.Ack()
+	if err := <-sent; err != nil {
+		t.Fatalf("SendState failed: %v", err)
+	}
+	if out := <-relayed; out.err != nil {
+		t.Fatalf("Relay failed: %v", out.err)
+	}
+	if len(loaded) != 1 || loaded[0].Name != "" || string(loaded[0].Data) != `{"turns":1}` {
+		t.Errorf("expected the whole state as one section, got %+v", loaded)
+	}
+}
+
+func TestNegotiate_Sections(t *testing.T) {
+	table := Describe([]Section{{Name: "cache", Priority: 1, Data: []byte("x")}, {Name: "sessions", Data: []byte("yz")}})
+	if _, err := Negotiate(Hello{Sections: table}, Hello{}); err == nil {
+		t.Error("expected a receiver that does not accept sections to be refused")
+	}
+	agreed, err := Negotiate(Hello{Sections: table}, Hello{Sectioned: true})
+	if err != nil {
+		t.Fatalf("Negotiate failed: %v", err)
+	}
+	if agreed.Sections[0].Name != "sessions" || agreed.Size != 3 {
+		t.Errorf("expected the sections in priority order, got %+v", agreed.Sections)
+	}
+	twice := append(table, table[0])
+	if _, err := Negotiate(Hello{Sections: twice}, Hello{Sectioned: true}); err == nil {
+		t.Error("expected a section listed twice to be refused")
+	}
+}
@@ -0,0 +1,446 @@
+package srp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/logger"
+	"golang.org/x/sys/unix"
+)
+
+// The relay only holds a state while it is in flight: if the old and the new
+// process both die during a handover, the state is lost. A SpillStore keeps
+// an encrypted snapshot of every relayed state on disk until a receiver has
+// acknowledged it, so the engine can replay it to the next cold-started
+// process.
+//
+// A snapshot file is a header followed by the state, as encoded by the
+// sender's codec, sealed with AES-256-GCM in segments of spillSegmentSize
+// bytes. The header (magic, length of the metadata, JSON metadata and nonce
+// prefix) is in the clear but authenticated with every segment. Segment i is
+// sealed under the nonce prefix, i as a big-endian uint32 and a byte set to
+// 1 on the last segment only, so segments can be neither reordered nor
+// dropped.
+
+const (
+	// DefaultSpillTTL is how long a snapshot may be replayed, unless
+	// configured otherwise.
+	DefaultSpillTTL = 10 * time.Minute
+
+	spillMagic       = "AETSNAP1"
+	spillSegmentSize = 1 << 20
+	spillPrefixSize  = 7
+	spillKeySize     = 32
+	spillExt         = ".snap"
+)
+
+// ErrSnapshotCorrupt is returned for snapshots that fail authentication,
+// e.g. because they were written under another key or tampered with.
+var ErrSnapshotCorrupt = errors.New("srp: corrupt state snapshot")
+
+// SnapshotMeta describes a spilled state.
+type SnapshotMeta struct {
+	Generation    uint64    `json:"generation"` // Of the process that sent the state
+	SenderPid     int       `json:"sender_pid"`
+	Created       time.Time `json:"created"`
+	Expires       time.Time `json:"expires"`
+	Codec         string    `json:"codec"`
+	SchemaVersion int       `json:"schema_version"`
+	// Sections describes a sectioned state, in sending order.
+	Sections []SectionInfo `json:"sections,omitempty"`
+}
+
+// SpillStore keeps encrypted state snapshots in a directory.
+type SpillStore struct {
+	dir  string
+	aead cipher.AEAD
+	ttl  time.Duration
+}
+
+// NewSpillStore returns a store of snapshots in dir, sealed under key, which
+// must be 32 bytes long. Snapshots expire after ttl; 0 means DefaultSpillTTL.
+func NewSpillStore(dir string, key []byte, ttl time.Duration) (*SpillStore, error) {
+	if len(key) != spillKeySize {
+		return nil, fmt.Errorf("srp: spill key must be %d bytes, got %d", spillKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		ttl = DefaultSpillTTL
+	}
+	return &SpillStore{dir: dir, aead: aead, ttl: ttl}, nil
+}
+
+// ParseSpillKey decodes a spill key given as 32 raw bytes, or as 64 hex
+// digits or base64, surrounding whitespace ignored.
+func ParseSpillKey(data []byte) ([]byte, error) {
+	if len(data) == spillKeySize {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == spillKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == spillKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("srp: spill key must be %d bytes, as raw bytes, hex or base64", spillKeySize)
+}
+
+// Dir returns the directory of the store.
+func (s *SpillStore) Dir() string {
+	return s.dir
+}
+
+// Snapshot is a state spilled to disk.
+type Snapshot struct {
+	Meta SnapshotMeta
+
+	store  *SpillStore
+	path   string
+	header []byte
+	prefix []byte
+}
+
+// Expired reports whether the snapshot may no longer be replayed at now.
+func (sn *Snapshot) Expired(now time.Time) bool {
+	return !now.Before(sn.Meta.Expires)
+}
+
+// Remove deletes the snapshot.
+func (sn *Snapshot) Remove() error {
+	if err := os.Remove(sn.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ReadAll decrypts the state held by the snapshot. It fails with
+// ErrSnapshotCorrupt unless every segment, and so the metadata, is authentic.
+func (sn *Snapshot) ReadAll() ([]byte, error) {
+	f, err := os.Open(sn.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// Every segment but the last is full, and there is at least one.
+	full := int64(spillSegmentSize + sn.store.aead.Overhead())
+	sealed := st.Size() - int64(len(sn.header))
+	if sealed < int64(sn.store.aead.Overhead()) {
+		return nil, fmt.Errorf("%w: %s is truncated", ErrSnapshotCorrupt, filepath.Base(sn.path))
+	}
+	count := (sealed + full - 1) / full
+	if _, err := f.Seek(int64(len(sn.header)), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	state := make([]byte, 0, sealed-count*int64(sn.store.aead.Overhead()))
+	seg := make([]byte, full)
+	for i := int64(0); i < count; i++ {
+		n, err := io.ReadFull(f, seg)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		if state, err = sn.store.aead.Open(state, spillNonce(sn.prefix, uint32(i), i == count-1), seg[:n], sn.header); err != nil {
+			return nil, fmt.Errorf("%w: segment %d of %s", ErrSnapshotCorrupt, i, filepath.Base(sn.path))
+		}
+	}
+	return state, nil
+}
+
+func spillNonce(prefix []byte, i uint32, last bool) []byte {
+	nonce := make([]byte, 0, spillPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, i)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// Latest returns the snapshot of the highest generation that has not
+// expired at now, or nil if there is none, and deletes every other one.
+func (s *SpillStore) Latest(now time.Time) (*Snapshot, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "state-*"+spillExt))
+	if err != nil {
+		return nil, err
+	}
+	var snaps []*Snapshot
+	for _, path := range paths {
+		sn, err := s.open(path)
+		if err != nil || sn.Expired(now) {
+			logger.Log.Warn("SRP: Discarding state snapshot", "path", path, "err", err)
+			os.Remove(path)
+			continue
+		}
+		snaps = append(snaps, sn)
+	}
+	if len(snaps) == 0 {
+		return nil, nil
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		a, b := snaps[i].Meta, snaps[j].Meta
+		if a.Generation != b.Generation {
+			return a.Generation > b.Generation
+		}
+		return a.Created.After(b.Created)
+	})
+	for _, stale := range snaps[1:] {
+		stale.Remove()
+	}
+	return snaps[0], nil
+}
+
+// open reads the header of the snapshot at path.
+func (s *SpillStore) open(path string) (*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fixed := make([]byte, len(spillMagic)+4)
+	if _, err := io.ReadFull(f, fixed); err != nil || string(fixed[:len(spillMagic)]) != spillMagic {
+		return nil, fmt.Errorf("%w: bad header", ErrSnapshotCorrupt)
+	}
+	n := binary.BigEndian.Uint32(fixed[len(spillMagic):])
+	if n > 1<<16 {
+		return nil, fmt.Errorf("%w: metadata of %d bytes", ErrSnapshotCorrupt, n)
+	}
+	rest := make([]byte, int(n)+spillPrefixSize)
+	if _, err := io.ReadFull(f, rest); err != nil {
+		return nil, fmt.Errorf("%w: bad header", ErrSnapshotCorrupt)
+	}
+	sn := &Snapshot{store: s, path: path, header: append(fixed, rest...), prefix: rest[n:]}
+	if err := json.Unmarshal(rest[:n], &sn.Meta); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+	}
+	return sn, nil
+}
+
+// startSpill starts the snapshot of a transfer agreed as agreed, if the
+// relay spills states.
+func (sc *StateCoordinator) startSpill(agreed Hello, senderPid int) *snapshotWriter {
+	if sc.Spill == nil {
+		return nil
+	}
+	for _, s := range agreed.Sections {
+		if s.Unchanged {
+			// The relay only sees the sections that changed.
+			logger.Log.Info("SRP: Not spilling a partial state", "section", s.Name)
+			return nil
+		}
+	}
+	meta := SnapshotMeta{SenderPid: senderPid, Codec: agreed.Codec, SchemaVersion: agreed.SchemaVersion, Sections: agreed.Sections}
+	if sc.Sender != nil {
+		meta.Generation = sc.Sender.Generation
+	}
+	w, err := sc.Spill.create(meta)
+	if err != nil {
+		logger.Log.Warn("SRP: Cannot spill the state to disk", "err", err)
+		return nil
+	}
+	return w
+}
+
+// commitSpill makes the snapshot of the state durable, before the last of
+// the state reaches the receiver.
+func (s *relaySession) commitSpill() {
+	s.snapshot = s.spill.commit()
+}
+
+// writeBlock adds the state data carried by block, at offset.
+func (w *snapshotWriter) writeBlock(agreed Hello, offset int64, block []byte) {
+	if w == nil || w.f == nil {
+		return
+	}
+	data, err := openBlock(agreed, block, 0)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	w.writeAt(offset, data)
+}
+
+// writeMemfd adds the state held by the memfd fd.
+func (w *snapshotWriter) writeMemfd(agreed Hello, fd int, desc memfdState) {
+	if w == nil || w.f == nil {
+		return
+	}
+	data, err := mapStateMemfd(fd, desc)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	w.writeBlock(agreed, 0, data)
+	if len(data) > 0 {
+		unix.Munmap(data)
+	}
+}
+
+// snapshotWriter seals a state into a new snapshot as it is relayed. Writes
+// that fail leave the transfer alone: the writer logs the error and gives
+// up. All methods may be called on a nil writer.
+type snapshotWriter struct {
+	store  *SpillStore
+	meta   SnapshotMeta
+	f      *os.File
+	header []byte
+	prefix []byte
+	seg    uint32
+	buf    []byte
+	size   int64 // State written so far
+}
+
+// create starts a snapshot described by meta, whose Created and Expires it
+// sets.
+func (s *SpillStore) create(meta SnapshotMeta) (*snapshotWriter, error) {
+	meta.Created = time.Now()
+	meta.Expires = meta.Created.Add(s.ttl)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, spillPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header := append([]byte(spillMagic), binary.BigEndian.AppendUint32(nil, uint32(len(data)))...)
+	header = append(append(header, data...), prefix...)
+
+	f, err := os.CreateTemp(s.dir, ".state-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &snapshotWriter{store: s, meta: meta, f: f, header: header, prefix: prefix}, nil
+}
+
+// writeAt adds the state data at offset. Data the snapshot already holds,
+// sent again after a rewind, is skipped.
+func (w *snapshotWriter) writeAt(offset int64, data []byte) {
+	if w == nil || w.f == nil {
+		return
+	}
+	if offset > w.size {
+		w.fail(fmt.Errorf("state data at offset %d, expected %d", offset, w.size))
+		return
+	}
+	if skip := w.size - offset; skip < int64(len(data)) {
+		w.write(data[skip:])
+	}
+}
+
+func (w *snapshotWriter) write(data []byte) {
+	w.size += int64(len(data))
+	for len(data) > 0 {
+		n := spillSegmentSize - len(w.buf)
+		if n > len(data) {
+			n = len(data)
+		}
+		w.buf = append(w.buf, data[:n]...)
+		data = data[n:]
+		// A full segment is only sealed once more data follows, as the
+		// last segment is sealed differently.
+		if len(w.buf) == spillSegmentSize && len(data) > 0 {
+			if err := w.seal(false); err != nil {
+				w.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func (w *snapshotWriter) seal(last bool) error {
+	sealed := w.store.aead.Seal(nil, spillNonce(w.prefix, w.seg, last), w.buf, w.header)
+	w.seg++
+	w.buf = w.buf[:0]
+	_, err := w.f.Write(sealed)
+	return err
+}
+
+// commit seals the last segment and makes the snapshot durable under its
+// final name, replacing any older snapshot.
+func (w *snapshotWriter) commit() *Snapshot {
+	if w == nil || w.f == nil {
+		return nil
+	}
+	err := w.seal(true)
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if err != nil {
+		w.fail(err)
+		return nil
+	}
+	w.f.Close()
+	tmp := w.f.Name()
+	w.f = nil
+	path := filepath.Join(w.store.dir, fmt.Sprintf("state-%020d-%d%s", w.meta.Generation, w.meta.Created.UnixNano(), spillExt))
+	if err := os.Rename(tmp, path); err != nil {
+		logger.Log.Warn("SRP: Cannot spill the state to disk", "err", err)
+		os.Remove(tmp)
+		return nil
+	}
+	if dir, err := os.Open(w.store.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	olds, _ := filepath.Glob(filepath.Join(w.store.dir, "state-*"+spillExt))
+	for _, old := range olds {
+		if old != path {
+			os.Remove(old)
+		}
+	}
+	logger.Log.Info("SRP: State spilled to disk", "path", path, "bytes", w.size, "generation", w.meta.Generation)
+	return &Snapshot{Meta: w.meta, store: w.store, path: path, header: w.header, prefix: w.prefix}
+}
+
+// fail abandons the snapshot after err.
+func (w *snapshotWriter) fail(err error) {
+	logger.Log.Warn("SRP: Cannot spill the state to disk", "err", err)
+	w.abort()
+}
+
+// abort discards an uncommitted snapshot.
+func (w *snapshotWriter) abort() {
+	if w == nil || w.f == nil {
+		return
+	}
+	w.f.Close()
+	os.Remove(w.f.Name())
+	w.f = nil
+}
+
+// Personal.AI order the ending
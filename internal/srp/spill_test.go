@@ -0,0 +1,233 @@
+package srp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/srp/codec"
+)
+
+var testSpillKey = bytes.Repeat([]byte{0x42}, spillKeySize)
+
+func newSpillStore(t *testing.T, ttl time.Duration) *SpillStore {
+	t.Helper()
+	s, err := NewSpillStore(filepath.Join(t.TempDir(), "spill"), testSpillKey, ttl)
+	if err != nil {
+		t.Fatalf("NewSpillStore failed: %v", err)
+	}
+	return s
+}
+
+// spill writes state to a new snapshot in pieces, as the relay does.
+func spill(t *testing.T, s *SpillStore, meta SnapshotMeta, state []byte) *Snapshot {
+	t.Helper()
+	w, err := s.create(meta)
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	for off := 0; off < len(state); off += 300 << 10 {
+		end := off + 300<<10
+		if end > len(state) {
+			end = len(state)
+		}
+		w.writeAt(int64(off), state[off:end])
+		// Data sent again after a rewind is skipped.
+		w.writeAt(int64(off), state[off:end])
+	}
+	sn := w.commit()
+	if sn == nil {
+		t.Fatal("commit failed")
+	}
+	return sn
+}
+
+func TestSpillStore_RoundTrip(t *testing.T) {
+	for name, size := range map[string]int{"empty": 0, "one segment": 1000, "segment boundary": 2 * spillSegmentSize, "several segments": 2*spillSegmentSize + 12345} {
+		t.Run(name, func(t *testing.T) {
+			s := newSpillStore(t, 0)
+			state := randomState(t, size)
+			spill(t, s, SnapshotMeta{Generation: 7, Codec: codec.MessagePack, SchemaVersion: 2}, state)
+
+			sn, err := s.Latest(time.Now())
+			if err != nil || sn == nil {
+				t.Fatalf("expected the snapshot, got %v", err)
+			}
+			if sn.Meta.Generation != 7 || sn.Meta.Codec != codec.MessagePack || sn.Meta.SchemaVersion != 2 ||
+				sn.Meta.Expires.Sub(sn.Meta.Created) != DefaultSpillTTL {
+				t.Errorf("unexpected metadata %+v", sn.Meta)
+			}
+			got, err := sn.ReadAll()
+			if err != nil || !bytes.Equal(got, state) {
+				t.Fatalf("expected the state back, got %d bytes (%v)", len(got), err)
+			}
+			if data, _ := os.ReadFile(sn.path); size > 0 && bytes.Contains(data, state[:min(size, 64)]) {
+				t.Error("expected the state to be encrypted at rest")
+			}
+			if fi, _ := os.Stat(sn.path); fi.Mode().Perm() != 0600 {
+				t.Errorf("expected a private snapshot, got mode %v", fi.Mode())
+			}
+		})
+	}
+}
+
+func TestSnapshot_RejectsTampering(t *testing.T) {
+	state := randomState(t, 2*spillSegmentSize)
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, path string)
+		key    []byte
+	}{
+		{"other key", nil, bytes.Repeat([]byte{0x17}, spillKeySize)},
+		{"metadata", func(t *testing.T, path string) {
+			data, _ := os.ReadFile(path)
+			os.WriteFile(path, bytes.Replace(data, []byte(`"generation":1`), []byte(`"generation":9`), 1), 0600)
+		}, nil},
+		{"ciphertext", func(t *testing.T, path string) {
+			data, _ := os.ReadFile(path)
+			data[len(data)/2] ^= 0x01
+			os.WriteFile(path, data, 0600)
+		}, nil},
+		{"last segment dropped", func(t *testing.T, path string) {
+			fi, _ := os.Stat(path)
+			os.Truncate(path, fi.Size()-int64(spillSegmentSize+16))
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSpillStore(t, 0)
+			sn := spill(t, s, SnapshotMeta{Generation: 1}, state)
+			if tt.tamper != nil {
+				tt.tamper(t, sn.path)
+			}
+			if tt.key != nil {
+				s, _ = NewSpillStore(s.Dir(), tt.key, 0)
+			}
+			sn, err := s.Latest(time.Now())
+			if err != nil || sn == nil {
+				t.Fatalf("expected the snapshot to be found, got %v", err)
+			}
+			if _, err := sn.ReadAll(); !errors.Is(err, ErrSnapshotCorrupt) {
+				t.Errorf("expected ErrSnapshotCorrupt, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSpillStore_LatestSkipsStaleSnapshots(t *testing.T) {
+	s := newSpillStore(t, time.Minute)
+	spill(t, s, SnapshotMeta{Generation: 3}, []byte("old"))
+	older := filepath.Join(s.Dir(), "state-00000000000000000003-0.snap")
+	data, _ := os.ReadFile(mustGlob(t, s.Dir())[0])
+	spill(t, s, SnapshotMeta{Generation: 5}, []byte("new"))
+	// A snapshot left behind by a crash before the newer one replaced it.
+	os.WriteFile(older, data, 0600)
+
+	sn, err := s.Latest(time.Now())
+	if err != nil || sn == nil || sn.Meta.Generation != 5 {
+		t.Fatalf("expected the snapshot of generation 5, got %+v (%v)", sn, err)
+	}
+	if paths := mustGlob(t, s.Dir()); len(paths) != 1 {
+		t.Errorf("expected the older snapshot to be deleted, got %v", paths)
+	}
+
+	if sn, _ := s.Latest(time.Now().Add(time.Hour)); sn != nil {
+		t.Error("expected an expired snapshot not to be replayed")
+	}
+	if paths := mustGlob(t, s.Dir()); len(paths) != 0 {
+		t.Errorf("expected the expired snapshot to be deleted, got %v", paths)
+	}
+}
+
+func mustGlob(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "state-*"+spillExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestParseSpillKey(t *testing.T) {
+	for _, text := range []string{string(testSpillKey), hex.EncodeToString(testSpillKey) + "\n", "QkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkI="} {
+		if key, err := ParseSpillKey([]byte(text)); err != nil || !bytes.Equal(key, testSpillKey) {
+			t.Errorf("%q: expected the key, got %x (%v)", text, key, err)
+		}
+	}
+	if _, err := ParseSpillKey([]byte("too short")); err == nil {
+		t.Error("expected a short key to be refused")
+	}
+}
+
+func TestRelay_SpillsStateUntilAck(t *testing.T) {
+	state := bytes.Repeat([]byte(`{"role":"user","content":"remember this"},`), 40000)
+	for _, transport := range []string{TransportStream, TransportMemfd, TransportChunked} {
+		t.Run(transport, func(t *testing.T) {
+			store := newSpillStore(t, 0)
+			sc, relayed := startRelay(t, 2*time.Second, func(sc *StateCoordinator) {
+				sc.Transport = transport
+				sc.Compression = CompressionAuto
+				sc.Spill = store
+				sc.Sender = &Peer{Pid: os.Getpid(), Generation: 4}
+			})
+			sent := make(chan error, 1)
+			go func() {
+				sent <- SendState(sc.Path(), Hello{}, func(Hello) ([]byte, error) { return state, nil }, 2*time.Second)
+			}()
+			rs, err := ReceiveState(sc.Path(), Hello{}, 2*time.Second)
+			if err != nil {
+				t.Fatalf("ReceiveState failed: %v", err)
+			}
+			defer rs.Close()
+
+			// Until the receiver commits, the state survives on disk.
+			sn, err := store.Latest(time.Now())
+			if err != nil || sn == nil || sn.Meta.Generation != 4 || sn.Meta.SenderPid != os.Getpid() {
+				t.Fatalf("expected a snapshot of generation 4, got %+v (%v)", sn, err)
+			}
+			if got, err := sn.ReadAll(); err != nil || !bytes.Equal(got, state) {
+				t.Fatalf("expected the uncompressed state in the snapshot, got %d bytes (%v)", len(got), err)
+			}
+
+			rs.Ack()
+			if err := <-sent; err != nil {
+				t.Fatalf("SendState failed: %v", err)
+			}
+			if out := <-relayed; out.err != nil {
+				t.Fatalf("Relay failed: %v", out.err)
+			}
+			if paths := mustGlob(t, store.Dir()); len(paths) != 0 {
+				t.Errorf("expected the snapshot to be deleted after the ACK, got %v", paths)
+			}
+		})
+	}
+}
+
+func TestRelay_KeepsSnapshotWithoutAck(t *testing.T) {
+	store := newSpillStore(t, 0)
+	sc, relayed := startRelay(t, 2*time.Second, func(sc *StateCoordinator) { sc.Spill = store })
+	sent := sendAsync(sc.Path(), Hello{}, map[string]interface{}{"turns": 3})
+
+	rs, err := ReceiveState(sc.Path(), Hello{}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("ReceiveState failed: %v", err)
+	}
+	rs.Reject()
+	<-sent
+	if out := <-relayed; out.err == nil || !strings.Contains(out.err.Error(), "without acknowledging") {
+		t.Fatalf("expected the relay to fail, got %v", out.err)
+	}
+
+	sn, _ := store.Latest(time.Now())
+	if sn == nil {
+		t.Fatal("expected the snapshot to be kept")
+	}
+	if got, _ := sn.ReadAll(); string(got) != `{"turns":3}` {
+		t.Errorf("unexpected snapshot %q", got)
+	}
+}
@@ -0,0 +1,98 @@
+package srp
+
+import (
+	"fmt"
+
+	"github.com/turtacn/Aeterna/pkg/srp/wire"
+)
+
+// State transports. The sender picks one of the agreed transports per
+// transfer: small states go in a single frame, large ones in a sealed memfd
+// or, where that is not available, in chunks.
+const (
+	TransportAuto    = "auto" // Relay setting: any transport, chosen by size
+	TransportStream  = "stream"
+	TransportMemfd   = "memfd"
+	TransportChunked = "chunked"
+
+	// DefaultMemfdThreshold is the state size from which TransportAuto
+	// avoids the stream transport.
+	DefaultMemfdThreshold = 1 << 20
+)
+
+// transports lists the transports this package implements, in the order a
+// large state prefers them.
+var transports = []string{TransportMemfd, TransportChunked, TransportStream}
+
+// restrictTransports limits the transports the peers agreed on to the ones
+// allowed by the relay's Transport setting.
+func (sc *StateCoordinator) restrictTransports(agreed *Hello) error {
+	var allowed []string
+	switch sc.Transport {
+	case "", TransportAuto:
+		allowed = transports
+	case TransportStream, TransportMemfd, TransportChunked:
+		allowed = []string{sc.Transport}
+	default:
+		return fmt.Errorf("unknown transport %q", sc.Transport)
+	}
+
+	var agreedTransports []string
+	for _, t := range agreed.Transports {
+		if contains(allowed, t) {
+			agreedTransports = append(agreedTransports, t)
+		}
+	}
+	if len(agreedTransports) == 0 {
+		return fmt.Errorf("no common transport (peers %v, relay %v)", agreed.Transports, allowed)
+	}
+	agreed.Transports = agreedTransports
+	agreed.MemfdThreshold = 0
+	if contains(agreedTransports, TransportStream) && len(agreedTransports) > 1 {
+		agreed.MemfdThreshold = sc.MemfdThreshold
+		if agreed.MemfdThreshold <= 0 {
+			agreed.MemfdThreshold = DefaultMemfdThreshold
+		}
+	}
+	agreed.ChunkSize = 0
+	if contains(agreedTransports, TransportChunked) {
+		agreed.ChunkSize = sc.chunkSize()
+	}
+	return nil
+}
+
+// chunkSize is the configured chunk size, limited to what both the relay and
+// a receiver with the default frame size accept.
+func (sc *StateCoordinator) chunkSize() int {
+	limit := wire.DefaultMaxFrameSize
+	if sc.MaxFrameSize > 0 && sc.MaxFrameSize < limit {
+		limit = sc.MaxFrameSize
+	}
+	limit -= wire.HeaderSize + wire.ChunkHeaderSize
+
+	size := sc.ChunkSize
+	if size <= 0 {
+		size = wire.DefaultChunkSize
+	}
+	if size > limit {
+		size = limit
+	}
+	return size
+}
+
+// chooseTransport picks the transport for a state of size bytes among the
+// agreed ones: a single frame below the agreed threshold, otherwise a memfd
+// or chunks.
+func chooseTransport(agreed Hello, size int) string {
+	if contains(agreed.Transports, TransportStream) && int64(size) < agreed.MemfdThreshold {
+		return TransportStream
+	}
+	for _, t := range transports {
+		if contains(agreed.Transports, t) {
+			return t
+		}
+	}
+	return TransportStream
+}
+
+// Personal.AI order the ending
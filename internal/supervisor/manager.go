@@ -1,10 +1,12 @@
 package supervisor
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"syscall"
+	"time"
 
 	"github.com/turtacn/Aeterna/pkg/consts"
 	"github.com/turtacn/Aeterna/pkg/logger"
@@ -13,7 +15,13 @@ import (
 // ProcessManager handles the lifecycle of the managed business process.
 // It manages starting, stopping, and waiting for the process.
 type ProcessManager struct {
-	cmd *exec.Cmd
+	cmd     *exec.Cmd
+	proc    *os.Process // Set instead of cmd for an adopted process
+	control *os.File    // Passed after the inherited sockets, see PassControl
+
+	// done is closed once the process has exited and err holds its exit status.
+	done chan struct{}
+	err  error
 }
 
 // New creates a new ProcessManager instance.
@@ -21,34 +29,120 @@ func New() *ProcessManager {
 	return &ProcessManager{}
 }
 
+// PassControl makes Start pass f to the process as its control FD, right
+// after the inherited sockets, and name it in AETERNA_CONTROL_FD. It is not
+// counted in LISTEN_FDS.
+func (pm *ProcessManager) PassControl(f *os.File) {
+	pm.control = f
+}
+
 // Start launches the business process with the given command, environment, and extra files.
-// It sets up standard output and error redirection and communicates inherited
-// file descriptors to the child process via the AETERNA_INHERITED_FDS environment variable.
+// It sets up standard output and error redirection and communicates the number of inherited
+// file descriptors to the child process via AETERNA_INHERITED_FDS and LISTEN_FDS.
+// When the exec shim is enabled, LISTEN_PID is set to the child's own PID as well.
 func (pm *ProcessManager) Start(command []string, env []string, extraFiles []*os.File) error {
 	if len(command) == 0 {
 		return nil
 	}
 
 	pm.cmd = exec.Command(command[0], command[1:]...)
-	pm.cmd.Env = append(os.Environ(), env...)
+	pm.cmd.Env = append(withoutInheritance(os.Environ()), env...)
 	pm.cmd.Stdout = os.Stdout
 	pm.cmd.Stderr = os.Stderr
+	// Each generation leads its own process group so that forwarded signals
+	// reach the tool subprocesses it spawns.
+	pm.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
+	if pm.control != nil {
+		pm.cmd.ExtraFiles = append(append([]*os.File(nil), extraFiles...), pm.control)
+		pm.cmd.Env = append(pm.cmd.Env, fmt.Sprintf("%s=%d", consts.EnvControlFD, 3+len(extraFiles)))
+	}
 	if len(extraFiles) > 0 {
-		pm.cmd.ExtraFiles = extraFiles
+		if pm.control == nil {
+			pm.cmd.ExtraFiles = extraFiles
+		}
 		// UPHR Core: Notify child about inherited FDs
-		pm.cmd.Env = append(pm.cmd.Env, fmt.Sprintf("%s=%d", consts.EnvInheritedFDs, len(extraFiles)))
+		pm.cmd.Env = append(pm.cmd.Env,
+			fmt.Sprintf("%s=%d", consts.EnvInheritedFDs, len(extraFiles)),
+			fmt.Sprintf("%s=%d", consts.EnvListenFDs, len(extraFiles)))
+
+		// The PID is only known after the fork, so the shim fills in LISTEN_PID
+		// right before it execs the resolved command. A command that cannot be
+		// executed is started directly so that Start reports the error.
+		if _, err := exec.LookPath(pm.cmd.Path); shimPath != "" && err == nil {
+			pm.cmd.Args = append([]string{shimPath, pm.cmd.Path}, pm.cmd.Args...)
+			pm.cmd.Path = shimPath
+			pm.cmd.Env = append(pm.cmd.Env, consts.EnvExecShim+"=1")
+		}
 	}
 
 	logger.Log.Info("Supervisor: Forking process", "cmd", command)
-	return pm.cmd.Start()
+	if err := StartCmd(pm.cmd); err != nil {
+		return err
+	}
+
+	// Reap the child in the background so that several parties (the engine,
+	// the soak observer, tests) can wait on the same process.
+	pm.done = make(chan struct{})
+	go func() {
+		pm.err = WaitCmd(pm.cmd)
+		close(pm.done)
+	}()
+	return nil
+}
+
+// Adopt takes over pid, a running child of this process that was started
+// before Aeterna re-executed itself during an upgrade.
+func Adopt(pid int) (*ProcessManager, error) {
+	if err := syscall.Kill(pid, 0); err != nil {
+		return nil, fmt.Errorf("cannot adopt process %d: %w", pid, err)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	pm := &ProcessManager{proc: proc, done: make(chan struct{})}
+	registerPid(pid)
+	logger.Log.Info("Supervisor: Adopted process", "pid", pid)
+	go func() {
+		pm.err = waitProcess(proc)
+		close(pm.done)
+	}()
+	return pm, nil
+}
+
+func (pm *ProcessManager) process() *os.Process {
+	if pm.cmd != nil {
+		return pm.cmd.Process
+	}
+	return pm.proc
+}
+
+// Pid returns the PID of the managed process, or 0 if it has not been started.
+func (pm *ProcessManager) Pid() int {
+	if p := pm.process(); p != nil {
+		return p.Pid
+	}
+	return 0
+}
+
+// Done returns a channel that is closed once the managed process has exited.
+// For a process that was never started the channel is already closed.
+func (pm *ProcessManager) Done() <-chan struct{} {
+	if pm.done == nil {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	return pm.done
 }
 
 // Stop sends a SIGTERM signal to the managed process to initiate a graceful shutdown.
 func (pm *ProcessManager) Stop() error {
-	if pm.cmd != nil && pm.cmd.Process != nil {
-		logger.Log.Info("Supervisor: Sending SIGTERM", "pid", pm.cmd.Process.Pid)
-		return pm.cmd.Process.Signal(syscall.SIGTERM)
+	if p := pm.process(); p != nil {
+		logger.Log.Info("Supervisor: Sending SIGTERM", "pid", p.Pid)
+		return p.Signal(syscall.SIGTERM)
 	}
 	return nil
 }
@@ -56,19 +150,82 @@ func (pm *ProcessManager) Stop() error {
 // Kill immediately terminates the managed process using a SIGKILL signal.
 // This is typically used during rollbacks if a graceful shutdown fails.
 func (pm *ProcessManager) Kill() error {
-	if pm.cmd != nil && pm.cmd.Process != nil {
-		logger.Log.Warn("Supervisor: Sending SIGKILL (Rollback)", "pid", pm.cmd.Process.Pid)
-		return pm.cmd.Process.Kill()
+	if p := pm.process(); p != nil {
+		logger.Log.Warn("Supervisor: Sending SIGKILL (Rollback)", "pid", p.Pid)
+		return p.Kill()
 	}
 	return nil
 }
 
+// Signal delivers sig to the managed process.
+func (pm *ProcessManager) Signal(sig os.Signal) error {
+	if p := pm.process(); p != nil {
+		logger.Log.Info("Supervisor: Sending signal", "pid", p.Pid, "signal", sig)
+		return p.Signal(sig)
+	}
+	return nil
+}
+
+// SignalGroup delivers sig to the process group led by the managed process.
+func (pm *ProcessManager) SignalGroup(sig syscall.Signal) error {
+	if p := pm.process(); p != nil {
+		logger.Log.Info("Supervisor: Forwarding signal to process group", "pgid", p.Pid, "signal", sig)
+		return syscall.Kill(-p.Pid, sig)
+	}
+	return nil
+}
+
+// Terminate asks the managed process to exit with sig and escalates to SIGKILL
+// if it is still running after the grace period. It returns once the process has exited.
+func (pm *ProcessManager) Terminate(sig os.Signal, grace time.Duration) error {
+	if pm.done == nil {
+		return nil
+	}
+	if err := pm.Signal(sig); err != nil {
+		logger.Log.Warn("Supervisor: Signal failed", "pid", pm.Pid(), "signal", sig, "err", err)
+	}
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-pm.done:
+		return nil
+	case <-timer.C:
+	}
+
+	logger.Log.Warn("Supervisor: Grace period expired", "pid", pm.Pid(), "grace", grace)
+	if err := pm.Kill(); err != nil {
+		return err
+	}
+	<-pm.done
+	return nil
+}
+
 // Wait waits for the managed process to exit and returns the resulting error, if any.
+// It is safe to call Wait from several goroutines.
 func (pm *ProcessManager) Wait() error {
-	if pm.cmd != nil {
-		return pm.cmd.Wait()
+	if pm.done == nil {
+		return nil
 	}
-	return nil
+	<-pm.done
+	return pm.err
+}
+
+// ExitCode converts the result of Wait into a shell-style exit code: the
+// process's own exit code, 128+signal if it was killed by a signal, or 1 for
+// any other error.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	return 1
 }
 
 // Personal.AI order the ending
@@ -2,7 +2,10 @@ package supervisor
 
 import (
 	"os"
+	"os/exec"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestProcessManager_StartStop(t *testing.T) {
@@ -68,3 +71,133 @@ func TestProcessManager_WithFiles(t *testing.T) {
 	}
 	pm.Wait()
 }
+
+func TestProcessManager_PassControl(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	listener, _ := os.Open(os.DevNull)
+	defer listener.Close()
+
+	pm := New()
+	pm.PassControl(w)
+	if err := pm.Start([]string{"sh", "-c", `echo "$AETERNA_CONTROL_FD $LISTEN_FDS" >&4`}, nil, []*os.File{listener}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	w.Close()
+	pm.Wait()
+
+	out := make([]byte, 64)
+	n, _ := r.Read(out)
+	if got := string(out[:n]); got != "4 1\n" {
+		t.Errorf("Expected the control FD after the listener, not counted in LISTEN_FDS, got %q", got)
+	}
+}
+
+func TestProcessManager_DoneAndPid(t *testing.T) {
+	pm := New()
+	select {
+	case <-pm.Done():
+	default:
+		t.Error("Done should be closed for a process that was never started")
+	}
+
+	if err := pm.Start([]string{"sleep", "10"}, nil, nil); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if pm.Pid() == 0 {
+		t.Fatal("Pid should be set after Start")
+	}
+
+	select {
+	case <-pm.Done():
+		t.Fatal("Done should not be closed while the process runs")
+	default:
+	}
+
+	pm.Kill()
+	<-pm.Done()
+	// Concurrent waiters all observe the same exit status.
+	if err1, err2 := pm.Wait(), pm.Wait(); err1 == nil || err1 != err2 {
+		t.Errorf("Expected the same non-nil exit error, got %v and %v", err1, err2)
+	}
+}
+
+func TestProcessManager_TerminateEscalates(t *testing.T) {
+	pm := New()
+	// The shell ignores SIGTERM, so only SIGKILL can stop it.
+	err := pm.Start([]string{"sh", "-c", "trap '' TERM; while :; do sleep 0.1; done"}, nil, nil)
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if err := pm.Terminate(syscall.SIGTERM, 200*time.Millisecond); err != nil {
+		t.Fatalf("Terminate failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected Terminate to wait for the grace period, returned after %v", elapsed)
+	}
+	select {
+	case <-pm.Done():
+	default:
+		t.Error("Process should have exited after Terminate")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if code := ExitCode(nil); code != 0 {
+		t.Errorf("Expected 0 for a clean exit, got %d", code)
+	}
+
+	pm := New()
+	pm.Start([]string{"sh", "-c", "exit 5"}, nil, nil)
+	if code := ExitCode(pm.Wait()); code != 5 {
+		t.Errorf("Expected exit code 5, got %d", code)
+	}
+
+	pm = New()
+	pm.Start([]string{"sleep", "10"}, nil, nil)
+	pm.Kill()
+	if code := ExitCode(pm.Wait()); code != 128+int(syscall.SIGKILL) {
+		t.Errorf("Expected exit code %d for SIGKILL, got %d", 128+int(syscall.SIGKILL), code)
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	// A child started outside the ProcessManager, as one inherited across an upgrade
+	cmd := exec.Command("sh", "-c", "sleep 0.2; exit 3")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	pm, err := Adopt(cmd.Process.Pid)
+	if err != nil {
+		t.Fatalf("Adopt failed: %v", err)
+	}
+	if pm.Pid() != cmd.Process.Pid {
+		t.Errorf("Expected pid %d, got %d", cmd.Process.Pid, pm.Pid())
+	}
+
+	select {
+	case <-pm.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Adopted process was not reaped")
+	}
+	if code := ExitCode(pm.Wait()); code != 3 {
+		t.Errorf("Expected exit code 3, got %d", code)
+	}
+}
+
+func TestAdopt_MissingProcess(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if _, err := Adopt(cmd.Process.Pid); err == nil {
+		t.Error("Expected adopting an exited process to fail")
+	}
+}
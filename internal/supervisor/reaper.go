@@ -0,0 +1,166 @@
+package supervisor
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/turtacn/Aeterna/pkg/logger"
+	"golang.org/x/sys/unix"
+)
+
+// reapInterval is how often the reaper rescans for zombies that were skipped
+// while a managed child was waiting to be collected by its own Wait.
+const reapInterval = time.Second
+
+var (
+	// reapMu serialises forking managed children with the reaper, so that a
+	// child can never be reaped before it is registered.
+	reapMu sync.Mutex
+	// managed holds the PIDs whose exit status belongs to an exec.Cmd.
+	managed = make(map[int]struct{})
+)
+
+// StartCmd starts cmd and registers it so that the Reaper leaves its exit
+// status to cmd.Wait. Commands started with it must be waited with WaitCmd.
+func StartCmd(cmd *exec.Cmd) error {
+	reapMu.Lock()
+	defer reapMu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	managed[cmd.Process.Pid] = struct{}{}
+	return nil
+}
+
+// WaitCmd waits for a command started with StartCmd and unregisters it.
+func WaitCmd(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	reapMu.Lock()
+	delete(managed, cmd.Process.Pid)
+	reapMu.Unlock()
+	return err
+}
+
+// registerPid leaves the exit status of an adopted child to waitProcess.
+func registerPid(pid int) {
+	reapMu.Lock()
+	managed[pid] = struct{}{}
+	reapMu.Unlock()
+}
+
+// waitProcess waits for an adopted child and unregisters it. A failed exit
+// is reported as an *exec.ExitError, like the result of WaitCmd.
+func waitProcess(proc *os.Process) error {
+	state, err := proc.Wait()
+	reapMu.Lock()
+	delete(managed, proc.Pid)
+	reapMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if !state.Success() {
+		return &exec.ExitError{ProcessState: state}
+	}
+	return nil
+}
+
+// Reaper collects orphaned descendants that get re-parented to Aeterna.
+// When Aeterna is not PID 1 it registers itself as a child subreaper so that
+// orphans of the business process are re-parented to it instead of to init.
+type Reaper struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartReaper enables subreaping and starts the reaper loop.
+func StartReaper() (*Reaper, error) {
+	if os.Getpid() != 1 {
+		if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &Reaper{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go r.loop()
+	logger.Log.Info("Supervisor: Zombie reaper started", "pid1", os.Getpid() == 1)
+	return r, nil
+}
+
+// Stop terminates the reaper loop.
+func (r *Reaper) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+func (r *Reaper) loop() {
+	defer close(r.done)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGCHLD)
+	defer signal.Stop(sigCh)
+
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-sigCh:
+		case <-ticker.C:
+		}
+		reapOrphans()
+	}
+}
+
+// waitInfo mirrors the leading fields of the kernel's siginfo_t for SIGCHLD on
+// 64-bit Linux; unix.Siginfo does not expose the child PID.
+type waitInfo struct {
+	Signo  int32
+	Errno  int32
+	Code   int32
+	_      int32
+	Pid    int32
+	Uid    uint32
+	Status int32
+	_      [100]byte
+}
+
+// reapOrphans collects every exited child that is not owned by an exec.Cmd.
+// Children are peeked with WNOWAIT first so that managed ones stay waitable.
+func reapOrphans() {
+	reapMu.Lock()
+	defer reapMu.Unlock()
+
+	for {
+		var info unix.Siginfo
+		err := unix.Waitid(unix.P_ALL, 0, &info, unix.WEXITED|unix.WNOHANG|unix.WNOWAIT, nil)
+		if err != nil {
+			return // ECHILD: no children at all
+		}
+		pid := int((*waitInfo)(unsafe.Pointer(&info)).Pid)
+		if pid == 0 {
+			return // No child has exited
+		}
+		if _, ok := managed[pid]; ok {
+			// Left to its Wait; other zombies are picked up on the next pass.
+			return
+		}
+
+		var status unix.WaitStatus
+		if _, err := unix.Wait4(pid, &status, unix.WNOHANG, nil); err != nil {
+			return
+		}
+		logger.Log.Debug("Supervisor: Reaped orphaned process", "pid", pid, "status", status.ExitStatus())
+	}
+}
+
+// Personal.AI order the ending
@@ -0,0 +1,101 @@
+package supervisor
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// isZombie reports whether pid exists and is a zombie.
+func isZombie(pid int) bool {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(data))
+	return len(fields) > 2 && fields[2] == "Z"
+}
+
+func TestReaper_ReapsOrphans(t *testing.T) {
+	r, err := StartReaper()
+	if err != nil {
+		t.Skipf("Subreaper not available: %v", err)
+	}
+	defer r.Stop()
+
+	pidFile := filepath.Join(t.TempDir(), "orphan.pid")
+	pm := New()
+	// The shell exits right away and leaves its background child orphaned.
+	if err := pm.Start([]string{"sh", "-c", "sleep 0.2 & echo $! > " + pidFile}, nil, nil); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := pm.Wait(); err != nil {
+		t.Fatalf("Managed process should exit cleanly, got %v", err)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("Failed to read orphan pid: %v", err)
+	}
+	orphan, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := syscall.Kill(orphan, 0); err == syscall.ESRCH {
+			return // Reaped
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if isZombie(orphan) {
+		t.Fatalf("Orphan %d was left as a zombie", orphan)
+	}
+}
+
+func TestReaper_PreservesManagedExitStatus(t *testing.T) {
+	r, err := StartReaper()
+	if err != nil {
+		t.Skipf("Subreaper not available: %v", err)
+	}
+	defer r.Stop()
+
+	for i := 0; i < 5; i++ {
+		pm := New()
+		if err := pm.Start([]string{"sh", "-c", "exit 3"}, nil, nil); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		err := pm.Wait()
+		exitErr, ok := err.(interface{ ExitCode() int })
+		if !ok || exitErr.ExitCode() != 3 {
+			t.Fatalf("Expected exit status 3, got %v", err)
+		}
+	}
+}
+
+func TestProcessManager_SignalGroup(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "usr1")
+	pm := New()
+	// The signal must reach the grandchild that lives in the same group.
+	script := "sh -c 'trap \"touch " + marker + "; exit 0\" USR1; while :; do sleep 0.05; done' & wait"
+	if err := pm.Start([]string{"sh", "-c", script}, nil, nil); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer pm.Kill()
+	time.Sleep(200 * time.Millisecond)
+
+	if err := pm.SignalGroup(syscall.SIGUSR1); err != nil {
+		t.Fatalf("SignalGroup failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(marker); err == nil {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("Expected the grandchild to receive the forwarded signal")
+}
@@ -0,0 +1,112 @@
+package supervisor
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/consts"
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+// Restart policies supported by RestartPolicy.
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+// RestartPolicy decides whether and when a crashed process is restarted.
+// The delay grows exponentially with the number of restarts in the current
+// window, and restarts are refused once MaxRestarts is reached in that window.
+type RestartPolicy struct {
+	Policy      string
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Multiplier  float64
+	Jitter      float64
+	MaxRestarts int
+	Window      time.Duration
+
+	history []time.Time
+}
+
+// NewRestartPolicy creates a RestartPolicy from the service configuration.
+func NewRestartPolicy(cfg protocol.RestartConfig) *RestartPolicy {
+	p := &RestartPolicy{
+		Policy:      cfg.Policy,
+		Backoff:     parseDuration(cfg.Backoff, consts.DefaultRestartBackoff),
+		MaxBackoff:  parseDuration(cfg.MaxBackoff, consts.DefaultRestartMaxBackoff),
+		Multiplier:  cfg.Multiplier,
+		Jitter:      cfg.Jitter,
+		MaxRestarts: cfg.MaxRestarts,
+		Window:      parseDuration(cfg.Window, consts.DefaultRestartWindow),
+	}
+	if p.Policy == "" {
+		p.Policy = RestartNever
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	return p
+}
+
+// Next records a crash at now and returns the delay before the restart.
+// It returns an error if the policy does not allow another restart.
+func (p *RestartPolicy) Next(exitErr error, now time.Time) (time.Duration, error) {
+	switch p.Policy {
+	case RestartAlways:
+	case RestartOnFailure:
+		if exitErr == nil {
+			return 0, fmt.Errorf("process exited cleanly and policy is %s", p.Policy)
+		}
+	case RestartNever:
+		return 0, fmt.Errorf("restart policy is %s", p.Policy)
+	default:
+		return 0, fmt.Errorf("unknown restart policy %q", p.Policy)
+	}
+
+	// Forget restarts that fell out of the window.
+	recent := p.history[:0]
+	for _, t := range p.history {
+		if now.Sub(t) < p.Window {
+			recent = append(recent, t)
+		}
+	}
+	p.history = recent
+
+	if p.MaxRestarts > 0 && len(p.history) >= p.MaxRestarts {
+		return 0, fmt.Errorf("restart limit reached: %d restarts within %v", len(p.history), p.Window)
+	}
+
+	delay := time.Duration(float64(p.Backoff) * math.Pow(p.Multiplier, float64(len(p.history))))
+	if delay > p.MaxBackoff || delay <= 0 {
+		delay = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(float64(delay) * p.Jitter * rand.Float64())
+	}
+
+	p.history = append(p.history, now)
+	return delay, nil
+}
+
+// History returns the times of the restarts counted against the limit.
+func (p *RestartPolicy) History() []time.Time {
+	return append([]time.Time(nil), p.history...)
+}
+
+// Restore replaces the restart history, e.g. with the one carried across an upgrade.
+func (p *RestartPolicy) Restore(history []time.Time) {
+	p.history = append([]time.Time(nil), history...)
+}
+
+func parseDuration(s string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// Personal.AI order the ending
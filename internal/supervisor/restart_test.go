@@ -0,0 +1,88 @@
+package supervisor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/turtacn/Aeterna/pkg/protocol"
+)
+
+var errCrash = errors.New("exit status 1")
+
+func TestRestartPolicy_Policies(t *testing.T) {
+	never := NewRestartPolicy(protocol.RestartConfig{})
+	if _, err := never.Next(errCrash, time.Now()); err == nil {
+		t.Error("Default policy should never restart")
+	}
+
+	onFailure := NewRestartPolicy(protocol.RestartConfig{Policy: RestartOnFailure})
+	if _, err := onFailure.Next(nil, time.Now()); err == nil {
+		t.Error("on-failure should not restart a clean exit")
+	}
+	if _, err := onFailure.Next(errCrash, time.Now()); err != nil {
+		t.Errorf("on-failure should restart a crash, got %v", err)
+	}
+
+	always := NewRestartPolicy(protocol.RestartConfig{Policy: RestartAlways})
+	if _, err := always.Next(nil, time.Now()); err != nil {
+		t.Errorf("always should restart a clean exit, got %v", err)
+	}
+
+	bogus := NewRestartPolicy(protocol.RestartConfig{Policy: "sometimes"})
+	if _, err := bogus.Next(errCrash, time.Now()); err == nil {
+		t.Error("Unknown policy should be rejected")
+	}
+}
+
+func TestRestartPolicy_ExponentialBackoff(t *testing.T) {
+	p := NewRestartPolicy(protocol.RestartConfig{
+		Policy:     RestartAlways,
+		Backoff:    "100ms",
+		MaxBackoff: "500ms",
+		Window:     "1m",
+	})
+
+	now := time.Now()
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 500 * time.Millisecond}
+	for i, w := range want {
+		got, err := p.Next(errCrash, now)
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if got != w {
+			t.Errorf("restart %d: expected delay %v, got %v", i+1, w, got)
+		}
+	}
+
+	// Once the window has passed, the backoff starts over.
+	got, _ := p.Next(errCrash, now.Add(2*time.Minute))
+	if got != 100*time.Millisecond {
+		t.Errorf("Expected backoff to reset after the window, got %v", got)
+	}
+}
+
+func TestRestartPolicy_Jitter(t *testing.T) {
+	p := NewRestartPolicy(protocol.RestartConfig{Policy: RestartAlways, Backoff: "100ms", Jitter: 0.5})
+	got, _ := p.Next(errCrash, time.Now())
+	if got < 100*time.Millisecond || got > 150*time.Millisecond {
+		t.Errorf("Expected delay within [100ms, 150ms], got %v", got)
+	}
+}
+
+func TestRestartPolicy_MaxRestartsPerWindow(t *testing.T) {
+	p := NewRestartPolicy(protocol.RestartConfig{Policy: RestartAlways, MaxRestarts: 2, Window: "1m"})
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := p.Next(errCrash, now); err != nil {
+			t.Fatalf("restart %d should be allowed: %v", i+1, err)
+		}
+	}
+	if _, err := p.Next(errCrash, now); err == nil {
+		t.Error("Expected the restart limit to be enforced")
+	}
+	if _, err := p.Next(errCrash, now.Add(time.Minute)); err != nil {
+		t.Errorf("Expected restarts to be allowed again in a new window, got %v", err)
+	}
+}
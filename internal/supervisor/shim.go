@@ -0,0 +1,60 @@
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/turtacn/Aeterna/pkg/consts"
+)
+
+// shimPath is the executable that execs children receiving listeners, so that
+// LISTEN_PID can name the child itself. Empty disables the shim.
+var shimPath string
+
+// InitExecShim must be called first thing in main. In a process started as
+// the exec shim it sets LISTEN_PID to its own PID and replaces itself with the
+// target command, never returning. Otherwise it enables the shim for the
+// processes started by this supervisor, using the current executable.
+func InitExecShim() {
+	if os.Getenv(consts.EnvExecShim) == "" {
+		shimPath, _ = os.Executable()
+		return
+	}
+	runExecShim(os.Args[1:])
+}
+
+// runExecShim execs args[0] with argv args[1:], keeping the PID of the shim.
+func runExecShim(args []string) {
+	os.Unsetenv(consts.EnvExecShim)
+	os.Setenv(consts.EnvListenPID, strconv.Itoa(os.Getpid()))
+
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "aeterna: exec shim: missing command")
+		os.Exit(127)
+	}
+	err := syscall.Exec(args[0], args[1:], os.Environ())
+	fmt.Fprintf(os.Stderr, "aeterna: exec shim: %s: %v\n", args[0], err)
+	os.Exit(127)
+}
+
+// withoutInheritance drops the variables describing inherited sockets, and
+// Aeterna's own state token and control FD, from env, so a child never sees stale values
+// from Aeterna's own environment.
+func withoutInheritance(env []string) []string {
+	out := make([]string, 0, len(env))
+	for _, kv := range env {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case consts.EnvInheritedFDs, consts.EnvFDNames, consts.EnvFDAddrs,
+			consts.EnvListenFDs, consts.EnvListenFDNames, consts.EnvListenPID, consts.EnvExecShim,
+			consts.EnvStateToken, consts.EnvControlFD:
+			continue
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+// Personal.AI order the ending
@@ -0,0 +1,74 @@
+package supervisor
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain lets the test binary serve as the exec shim for the processes the
+// tests start, as the aeterna binary does in production.
+func TestMain(m *testing.M) {
+	InitExecShim()
+	os.Exit(m.Run())
+}
+
+func TestProcessManager_StartDescribesListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+	defer f.Close()
+
+	// Stale values from the supervisor's own environment must not leak.
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("AETERNA_FD_NAMES", "stale")
+
+	out := filepath.Join(t.TempDir(), "env")
+	pm := New()
+	script := `echo "$$ $LISTEN_PID $LISTEN_FDS $AETERNA_INHERITED_FDS $LISTEN_FDNAMES ${AETERNA_FD_NAMES:-none} ${AETERNA_EXEC_SHIM:-unset}" > "$OUT"`
+	env := []string{"OUT=" + out, "LISTEN_FDNAMES=http"}
+	if err := pm.Start([]string{"sh", "-c", script}, env, []*os.File{f}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := pm.Wait(); err != nil {
+		t.Fatalf("child failed: %v", err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 7 {
+		t.Fatalf("unexpected output %q", data)
+	}
+	if fields[0] != fields[1] {
+		t.Errorf("LISTEN_PID = %s, want the child's PID %s", fields[1], fields[0])
+	}
+	if fields[2] != "1" || fields[3] != "1" || fields[4] != "http" {
+		t.Errorf("unexpected listener variables %q", data)
+	}
+	if fields[5] != "none" || fields[6] != "unset" {
+		t.Errorf("inherited variables leaked into the child: %q", data)
+	}
+}
+
+func TestProcessManager_StartWithListenersReportsMissingCommand(t *testing.T) {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := New().Start([]string{"/nonexistent/aeterna-test"}, nil, []*os.File{f}); err == nil {
+		t.Error("expected Start to fail for a missing command")
+	}
+}
@@ -0,0 +1,36 @@
+package supervisor
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+var signalNames = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGKILL":  syscall.SIGKILL,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGWINCH": syscall.SIGWINCH,
+}
+
+// ParseSignal converts a signal name such as "SIGTERM" or "term" into a syscall.Signal.
+// An empty name yields the given default.
+func ParseSignal(name string, def syscall.Signal) (syscall.Signal, error) {
+	if name == "" {
+		return def, nil
+	}
+	key := strings.ToUpper(name)
+	if !strings.HasPrefix(key, "SIG") {
+		key = "SIG" + key
+	}
+	if sig, ok := signalNames[key]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unsupported signal %q", name)
+}
+
+// Personal.AI order the ending
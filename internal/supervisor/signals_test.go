@@ -0,0 +1,28 @@
+package supervisor
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	cases := map[string]syscall.Signal{
+		"":        syscall.SIGTERM,
+		"SIGQUIT": syscall.SIGQUIT,
+		"int":     syscall.SIGINT,
+		"sigusr2": syscall.SIGUSR2,
+	}
+	for name, want := range cases {
+		got, err := ParseSignal(name, syscall.SIGTERM)
+		if err != nil {
+			t.Errorf("ParseSignal(%q) failed: %v", name, err)
+		}
+		if got != want {
+			t.Errorf("ParseSignal(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	if _, err := ParseSignal("SIGBOGUS", syscall.SIGTERM); err == nil {
+		t.Error("Expected error for unknown signal")
+	}
+}
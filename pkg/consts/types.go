@@ -26,12 +26,76 @@ const (
 	StateFailed      ProcessState = "FAILED"
 )
 
+// Restart Constants
+const (
+	DefaultWarmupDelay       = 2 * time.Second
+	DefaultRestartBackoff    = 1 * time.Second
+	DefaultRestartMaxBackoff = 1 * time.Minute
+	DefaultRestartWindow     = 10 * time.Minute
+)
+
+// DefaultForwardSignals are relayed to the serving process group unless
+// service.forward_signals overrides them.
+var DefaultForwardSignals = []string{"SIGUSR1", "SIGUSR2", "SIGWINCH", "SIGQUIT"}
+
 // SRP (State Relay Protocol) Constants
 const (
-	EnvStateSocketPath = "AETERNA_STATE_SOCK"
-	EnvInheritedFDs    = "AETERNA_INHERITED_FDS" // Count of FDs passed
-	DefaultSRPTimeout  = 5 * time.Second
-	DefaultSoakTime    = 30 * time.Second
+	EnvStateSocketPath     = "AETERNA_STATE_SOCK"
+	EnvStateSignal         = "AETERNA_STATE_SIGNAL"  // Signal that requests the state from the serving process
+	EnvStateToken          = "AETERNA_STATE_TOKEN"   // Proves to the state relay and the connection broker that a peer is the process Aeterna started
+	EnvControlFD           = "AETERNA_CONTROL_FD"    // FD on which Aeterna asks the process for its state
+	EnvInheritedFDs        = "AETERNA_INHERITED_FDS" // Count of FDs passed
+	DefaultListenAddr      = ":8080"                 // Used when no listeners are configured
+	DefaultSRPTimeout      = 5 * time.Second
+	DefaultStateSocketPath = "/tmp/aeterna.sock"
+	DefaultStateSignal     = "SIGUSR1"
+	DefaultSoakTime        = 30 * time.Second
+
+	EnvProbePort = "AETERNA_PROBE_PORT" // Port of its own on 127.0.0.1 on which a generation serves its probes
+
+	EnvConnSocketPath         = "AETERNA_CONN_SOCK"
+	DefaultConnSocketPath     = "/tmp/aeterna-conns.sock"
+	DefaultConnHandoffTimeout = 30 * time.Second // How long handed connections wait for the new process
+
+	DefaultControlSocketPath = "/tmp/aeterna-control.sock"
+
+	StateModeRelay  = "relay"  // state_handoff.mode: the candidate receives the state from the old process
+	StateModeBroker = "broker" // state_handoff.mode: Aeterna holds the state between the two
+
+	DefaultSpillDir       = "/var/lib/aeterna/state"
+	DefaultCheckpointKeep = 3
+
+	// Set for a state_handoff.migrations command, which reads the section
+	// on stdin and writes it migrated to stdout.
+	EnvMigrationSection = "AETERNA_MIGRATION_SECTION" // Empty for a whole state
+	EnvMigrationFrom    = "AETERNA_MIGRATION_FROM"
+	EnvMigrationTo      = "AETERNA_MIGRATION_TO"
+	EnvStateCodec       = "AETERNA_STATE_CODEC" // Codec the section is encoded with
+)
+
+// Socket Activation Constants
+// Listeners are passed as FD 3, 4, ... and described in both the systemd
+// socket activation form and Aeterna's own variables.
+const (
+	ListenFDsStart   = 3
+	EnvListenFDs     = "LISTEN_FDS"
+	EnvListenFDNames = "LISTEN_FDNAMES" // Colon separated
+	EnvListenPID     = "LISTEN_PID"
+	EnvFDNames       = "AETERNA_FD_NAMES" // Comma separated, same order as the FDs
+	EnvFDAddrs       = "AETERNA_FD_ADDRS" // Comma separated, e.g. "0.0.0.0:8080,127.0.0.1:9091"
+	EnvExecShim      = "AETERNA_EXEC_SHIM"
+	EnvUpgradeFD     = "AETERNA_UPGRADE_FD" // State handed to the next Aeterna binary
+	UnnamedFD        = "unknown"
+)
+
+// Orchestration Constants
+const (
+	DefaultCanaryInterval = 2 * time.Second
+	DefaultProbeTimeout   = 1 * time.Second
+	DefaultRollbackGrace  = 10 * time.Second
+	DefaultDrainTimeout   = 30 * time.Second
+	DefaultHookTimeout    = 30 * time.Second
+	DefaultHookRetryDelay = 500 * time.Millisecond
 )
 
 // Personal.AI order the ending
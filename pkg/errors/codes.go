@@ -17,9 +17,17 @@ const (
 	ErrCodeProcessStartFail ErrorCode = 3002
 	ErrCodeStateDumpTimeout ErrorCode = 3003
 	ErrCodeStateLoadFail    ErrorCode = 3004
+	// The state cannot be migrated to a schema version the candidate reads.
+	ErrCodeStateMigrationFailed ErrorCode = 3005
 
 	// Phase 3: Soak
 	ErrCodeSoakFailed ErrorCode = 4001
+
+	// Phase 6: Post-process
+	ErrCodeHookFailed ErrorCode = 6001
+
+	// Self-upgrade
+	ErrCodeUpgradeFailed ErrorCode = 7001
 )
 
 // AeternaError is a custom error type that provides structured error information,
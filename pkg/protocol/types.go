@@ -4,8 +4,10 @@ package protocol
 type Config struct {
 	Version       string              `yaml:"version"`
 	Service       ServiceConfig       `yaml:"service"`
+	Listeners     []ListenerConfig    `yaml:"listeners"`
 	Orchestration OrchestrationConfig `yaml:"orchestration"`
 	Observability ObservabilityConfig `yaml:"observability"`
+	Control       ControlConfig       `yaml:"control"`
 }
 
 // ServiceConfig defines the basic parameters for the service to be managed.
@@ -14,6 +16,33 @@ type ServiceConfig struct {
 	Command    []string `yaml:"command"`     // Main run command
 	BinaryPath string   `yaml:"binary_path"` // Path for checks
 	Env        []string `yaml:"env"`
+	// ForwardSignals lists the signals relayed to the serving process group.
+	// Defaults to SIGUSR1, SIGUSR2, SIGWINCH and SIGQUIT; an empty list disables forwarding.
+	ForwardSignals []string `yaml:"forward_signals"`
+	// Restart controls what happens when the serving process crashes.
+	Restart RestartConfig `yaml:"restart"`
+}
+
+// RestartConfig defines the crash restart policy of the managed process.
+// Restarts back off exponentially and are capped per time window.
+type RestartConfig struct {
+	Policy      string  `yaml:"policy"`       // always | on-failure | never (default)
+	Backoff     string  `yaml:"backoff"`      // Delay before the first restart
+	MaxBackoff  string  `yaml:"max_backoff"`  // Upper bound of the delay
+	Multiplier  float64 `yaml:"multiplier"`   // Growth factor per restart, default 2
+	Jitter      float64 `yaml:"jitter"`       // Random fraction added to each delay, e.g. 0.2
+	MaxRestarts int     `yaml:"max_restarts"` // Per window; 0 means unlimited
+	Window      string  `yaml:"window"`
+}
+
+// ListenerConfig declares a listener or packet socket that Aeterna binds and
+// hands to every generation of the service. Listeners are passed as FD 3, 4, ... in the
+// order they are declared.
+type ListenerConfig struct {
+	Name    string `yaml:"name"`
+	Network string `yaml:"network"` // tcp (default) | tcp4 | tcp6 | udp | udp4 | udp6 | unix | unixpacket | unixgram
+	Address string `yaml:"address"` // e.g. ":8080", "127.0.0.1:9090" or "/run/app/syslog.sock"
+	Backlog int    `yaml:"backlog"` // Accept queue length of stream listeners; 0 keeps the system default
 }
 
 // OrchestrationConfig defines the strategy and lifecycle hooks for process orchestration.
@@ -28,10 +57,14 @@ type OrchestrationConfig struct {
 }
 
 // Hook represents a custom command to be executed during specific orchestration phases.
+// Each attempt is killed after Timeout; a failing hook is retried up to Retries times.
 type Hook struct {
 	Name    string   `yaml:"name"`
 	Command []string `yaml:"command"`
 	Timeout string   `yaml:"timeout"`
+	Env     []string `yaml:"env"` // Extra KEY=VALUE pairs on top of Aeterna's environment
+	Dir     string   `yaml:"dir"` // Working directory
+	Retries int      `yaml:"retries"`
 }
 
 // StartupConfig defines parameters for the process startup phase.
@@ -40,27 +73,139 @@ type StartupConfig struct {
 }
 
 // CanaryConfig defines parameters for the canary observation (soaking) phase.
+// Besides staying alive, the candidate must satisfy every configured success
+// criterion on each check during the soak; the first breach triggers a rollback.
 type CanaryConfig struct {
-	Enabled  bool   `yaml:"enabled"`
-	SoakTime string `yaml:"soak_time"`
+	Enabled          bool               `yaml:"enabled"`
+	SoakTime         string             `yaml:"soak_time"`
+	Interval         string             `yaml:"interval"`          // Time between checks
+	FailureThreshold int                `yaml:"failure_threshold"` // Consecutive failed checks tolerated before rollback
+	RollbackGrace    string             `yaml:"rollback_grace"`    // SIGTERM to SIGKILL delay for a rejected candidate
+	HealthCheck      HealthCheckConfig  `yaml:"health_check"`
+	Metrics          MetricsCheckConfig `yaml:"metrics"`
+}
+
+// HealthCheckConfig defines the liveness probe run against the candidate.
+// Both generations serve the inherited listeners during a soak, so the probe
+// should target the candidate alone: {probe_port} is replaced with the port
+// the candidate gets in AETERNA_PROBE_PORT, {pid} with its pid.
+type HealthCheckConfig struct {
+	HTTPGet   string `yaml:"http_get"`   // URL that must answer with a 2xx status
+	TCPSocket string `yaml:"tcp_socket"` // Address that must accept a connection
+	Timeout   string `yaml:"timeout"`
+}
+
+// MetricsCheckConfig defines thresholds on Prometheus-format metrics scraped from the candidate.
+// URL takes the placeholders of HealthCheckConfig.
+type MetricsCheckConfig struct {
+	URL        string            `yaml:"url"`
+	Thresholds []MetricThreshold `yaml:"thresholds"`
+}
+
+// MetricThreshold bounds the value of every sample of a metric that matches the given labels.
+type MetricThreshold struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels"`
+	Min    *float64          `yaml:"min"`
+	Max    *float64          `yaml:"max"`
 }
 
 // DrainConfig defines parameters for the old process shutdown phase.
+// The old process receives Signal and is killed if it has not exited after Timeout.
 type DrainConfig struct {
 	Timeout string `yaml:"timeout"`
+	Signal  string `yaml:"signal"` // Stop signal, e.g. "SIGTERM" (default) or "SIGQUIT"
 }
 
-// PostProcessConfig defines hooks to be executed after a success or failure of orchestration.
+// PostProcessConfig defines hooks to be executed after a success or failure of orchestration,
+// and when Aeterna itself shuts down.
 type PostProcessConfig struct {
-	OnSuccess []Hook `yaml:"on_success"`
-	OnFailure []Hook `yaml:"on_failure"`
+	OnSuccess  []Hook `yaml:"on_success"`
+	OnFailure  []Hook `yaml:"on_failure"`
+	OnShutdown []Hook `yaml:"on_shutdown"`
 }
 
 // StateHandoffConfig defines parameters for the State Relay Protocol (SRP) memory context transfer.
 type StateHandoffConfig struct {
 	Enabled    bool   `yaml:"enabled"`
 	SocketPath string `yaml:"socket_path"`
-	Timeout    string `yaml:"timeout"`
+	Timeout    string `yaml:"timeout"` // Bounds each step of the transfer, not the whole of it
+	// MaxFrameSize bounds a single SRP frame in bytes (default 64 MiB).
+	MaxFrameSize int `yaml:"max_frame_size"`
+	// Transport is "auto" (default), "stream" or "memfd". Auto passes states of
+	// at least MemfdThreshold bytes (default 1 MiB) in a sealed memfd.
+	Transport      string `yaml:"transport"`
+	MemfdThreshold int64  `yaml:"memfd_threshold"`
+	// ChunkSize is the data size of a chunk when the state is streamed in chunks (default 1 MiB).
+	ChunkSize int `yaml:"chunk_size"`
+	// Compression is "none" (default), "auto", "zstd" or "gzip". Peers that do
+	// not support it transfer the state uncompressed. Data of a chunk, or
+	// states, smaller than CompressionThreshold (default 4 KiB) are not compressed.
+	Compression          string `yaml:"compression"`
+	CompressionLevel     int    `yaml:"compression_level"`
+	CompressionThreshold int    `yaml:"compression_threshold"`
+	// Signal asks the serving process to send its state during a reload (default SIGUSR1).
+	Signal string `yaml:"signal"`
+	// Mode is "relay" (default): the state goes straight from the old process
+	// to the candidate, both connected at once. In "broker" mode Aeterna asks
+	// the old process for its state on its control FD, holds it, and only then
+	// starts the candidate, which it serves the state to.
+	Mode string `yaml:"mode"`
+	// MaxStateSize bounds, in bytes, a state Aeterna receives itself: in
+	// broker mode and for checkpoints. 0 means no limit.
+	MaxStateSize int64 `yaml:"max_state_size"`
+	// Delta lets a sectioned state that Aeterna receives itself leave out the
+	// sections that did not change since the newest checkpoint.
+	Delta bool `yaml:"delta"`
+	// Migrations rewrite a state Aeterna holds for a receiver that needs
+	// another schema version of it. Aeterna only holds the state of a
+	// reload in broker mode, so configuring any brokers every reload.
+	Migrations []StateMigration `yaml:"migrations"`
+	// Connections hands established connections from the old process to the new one.
+	Connections ConnHandoffConfig `yaml:"connections"`
+	// Spill keeps an encrypted copy of the state on disk until it is acknowledged.
+	Spill SpillConfig `yaml:"spill"`
+	// Checkpoint asks the serving process for its state between reloads.
+	Checkpoint CheckpointConfig `yaml:"checkpoint"`
+}
+
+// StateMigration is a command that rewrites a section of a state, or the
+// whole state if Section is empty, from schema version From to To. It reads
+// the section on stdin and writes the migrated section to stdout.
+type StateMigration struct {
+	Section string `yaml:"section"`
+	From    int    `yaml:"from"`
+	To      int    `yaml:"to"`
+	Hook    `yaml:",inline"`
+}
+
+// CheckpointConfig enables periodic state checkpoints: the serving process
+// is asked for its state every Interval, and the newest checkpoint is
+// replayed to the process restarted after a crash. Checkpoints can also be
+// requested through the control API.
+type CheckpointConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Interval string `yaml:"interval"` // Empty or 0: on demand only
+	Keep     int    `yaml:"keep"`     // Checkpoints kept, newest first (default 3)
+}
+
+// SpillConfig enables writing every handed-over state to disk, sealed with
+// AES-256-GCM, so that it survives the loss of both generations and is
+// replayed to the next cold-started process.
+type SpillConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`      // Default /var/lib/aeterna/state
+	KeyFile string `yaml:"key_file"` // 32-byte key, raw, hex or base64
+	KeyEnv  string `yaml:"key_env"`  // Variable holding the key if KeyFile is not set
+	TTL     string `yaml:"ttl"`      // How long a snapshot may be replayed (default 10m)
+}
+
+// ConnHandoffConfig enables passing established connections (SCM_RIGHTS) to
+// the next generation through a broker run by Aeterna.
+type ConnHandoffConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	SocketPath string `yaml:"socket_path"` // Default /tmp/aeterna-conns.sock
+	Timeout    string `yaml:"timeout"`     // How long handed connections wait for the new process
 }
 
 // ObservabilityConfig defines parameters for metrics and logging.
@@ -69,4 +214,13 @@ type ObservabilityConfig struct {
 	LogLevel    string `yaml:"log_level"`
 }
 
+// ControlConfig defines where the control API (upgrade, checkpoint) is served.
+// It is kept off the metrics port: requests come over a Unix socket of mode
+// 0600 from processes of Aeterna's user and carry the token Aeterna writes to
+// TokenFile.
+type ControlConfig struct {
+	SocketPath string `yaml:"socket_path"` // Defaults to /tmp/aeterna-control.sock
+	TokenFile  string `yaml:"token_file"`  // Defaults to the socket path with a .token suffix
+}
+
 // Personal.AI order the ending
@@ -0,0 +1,128 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func init() {
+	// Generic states hold these in interface values.
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// jsonCodec is the default codec, understood by every SDK. Numbers decode
+// as float64, so integers beyond 2^53 lose precision, and binary data has to
+// be carried as base64 strings.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return JSON }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// msgpackCodec keeps integers exact and carries binary data as such: it
+// decodes as []byte, bit for bit.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return MessagePack }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+// protobufCodec encodes proto.Message values. A generic state travels as a
+// google.protobuf.Struct, whose numbers are doubles and whose binary data is
+// base64-encoded, so it is no more precise than JSON.
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string { return Protobuf }
+
+func (c protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case proto.Message:
+		return proto.Marshal(v)
+	case map[string]interface{}:
+		s, err := structpb.NewStruct(v)
+		if err != nil {
+			return nil, err
+		}
+		return proto.Marshal(s)
+	}
+	return nil, unsupported(c, "encode", v)
+}
+
+func (c protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case proto.Message:
+		return proto.Unmarshal(data, v)
+	case *map[string]interface{}:
+		var s structpb.Struct
+		if err := proto.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*v = s.AsMap()
+		return nil
+	case *interface{}:
+		var s structpb.Struct
+		if err := proto.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*v = s.AsMap()
+		return nil
+	}
+	return unsupported(c, "decode into", v)
+}
+
+// gobCodec keeps Go types exact. It is only understood by Go peers.
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return Gob }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// rawCodec passes the state through as opaque bytes, for applications that
+// serialize it themselves. It cannot carry a generic state.
+type rawCodec struct{}
+
+func (rawCodec) Name() string { return Raw }
+
+func (c rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case *[]byte:
+		return *v, nil
+	}
+	return nil, unsupported(c, "encode", v)
+}
+
+func (c rawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = append([]byte(nil), data...)
+		return nil
+	case *interface{}:
+		*v = append([]byte(nil), data...)
+		return nil
+	}
+	return unsupported(c, "decode into", v)
+}
+
+// Personal.AI order the ending
@@ -0,0 +1,104 @@
+// Package codec implements the encodings of SRP state payloads. Codecs are
+// registered by name, and peers list the names they support in their Hello
+// frame (see docs/apis.md, section 3.3). JSON, MessagePack, Protobuf, gob
+// and raw bytes are built in.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/turtacn/Aeterna/pkg/srp/wire"
+)
+
+// Names of the built-in codecs.
+const (
+	JSON        = "json"
+	MessagePack = "msgpack"
+	Protobuf    = "protobuf"
+	Gob         = "gob"
+	Raw         = "raw"
+)
+
+// ErrUnsupportedValue is returned by codecs asked to encode a value, or
+// decode into a target, that their format cannot represent.
+var ErrUnsupportedValue = errors.New("srp: value not supported by the codec")
+
+// Codec encodes and decodes state payloads. Decoding into a
+// *map[string]interface{} or an *interface{} must be supported by codecs
+// that can carry a generic state.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	mu       sync.RWMutex
+	registry = make(map[string]Codec)
+)
+
+func init() {
+	Register(jsonCodec{})
+	Register(msgpackCodec{})
+	Register(protobufCodec{})
+	Register(gobCodec{})
+	Register(rawCodec{})
+}
+
+// Register makes c available under its name. It panics if the name is empty
+// or already taken.
+func Register(c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	name := c.Name()
+	if name == "" {
+		panic("codec: Register with an empty name")
+	}
+	if _, dup := registry[name]; dup {
+		panic("codec: Register called twice for " + name)
+	}
+	registry[name] = c
+}
+
+// Get returns the codec registered under name.
+func Get(name string) (Codec, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := registry[name]
+	return c, ok
+}
+
+// Names returns the names of the registered codecs, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FrameType is the type of the frame that carries a state encoded with the
+// codec name when it is sent in a single frame. JSON and Protobuf have frame
+// types of their own; all other codecs share STATE_DATA.
+func FrameType(name string) wire.Type {
+	switch name {
+	case JSON:
+		return wire.TypeStateJSON
+	case Protobuf:
+		return wire.TypeStateProtobuf
+	default:
+		return wire.TypeStateData
+	}
+}
+
+func unsupported(c Codec, op string, v interface{}) error {
+	return fmt.Errorf("%w: %s cannot %s %T", ErrUnsupportedValue, c.Name(), op, v)
+}
+
+// Personal.AI order the ending
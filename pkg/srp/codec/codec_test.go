@@ -0,0 +1,122 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/turtacn/Aeterna/pkg/srp/wire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestRegistry(t *testing.T) {
+	if got, want := Names(), []string{Gob, JSON, MessagePack, Protobuf, Raw}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the built-in codecs %v, got %v", want, got)
+	}
+	if _, ok := Get("cbor"); ok {
+		t.Error("expected an unregistered codec not to be found")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a name twice to panic")
+		}
+	}()
+	Register(jsonCodec{})
+}
+
+func TestFrameType(t *testing.T) {
+	for name, want := range map[string]wire.Type{
+		JSON:        wire.TypeStateJSON,
+		Protobuf:    wire.TypeStateProtobuf,
+		MessagePack: wire.TypeStateData,
+		Raw:         wire.TypeStateData,
+	} {
+		if got := FrameType(name); got != want {
+			t.Errorf("%s: expected %s, got %s", name, want, got)
+		}
+	}
+}
+
+func roundTrip(t *testing.T, name string, v interface{}) map[string]interface{} {
+	t.Helper()
+	c, _ := Get(name)
+	data, err := c.Marshal(v)
+	if err != nil {
+		t.Fatalf("%s: Marshal failed: %v", name, err)
+	}
+	var got map[string]interface{}
+	if err := c.Unmarshal(data, &got); err != nil {
+		t.Fatalf("%s: Unmarshal failed: %v", name, err)
+	}
+	return got
+}
+
+func TestCodecs_GenericState(t *testing.T) {
+	state := map[string]interface{}{"session": "abc", "turns": 3.0, "history": []interface{}{"hi", "hello"}}
+	for _, name := range []string{JSON, MessagePack, Protobuf, Gob} {
+		if got := roundTrip(t, name, state); !reflect.DeepEqual(got, state) {
+			t.Errorf("%s: expected %v, got %v", name, state, got)
+		}
+	}
+}
+
+func TestCodecs_TypedValuesSurvive(t *testing.T) {
+	embedding := make([]byte, 256)
+	for i := range embedding {
+		embedding[i] = byte(i)
+	}
+	state := map[string]interface{}{"embedding": embedding, "counter": int64(math.MaxInt64)}
+
+	for _, name := range []string{MessagePack, Gob} {
+		got := roundTrip(t, name, state)
+		if b, _ := got["embedding"].([]byte); !bytes.Equal(b, embedding) {
+			t.Errorf("%s: expected the bytes to survive, got %T", name, got["embedding"])
+		}
+		if got["counter"] != int64(math.MaxInt64) {
+			t.Errorf("%s: expected the counter to stay exact, got %v (%T)", name, got["counter"], got["counter"])
+		}
+	}
+
+	// JSON is the lowest common denominator.
+	if got := roundTrip(t, JSON, state); got["counter"] == int64(math.MaxInt64) {
+		t.Error("expected JSON to decode numbers as float64")
+	}
+}
+
+func TestProtobuf_Message(t *testing.T) {
+	c, _ := Get(Protobuf)
+	msg, _ := structpb.NewStruct(map[string]interface{}{"turns": 3.0})
+	data, err := c.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var got structpb.Struct
+	if err := c.Unmarshal(data, &got); err != nil || !proto.Equal(&got, msg) {
+		t.Errorf("expected %v, got %v (%v)", msg, &got, err)
+	}
+
+	if _, err := c.Marshal([]string{"not a message"}); !errors.Is(err, ErrUnsupportedValue) {
+		t.Errorf("expected ErrUnsupportedValue, got %v", err)
+	}
+}
+
+func TestRaw(t *testing.T) {
+	c, _ := Get(Raw)
+	data, err := c.Marshal([]byte("opaque"))
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var got []byte
+	if err := c.Unmarshal(data, &got); err != nil || string(got) != "opaque" {
+		t.Errorf("expected the bytes back, got %q (%v)", got, err)
+	}
+
+	var state map[string]interface{}
+	if err := c.Unmarshal(data, &state); !errors.Is(err, ErrUnsupportedValue) {
+		t.Errorf("expected raw bytes not to decode into a map, got %v", err)
+	}
+}
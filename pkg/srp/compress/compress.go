@@ -0,0 +1,210 @@
+// Package compress implements the optional compression of SRP state data.
+// When the peers agree on a compression, every unit of state data (a state
+// sent in a single frame, the contents of a memfd, or the data of a chunk)
+// is a block: a method byte, the uvarint size of the data before
+// compression, then the data, compressed unless it was too small or did not
+// shrink. See docs/apis.md, section 3.3.
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions a peer can list in its Hello frame.
+const (
+	None = "none"
+	Zstd = "zstd"
+	Gzip = "gzip"
+)
+
+// Algorithms lists the supported compressions, in order of preference.
+var Algorithms = []string{Zstd, Gzip}
+
+// Block methods.
+const (
+	methodStored byte = 0x00
+	methodGzip   byte = 0x01
+	methodZstd   byte = 0x02
+)
+
+// MaxHeaderSize is the largest block header: the method and a uvarint size.
+const MaxHeaderSize = 1 + binary.MaxVarintLen64
+
+// DefaultThreshold is the data size below which blocks are stored rather
+// than compressed, unless configured otherwise.
+const DefaultThreshold = 4 << 10
+
+// ErrCorrupt is returned for blocks that cannot be decompressed, or that do
+// not decompress to the size in their header.
+var ErrCorrupt = errors.New("srp: corrupt compressed block")
+
+// Known reports whether name is a compression this package implements.
+func Known(name string) bool {
+	return name == None || name == Zstd || name == Gzip
+}
+
+func method(name string) (byte, error) {
+	switch name {
+	case "", None:
+		return methodStored, nil
+	case Gzip:
+		return methodGzip, nil
+	case Zstd:
+		return methodZstd, nil
+	}
+	return 0, fmt.Errorf("srp: unknown compression %q", name)
+}
+
+// Compressor turns data into blocks. It is not safe for concurrent use.
+type Compressor struct {
+	method    byte
+	level     int
+	threshold int
+	zstd      *zstd.Encoder
+	buf       bytes.Buffer
+}
+
+// NewCompressor returns a Compressor for the compression name. level is the
+// compression level of the algorithm (1-9 for gzip, 1-22 for zstd), 0 for
+// its default. Data shorter than threshold is stored; 0 means
+// DefaultThreshold.
+func NewCompressor(name string, level, threshold int) (*Compressor, error) {
+	m, err := method(name)
+	if err != nil {
+		return nil, err
+	}
+	if threshold <= 0 {
+		threshold = DefaultThreshold
+	}
+	c := &Compressor{method: m, level: level, threshold: threshold}
+	switch m {
+	case methodGzip:
+		if level == 0 {
+			c.level = gzip.DefaultCompression
+		}
+		if _, err := gzip.NewWriterLevel(io.Discard, c.level); err != nil {
+			return nil, fmt.Errorf("srp: gzip level %d: %w", level, err)
+		}
+	case methodZstd:
+		encLevel := zstd.SpeedDefault
+		if level != 0 {
+			encLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		if c.zstd, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(encLevel), zstd.WithEncoderConcurrency(1)); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Block returns data as a block, compressed if that makes it smaller.
+func (c *Compressor) Block(data []byte) []byte {
+	if c.method != methodStored && len(data) >= c.threshold {
+		var compressed []byte
+		switch c.method {
+		case methodGzip:
+			c.buf.Reset()
+			zw, _ := gzip.NewWriterLevel(&c.buf, c.level)
+			zw.Write(data)
+			zw.Close()
+			compressed = c.buf.Bytes()
+		case methodZstd:
+			compressed = c.zstd.EncodeAll(data, nil)
+		}
+		if len(compressed) < len(data) {
+			return appendBlock(c.method, len(data), compressed)
+		}
+	}
+	return appendBlock(methodStored, len(data), data)
+}
+
+func appendBlock(m byte, size int, data []byte) []byte {
+	block := make([]byte, 0, MaxHeaderSize+len(data))
+	block = append(block, m)
+	block = binary.AppendUvarint(block, uint64(size))
+	return append(block, data...)
+}
+
+// Header is the decoded header of a block.
+type Header struct {
+	Compressed bool
+	Size       int64 // Size of the data before compression
+	Len        int   // Size of the header itself
+}
+
+// ParseHeader decodes the header at the start of block, which must use the
+// compression name or be stored.
+func ParseHeader(name string, block []byte) (Header, error) {
+	want, err := method(name)
+	if err != nil {
+		return Header{}, err
+	}
+	if len(block) == 0 {
+		return Header{}, fmt.Errorf("%w: empty block", ErrCorrupt)
+	}
+	if m := block[0]; m != methodStored && m != want {
+		return Header{}, fmt.Errorf("%w: method 0x%02x, agreed on %s", ErrCorrupt, m, name)
+	}
+	size, n := binary.Uvarint(block[1:])
+	if n <= 0 || size > 1<<62 {
+		return Header{}, fmt.Errorf("%w: bad size", ErrCorrupt)
+	}
+	return Header{Compressed: block[0] != methodStored, Size: int64(size), Len: 1 + n}, nil
+}
+
+// Open returns the data of a block compressed with name, or stored. It
+// refuses blocks whose data is larger than limit, if limit is positive.
+func Open(name string, block []byte, limit int64) ([]byte, error) {
+	h, err := ParseHeader(name, block)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && h.Size > limit {
+		return nil, fmt.Errorf("%w: %d bytes exceeds the limit of %d", ErrCorrupt, h.Size, limit)
+	}
+	data := block[h.Len:]
+	if !h.Compressed {
+		if int64(len(data)) != h.Size {
+			return nil, fmt.Errorf("%w: %d stored bytes, header says %d", ErrCorrupt, len(data), h.Size)
+		}
+		return data, nil
+	}
+
+	var r io.Reader
+	if block[0] == methodGzip {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		r = zr
+	} else {
+		zr, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	// The size in the header bounds the output, so a block cannot expand
+	// beyond what it announced.
+	var out bytes.Buffer
+	if h.Size <= int64(len(data))*64 {
+		out.Grow(int(h.Size))
+	}
+	if _, err := io.Copy(&out, io.LimitReader(r, h.Size+1)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if int64(out.Len()) != h.Size {
+		return nil, fmt.Errorf("%w: decompressed to %d bytes, header says %d", ErrCorrupt, out.Len(), h.Size)
+	}
+	return out.Bytes(), nil
+}
+
+// Personal.AI order the ending
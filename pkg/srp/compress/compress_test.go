@@ -0,0 +1,96 @@
+package compress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestBlock_RoundTrip(t *testing.T) {
+	history := bytes.Repeat([]byte(`{"role":"user","content":"hello again"},`), 1000)
+	for _, name := range Algorithms {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewCompressor(name, 0, 0)
+			if err != nil {
+				t.Fatalf("NewCompressor failed: %v", err)
+			}
+			block := c.Block(history)
+			h, err := ParseHeader(name, block)
+			if err != nil || !h.Compressed || h.Size != int64(len(history)) {
+				t.Fatalf("unexpected header %+v (%v)", h, err)
+			}
+			if len(block) >= len(history)/10 {
+				t.Errorf("expected the history to compress well, got %d of %d bytes", len(block), len(history))
+			}
+			data, err := Open(name, block, 0)
+			if err != nil || !bytes.Equal(data, history) {
+				t.Fatalf("expected the data back, got %d bytes (%v)", len(data), err)
+			}
+		})
+	}
+}
+
+func TestBlock_StoresWhatDoesNotShrink(t *testing.T) {
+	random := make([]byte, 8192)
+	rand.Read(random)
+	small := bytes.Repeat([]byte("a"), 100)
+
+	c, _ := NewCompressor(Zstd, 3, 1024)
+	for name, data := range map[string][]byte{"below the threshold": small, "incompressible": random} {
+		block := c.Block(data)
+		if h, _ := ParseHeader(Zstd, block); h.Compressed {
+			t.Errorf("%s: expected a stored block", name)
+		}
+		if got, err := Open(Zstd, block, 0); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: expected the data back (%v)", name, err)
+		}
+	}
+
+	// Without a compression every block is stored.
+	none, _ := NewCompressor(None, 0, 0)
+	if h, _ := ParseHeader(None, none.Block(bytes.Repeat([]byte("a"), 1<<20))); h.Compressed {
+		t.Error("expected no compression")
+	}
+}
+
+func TestOpen_RejectsBadBlocks(t *testing.T) {
+	data := bytes.Repeat([]byte("state "), 2000)
+	c, _ := NewCompressor(Gzip, 9, 0)
+	block := c.Block(data)
+
+	lying := append([]byte(nil), block...)
+	lying[1]++ // The size in the header
+	corrupt := append([]byte(nil), block...)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	tests := []struct {
+		name  string
+		alg   string
+		block []byte
+		limit int64
+	}{
+		{"empty", Gzip, nil, 0},
+		{"wrong size", Gzip, lying, 0},
+		{"corrupt", Gzip, corrupt, 0},
+		{"not agreed", Zstd, block, 0},
+		{"over the limit", Gzip, block, int64(len(data)) - 1},
+		{"truncated stored block", None, []byte{0x00, 0x05, 'a'}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Open(tt.alg, tt.block, tt.limit); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("expected ErrCorrupt, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNewCompressor_RejectsBadSettings(t *testing.T) {
+	if _, err := NewCompressor("lz4", 0, 0); err == nil {
+		t.Error("expected an unknown compression to be refused")
+	}
+	if _, err := NewCompressor(Gzip, 42, 0); err == nil {
+		t.Error("expected an invalid gzip level to be refused")
+	}
+}
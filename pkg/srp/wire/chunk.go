@@ -0,0 +1,111 @@
+package wire
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+)
+
+// A chunked state is a sequence of STATE_CHUNK frames followed by a
+// STATE_END frame. Each chunk carries its offset in the state and the CRC32C
+// of its data, so a transfer can be checked as it goes and resumed from the
+// last good offset; the end frame carries the size and SHA-256 of the state.
+
+// ChunkHeaderSize is the size of the offset and checksum before the data of a chunk.
+const ChunkHeaderSize = 12
+
+// DefaultChunkSize is the amount of state data sent per chunk unless
+// configured otherwise.
+const DefaultChunkSize = 1 << 20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Chunk is the payload of a STATE_CHUNK frame: a big-endian uint64 offset,
+// the big-endian CRC32C of the data, then the data.
+type Chunk struct {
+	Offset uint64
+	Data   []byte
+}
+
+// EncodeChunk returns the payload of a STATE_CHUNK frame.
+func EncodeChunk(offset uint64, data []byte) []byte {
+	buf := make([]byte, ChunkHeaderSize+len(data))
+	binary.BigEndian.PutUint64(buf[0:8], offset)
+	binary.BigEndian.PutUint32(buf[8:12], crc32.Checksum(data, castagnoli))
+	copy(buf[ChunkHeaderSize:], data)
+	return buf
+}
+
+// DecodeChunk parses and verifies the payload of a STATE_CHUNK frame. Data
+// shares the memory of payload.
+func DecodeChunk(payload []byte) (Chunk, error) {
+	if len(payload) < ChunkHeaderSize {
+		return Chunk{}, fmt.Errorf("%w: chunk of %d bytes is shorter than its header", ErrMalformed, len(payload))
+	}
+	c := Chunk{Offset: binary.BigEndian.Uint64(payload[0:8]), Data: payload[ChunkHeaderSize:]}
+	if sum := crc32.Checksum(c.Data, castagnoli); sum != binary.BigEndian.Uint32(payload[8:12]) {
+		return Chunk{}, fmt.Errorf("%w: chunk at offset %d", ErrChecksum, c.Offset)
+	}
+	return c, nil
+}
+
+// End is the JSON payload of a STATE_END frame.
+type End struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"` // Hex encoded
+}
+
+// Digest computes the End of a chunked state as its chunks go by. Chunks
+// must be written in order; chunks that were already written, as when a
+// transfer resumes from an earlier offset, are skipped.
+type Digest struct {
+	h    hash.Hash
+	size int64
+}
+
+// NewDigest returns an empty Digest.
+func NewDigest() *Digest {
+	return &Digest{h: sha256.New()}
+}
+
+// Write adds the data of the chunk at offset. It fails if the chunk would
+// leave a gap.
+func (d *Digest) Write(offset int64, data []byte) error {
+	if offset > d.size {
+		return fmt.Errorf("%w: chunk at offset %d after %d bytes", ErrMalformed, offset, d.size)
+	}
+	if skip := d.size - offset; skip < int64(len(data)) {
+		d.h.Write(data[skip:])
+		d.size = offset + int64(len(data))
+	}
+	return nil
+}
+
+// Size returns the number of bytes digested so far.
+func (d *Digest) Size() int64 {
+	return d.size
+}
+
+// End returns the STATE_END payload for the bytes digested so far.
+func (d *Digest) End() End {
+	return End{Size: d.size, SHA256: hex.EncodeToString(d.h.Sum(nil))}
+}
+
+// Verify checks the payload of a STATE_END frame against the bytes digested so far.
+func (d *Digest) Verify(payload []byte) error {
+	var end End
+	if err := json.Unmarshal(payload, &end); err != nil {
+		return fmt.Errorf("%w: %s payload: %v", ErrMalformed, TypeStateEnd, err)
+	}
+	if got := d.End(); end != got {
+		return fmt.Errorf("%w: state of %d bytes with SHA-256 %s, received %d bytes with %s",
+			ErrChecksum, end.Size, end.SHA256, got.Size, got.SHA256)
+	}
+	return nil
+}
+
+// Personal.AI order the ending
@@ -0,0 +1,75 @@
+package wire
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestChunk_RoundTrip(t *testing.T) {
+	payload := EncodeChunk(1<<40, []byte("state"))
+	c, err := DecodeChunk(payload)
+	if err != nil {
+		t.Fatalf("DecodeChunk failed: %v", err)
+	}
+	if c.Offset != 1<<40 || string(c.Data) != "state" {
+		t.Errorf("unexpected chunk %d %q", c.Offset, c.Data)
+	}
+
+	// The offset is big-endian.
+	if want := []byte{0, 0, 1, 0, 0, 0, 0, 0}; !bytes.Equal(payload[:8], want) {
+		t.Errorf("unexpected offset encoding % x", payload[:8])
+	}
+}
+
+func TestDecodeChunk_RejectsCorruption(t *testing.T) {
+	payload := EncodeChunk(0, []byte("state"))
+	payload[len(payload)-1] ^= 0x01
+	if _, err := DecodeChunk(payload); !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected ErrChecksum, got %v", err)
+	}
+	if _, err := DecodeChunk(payload[:ChunkHeaderSize-1]); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+}
+
+func TestDigest_SkipsResentChunks(t *testing.T) {
+	state := []byte("0123456789")
+	d := NewDigest()
+	for _, c := range []struct {
+		offset int64
+		data   string
+	}{{0, "0123"}, {4, "4567"}, {2, "234567"}, {6, "6789"}} {
+		if err := d.Write(c.offset, []byte(c.data)); err != nil {
+			t.Fatalf("Write(%d) failed: %v", c.offset, err)
+		}
+	}
+	sum := sha256.Sum256(state)
+	if got := d.End(); got.Size != 10 || got.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected digest %+v", got)
+	}
+	if err := d.Write(11, []byte("x")); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected a gap to be refused, got %v", err)
+	}
+}
+
+func TestDigest_Verify(t *testing.T) {
+	d := NewDigest()
+	d.Write(0, []byte("state"))
+	end, _ := json.Marshal(d.End())
+	if err := d.Verify(end); err != nil {
+		t.Errorf("Verify failed: %v", err)
+	}
+
+	other := NewDigest()
+	other.Write(0, []byte("stale"))
+	if err := other.Verify(end); !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected ErrChecksum, got %v", err)
+	}
+	if err := d.Verify([]byte("{")); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+}
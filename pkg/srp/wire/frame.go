@@ -0,0 +1,204 @@
+// Package wire implements the SRP frame format described in docs/apis.md:
+// a big-endian length prefix followed by magic, version, type, two reserved
+// bytes and the payload. The length counts everything after itself.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// Magic identifies an SRP frame.
+	Magic uint32 = 0xAE7E2024
+	// Version is the protocol version written and accepted by this package.
+	Version uint8 = 0x01
+
+	// HeaderSize is the size of the header counted by the length field.
+	HeaderSize = 8
+	// DefaultMaxFrameSize bounds the length field unless configured otherwise.
+	DefaultMaxFrameSize = 64 << 20
+)
+
+// Type is the message type of a frame.
+type Type uint8
+
+// Message types
+const (
+	TypeHello         Type = 0x01 // Handshake
+	TypeStateJSON     Type = 0x02 // State data encoded as JSON
+	TypeStateProtobuf Type = 0x03 // State data encoded as Protobuf
+	TypeStateMemfd    Type = 0x04 // State data in a sealed memfd passed with SCM_RIGHTS
+	TypeStateChunk    Type = 0x05 // Part of a chunked state (see Chunk)
+	TypeStateEnd      Type = 0x06 // End of a chunked state (see End)
+	TypeStateData     Type = 0x07 // State data in a codec without a frame type of its own
+	TypeStateRequest  Type = 0x08 // Aeterna asks a process for its state, on its control FD
+	TypeACK           Type = 0xFF // Acknowledgement / finished
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeHello:
+		return "HELLO"
+	case TypeStateJSON:
+		return "STATE_JSON"
+	case TypeStateProtobuf:
+		return "STATE_PROTOBUF"
+	case TypeStateMemfd:
+		return "STATE_MEMFD"
+	case TypeStateChunk:
+		return "STATE_CHUNK"
+	case TypeStateEnd:
+		return "STATE_END"
+	case TypeStateData:
+		return "STATE_DATA"
+	case TypeStateRequest:
+		return "STATE_REQUEST"
+	case TypeACK:
+		return "ACK"
+	default:
+		return fmt.Sprintf("UNKNOWN(0x%02x)", uint8(t))
+	}
+}
+
+// Valid reports whether t is a known message type.
+func (t Type) Valid() bool {
+	switch t {
+	case TypeHello, TypeStateJSON, TypeStateProtobuf, TypeStateMemfd, TypeStateChunk, TypeStateEnd, TypeStateData, TypeStateRequest, TypeACK:
+		return true
+	}
+	return false
+}
+
+// Validation errors. ReadFrame and WriteFrame wrap them with details, so
+// callers should match them with errors.Is.
+var (
+	ErrBadMagic           = errors.New("srp: bad magic")
+	ErrUnsupportedVersion = errors.New("srp: unsupported version")
+	ErrUnknownType        = errors.New("srp: unknown frame type")
+	ErrFrameTooLarge      = errors.New("srp: frame too large")
+	ErrMalformed          = errors.New("srp: malformed frame")
+	ErrChecksum           = errors.New("srp: checksum mismatch")
+)
+
+// Frame is a decoded SRP frame.
+type Frame struct {
+	Type    Type
+	Payload []byte
+}
+
+// Reader reads frames from a stream.
+type Reader struct {
+	r   io.Reader
+	max int
+}
+
+// NewReader returns a Reader that rejects frames whose length field exceeds
+// maxFrameSize. A maxFrameSize of 0 or less means DefaultMaxFrameSize.
+func NewReader(r io.Reader, maxFrameSize int) *Reader {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	return &Reader{r: r, max: maxFrameSize}
+}
+
+// ReadFrame reads and validates the next frame. It returns io.EOF if the
+// stream ends cleanly before a frame, and io.ErrUnexpectedEOF if it ends
+// inside one. The payload is only allocated once the header is validated.
+func (fr *Reader) ReadFrame() (Frame, error) {
+	var hdr [4 + HeaderSize]byte
+	if _, err := io.ReadFull(fr.r, hdr[:4]); err != nil {
+		return Frame{}, err
+	}
+	length := binary.BigEndian.Uint32(hdr[:4])
+	if length < HeaderSize {
+		return Frame{}, fmt.Errorf("%w: length %d is shorter than the header", ErrMalformed, length)
+	}
+	if uint64(length) > uint64(fr.max) {
+		return Frame{}, fmt.Errorf("%w: %d bytes exceeds the limit of %d", ErrFrameTooLarge, length, fr.max)
+	}
+	if _, err := io.ReadFull(fr.r, hdr[4:]); err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+
+	if magic := binary.BigEndian.Uint32(hdr[4:8]); magic != Magic {
+		return Frame{}, fmt.Errorf("%w: 0x%08x", ErrBadMagic, magic)
+	}
+	if version := hdr[8]; version != Version {
+		return Frame{}, fmt.Errorf("%w: 0x%02x", ErrUnsupportedVersion, version)
+	}
+	t := Type(hdr[9])
+	if !t.Valid() {
+		return Frame{}, fmt.Errorf("%w: 0x%02x", ErrUnknownType, uint8(t))
+	}
+	if reserved := binary.BigEndian.Uint16(hdr[10:12]); reserved != 0 {
+		return Frame{}, fmt.Errorf("%w: reserved bits 0x%04x are set", ErrMalformed, reserved)
+	}
+
+	payload := make([]byte, length-HeaderSize)
+	if _, err := io.ReadFull(fr.r, payload); err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+	return Frame{Type: t, Payload: payload}, nil
+}
+
+// Writer writes frames to a stream.
+type Writer struct {
+	w   io.Writer
+	max int
+}
+
+// NewWriter returns a Writer that refuses frames the peer's Reader with the
+// same maxFrameSize would reject. A maxFrameSize of 0 or less means
+// DefaultMaxFrameSize.
+func NewWriter(w io.Writer, maxFrameSize int) *Writer {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	return &Writer{w: w, max: maxFrameSize}
+}
+
+// WriteFrame writes a frame of type t with a single Write call.
+func (fw *Writer) WriteFrame(t Type, payload []byte) error {
+	buf, err := Encode(t, payload, fw.max)
+	if err != nil {
+		return err
+	}
+	_, err = fw.w.Write(buf)
+	return err
+}
+
+// Encode returns the encoded frame. A maxFrameSize of 0 or less means
+// DefaultMaxFrameSize.
+func Encode(t Type, payload []byte, maxFrameSize int) ([]byte, error) {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	if !t.Valid() {
+		return nil, fmt.Errorf("%w: 0x%02x", ErrUnknownType, uint8(t))
+	}
+	length := uint64(HeaderSize + len(payload))
+	if length > uint64(maxFrameSize) || length > uint64(^uint32(0)) {
+		return nil, fmt.Errorf("%w: %d bytes exceeds the limit of %d", ErrFrameTooLarge, length, maxFrameSize)
+	}
+
+	buf := make([]byte, 4+length)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(length))
+	binary.BigEndian.PutUint32(buf[4:8], Magic)
+	buf[8] = Version
+	buf[9] = uint8(t)
+	// buf[10:12] is reserved and left zero
+	copy(buf[12:], payload)
+	return buf, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Personal.AI order the ending
@@ -0,0 +1,100 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrame_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, 0)
+	if err := w.WriteFrame(TypeHello, []byte(`{"pid":1}`)); err != nil {
+		t.Fatalf("WriteFrame failed: %v", err)
+	}
+	if err := w.WriteFrame(TypeACK, nil); err != nil {
+		t.Fatalf("WriteFrame failed: %v", err)
+	}
+
+	r := NewReader(&buf, 0)
+	f, err := r.ReadFrame()
+	if err != nil || f.Type != TypeHello || string(f.Payload) != `{"pid":1}` {
+		t.Fatalf("unexpected first frame %v %q, %v", f.Type, f.Payload, err)
+	}
+	f, err = r.ReadFrame()
+	if err != nil || f.Type != TypeACK || len(f.Payload) != 0 {
+		t.Fatalf("unexpected second frame %v %q, %v", f.Type, f.Payload, err)
+	}
+	if _, err := r.ReadFrame(); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of the stream, got %v", err)
+	}
+}
+
+func TestFrame_Layout(t *testing.T) {
+	buf, err := Encode(TypeStateJSON, []byte("{}"), 0)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	want := []byte{0, 0, 0, 10, 0xAE, 0x7E, 0x20, 0x24, 0x01, 0x02, 0, 0, '{', '}'}
+	if !bytes.Equal(buf, want) {
+		t.Errorf("unexpected encoding\n got % x\nwant % x", buf, want)
+	}
+}
+
+func TestReader_RejectsInvalidFrames(t *testing.T) {
+	valid, _ := Encode(TypeStateJSON, []byte(`{"k":"v"}`), 0)
+	corrupt := func(offset int, b byte) []byte {
+		buf := append([]byte(nil), valid...)
+		buf[offset] = b
+		return buf
+	}
+	withLength := func(length uint32) []byte {
+		buf := append([]byte(nil), valid...)
+		binary.BigEndian.PutUint32(buf, length)
+		return buf
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		max  int
+		want error
+	}{
+		{"bad magic", corrupt(4, 0x00), 0, ErrBadMagic},
+		{"unsupported version", corrupt(8, 0x02), 0, ErrUnsupportedVersion},
+		{"unknown type", corrupt(9, 0x42), 0, ErrUnknownType},
+		{"reserved bits", corrupt(11, 0x01), 0, ErrMalformed},
+		{"shorter than header", withLength(HeaderSize - 1), 0, ErrMalformed},
+		{"over the limit", valid, len(valid) - 5, ErrFrameTooLarge},
+		{"huge length", withLength(^uint32(0)), 0, ErrFrameTooLarge},
+		{"truncated header", valid[:7], 0, io.ErrUnexpectedEOF},
+		{"truncated payload", valid[:len(valid)-1], 0, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewReader(bytes.NewReader(tt.data), tt.max).ReadFrame()
+			if !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestWriter_RejectsInvalidFrames(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, 16)
+	if err := w.WriteFrame(Type(0x42), nil); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("expected ErrUnknownType, got %v", err)
+	}
+	if err := w.WriteFrame(TypeStateJSON, make([]byte, 16-HeaderSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("expected ErrFrameTooLarge, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be written, got %d bytes", buf.Len())
+	}
+	if err := w.WriteFrame(TypeStateJSON, make([]byte, 16-HeaderSize)); err != nil {
+		t.Errorf("a frame of exactly the limit should be accepted: %v", err)
+	}
+}
@@ -4,16 +4,79 @@ Helps AI Agents interact with the Aeterna Supervisor for Zero-Downtime Hot Relay
 """
 
 import os
+import signal
 import socket
 import json
+import gzip
+import zlib
 import struct
 import sys
+import array
+import fcntl
 import logging
-from typing import Optional, Dict, Any
+import mmap
+import threading
+from typing import Optional, Dict, Any, Callable, Iterable, List, Tuple, Union
+
+try:
+    import msgpack
+except ImportError:  # MessagePack is optional; JSON is always available
+    msgpack = None
+
+try:
+    import zstandard
+except ImportError:  # zstd is optional; gzip is always available
+    zstandard = None
 
 # Constants matching Go implementation
 ENV_INHERITED_FDS = "AETERNA_INHERITED_FDS"
 ENV_STATE_SOCK = "AETERNA_STATE_SOCK"
+ENV_STATE_SIGNAL = "AETERNA_STATE_SIGNAL"
+ENV_STATE_TOKEN = "AETERNA_STATE_TOKEN"
+ENV_CONTROL_FD = "AETERNA_CONTROL_FD"
+ENV_FD_NAMES = "AETERNA_FD_NAMES"
+ENV_LISTEN_FDNAMES = "LISTEN_FDNAMES"
+LISTEN_FDS_START = 3
+ENV_CONN_SOCK = "AETERNA_CONN_SOCK"
+ENV_PROBE_PORT = "AETERNA_PROBE_PORT"
+MAX_CONNS_PER_MESSAGE = 64
+
+# SRP frame format (see docs/apis.md, section 3.2)
+SRP_MAGIC = 0xAE7E2024
+SRP_VERSION = 0x01
+SRP_HEADER = struct.Struct(">IIBBH")  # length, magic, version, type, reserved
+SRP_HEADER_SIZE = 8  # counted by the length field
+SRP_MAX_FRAME_SIZE = 64 << 20
+FRAME_HELLO = 0x01
+FRAME_STATE_JSON = 0x02
+FRAME_STATE_PROTOBUF = 0x03
+FRAME_STATE_MEMFD = 0x04
+FRAME_STATE_DATA = 0x07
+FRAME_STATE_REQUEST = 0x08
+FRAME_ACK = 0xFF
+SRP_FRAME_TYPES = (FRAME_HELLO, FRAME_STATE_JSON, FRAME_STATE_PROTOBUF, FRAME_STATE_MEMFD, FRAME_STATE_DATA,
+                   FRAME_STATE_REQUEST, FRAME_ACK)
+
+# State codecs (see docs/apis.md, section 3.3). MessagePack keeps integers
+# exact and carries bytes values as such; it needs the msgpack package.
+CODEC_JSON = "json"
+CODEC_MSGPACK = "msgpack"
+SUPPORTED_CODECS = ([CODEC_MSGPACK] if msgpack is not None else []) + [CODEC_JSON]
+
+# Compression of the state data (see docs/apis.md, section 3.3). Once agreed,
+# the state is a block: a method byte, the uvarint size before compression,
+# then the data, compressed unless that does not make it smaller.
+COMPRESSION_NONE = "none"
+COMPRESSION_GZIP = "gzip"
+COMPRESSION_ZSTD = "zstd"
+SUPPORTED_COMPRESSIONS = ([COMPRESSION_ZSTD] if zstandard is not None else []) + [COMPRESSION_GZIP, COMPRESSION_NONE]
+BLOCK_METHODS = {COMPRESSION_NONE: 0x00, COMPRESSION_GZIP: 0x01, COMPRESSION_ZSTD: 0x02}
+DEFAULT_COMPRESSION_THRESHOLD = 4 << 10
+
+# Large states travel in a sealed memfd (see docs/apis.md, section 3.3)
+TRANSPORT_STREAM = "stream"
+TRANSPORT_MEMFD = "memfd"
+MEMFD_SUPPORTED = hasattr(os, "memfd_create") and hasattr(fcntl, "F_ADD_SEALS")
 
 logging.basicConfig(level=logging.INFO, format='%(asctime)s [SDK] %(message)s')
 logger = logging.getLogger("aeterna")
@@ -24,23 +87,57 @@ class AeternaClient:
     It handles socket inheritance and state transfer via the State Relay Protocol (SRP).
     """
 
-    def __init__(self):
+    def __init__(self, schema_version: int = 0, codecs: Optional[List[str]] = None):
         """
         Initializes the AeternaClient by reading environment variables set by the supervisor.
+
+        Args:
+            schema_version (int): Version of the application's context layout. A
+                new process only accepts context written with the same or an
+                older schema version, unless a migration registered with
+                register_migration() brings it to this one.
+            codecs (List[str]): Codecs to encode the context with, in order of
+                preference. Defaults to MessagePack, if installed, then JSON.
         """
+        codecs = list(codecs or SUPPORTED_CODECS)
+        for codec in codecs:
+            if codec not in SUPPORTED_CODECS:
+                raise ValueError(f"unsupported codec {codec!r} (have {SUPPORTED_CODECS})")
+        self.schema_version = schema_version
+        self.codecs = codecs
+        self.loaded_schema_version = 0
+        self._migrations: Dict[Tuple[int, int], Callable[[Dict[str, Any]], Dict[str, Any]]] = {}
+        self._pending_ack = None
         self.state_sock_path = os.getenv(ENV_STATE_SOCK)
+        # The token proves to Aeterna that this is the process it started.
+        # Tools the agent runs must not inherit it.
+        self._state_token = os.environ.pop(ENV_STATE_TOKEN, "")
         self.inherited_fds_count = int(os.getenv(ENV_INHERITED_FDS, "0"))
+        self.conn_sock_path = os.getenv(ENV_CONN_SOCK)
+        # Port of this generation's own for the health and metrics endpoints
+        # the canary probes, 0 if they do not use one.
+        self.probe_port = int(os.getenv(ENV_PROBE_PORT, "0"))
+        if os.getenv(ENV_FD_NAMES):
+            self.fd_names = os.getenv(ENV_FD_NAMES).split(",")
+        else:
+            self.fd_names = [n for n in os.getenv(ENV_LISTEN_FDNAMES, "").split(":") if n]
 
-    def get_listener_socket(self) -> socket.socket:
+    def get_listener_socket(self, name: Optional[str] = None) -> socket.socket:
         """
         Retrieves the listening socket.
-        If hot-reloading, it grabs the inherited FD (usually FD 3).
+        If hot-reloading, it grabs the inherited FD: the one passed under `name`,
+        or the first one (FD 3) when no name is given.
         If cold-start, it creates a new socket (bound to port from env or default).
         """
         if self.inherited_fds_count > 0:
-            logger.info(f"Hot Relay detected! Inheriting FD 3...")
-            # FD 0,1,2 are stdin/out/err. Go passes listener as FD 3.
-            return socket.fromfd(3, socket.AF_INET, socket.SOCK_STREAM)
+            fd = LISTEN_FDS_START
+            if name is not None:
+                if name not in self.fd_names:
+                    raise KeyError(f"no inherited listener named {name!r} (have {self.fd_names})")
+                fd += self.fd_names.index(name)
+            logger.info(f"Hot Relay detected! Inheriting FD {fd}...")
+            # FD 0,1,2 are stdin/out/err. Listeners start at FD 3; the family is read from the FD.
+            return socket.socket(fileno=fd)
         else:
             logger.info("Cold Start detected. Creating new socket.")
             port = int(os.getenv("PORT", "8080"))
@@ -54,46 +151,517 @@ class AeternaClient:
         """
         Attempts to load state from the previous process via SRP (State Relay Protocol).
         Returns empty dict if this is a cold start.
+
+        The reload only goes ahead once the state is acknowledged: call
+        ack_context() after the application has restored it, or reject_context()
+        if it cannot. Without an ACK Aeterna rolls the reload back and the
+        previous process keeps serving with its state.
         """
         if not self.state_sock_path or not os.path.exists(self.state_sock_path):
             logger.info("No state socket found. Starting with empty memory.")
             return {}
 
         logger.info(f"Connecting to SRP socket: {self.state_sock_path}")
+        client = None
+        fds: List[int] = []
         try:
-            client = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
-            client.connect(self.state_sock_path)
+            client, agreed = self._srp_handshake("receiver")
+            frame_type, payload = _read_frame(client, fds=fds)
+            codec = agreed.get("codec", CODEC_JSON)
+            if frame_type == FRAME_STATE_MEMFD and TRANSPORT_MEMFD in agreed.get("transports", []):
+                payload = _read_memfd(payload, fds)
+            elif frame_type != _state_frame_type(codec):
+                raise ValueError(f"unexpected SRP frame type 0x{frame_type:02x}")
+            state = _decode_state(codec, _open_block(agreed, payload))
+            if not isinstance(state, dict):
+                raise ValueError("SRP state is not an object")
+            state, version = self._migrate(state, agreed.get("schema_version", 0))
+        except Exception as e:
+            logger.error(f"Failed to load context: {e}")
+            if client is not None:
+                client.close()
+            return {}
+        finally:
+            for fd in fds:
+                os.close(fd)
 
-            # Read all data (Simple implementation, in prod handle framing)
-            data = b""
-            while True:
-                packet = client.recv(4096)
-                if not packet:
-                    break
-                data += packet
+        self._pending_ack = client
+        self.loaded_schema_version = version
+        logger.info(f"Successfully restored context: {state.keys()}")
+        return state
 
-            client.close()
+    def register_migration(self, from_version: int, to_version: int,
+                           migrate: Callable[[Dict[str, Any]], Dict[str, Any]]):
+        """
+        Registers migrate to rewrite a context of schema version from_version
+        into to_version. load_context() chains registered migrations to bring
+        the context it receives to schema_version; Aeterna refuses the reload
+        when no chain leads from a newer context to it.
+        """
+        if from_version == to_version:
+            raise ValueError("a migration must change the schema version")
+        self._migrations[(from_version, to_version)] = migrate
 
-            if not data:
-                return {}
+    def _migration_path(self, from_version: int, to_version: int) -> Optional[List[Tuple[int, int]]]:
+        """Returns the shortest chain of registered migrations between two versions."""
+        paths = {from_version: []}
+        queue = [from_version]
+        while queue:
+            version = queue.pop(0)
+            if version == to_version:
+                return paths[version]
+            for step in sorted(self._migrations):
+                if step[0] == version and step[1] not in paths:
+                    paths[step[1]] = paths[version] + [step]
+                    queue.append(step[1])
+        return None
 
-            state = json.loads(data.decode('utf-8'))
-            logger.info(f"Successfully restored context: {state.keys()}")
-            return state
-        except Exception as e:
-            logger.error(f"Failed to load context: {e}")
-            return {}
+    def _migrate(self, state: Dict[str, Any], version: int) -> Tuple[Dict[str, Any], int]:
+        """Brings state of schema version version to schema_version, if a chain leads there."""
+        path = self._migration_path(version, self.schema_version)
+        if path is None:
+            if version > self.schema_version:
+                raise ValueError(f"no migration from schema version {version} to {self.schema_version}")
+            return state, version
+        for step in path:
+            state = self._migrations[step](state)
+            if not isinstance(state, dict):
+                raise ValueError(f"migration {step[0]}>{step[1]} did not return an object")
+            logger.info(f"Context migrated from schema version {step[0]} to {step[1]}")
+        return state, self.schema_version
+
+    def ack_context(self):
+        """
+        Confirms that the context returned by load_context() was restored. Only
+        then does Aeterna drain the previous process. No-op on a cold start.
+        """
+        client, self._pending_ack = self._pending_ack, None
+        if client is None:
+            return
+        try:
+            client.sendall(_encode_frame(FRAME_ACK))
+        finally:
+            client.close()
 
-    def save_context(self, context: Dict[str, Any]):
+    def reject_context(self):
+        """
+        Refuses the context returned by load_context(), which rolls the reload back.
+        """
+        client, self._pending_ack = self._pending_ack, None
+        if client is not None:
+            client.close()
+
+    def save_context(self, context: Dict[str, Any], timeout: Optional[float] = None) -> bool:
         """
         Dumps the current memory context to the SRP coordinator.
-        This is usually called by the OLD process before exiting.
+        This is called by the OLD process when Aeterna asks for its state
+        (see on_state_request). It blocks until the new process acknowledged it.
+        Contexts of at least the threshold announced by Aeterna are passed in a
+        sealed memfd instead of being streamed through the socket.
 
         Args:
             context (Dict[str, Any]): The state data to be transferred to the new process.
+
+        Returns:
+            bool: True once the new process has loaded the context. On False the
+            reload is rolled back and this process keeps serving.
         """
-        # Actual implementation depends on whether we are pushing or being pulled.
-        # This acts as a placeholder for the Agent to serialize its memory.
-        pass
+        if not self.state_sock_path:
+            logger.info("No state socket configured. Context is not handed over.")
+            return False
+
+        client = None
+        try:
+            client, agreed = self._srp_handshake("sender", timeout)
+            codec = agreed.get("codec", CODEC_JSON)
+            payload = _encode_state(codec, context)
+            transport = _choose_transport(agreed, len(payload))
+            payload = _compress_block(agreed, payload)
+            if transport == TRANSPORT_MEMFD:
+                _send_memfd(client, payload)
+            else:
+                client.sendall(_encode_frame(_state_frame_type(codec), payload))
+            frame_type, _ = _read_frame(client)
+            if frame_type != FRAME_ACK:
+                raise ValueError(f"unexpected SRP frame type 0x{frame_type:02x}")
+            logger.info(f"Context handed over ({len(payload)} bytes, {codec}, {transport})")
+            return True
+        except Exception as e:
+            logger.error(f"Context was not acknowledged: {e}")
+            return False
+        finally:
+            if client is not None:
+                client.close()
+
+    def on_state_request(self, get_context: Callable[[], Dict[str, Any]]):
+        """
+        Hands the context returned by get_context to the next generation
+        whenever Aeterna asks for it during a reload, or to Aeterna itself when
+        it takes a checkpoint (AETERNA_STATE_SIGNAL, SIGUSR1 by default). In
+        broker mode the requests arrive on the control channel
+        (AETERNA_CONTROL_FD) instead. Must be called from the main thread.
+        """
+        control_fd = os.environ.pop(ENV_CONTROL_FD, "")
+        if control_fd:
+            control = socket.socket(fileno=int(control_fd))
+            control.set_inheritable(False)
+
+            def serve():
+                with control:
+                    while True:
+                        try:
+                            frame_type, _ = _read_frame(control)
+                        except (OSError, ValueError):
+                            return  # Aeterna closed the channel
+                        if frame_type == FRAME_STATE_REQUEST:
+                            self.save_context(get_context())
+
+            threading.Thread(target=serve, daemon=True).start()
+
+        name = os.getenv(ENV_STATE_SIGNAL)
+        if not name:
+            return
+        sig = getattr(signal, name.upper(), None)
+        if sig is None:
+            raise ValueError(f"unknown state signal {name!r}")
+
+        def handler(signum, frame):
+            threading.Thread(target=lambda: self.save_context(get_context()), daemon=True).start()
+
+        signal.signal(sig, handler)
+
+    def _srp_handshake(self, role: str, timeout: Optional[float] = None) -> Tuple[socket.socket, Dict[str, Any]]:
+        """Connects to the SRP socket and negotiates the transfer."""
+        client = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+        try:
+            client.settimeout(timeout)
+            client.connect(self.state_sock_path)
+            hello = {
+                "role": role,
+                "pid": os.getpid(),
+                "versions": [SRP_VERSION],
+                "codecs": self.codecs,
+                "schema_version": self.schema_version,
+                "transports": [TRANSPORT_STREAM] + ([TRANSPORT_MEMFD] if MEMFD_SUPPORTED else []),
+                "compressions": SUPPORTED_COMPRESSIONS,
+            }
+            if role == "receiver" and self._migrations:
+                hello["migrations"] = [{"from": f, "to": t} for f, t in sorted(self._migrations)]
+            if self._state_token:
+                hello["token"] = self._state_token
+            client.sendall(_encode_frame(FRAME_HELLO, json.dumps(hello).encode("utf-8")))
+            frame_type, payload = _read_frame(client)
+            if frame_type != FRAME_HELLO:
+                raise ValueError(f"unexpected SRP frame type 0x{frame_type:02x}")
+            agreed = json.loads(payload.decode("utf-8"))
+            if agreed.get("error"):
+                raise ValueError(f"SRP handshake refused: {agreed['error']}")
+            return client, agreed
+        except Exception:
+            client.close()
+            raise
+
+    def handoff_connections(self, conns: Iterable[Union[socket.socket, Tuple[socket.socket, str]]],
+                            timeout: Optional[float] = 10.0) -> bool:
+        """
+        Passes established connections to the next generation through Aeterna's
+        connection broker. Call it from the OLD process when it is drained, before
+        exiting. Each item is a socket or a (socket, session_key) tuple; the session
+        key is handed to the new process unchanged.
+        The caller may close its sockets once this returns True.
+
+        Returns:
+            bool: False if connection handoff is not enabled or failed.
+        """
+        if not self.conn_sock_path:
+            return False
+
+        items = [c if isinstance(c, tuple) else (c, None) for c in conns]
+        try:
+            with socket.socket(socket.AF_UNIX, socket.SOCK_STREAM) as broker:
+                broker.settimeout(timeout)
+                broker.connect(self.conn_sock_path)
+                _send_conn_message(broker, {"role": "sender", "token": self._state_token})
+                for start in range(0, len(items), MAX_CONNS_PER_MESSAGE):
+                    batch = items[start:start + MAX_CONNS_PER_MESSAGE]
+                    metas = [_conn_meta(sock, key) for sock, key in batch]
+                    _send_conn_message(broker, {"conns": metas}, [sock.fileno() for sock, _ in batch])
+                _send_conn_message(broker, {"done": True})
+                reply, _ = _recv_conn_message(broker)
+            logger.info(f"Handed off {len(items)} connections")
+            return bool(reply.get("done"))
+        except Exception as e:
+            logger.error(f"Failed to hand off connections: {e}")
+            return False
+
+    def receive_connections(self, timeout: Optional[float] = None) -> List[Tuple[socket.socket, Dict[str, Any]]]:
+        """
+        Waits for the connections handed off by the previous generation. Call it from
+        the NEW process at startup, typically in a background thread: it returns once
+        the old process is drained. Each item is a (socket, metadata) tuple where the
+        metadata holds "network", "local", "peer" and "session_key".
+
+        Returns an empty list if connection handoff is not enabled or failed.
+        """
+        if not self.conn_sock_path:
+            return []
+
+        handed = []
+        try:
+            with socket.socket(socket.AF_UNIX, socket.SOCK_STREAM) as broker:
+                broker.settimeout(timeout)
+                broker.connect(self.conn_sock_path)
+                _send_conn_message(broker, {"role": "receiver", "token": self._state_token})
+                while True:
+                    msg, fds = _recv_conn_message(broker)
+                    for fd, meta in zip(fds, msg.get("conns") or []):
+                        handed.append((socket.socket(fileno=fd), meta))
+                    if msg.get("done"):
+                        break
+            logger.info(f"Received {len(handed)} connections from the previous generation")
+            return handed
+        except Exception as e:
+            logger.error(f"Failed to receive connections: {e}")
+            for sock, _ in handed:
+                sock.close()
+            return []
+
+
+def _encode_frame(frame_type: int, payload: bytes = b"", max_size: int = SRP_MAX_FRAME_SIZE) -> bytes:
+    """Encodes one SRP frame."""
+    length = SRP_HEADER_SIZE + len(payload)
+    if length > max_size:
+        raise ValueError(f"SRP frame of {length} bytes exceeds the limit of {max_size}")
+    return SRP_HEADER.pack(length, SRP_MAGIC, SRP_VERSION, frame_type, 0) + payload
+
+
+def _read_frame(sock: socket.socket, max_size: int = SRP_MAX_FRAME_SIZE,
+                fds: Optional[List[int]] = None) -> Tuple[int, bytes]:
+    """
+    Reads and validates one SRP frame. Returns its type and payload.
+    If fds is given, the descriptors passed with the frame are appended to it.
+    """
+    def read(n: int) -> bytes:
+        buf = b""
+        while len(buf) < n:
+            if fds is None:
+                chunk = sock.recv(n - len(buf))
+            else:
+                chunk, ancdata, _, _ = sock.recvmsg(n - len(buf), socket.CMSG_SPACE(4 * 4))
+                fds.extend(_parse_rights(ancdata))
+            if not chunk:
+                raise ConnectionError("SRP connection closed mid-frame")
+            buf += chunk
+        return buf
+
+    length, magic, version, frame_type, reserved = SRP_HEADER.unpack(read(SRP_HEADER.size))
+    if length < SRP_HEADER_SIZE or length > max_size:
+        raise ValueError(f"invalid SRP frame length {length}")
+    if magic != SRP_MAGIC:
+        raise ValueError(f"bad SRP magic 0x{magic:08x}")
+    if version != SRP_VERSION:
+        raise ValueError(f"unsupported SRP version 0x{version:02x}")
+    if frame_type not in SRP_FRAME_TYPES:
+        raise ValueError(f"unknown SRP frame type 0x{frame_type:02x}")
+    if reserved != 0:
+        raise ValueError("SRP reserved bits are set")
+    return frame_type, read(length - SRP_HEADER_SIZE)
+
+
+def _state_frame_type(codec: str) -> int:
+    """Returns the type of the frame that carries a state encoded with codec."""
+    return FRAME_STATE_JSON if codec == CODEC_JSON else FRAME_STATE_DATA
+
+
+def _encode_state(codec: str, context: Dict[str, Any]) -> bytes:
+    """Encodes the context with the negotiated codec."""
+    if codec == CODEC_MSGPACK and msgpack is not None:
+        return msgpack.packb(context, use_bin_type=True)
+    if codec == CODEC_JSON:
+        return json.dumps(context).encode("utf-8")
+    raise ValueError(f"unsupported codec {codec!r}")
+
+
+def _decode_state(codec: str, payload: bytes) -> Any:
+    """Decodes a state encoded with the negotiated codec."""
+    if codec == CODEC_MSGPACK and msgpack is not None:
+        return msgpack.unpackb(payload, raw=False, strict_map_key=False)
+    if codec == CODEC_JSON:
+        return json.loads(payload.decode("utf-8"))
+    raise ValueError(f"unsupported codec {codec!r}")
+
+
+def _compress_block(agreed: Dict[str, Any], data: bytes) -> bytes:
+    """Turns the encoded state into a block if a compression was agreed."""
+    compression = agreed.get("compression") or COMPRESSION_NONE
+    if compression == COMPRESSION_NONE:
+        return data
+    method, packed = BLOCK_METHODS[COMPRESSION_NONE], data
+    level = agreed.get("compression_level") or 0
+    if len(data) >= (agreed.get("compression_threshold") or DEFAULT_COMPRESSION_THRESHOLD):
+        if compression == COMPRESSION_GZIP:
+            compressed = gzip.compress(data, compresslevel=level if 1 <= level <= 9 else 6)
+        elif compression == COMPRESSION_ZSTD and zstandard is not None:
+            compressed = zstandard.ZstdCompressor(level=level or 3).compress(data)
+        else:
+            raise ValueError(f"unsupported compression {compression!r}")
+        if len(compressed) < len(data):
+            method, packed = BLOCK_METHODS[compression], compressed
+    return bytes([method]) + _uvarint(len(data)) + packed
+
+
+def _open_block(agreed: Dict[str, Any], block: bytes) -> bytes:
+    """Returns the encoded state carried by a block if a compression was agreed."""
+    compression = agreed.get("compression") or COMPRESSION_NONE
+    if compression == COMPRESSION_NONE:
+        return block
+    if not block or block[0] not in (BLOCK_METHODS[COMPRESSION_NONE], BLOCK_METHODS.get(compression)):
+        raise ValueError("SRP state block does not use the agreed compression")
+    size, pos = _read_uvarint(block, 1)
+    data = block[pos:]
+    if block[0] == BLOCK_METHODS[COMPRESSION_GZIP]:
+        # The size in the header bounds the output.
+        data = zlib.decompressobj(16 + zlib.MAX_WBITS).decompress(data, size + 1)
+    elif block[0] == BLOCK_METHODS[COMPRESSION_ZSTD]:
+        if zstandard is None:
+            raise ValueError("zstd compressed state, but zstandard is not installed")
+        data = zstandard.ZstdDecompressor().stream_reader(data).read(size + 1)
+    if len(data) != size:
+        raise ValueError(f"SRP state block holds {len(data)} bytes, header says {size}")
+    return data
+
+
+def _uvarint(n: int) -> bytes:
+    out = bytearray()
+    while n >= 0x80:
+        out.append(n & 0x7F | 0x80)
+        n >>= 7
+    out.append(n)
+    return bytes(out)
+
+
+def _read_uvarint(data: bytes, pos: int) -> Tuple[int, int]:
+    n = shift = 0
+    while pos < len(data) and shift < 64:
+        b = data[pos]
+        pos += 1
+        n |= (b & 0x7F) << shift
+        if b < 0x80:
+            return n, pos
+        shift += 7
+    raise ValueError("bad size in SRP state block")
+
+
+def _choose_transport(agreed: Dict[str, Any], size: int) -> str:
+    """Picks the transport for a state of size bytes, like the Go SDK."""
+    transports = agreed.get("transports") or [TRANSPORT_STREAM]
+    if TRANSPORT_MEMFD not in transports or not MEMFD_SUPPORTED:
+        return TRANSPORT_STREAM
+    if TRANSPORT_STREAM not in transports or size >= agreed.get("memfd_threshold", 0):
+        return TRANSPORT_MEMFD
+    return TRANSPORT_STREAM
+
+
+def _send_memfd(sock: socket.socket, payload: bytes):
+    """Writes payload into a sealed memfd and sends it in a STATE_MEMFD frame."""
+    fd = os.memfd_create("aeterna-state", os.MFD_CLOEXEC | os.MFD_ALLOW_SEALING)
+    try:
+        view = memoryview(payload)
+        while view:
+            view = view[os.write(fd, view):]
+        fcntl.fcntl(fd, fcntl.F_ADD_SEALS,
+                    fcntl.F_SEAL_SHRINK | fcntl.F_SEAL_GROW | fcntl.F_SEAL_WRITE | fcntl.F_SEAL_SEAL)
+        frame = _encode_frame(FRAME_STATE_MEMFD, json.dumps({"size": len(payload)}).encode("utf-8"))
+        sent = sock.sendmsg([frame], [(socket.SOL_SOCKET, socket.SCM_RIGHTS, array.array("i", [fd]))])
+        if sent < len(frame):
+            sock.sendall(frame[sent:])
+    finally:
+        os.close(fd)
+
+
+def _read_memfd(payload: bytes, fds: List[int]) -> bytes:
+    """Reads the state from the sealed memfd announced by a STATE_MEMFD frame."""
+    if len(fds) != 1:
+        raise ValueError(f"expected one descriptor with the state, received {len(fds)}")
+    fd = fds.pop()
+    try:
+        size = json.loads(payload.decode("utf-8"))["size"]
+        seals = fcntl.fcntl(fd, fcntl.F_GET_SEALS)
+        required = fcntl.F_SEAL_SHRINK | fcntl.F_SEAL_GROW | fcntl.F_SEAL_WRITE
+        if seals & required != required:
+            raise ValueError("state memfd is not sealed")
+        if os.fstat(fd).st_size != size:
+            raise ValueError(f"state memfd does not hold the announced {size} bytes")
+        if size == 0:
+            return b""
+        with mmap.mmap(fd, size, prot=mmap.PROT_READ) as mm:
+            return mm[:]
+    finally:
+        os.close(fd)
+
+
+def _parse_rights(ancdata) -> List[int]:
+    fds: List[int] = []
+    for level, kind, cdata in ancdata:
+        if level == socket.SOL_SOCKET and kind == socket.SCM_RIGHTS:
+            rights = array.array("i")
+            rights.frombytes(cdata[:len(cdata) - (len(cdata) % rights.itemsize)])
+            fds.extend(rights)
+    return fds
+
+
+def _conn_meta(sock: socket.socket, session_key: Optional[str]) -> Dict[str, Any]:
+    network = "unix" if sock.family == socket.AF_UNIX else "tcp"
+
+    def fmt(addr):
+        if isinstance(addr, tuple):
+            host = addr[0]
+            return f"[{host}]:{addr[1]}" if ":" in host else f"{host}:{addr[1]}"
+        return addr.decode() if isinstance(addr, bytes) else str(addr)
+
+    meta = {"network": network, "local": fmt(sock.getsockname()), "peer": fmt(sock.getpeername())}
+    if session_key:
+        meta["session_key"] = session_key
+    return meta
+
+
+def _send_conn_message(sock: socket.socket, msg: Dict[str, Any], fds: List[int] = ()):
+    """Sends a length-prefixed JSON message with the FDs attached as SCM_RIGHTS."""
+    payload = json.dumps(msg).encode("utf-8")
+    data = struct.pack(">I", len(payload)) + payload
+    ancillary = []
+    if fds:
+        ancillary = [(socket.SOL_SOCKET, socket.SCM_RIGHTS, array.array("i", fds))]
+    sent = sock.sendmsg([data], ancillary)
+    if sent < len(data):
+        sock.sendall(data[sent:])
+
+
+def _recv_conn_message(sock: socket.socket) -> Tuple[Dict[str, Any], List[int]]:
+    """Receives one message and the FDs attached to it."""
+    fds: List[int] = []
+
+    def read(n: int) -> bytes:
+        buf = b""
+        while len(buf) < n:
+            data, ancdata, flags, _ = sock.recvmsg(n - len(buf), socket.CMSG_SPACE(MAX_CONNS_PER_MESSAGE * 4))
+            fds.extend(_parse_rights(ancdata))
+            if flags & socket.MSG_CTRUNC:
+                raise ConnectionError("too many descriptors in one message")
+            if not data:
+                raise ConnectionError("handoff socket closed")
+            buf += data
+        return buf
+
+    try:
+        (size,) = struct.unpack(">I", read(4))
+        msg = json.loads(read(size).decode("utf-8"))
+        if len(fds) != len(msg.get("conns") or []):
+            raise ConnectionError("descriptor count does not match the message")
+        return msg, fds
+    except Exception:
+        for fd in fds:
+            os.close(fd)
+        raise
 
 # Personal.AI order the ending
\ No newline at end of file